@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// API keys are apiKeyPrefix followed by a random token; the first
+// apiKeyDisplayLength characters are stored in the clear to tell keys apart
+const (
+	apiKeyPrefix        = "crk_"
+	apiKeyDisplayLength = 12
+)
+
+// maxAPIKeyNameLength matches the size of the api_keys name column
+const maxAPIKeyNameLength = 100
+
+// apiKeyLastUsedInterval is how stale last_used_at may get before a request
+// updates it, so busy clients do not write on every request
+const apiKeyLastUsedInterval = time.Minute
+
+// ErrInvalidAPIKey is returned for unknown or expired API keys and keys of
+// disabled users
+var ErrInvalidAPIKey = errors.New("invalid or expired API key")
+
+// validateAPIKeyRequest returns the problems with a new API key for a member
+// with role
+func validateAPIKeyRequest(req *CreateAPIKeyRequest, role string, now time.Time) []FieldError {
+	var errs []FieldError
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength {
+		errs = append(errs, FieldError{Field: "name", Message: fmt.Sprintf("must be 1 to %d characters", maxAPIKeyNameLength)})
+	}
+
+	valid := make([]string, len(APIKeyScopes))
+	for i, scope := range APIKeyScopes {
+		valid[i] = string(scope)
+	}
+	seen := map[string]bool{}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, FieldError{Field: "scopes", Message: "must not be empty"})
+	}
+	for _, scope := range req.Scopes {
+		switch {
+		case !containsString(valid, scope):
+			errs = append(errs, FieldError{Field: "scopes", Message: fmt.Sprintf("%q is not one of %s", scope, strings.Join(valid, ", "))})
+		case seen[scope]:
+			errs = append(errs, FieldError{Field: "scopes", Message: fmt.Sprintf("%q is listed twice", scope)})
+		case !roleCan(role, Permission(scope)):
+			errs = append(errs, FieldError{Field: "scopes", Message: fmt.Sprintf("%q is not granted by your %s role", scope, role)})
+		}
+		seen[scope] = true
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		errs = append(errs, FieldError{Field: "expires_at", Message: "must be in the future"})
+	}
+	return errs
+}
+
+// APIKeyService issues API keys and authenticates requests made with them
+type APIKeyService struct {
+	apiKeyRepo APIKeyRepository
+	userRepo   UserRepository
+	logger     *slog.Logger
+}
+
+func NewAPIKeyService(apiKeyRepo APIKeyRepository, userRepo UserRepository) *APIKeyService {
+	return &APIKeyService{
+		apiKeyRepo: apiKeyRepo,
+		userRepo:   userRepo,
+		logger:     slog.Default().With("component", "api_keys"),
+	}
+}
+
+// Create returns a new key for user in a workspace and the key itself, which
+// is not stored
+func (s *APIKeyService) Create(ctx context.Context, user *User, workspaceID int64, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := apiKeyPrefix + token
+
+	created, err := s.apiKeyRepo.Create(ctx, &APIKey{
+		UserID:      user.ID,
+		WorkspaceID: workspaceID,
+		Name:        name,
+		Prefix:      key[:apiKeyDisplayLength],
+		KeyHash:     hashToken(key),
+		Scopes:      scopes,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return created, key, nil
+}
+
+// Authenticate returns a key and the user it acts for. It returns
+// ErrInvalidAPIKey when the key is unknown or expired or its user disabled.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (*APIKey, *User, error) {
+	now := time.Now().UTC()
+	apiKey, err := s.apiKeyRepo.GetByHash(ctx, hashToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	user, err := s.userRepo.GetByID(ctx, apiKey.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	// Recording the use is best effort; it must not fail the request
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyLastUsedInterval {
+		if err := s.apiKeyRepo.UpdateLastUsed(ctx, apiKey.ID, now); err != nil {
+			s.logger.Warn("Failed to record API key use", "api_key_id", apiKey.ID, "error", err)
+		} else {
+			apiKey.LastUsedAt = &now
+		}
+	}
+	return apiKey, user, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Trailing slash policies for URLCanonicalizer
+const (
+	TrailingSlashKeep  = "keep"
+	TrailingSlashStrip = "strip"
+	TrailingSlashAdd   = "add"
+)
+
+// trackingParams lists query parameters that never change page content
+var trackingParams = map[string]bool{
+	"gclid":   true,
+	"dclid":   true,
+	"fbclid":  true,
+	"msclkid": true,
+	"yclid":   true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// URLCanonicalizer rewrites URLs into a canonical form so that equivalent
+// inputs are stored and deduplicated as a single row
+type URLCanonicalizer struct {
+	StripTrackingParams bool
+	TrailingSlash       string
+}
+
+func NewURLCanonicalizer() *URLCanonicalizer {
+	policy := getEnv("URL_TRAILING_SLASH", TrailingSlashKeep)
+	if policy != TrailingSlashStrip && policy != TrailingSlashAdd {
+		policy = TrailingSlashKeep
+	}
+
+	return &URLCanonicalizer{
+		StripTrackingParams: getEnv("URL_STRIP_TRACKING_PARAMS", "true") == "true",
+		TrailingSlash:       policy,
+	}
+}
+
+// Canonicalize returns the canonical form of raw. URLs without a scheme are
+// assumed to be https.
+func (c *URLCanonicalizer) Canonicalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("URL is empty")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URL: %w", err)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	host := strings.ToLower(u.Hostname())
+	if net.ParseIP(host) == nil {
+		host, err = idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+		if err != nil {
+			return "", fmt.Errorf("invalid host %q: %w", u.Hostname(), err)
+		}
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	u.Path = c.applyTrailingSlash(u.Path)
+	u.RawPath = ""
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		if c.StripTrackingParams {
+			for key := range query {
+				if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+					query.Del(key)
+				}
+			}
+		}
+		// Encode sorts by key, so parameter order no longer matters
+		u.RawQuery = query.Encode()
+	}
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+func (c *URLCanonicalizer) applyTrailingSlash(path string) string {
+	if path == "" || path == "/" {
+		return "/"
+	}
+
+	switch c.TrailingSlash {
+	case TrailingSlashStrip:
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	}
+	return path
+}
+
+// URLHash returns the hex encoded SHA-256 of a canonical URL, used as its
+// uniqueness key in the database
+func URLHash(canonicalURL string) string {
+	sum := sha256.Sum256([]byte(canonicalURL))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,14 +1,350 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
+// Store bundles the repositories of the configured storage backend
+type Store struct {
+	URLs       URLRepository
+	Analysis   AnalysisRepository
+	Users      UserRepository
+	Webhooks   WebhookRepository
+	Stats      StatsRepository
+	Workspaces WorkspaceRepository
+	APIKeys    APIKeyRepository
+	Logins     LoginThrottleRepository
+	RateLimits RateLimitRepository
+
+	// UnitOfWork runs URL, analysis and workspace changes in one transaction
+	UnitOfWork UnitOfWork
+
+	// DB and Dialect are nil for the in-memory store
+	DB      *sql.DB
+	Dialect *sqlDialect
+}
+
+// NewSQLStore returns a store backed by db whose queries are cancelled after
+// queryTimeout, or only when their context ends if it is zero
+func NewSQLStore(db *sql.DB, dialect *sqlDialect, queryTimeout time.Duration) *Store {
+	return &Store{
+		URLs:       NewSQLURLRepository(db, dialect, queryTimeout),
+		Analysis:   NewSQLAnalysisRepository(db, dialect, queryTimeout),
+		Users:      NewSQLUserRepository(db, dialect, queryTimeout),
+		Webhooks:   NewSQLWebhookRepository(db, dialect, queryTimeout),
+		Stats:      NewSQLStatsRepository(db, dialect, queryTimeout),
+		Workspaces: NewSQLWorkspaceRepository(db, dialect, queryTimeout),
+		APIKeys:    NewSQLAPIKeyRepository(db, dialect, queryTimeout),
+		Logins:     NewSQLLoginThrottleRepository(db, dialect, queryTimeout),
+		RateLimits: NewSQLRateLimitRepository(db, dialect, queryTimeout),
+		UnitOfWork: NewSQLUnitOfWork(db, dialect, queryTimeout),
+		DB:         db,
+		Dialect:    dialect,
+	}
+}
+
+// PingContext checks that the database is reachable
+func (s *Store) PingContext(ctx context.Context) error {
+	if s.DB == nil {
+		return nil
+	}
+	return s.DB.PingContext(ctx)
+}
+
+func (s *Store) Close() error {
+	if s.DB == nil {
+		return nil
+	}
+	return s.DB.Close()
+}
+
+// sqlDialect captures what differs between the supported SQL databases
+type sqlDialect struct {
+	// name selects the migrations/<name> directory
+	name string
+	// system tags tracing spans
+	system attribute.KeyValue
+	// numberedPlaceholders is set for databases that use $1, $2... instead of ?
+	numberedPlaceholders bool
+	// returningID is set for databases without LastInsertId support
+	returningID bool
+	// transactionalDDL is set for databases that roll back schema changes
+	// with the transaction they ran in
+	transactionalDDL bool
+	// isDuplicate reports whether err is a unique key violation
+	isDuplicate func(err error) bool
+	// lock serializes migrations across processes and returns the unlock function
+	lock func(ctx context.Context, conn *sql.Conn) (func(), error)
+	// timeFormat, when set, is the text format the database stores timestamps
+	// in, which time arguments are converted to so they compare correctly
+	timeFormat string
+	// matchTerm returns a full-text condition on urls u and analysis_results a
+	// that holds when term is found in the URL or the page content
+	matchTerm func(term searchTerm) (string, []interface{})
+	// day formats a timestamp column as its YYYY-MM-DD date
+	day func(column string) string
+	// seconds returns the seconds between two timestamp columns
+	seconds func(from, to string) string
+	// host extracts the hostname, without any port, from a canonical URL column
+	host func(column string) string
+}
+
+// rebind rewrites the ? placeholders of query into the dialect's style. A ?
+// inside a quoted literal or identifier, or in a comment, is left alone.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			// Doubled quotes inside are escapes, which this reads as the
+			// literal ending and a new one starting right away
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+4])
+			i += end + 3
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// timeArg converts t into a query argument compared against stored timestamps
+func (d *sqlDialect) timeArg(t time.Time) interface{} {
+	if d.timeFormat == "" {
+		return t
+	}
+	return t.UTC().Format(d.timeFormat)
+}
+
+// execQueryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx
+type execQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx, so repositories can run inside
+// a unit of work
+type queryer interface {
+	execQueryer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// insert runs an INSERT and returns the ID of the new row
+func (d *sqlDialect) insert(ctx context.Context, db execQueryer, query string, args ...interface{}) (int64, error) {
+	if d.returningID {
+		var id int64
+		err := db.QueryRowContext(ctx, d.rebind(query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.ExecContext(ctx, d.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// mysqlDuplicateEntry is the MySQL error number for unique key violations
+const mysqlDuplicateEntry = 1062
+
+// migrationLockName serializes migrations across replicas via GET_LOCK
+const migrationLockName = "crawler_schema_migrations"
+
+var mysqlDialect = &sqlDialect{
+	name:   "mysql",
+	system: semconv.DBSystemMySQL,
+	isDuplicate: func(err error) bool {
+		var mysqlErr *mysql.MySQLError
+		return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+	},
+	lock: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 60)`, migrationLockName).Scan(&locked); err != nil {
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if locked.Int64 != 1 {
+			return nil, fmt.Errorf("timed out waiting for migration lock")
+		}
+		return func() {
+			conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrationLockName)
+		}, nil
+	},
+	matchTerm: func(term searchTerm) (string, []interface{}) {
+		return `(MATCH(u.url) AGAINST (? IN BOOLEAN MODE) OR MATCH(a.page_title, a.meta_description, a.extracted_text) AGAINST (? IN BOOLEAN MODE))`,
+			[]interface{}{term.mysql(), term.mysql()}
+	},
+	day: func(column string) string {
+		return "DATE_FORMAT(" + column + ", '%Y-%m-%d')"
+	},
+	seconds: func(from, to string) string {
+		return "TIMESTAMPDIFF(MICROSECOND, " + from + ", " + to + ") / 1000000.0"
+	},
+	host: func(column string) string {
+		return "SUBSTRING_INDEX(SUBSTRING_INDEX(SUBSTRING_INDEX(" + column + ", '://', -1), '/', 1), ':', 1)"
+	},
+}
+
+// sqliteDialect is for single process deployments, so migrations need no lock.
+// SQLite compares timestamps as text in the format of CURRENT_TIMESTAMP.
+var sqliteDialect = &sqlDialect{
+	name:             "sqlite",
+	system:           semconv.DBSystemSqlite,
+	timeFormat:       "2006-01-02 15:04:05",
+	transactionalDDL: true,
+	isDuplicate: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		if !errors.As(err, &sqliteErr) {
+			return false
+		}
+		// Composite primary keys, like workspace_members', report their own code
+		code := sqliteErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	},
+	lock: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		return func() {}, nil
+	},
+	matchTerm: func(term searchTerm) (string, []interface{}) {
+		return `u.id IN (SELECT rowid FROM url_search WHERE url_search MATCH ?)`, []interface{}{term.fts5()}
+	},
+	day: func(column string) string {
+		return "strftime('%Y-%m-%d', " + column + ")"
+	},
+	seconds: func(from, to string) string {
+		return "((julianday(" + to + ") - julianday(" + from + ")) * 86400.0)"
+	},
+	host: func(column string) string {
+		// SQLite has no split function, so cut the URL after the scheme, then
+		// at the first / and :
+		rest := "substr(" + column + ", instr(" + column + ", '://') + 3)"
+		host := "substr(" + rest + ", 1, instr(" + rest + " || '/', '/') - 1)"
+		return "substr(" + host + ", 1, instr(" + host + " || ':', ':') - 1)"
+	},
+}
+
+// postgresUniqueViolation is the SQLSTATE for unique key violations
+const postgresUniqueViolation = "23505"
+
+var postgresDialect = &sqlDialect{
+	name:                 "postgres",
+	system:               semconv.DBSystemPostgreSQL,
+	numberedPlaceholders: true,
+	returningID:          true,
+	transactionalDDL:     true,
+	isDuplicate: func(err error) bool {
+		var pgErr *pgconn.PgError
+		return errors.As(err, &pgErr) && pgErr.Code == postgresUniqueViolation
+	},
+	lock: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, migrationLockName); err != nil {
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, migrationLockName)
+		}, nil
+	},
+	matchTerm: func(term searchTerm) (string, []interface{}) {
+		return `(` + postgresURLVector + ` @@ to_tsquery('simple', ?) OR ` + postgresContentVector + ` @@ to_tsquery('simple', ?))`,
+			[]interface{}{term.postgres(), term.postgres()}
+	},
+	day: func(column string) string {
+		return "to_char(" + column + " AT TIME ZONE 'UTC', 'YYYY-MM-DD')"
+	},
+	seconds: func(from, to string) string {
+		return "CAST(EXTRACT(EPOCH FROM (" + to + " - " + from + ")) AS DOUBLE PRECISION)"
+	},
+	host: func(column string) string {
+		return "split_part(split_part(split_part(" + column + ", '://', 2), '/', 1), ':', 1)"
+	},
+}
+
+// The tsvector expressions of the PostgreSQL search indexes, which queries
+// must repeat exactly for the indexes to be used
+const (
+	postgresURLVector     = `to_tsvector('simple', translate(u.url, '/.:-_?=&#%+~', '            '))`
+	postgresContentVector = `to_tsvector('simple', coalesce(a.page_title, '') || ' ' || coalesce(a.meta_description, '') || ' ' || coalesce(a.extracted_text, ''))`
+)
+
+// openStore opens the storage backend selected by DB_DRIVER: mysql (default),
+// postgres, sqlite or memory
+func openStore() (*Store, error) {
+	queryTimeout, err := time.ParseDuration(getEnv("DB_QUERY_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_QUERY_TIMEOUT: %w", err)
+	}
+
+	switch driver := getEnv("DB_DRIVER", "mysql"); driver {
+	case "mysql":
+		db, err := initDatabase()
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLStore(db, mysqlDialect, queryTimeout), nil
+	case "postgres":
+		db, err := initPostgres()
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLStore(db, postgresDialect, queryTimeout), nil
+	case "sqlite":
+		db, err := initSQLite(getEnv("SQLITE_PATH", "crawler.db"))
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLStore(db, sqliteDialect, queryTimeout), nil
+	case "memory":
+		slog.Warn("Using the in-memory store, data is lost on restart")
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q, expected mysql, postgres, sqlite or memory", driver)
+	}
+}
+
 func initDatabase() (*sql.DB, error) {
 	// Get database configuration from environment variables
 	dbHost := getEnv("DB_HOST", "localhost")
@@ -36,7 +372,67 @@ func initDatabase() (*sql.DB, error) {
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(5)
 
-	log.Println("Database connection established successfully")
+	slog.Info("Database connection established successfully", "host", dbHost, "database", dbName)
+	return db, nil
+}
+
+// initPostgres connects to PostgreSQL using the same DB_* variables as MySQL
+func initPostgres() (*sql.DB, error) {
+	dbHost := getEnv("DB_HOST", "localhost")
+	dbPort := getEnv("DB_PORT", "5432")
+	dbName := getEnv("DB_NAME", "crawler_db")
+	dbUser := getEnv("DB_USER", "crawler_user")
+	dbPassword := getEnv("DB_PASSWORD", "crawler_password")
+
+	// A URL escapes passwords with spaces, quotes or other special characters
+	dsn := (&url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(dbUser, dbPassword),
+		Host:     net.JoinHostPort(dbHost, dbPort),
+		Path:     "/" + dbName,
+		RawQuery: url.Values{"sslmode": {getEnv("DB_SSLMODE", "disable")}}.Encode(),
+	}).String()
+
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Database connection established successfully", "driver", "postgres", "host", dbHost, "database", dbName)
+	return db, nil
+}
+
+// openPostgres opens and pings a PostgreSQL connection pool for dsn
+func openPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	return db, nil
+}
+
+// initSQLite opens the SQLite database file at path, creating it if needed
+func initSQLite(path string) (*sql.DB, error) {
+	// WAL and a busy timeout let the crawler workers and API write concurrently
+	dsn := path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	slog.Info("Database connection established successfully", "driver", "sqlite", "path", path)
 	return db, nil
 }
 
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the crawler
+const (
+	EventURLStatus = "url.status"
+)
+
+// URLEvent describes a status transition of a crawl job
+type URLEvent struct {
+	Type        string           `json:"type"`
+	WorkspaceID int64            `json:"workspace_id"`
+	URLID       int64            `json:"url_id"`
+	URL         string           `json:"url"`
+	Status      string           `json:"status"`
+	Error       *string          `json:"error,omitempty"`
+	Analysis    *AnalysisSummary `json:"analysis,omitempty"`
+	Timestamp   time.Time        `json:"timestamp"`
+}
+
+// AnalysisSummary is the subset of an analysis shown next to a URL
+type AnalysisSummary struct {
+	HTMLVersion        *string `json:"html_version,omitempty"`
+	PageTitle          *string `json:"page_title,omitempty"`
+	InternalLinksCount int     `json:"internal_links_count"`
+	ExternalLinksCount int     `json:"external_links_count"`
+	BrokenLinksCount   int     `json:"broken_links_count"`
+	HasLoginForm       bool    `json:"has_login_form"`
+}
+
+func NewAnalysisSummary(analysis *AnalysisResult) *AnalysisSummary {
+	return &AnalysisSummary{
+		HTMLVersion:        analysis.HTMLVersion,
+		PageTitle:          analysis.PageTitle,
+		InternalLinksCount: analysis.InternalLinksCount,
+		ExternalLinksCount: analysis.ExternalLinksCount,
+		BrokenLinksCount:   analysis.BrokenLinksCount,
+		HasLoginForm:       analysis.HasLoginForm,
+	}
+}
+
+// EventBroker fans URL events out to subscribers. EventHub is the in-process
+// implementation; a DB or message bus backed broker can replace it when the
+// backend runs as several replicas.
+type EventBroker interface {
+	Publish(event URLEvent)
+	// Subscribe returns a channel of events and a function that cancels the
+	// subscription and closes the channel
+	Subscribe(buffer int) (<-chan URLEvent, func())
+}
+
+// EventHub is an in-memory EventBroker
+type EventHub struct {
+	mu          sync.RWMutex
+	subscribers map[chan URLEvent]struct{}
+	closed      bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan URLEvent]struct{})}
+}
+
+func (h *EventHub) Publish(event URLEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Subscriber is not keeping up, drop the event rather than block the crawler
+		}
+	}
+}
+
+func (h *EventHub) Subscribe(buffer int) (<-chan URLEvent, func()) {
+	ch := make(chan URLEvent, buffer)
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// Close ends every subscription, so event streams finish when the server
+// shuts down, and makes later subscriptions end at once
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
@@ -1,20 +1,68 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// StatusClientClosedRequest is the non-standard status logged when the client
+// disconnects before the response is written
+const StatusClientClosedRequest = 499
+
+// respondDatabaseError reports a failed repository call: 499 when the client
+// went away, 503 when the query timed out and 500 otherwise
+func respondDatabaseError(c *gin.Context, err error, message string) {
+	c.Error(err)
+
+	code, errorCode := http.StatusInternalServerError, "database_error"
+	switch {
+	case errors.Is(err, context.Canceled):
+		code, errorCode, message = StatusClientClosedRequest, "request_canceled", "Request was canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		code, errorCode, message = http.StatusServiceUnavailable, "database_timeout", "Database did not respond in time"
+	}
+
+	c.JSON(code, ErrorResponse{
+		Error:   errorCode,
+		Message: message,
+		Code:    code,
+	})
+}
+
+// respondLookupError reports a failed lookup by ID as not found, unless the
+// request was canceled or timed out
+func respondLookupError(c *gin.Context, err error, message string) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		respondDatabaseError(c, err, message)
+		return
+	}
+
+	c.Error(err)
+	c.JSON(http.StatusNotFound, ErrorResponse{
+		Error:   "not_found",
+		Message: message,
+		Code:    http.StatusNotFound,
+	})
+}
+
 // AuthHandler handles authentication endpoints
 type AuthHandler struct {
 	authService *AuthService
+	throttle    *LoginThrottle
 }
 
-func NewAuthHandler(authService *AuthService) *AuthHandler {
-	return &AuthHandler{authService: authService}
+func NewAuthHandler(authService *AuthService, throttle *LoginThrottle) *AuthHandler {
+	return &AuthHandler{authService: authService, throttle: throttle}
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -28,8 +76,23 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Login(req.Username, req.Password)
+	ctx := c.Request.Context()
+	attempt, wait, err := h.throttle.Attempt(ctx, req.Username, c.ClientIP())
 	if err != nil {
+		respondDatabaseError(c, err, "Failed to log in")
+		return
+	}
+	if wait > 0 {
+		respondTooManyAttempts(c, wait, "Too many failed login attempts, try again later")
+		return
+	}
+
+	response, err := h.authService.Login(ctx, req.Username, req.Password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		if err := h.throttle.RecordFailure(ctx, attempt); err != nil {
+			respondDatabaseError(c, err, "Failed to log in")
+			return
+		}
 		c.JSON(http.StatusUnauthorized, ErrorResponse{
 			Error:   "authentication_error",
 			Message: "Invalid credentials",
@@ -37,46 +100,420 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		})
 		return
 	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to log in")
+		return
+	}
+	if err := h.throttle.RecordSuccess(ctx, attempt); err != nil {
+		respondDatabaseError(c, err, "Failed to log in")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// respondTooManyAttempts refuses a password attempt the login throttle holds
+// back for wait
+func respondTooManyAttempts(c *gin.Context, wait time.Duration, message string) {
+	c.Header("Retry-After", ceilSeconds(wait))
+	c.JSON(http.StatusTooManyRequests, ErrorResponse{
+		Error:   "too_many_attempts",
+		Message: message,
+		Code:    http.StatusTooManyRequests,
+	})
+}
+
+// GetLockouts lists the login lockouts since the since query parameter, an
+// RFC 3339 time defaulting to a week ago
+func (h *AuthHandler) GetLockouts(c *gin.Context) {
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if value := c.Query("since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "since must be an RFC 3339 time",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		since = parsed
+	}
+
+	lockouts, err := h.throttle.Lockouts(c.Request.Context(), since)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to get login lockouts")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// Refresh exchanges a refresh token for a new token pair
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	response, err := h.authService.Refresh(c.Request.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{
+			Error:   "invalid_token",
+			Message: "Refresh token is invalid or expired",
+			Code:    http.StatusUnauthorized,
+		})
+		return
+	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to refresh token")
+		return
+	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// Logout revokes the refresh token and the access tokens of its login. It
+// takes the refresh token rather than the access token, so it works after
+// the access token expired.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req LogoutRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if err := h.authService.Logout(c.Request.Context(), req.RefreshToken); err != nil {
+		respondDatabaseError(c, err, "Failed to log out")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// Me returns the authenticated user
+func (h *AuthHandler) Me(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"user": currentUser(c)})
+}
+
+// CreateStreamTicket issues a single-use ticket for GET /api/events
+func (h *AuthHandler) CreateStreamTicket(c *gin.Context) {
+	ticket, err := h.authService.IssueStreamTicket(c.Request.Context(), currentUser(c))
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create stream ticket")
+		return
+	}
+
+	c.JSON(http.StatusCreated, ticket)
+}
+
+// UserHandler handles user management and password endpoints
+type UserHandler struct {
+	userRepo    UserRepository
+	userService *UserService
+	throttle    *LoginThrottle
+}
+
+func NewUserHandler(userRepo UserRepository, userService *UserService, throttle *LoginThrottle) *UserHandler {
+	return &UserHandler{userRepo: userRepo, userService: userService, throttle: throttle}
+}
+
+// bindJSON parses the request body into req, writing the error response and
+// returning false when it is malformed
+func bindJSON(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request format",
+			Code:    http.StatusBadRequest,
+		})
+		return false
+	}
+	return true
+}
+
+// respondValidationErrors writes a 422 response when fieldErrors is not
+// empty and reports whether it did
+func respondValidationErrors(c *gin.Context, message string, fieldErrors []FieldError) bool {
+	if len(fieldErrors) == 0 {
+		return false
+	}
+	c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+		Error:   "validation_error",
+		Message: message,
+		Code:    http.StatusUnprocessableEntity,
+		Details: fieldErrors,
+	})
+	return true
+}
+
+// loadUser fetches the user named by the :id parameter, writing the error
+// response and returning nil when it cannot
+func (h *UserHandler) loadUser(c *gin.Context) *User {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return nil
+	}
+
+	user, err := h.userRepo.GetByID(c.Request.Context(), id)
+	if err != nil {
+		respondLookupError(c, err, "User not found")
+		return nil
+	}
+
+	return user
+}
+
+func (h *UserHandler) GetUsers(c *gin.Context) {
+	users, err := h.userRepo.GetAll(c.Request.Context())
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve users")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func (h *UserHandler) GetUser(c *gin.Context) {
+	user := h.loadUser(c)
+	if user == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func (h *UserHandler) CreateUser(c *gin.Context) {
+	var req CreateUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	email, fieldErrors := normalizeEmail(req.Email)
+	fieldErrors = append(validateUsername(req.Username), fieldErrors...)
+	fieldErrors = append(fieldErrors, h.userService.ValidatePassword("password", req.Password)...)
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	fieldErrors = append(fieldErrors, validateRole(req.Role)...)
+	if respondValidationErrors(c, "Invalid user", fieldErrors) {
+		return
+	}
+
+	user, err := h.userService.CreateUser(c.Request.Context(), &User{Username: req.Username, Email: email, Role: req.Role}, req.Password)
+	if errors.Is(err, ErrDuplicateUsername) {
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "duplicate_username",
+			Message: "Username is already taken",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create user")
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// saveUser stores changes to a user. Admins cannot demote or disable
+// themselves, so there is always an admin left to undo mistakes.
+func (h *UserHandler) saveUser(c *gin.Context, user *User) {
+	if self := currentUser(c); self != nil && self.ID == user.ID && (user.Role != RoleAdmin || user.Disabled) {
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "self_lockout",
+			Message: "You cannot remove your own admin access or disable yourself",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+
+	if err := h.userRepo.Update(c.Request.Context(), user); err != nil {
+		respondDatabaseError(c, err, "Failed to update user")
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func (h *UserHandler) UpdateUser(c *gin.Context) {
+	user := h.loadUser(c)
+	if user == nil {
+		return
+	}
+
+	var req UpdateUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if req.Email != nil {
+		email, fieldErrors := normalizeEmail(req.Email)
+		if respondValidationErrors(c, "Invalid user", fieldErrors) {
+			return
+		}
+		user.Email = email
+	}
+	if req.Role != nil {
+		if respondValidationErrors(c, "Invalid user", validateRole(*req.Role)) {
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+
+	h.saveUser(c, user)
+}
+
+func (h *UserHandler) DisableUser(c *gin.Context) {
+	if user := h.loadUser(c); user != nil {
+		user.Disabled = true
+		h.saveUser(c, user)
+	}
+}
+
+func (h *UserHandler) EnableUser(c *gin.Context) {
+	if user := h.loadUser(c); user != nil {
+		user.Disabled = false
+		h.saveUser(c, user)
+	}
+}
+
+// IssuePasswordReset returns a one-time token for an admin to pass on to
+// the user, who sets a new password with it
+func (h *UserHandler) IssuePasswordReset(c *gin.Context) {
+	user := h.loadUser(c)
+	if user == nil {
+		return
+	}
+
+	token, expiresAt, err := h.userService.IssuePasswordReset(c.Request.Context(), user)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create password reset token")
+		return
+	}
+
+	c.JSON(http.StatusCreated, PasswordResetResponse{Token: token, ExpiresAt: expiresAt})
+}
+
+// ChangePassword lets the authenticated user change their own password
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if respondValidationErrors(c, "Invalid password", h.userService.ValidatePassword("new_password", req.NewPassword)) {
+		return
+	}
+
+	// The current password is guessed like a login one, so it shares the
+	// login throttle of the user
+	ctx := c.Request.Context()
+	user := currentUser(c)
+	attempt, wait, err := h.throttle.Attempt(ctx, user.Username, c.ClientIP())
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to change password")
+		return
+	}
+	if wait > 0 {
+		respondTooManyAttempts(c, wait, "Too many failed password attempts, try again later")
+		return
+	}
+
+	err = h.userService.ChangePassword(ctx, user, req.CurrentPassword, req.NewPassword)
+	if errors.Is(err, ErrInvalidCredentials) {
+		if err := h.throttle.RecordFailure(ctx, attempt); err != nil {
+			respondDatabaseError(c, err, "Failed to change password")
+			return
+		}
+		c.JSON(http.StatusForbidden, ErrorResponse{
+			Error:   "invalid_password",
+			Message: "Current password is incorrect",
+			Code:    http.StatusForbidden,
+		})
+		return
+	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to change password")
+		return
+	}
+	if err := h.throttle.RecordSuccess(ctx, attempt); err != nil {
+		respondDatabaseError(c, err, "Failed to change password")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// ResetPassword sets a new password with a token from IssuePasswordReset
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if respondValidationErrors(c, "Invalid password", h.userService.ValidatePassword("new_password", req.NewPassword)) {
+		return
+	}
+
+	err := h.userService.ResetPassword(c.Request.Context(), req.Token, req.NewPassword)
+	if errors.Is(err, ErrInvalidResetToken) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_token",
+			Message: "Password reset token is invalid or expired",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to reset password")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
+
 // URLHandler handles URL management endpoints
 type URLHandler struct {
-	urlRepo        *URLRepository
+	urlRepo        URLRepository
 	crawlerService *CrawlerService
+	canonicalizer  *URLCanonicalizer
+	validator      *URLValidator
 }
 
-func NewURLHandler(urlRepo *URLRepository, crawlerService *CrawlerService) *URLHandler {
+func NewURLHandler(urlRepo URLRepository, crawlerService *CrawlerService, canonicalizer *URLCanonicalizer, validator *URLValidator) *URLHandler {
 	return &URLHandler{
 		urlRepo:        urlRepo,
 		crawlerService: crawlerService,
+		canonicalizer:  canonicalizer,
+		validator:      validator,
 	}
 }
 
 func (h *URLHandler) GetURLs(c *gin.Context) {
-	// Get query parameters
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
-	status := c.Query("status")
-	search := c.Query("search")
-
-	// Validate parameters
-	if page < 1 {
-		page = 1
-	}
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 10
+	// Parse and validate query parameters
+	opts, fieldErrors := ParseURLListOptions(c.Request.URL.Query())
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid query parameters",
+			Code:    http.StatusBadRequest,
+			Details: fieldErrors,
+		})
+		return
 	}
+	opts.WorkspaceID = currentWorkspaceID(c)
 
 	// Get URLs from repository
-	response, err := h.urlRepo.GetAll(page, pageSize, status, search)
+	response, err := h.urlRepo.GetAll(c.Request.Context(), opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to retrieve URLs",
-			Code:    http.StatusInternalServerError,
-		})
+		respondDatabaseError(c, err, "Failed to retrieve URLs")
 		return
 	}
 
@@ -94,21 +531,54 @@ func (h *URLHandler) CreateURL(c *gin.Context) {
 		return
 	}
 
-	// Validate URL format
-	if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
-		req.URL = "https://" + req.URL
+	// Canonicalize so equivalent URLs deduplicate to one row
+	canonicalURL, err := h.canonicalizer.Canonicalize(req.URL)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid URL",
+			Code:    http.StatusUnprocessableEntity,
+			Details: []FieldError{{Field: "url", Message: "is not a valid URL"}},
+		})
+		return
+	}
+
+	if fieldErrors := h.validator.Validate(canonicalURL); len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid URL",
+			Code:    http.StatusUnprocessableEntity,
+			Details: fieldErrors,
+		})
+		return
 	}
 
 	// Create URL in database
-	url, err := h.urlRepo.Create(req.URL)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to create URL",
-			Code:    http.StatusInternalServerError,
+	workspaceID := currentWorkspaceID(c)
+	url, err := h.urlRepo.Create(c.Request.Context(), workspaceID, strings.TrimSpace(req.URL), canonicalURL)
+	if errors.Is(err, ErrDuplicateURL) {
+		existing, err := h.urlRepo.GetByCanonicalURL(c.Request.Context(), workspaceID, canonicalURL)
+		if err != nil {
+			respondDatabaseError(c, err, "Failed to load existing URL")
+			return
+		}
+
+		c.JSON(http.StatusConflict, DuplicateURLResponse{
+			ErrorResponse: ErrorResponse{
+				Error:   "duplicate_url",
+				Message: "URL has already been added",
+				Code:    http.StatusConflict,
+			},
+			URL: existing,
 		})
 		return
 	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create URL")
+		return
+	}
+
+	h.crawlerService.NotifyStatus(url)
 
 	c.JSON(http.StatusCreated, url)
 }
@@ -154,19 +624,34 @@ func (h *URLHandler) UpdateStatus(c *gin.Context) {
 		return
 	}
 
+	// Look the URL up first to answer 404 for IDs outside the workspace
+	workspaceID := currentWorkspaceID(c)
+	if _, err := h.urlRepo.GetByID(c.Request.Context(), workspaceID, id); err != nil {
+		respondLookupError(c, err, "URL not found")
+		return
+	}
+
 	// Update status
-	if err := h.urlRepo.UpdateStatus(id, req.Status); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to update status",
-			Code:    http.StatusInternalServerError,
-		})
+	if err := h.urlRepo.UpdateStatus(c.Request.Context(), workspaceID, id, req.Status); err != nil {
+		respondDatabaseError(c, err, "Failed to update status")
 		return
 	}
 
+	h.notifyStatus(c, id)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Status updated successfully"})
 }
 
+// notifyStatus publishes the current status of a URL to event stream subscribers
+func (h *URLHandler) notifyStatus(c *gin.Context, id int64) {
+	url, err := h.urlRepo.GetByID(c.Request.Context(), currentWorkspaceID(c), id)
+	if err != nil {
+		loggerFromContext(c.Request.Context()).Warn("Failed to load URL for status event", "url_id", id, "error", err)
+		return
+	}
+	h.crawlerService.NotifyStatus(url)
+}
+
 func (h *URLHandler) DeleteURL(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -179,12 +664,8 @@ func (h *URLHandler) DeleteURL(c *gin.Context) {
 		return
 	}
 
-	if err := h.urlRepo.Delete(id); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to delete URL",
-			Code:    http.StatusInternalServerError,
-		})
+	if err := h.urlRepo.Delete(c.Request.Context(), currentWorkspaceID(c), id); err != nil {
+		respondDatabaseError(c, err, "Failed to delete URL")
 		return
 	}
 
@@ -202,12 +683,8 @@ func (h *URLHandler) BulkDelete(c *gin.Context) {
 		return
 	}
 
-	if err := h.urlRepo.BulkDelete(req.IDs); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to delete URLs",
-			Code:    http.StatusInternalServerError,
-		})
+	if err := h.urlRepo.BulkDelete(c.Request.Context(), currentWorkspaceID(c), req.IDs); err != nil {
+		respondDatabaseError(c, err, "Failed to delete URLs")
 		return
 	}
 
@@ -225,16 +702,20 @@ func (h *URLHandler) BulkRerun(c *gin.Context) {
 		return
 	}
 
-	// Reset status for each URL to queued
+	// Reset status for each URL to queued, skipping IDs outside the workspace
+	workspaceID := currentWorkspaceID(c)
 	for _, id := range req.IDs {
-		if err := h.urlRepo.UpdateStatus(id, "queued"); err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Error:   "database_error",
-				Message: "Failed to reset URL status",
-				Code:    http.StatusInternalServerError,
-			})
+		if _, err := h.urlRepo.GetByID(c.Request.Context(), workspaceID, id); errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			respondDatabaseError(c, err, "Failed to load URL")
+			return
+		}
+		if err := h.urlRepo.UpdateStatus(c.Request.Context(), workspaceID, id, "queued"); err != nil {
+			respondDatabaseError(c, err, "Failed to reset URL status")
 			return
 		}
+		h.notifyStatus(c, id)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Analysis queued for rerun"})
@@ -242,11 +723,11 @@ func (h *URLHandler) BulkRerun(c *gin.Context) {
 
 // AnalysisHandler handles analysis endpoints
 type AnalysisHandler struct {
-	analysisRepo *AnalysisRepository
-	urlRepo      *URLRepository
+	analysisRepo AnalysisRepository
+	urlRepo      URLRepository
 }
 
-func NewAnalysisHandler(analysisRepo *AnalysisRepository, urlRepo *URLRepository) *AnalysisHandler {
+func NewAnalysisHandler(analysisRepo AnalysisRepository, urlRepo URLRepository) *AnalysisHandler {
 	return &AnalysisHandler{analysisRepo: analysisRepo, urlRepo: urlRepo}
 }
 
@@ -262,43 +743,44 @@ func (h *AnalysisHandler) GetAnalysis(c *gin.Context) {
 		return
 	}
 
-	// Get URL
-	url, err := h.urlRepo.GetByID(id)
+	// Get URL, which limits the analysis to the request's workspace
+	url, err := h.urlRepo.GetByID(c.Request.Context(), currentWorkspaceID(c), id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{
-			Error:   "not_found",
-			Message: "URL not found",
-			Code:    http.StatusNotFound,
-		})
+		respondLookupError(c, err, "URL not found")
 		return
 	}
 
 	// Get analysis
-	analysis, err := h.analysisRepo.GetByURLID(id)
+	analysis, err := h.analysisRepo.GetByURLID(c.Request.Context(), url.WorkspaceID, id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{
-			Error:   "not_found",
-			Message: "Analysis not found",
-			Code:    http.StatusNotFound,
-		})
+		respondLookupError(c, err, "Analysis not found")
 		return
 	}
 
 	// Get broken links
-	brokenLinks, err := h.analysisRepo.GetBrokenLinks(id)
+	brokenLinks, err := h.analysisRepo.GetBrokenLinks(c.Request.Context(), url.WorkspaceID, id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to retrieve broken links",
-			Code:    http.StatusInternalServerError,
-		})
+		respondDatabaseError(c, err, "Failed to retrieve broken links")
+		return
+	}
+
+	internalLinks, err := h.analysisRepo.GetLinks(c.Request.Context(), url.WorkspaceID, id, LinkInternal)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve internal links")
+		return
+	}
+	externalLinks, err := h.analysisRepo.GetLinks(c.Request.Context(), url.WorkspaceID, id, LinkExternal)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve external links")
 		return
 	}
 
 	response := AnalysisDetailResponse{
-		URL:         *url,
-		Analysis:    *analysis,
-		BrokenLinks: brokenLinks,
+		URL:           *url,
+		Analysis:      *analysis,
+		BrokenLinks:   brokenLinks,
+		InternalLinks: internalLinks,
+		ExternalLinks: externalLinks,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -316,15 +798,732 @@ func (h *AnalysisHandler) GetBrokenLinks(c *gin.Context) {
 		return
 	}
 
-	brokenLinks, err := h.analysisRepo.GetBrokenLinks(id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "database_error",
-			Message: "Failed to retrieve broken links",
-			Code:    http.StatusInternalServerError,
-		})
+	workspaceID := currentWorkspaceID(c)
+	if _, err := h.urlRepo.GetByID(c.Request.Context(), workspaceID, id); err != nil {
+		respondLookupError(c, err, "URL not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"broken_links": brokenLinks})
-} 
\ No newline at end of file
+	brokenLinks, err := h.analysisRepo.GetBrokenLinks(c.Request.Context(), workspaceID, id)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve broken links")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"broken_links": brokenLinks})
+}
+
+// StatsHandler serves the dashboard aggregates
+type StatsHandler struct {
+	statsService *StatsService
+}
+
+func NewStatsHandler(statsService *StatsService) *StatsHandler {
+	return &StatsHandler{statsService: statsService}
+}
+
+func (h *StatsHandler) GetStats(c *gin.Context) {
+	opts, fieldErrors := ParseStatsOptions(c.Request.URL.Query(), time.Now().UTC())
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid query parameters",
+			Code:    http.StatusBadRequest,
+			Details: fieldErrors,
+		})
+		return
+	}
+	opts.WorkspaceID = currentWorkspaceID(c)
+
+	stats, err := h.statsService.Get(c.Request.Context(), opts)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve stats")
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// EventHandler streams crawl status events to clients
+type EventHandler struct {
+	events EventBroker
+}
+
+func NewEventHandler(events EventBroker) *EventHandler {
+	return &EventHandler{events: events}
+}
+
+// Stream sends the URL status events of the request's workspace as
+// Server-Sent Events until the client disconnects. An optional url_id query
+// parameter limits the stream to one URL.
+func (h *EventHandler) Stream(c *gin.Context) {
+	workspaceID := currentWorkspaceID(c)
+
+	var urlID int64
+	if idStr := c.Query("url_id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Invalid URL ID",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		urlID = id
+	}
+
+	events, cancel := h.events.Subscribe(64)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if event.WorkspaceID == workspaceID && (urlID == 0 || event.URLID == urlID) {
+				c.SSEvent(event.Type, event)
+			}
+			return true
+		case <-heartbeat.C:
+			c.SSEvent("ping", gin.H{"time": time.Now().UTC()})
+			return true
+		}
+	})
+}
+
+// WebhookHandler handles webhook subscription endpoints
+type WebhookHandler struct {
+	webhookRepo    WebhookRepository
+	webhookService *WebhookService
+}
+
+func NewWebhookHandler(webhookRepo WebhookRepository, webhookService *WebhookService) *WebhookHandler {
+	return &WebhookHandler{webhookRepo: webhookRepo, webhookService: webhookService}
+}
+
+func validateWebhookRequest(req *WebhookRequest) []FieldError {
+	var errs []FieldError
+
+	u, err := neturl.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, FieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	} else if !webhookAllowPrivateNetworks() && !isPublicWebhookHost(u.Hostname()) {
+		errs = append(errs, FieldError{Field: "url", Message: "must not point to a loopback, private or link-local address"})
+	}
+
+	if len(req.EventTypes) == 0 {
+		errs = append(errs, FieldError{Field: "event_types", Message: "must contain at least one event type"})
+	}
+	for _, eventType := range req.EventTypes {
+		known := false
+		for _, t := range WebhookEventTypes {
+			if eventType == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			errs = append(errs, FieldError{Field: "event_types", Message: "unknown event type " + eventType})
+		}
+	}
+
+	return errs
+}
+
+// isPublicWebhookHost rejects the receiver hosts that are known not to be
+// public without resolving them. Host names are checked again when
+// deliveries dial them.
+func isPublicWebhookHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicIP(ip)
+	}
+	return true
+}
+
+// bindWebhookRequest parses and validates a webhook request, writing the error
+// response and returning false when it is invalid
+func bindWebhookRequest(c *gin.Context) (*WebhookRequest, bool) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request format",
+			Code:    http.StatusBadRequest,
+		})
+		return nil, false
+	}
+
+	if fieldErrors := validateWebhookRequest(&req); len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid webhook",
+			Code:    http.StatusUnprocessableEntity,
+			Details: fieldErrors,
+		})
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// loadWebhook fetches the webhook named by the :id parameter, writing the
+// error response and returning nil when it cannot
+func (h *WebhookHandler) loadWebhook(c *gin.Context) *Webhook {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid webhook ID",
+			Code:    http.StatusBadRequest,
+		})
+		return nil
+	}
+
+	webhook, err := h.webhookRepo.GetByID(c.Request.Context(), currentWorkspaceID(c), id)
+	if err != nil {
+		respondLookupError(c, err, "Webhook not found")
+		return nil
+	}
+
+	return webhook
+}
+
+func (h *WebhookHandler) GetWebhooks(c *gin.Context) {
+	webhooks, err := h.webhookRepo.GetAll(c.Request.Context(), currentWorkspaceID(c))
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve webhooks")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	req, ok := bindWebhookRequest(c)
+	if !ok {
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		generated, err := generateWebhookSecret()
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error:   "internal_error",
+				Message: "Failed to generate webhook secret",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		secret = generated
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	webhook, err := h.webhookRepo.Create(c.Request.Context(), &Webhook{
+		WorkspaceID: currentWorkspaceID(c),
+		URL:         req.URL,
+		Secret:      secret,
+		EventTypes:  req.EventTypes,
+		Active:      active,
+	})
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create webhook")
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateWebhookResponse{Webhook: webhook, Secret: secret})
+}
+
+func (h *WebhookHandler) GetWebhook(c *gin.Context) {
+	webhook := h.loadWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	webhook := h.loadWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	req, ok := bindWebhookRequest(c)
+	if !ok {
+		return
+	}
+
+	webhook.URL = req.URL
+	webhook.EventTypes = req.EventTypes
+	if req.Secret != "" {
+		webhook.Secret = req.Secret
+	}
+	if req.Active != nil {
+		webhook.Active = *req.Active
+	}
+
+	if err := h.webhookRepo.Update(c.Request.Context(), webhook); err != nil {
+		respondDatabaseError(c, err, "Failed to update webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	webhook := h.loadWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	if err := h.webhookRepo.Delete(c.Request.Context(), webhook.WorkspaceID, webhook.ID); err != nil {
+		respondDatabaseError(c, err, "Failed to delete webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+func (h *WebhookHandler) GetDeliveries(c *gin.Context) {
+	webhook := h.loadWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+
+	deliveries, err := h.webhookRepo.GetDeliveries(c.Request.Context(), webhook.ID, limit)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+func (h *WebhookHandler) Redeliver(c *gin.Context) {
+	webhook := h.loadWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	deliveryID, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid delivery ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	original, err := h.webhookRepo.GetDeliveryByID(c.Request.Context(), webhook.ID, deliveryID)
+	if err != nil {
+		respondLookupError(c, err, "Delivery not found")
+		return
+	}
+
+	delivery, err := h.webhookService.Redeliver(c.Request.Context(), webhook, original)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to redeliver webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+// WorkspaceHandler handles workspace, membership and invitation endpoints
+type WorkspaceHandler struct {
+	workspaceRepo    WorkspaceRepository
+	workspaceService *WorkspaceService
+}
+
+func NewWorkspaceHandler(workspaceRepo WorkspaceRepository, workspaceService *WorkspaceService) *WorkspaceHandler {
+	return &WorkspaceHandler{workspaceRepo: workspaceRepo, workspaceService: workspaceService}
+}
+
+// pathInt64 reads a numeric path parameter, writing a 400 response naming
+// what it identifies when it is invalid
+func pathInt64(c *gin.Context, param, name string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param(param), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid " + name + " ID",
+			Code:    http.StatusBadRequest,
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// GetWorkspaces lists the workspaces of the authenticated user
+func (h *WorkspaceHandler) GetWorkspaces(c *gin.Context) {
+	workspaces, err := h.workspaceRepo.GetForUser(c.Request.Context(), currentUser(c).ID)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve workspaces")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"workspaces": workspaces})
+}
+
+// CreateWorkspace starts a workspace with the authenticated user as its admin
+func (h *WorkspaceHandler) CreateWorkspace(c *gin.Context) {
+	var req CreateWorkspaceRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if respondValidationErrors(c, "Invalid workspace", validateWorkspaceName(name)) {
+		return
+	}
+
+	workspace, err := h.workspaceService.Create(c.Request.Context(), name, currentUser(c))
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create workspace")
+		return
+	}
+
+	c.JSON(http.StatusCreated, workspace)
+}
+
+// GetWorkspace returns the workspace selected by workspaceMiddleware, with
+// the user's role in it
+func (h *WorkspaceHandler) GetWorkspace(c *gin.Context) {
+	workspace, _ := c.Get("workspace")
+	c.JSON(http.StatusOK, workspace)
+}
+
+func (h *WorkspaceHandler) GetMembers(c *gin.Context) {
+	members, err := h.workspaceRepo.GetMembers(c.Request.Context(), currentWorkspaceID(c))
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve members")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// respondMemberError reports a failed membership change
+func respondMemberError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondLookupError(c, err, "Member not found")
+	case errors.Is(err, ErrLastWorkspaceAdmin):
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "last_admin",
+			Message: "A workspace must keep at least one admin",
+			Code:    http.StatusConflict,
+		})
+	default:
+		respondDatabaseError(c, err, message)
+	}
+}
+
+func (h *WorkspaceHandler) UpdateMember(c *gin.Context) {
+	userID, ok := pathInt64(c, "userId", "user")
+	if !ok {
+		return
+	}
+
+	var req UpdateMemberRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if respondValidationErrors(c, "Invalid member", validateRole(req.Role)) {
+		return
+	}
+
+	workspaceID := currentWorkspaceID(c)
+	if err := h.workspaceService.UpdateMemberRole(c.Request.Context(), workspaceID, userID, req.Role); err != nil {
+		respondMemberError(c, err, "Failed to update member")
+		return
+	}
+
+	member, err := h.workspaceRepo.GetMember(c.Request.Context(), workspaceID, userID)
+	if err != nil {
+		respondLookupError(c, err, "Member not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+func (h *WorkspaceHandler) RemoveMember(c *gin.Context) {
+	userID, ok := pathInt64(c, "userId", "user")
+	if !ok {
+		return
+	}
+
+	if err := h.workspaceService.RemoveMember(c.Request.Context(), currentWorkspaceID(c), userID); err != nil {
+		respondMemberError(c, err, "Failed to remove member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// GetInvitations lists the workspace's invitations that are not accepted yet
+func (h *WorkspaceHandler) GetInvitations(c *gin.Context) {
+	invitations, err := h.workspaceRepo.GetInvitations(c.Request.Context(), currentWorkspaceID(c))
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve invitations")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// CreateInvitation returns a one-time token for an admin to pass on to
+// whoever should join the workspace
+func (h *WorkspaceHandler) CreateInvitation(c *gin.Context) {
+	var req CreateInvitationRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	email, fieldErrors := normalizeEmail(req.Email)
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	fieldErrors = append(fieldErrors, validateRole(req.Role)...)
+	if respondValidationErrors(c, "Invalid invitation", fieldErrors) {
+		return
+	}
+
+	invitation, token, err := h.workspaceService.Invite(c.Request.Context(), currentWorkspaceID(c), currentUser(c), req.Role, email)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create invitation")
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateInvitationResponse{Invitation: invitation, Token: token})
+}
+
+func (h *WorkspaceHandler) DeleteInvitation(c *gin.Context) {
+	id, ok := pathInt64(c, "id", "invitation")
+	if !ok {
+		return
+	}
+
+	if err := h.workspaceRepo.DeleteInvitation(c.Request.Context(), currentWorkspaceID(c), id); err != nil {
+		respondDatabaseError(c, err, "Failed to delete invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation deleted successfully"})
+}
+
+// AcceptInvitation adds the authenticated user to the workspace of an
+// invitation token
+func (h *WorkspaceHandler) AcceptInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	workspace, err := h.workspaceService.AcceptInvitation(c.Request.Context(), req.Token, currentUser(c))
+	if errors.Is(err, ErrInvalidInvitation) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_token",
+			Message: "Invitation is invalid or expired",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+	if errors.Is(err, ErrInvitationEmailMismatch) {
+		c.JSON(http.StatusForbidden, ErrorResponse{
+			Error:   "invitation_email_mismatch",
+			Message: "Invitation was sent to another email address",
+			Code:    http.StatusForbidden,
+		})
+		return
+	}
+	if errors.Is(err, ErrAlreadyMember) {
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "already_member",
+			Message: "You are already a member of this workspace",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to accept invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, workspace)
+}
+
+// APIKeyHandler handles the API key endpoints of the authenticated user
+type APIKeyHandler struct {
+	apiKeyRepo    APIKeyRepository
+	apiKeyService *APIKeyService
+}
+
+func NewAPIKeyHandler(apiKeyRepo APIKeyRepository, apiKeyService *APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{apiKeyRepo: apiKeyRepo, apiKeyService: apiKeyService}
+}
+
+// GetAPIKeys lists the keys of the authenticated user in every workspace
+func (h *APIKeyHandler) GetAPIKeys(c *gin.Context) {
+	keys, err := h.apiKeyRepo.GetForUser(c.Request.Context(), currentUser(c).ID)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to retrieve API keys")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// CreateAPIKey returns a new key in the request's workspace, with scopes the
+// user's role there grants
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if respondValidationErrors(c, "Invalid API key", validateAPIKeyRequest(&req, c.GetString("workspace_role"), time.Now())) {
+		return
+	}
+
+	apiKey, key, err := h.apiKeyService.Create(c.Request.Context(), currentUser(c), currentWorkspaceID(c), req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		respondDatabaseError(c, err, "Failed to create API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+// DeleteAPIKey revokes a key of the authenticated user
+func (h *APIKeyHandler) DeleteAPIKey(c *gin.Context) {
+	id, ok := pathInt64(c, "id", "API key")
+	if !ok {
+		return
+	}
+
+	if err := h.apiKeyRepo.Delete(c.Request.Context(), currentUser(c).ID, id); err != nil {
+		respondLookupError(c, err, "API key not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
+
+// HealthHandler serves the liveness and readiness probes
+type HealthHandler struct {
+	store          *Store
+	urlRepo        URLRepository
+	crawlerService *CrawlerService
+	timeout        time.Duration
+}
+
+func NewHealthHandler(store *Store, crawlerService *CrawlerService) *HealthHandler {
+	return &HealthHandler{
+		store:          store,
+		urlRepo:        store.URLs,
+		crawlerService: crawlerService,
+		timeout:        2 * time.Second,
+	}
+}
+
+// ComponentHealth is the readiness status of one dependency
+type ComponentHealth struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// QueueHealth reports the crawl backlog
+type QueueHealth struct {
+	Depth            int64      `json:"depth"`
+	OldestQueuedAt   *time.Time `json:"oldest_queued_at,omitempty"`
+	OldestAgeSeconds float64    `json:"oldest_age_seconds"`
+}
+
+// Live reports that the process is up and serving requests
+func (h *HealthHandler) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Ready checks the database and crawler and returns 503 with per-component
+// details when any of them is degraded. The probe is unauthenticated, so
+// database errors are logged rather than returned.
+func (h *HealthHandler) Ready(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeout)
+	defer cancel()
+	logger := loggerFromContext(c.Request.Context())
+
+	ready := true
+	components := map[string]ComponentHealth{}
+
+	start := time.Now()
+	if err := h.store.PingContext(ctx); err != nil {
+		ready = false
+		logger.Error("Readiness check failed to reach the database", "error", err)
+		components["database"] = ComponentHealth{Status: "down", Error: "database is unreachable"}
+	} else {
+		components["database"] = ComponentHealth{
+			Status:  "up",
+			Details: gin.H{"latency_ms": time.Since(start).Milliseconds()},
+		}
+	}
+
+	crawler := h.crawlerService.Health()
+	if crawler.Healthy {
+		components["crawler"] = ComponentHealth{Status: "up", Details: crawler}
+	} else {
+		ready = false
+		components["crawler"] = ComponentHealth{Status: "down", Error: "crawler is stopped or workers are not running", Details: crawler}
+	}
+
+	if components["database"].Status == "up" {
+		depth, oldest, err := h.urlRepo.QueueStats(ctx)
+		if err != nil {
+			ready = false
+			logger.Error("Readiness check failed to read the queue", "error", err)
+			components["queue"] = ComponentHealth{Status: "down", Error: "queue stats are unavailable"}
+		} else {
+			queue := QueueHealth{Depth: depth, OldestQueuedAt: oldest}
+			if oldest != nil {
+				queue.OldestAgeSeconds = time.Since(*oldest).Seconds()
+			}
+			components["queue"] = ComponentHealth{Status: "up", Details: queue}
+		}
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, gin.H{"status": status, "components": components})
+}
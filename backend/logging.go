@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RequestIDHeader carries the request correlation ID in and out of the API
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits client supplied IDs to something safe to log and echo
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type loggerContextKey struct{}
+
+// setupLogger installs the process wide slog logger, writing to stdout
+func setupLogger() *slog.Logger {
+	logger := newLogger(os.Stdout)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// newLogger returns a logger writing to w. LOG_LEVEL selects debug, info,
+// warn or error and LOG_FORMAT selects json (default) or text.
+func newLogger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(getEnv("LOG_FORMAT", "json"), "text") {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// newCorrelationID returns a random hex ID for requests and crawl jobs
+func newCorrelationID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// withLogger returns a context carrying logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// loggerFromContext returns the logger stored by withLogger, or the default
+// logger when there is none
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Login failures are counted per username and per client IP
+const (
+	loginScopeUsername = "username"
+	loginScopeIP       = "ip"
+)
+
+// LoginThrottle slows down and locks out repeated failed logins. After a few
+// failures of a username each further attempt must wait twice as long as the
+// previous one, and enough failures of a username or an IP within the window
+// lock it out for a while. Unknown usernames are counted like known ones, so
+// the throttle does not reveal which accounts exist. Attempts of a username
+// are counted before its password is checked, so concurrent attempts cannot
+// slip through on one count; failures of an IP are counted once the password
+// turned out wrong, so logins sharing an address do not add up.
+type LoginThrottle struct {
+	repo            LoginThrottleRepository
+	window          time.Duration
+	delayAfter      int
+	baseDelay       time.Duration
+	maxDelay        time.Duration
+	userThreshold   int
+	ipThreshold     int
+	lockoutDuration time.Duration
+	logger          *slog.Logger
+	now             func() time.Time
+}
+
+func NewLoginThrottle(repo LoginThrottleRepository) *LoginThrottle {
+	return &LoginThrottle{
+		repo:            repo,
+		window:          envPositiveDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		delayAfter:      envPositiveInt("LOGIN_DELAY_AFTER", 3),
+		baseDelay:       time.Second,
+		maxDelay:        envPositiveDuration("LOGIN_MAX_DELAY", time.Minute),
+		userThreshold:   envPositiveInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		ipThreshold:     envPositiveInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50),
+		lockoutDuration: envPositiveDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		logger:          slog.Default().With("component", "login_throttle"),
+		now:             time.Now,
+	}
+}
+
+// envPositiveDuration reads a duration from the environment, falling back to
+// defaultValue when it is unset or not positive
+func envPositiveDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// envPositiveInt reads an integer from the environment, falling back to
+// defaultValue when it is unset or not positive
+func envPositiveInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func normalizeLoginUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// LoginAttempt is an attempt let through by Attempt, awaiting its outcome
+type LoginAttempt struct {
+	username string
+	ip       string
+	failure  *LoginFailure
+}
+
+// Attempt counts an attempt to log in as username from ip, before the
+// password is checked, and returns it, or how long the client must wait
+// when it may not try now. Report the outcome with RecordFailure or
+// RecordSuccess.
+func (t *LoginThrottle) Attempt(ctx context.Context, username, ip string) (*LoginAttempt, time.Duration, error) {
+	wait, previous, err := t.check(ctx, username, ip)
+	if err != nil || wait > 0 {
+		return nil, wait, err
+	}
+
+	now := t.now().UTC()
+	subject := normalizeLoginUsername(username)
+	failure, err := t.repo.RecordFailure(ctx, loginScopeUsername, subject, now, now.Add(-t.window))
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait := t.lockedFor(failure, now); wait > 0 {
+		return nil, wait, nil
+	}
+	// Attempts counted since the check raced this one. Up to delayAfter of
+	// them may run at once; beyond that only the one that got the next count
+	// goes ahead.
+	if failure.Failures > t.userThreshold || (failure.Failures > t.delayAfter && failure.Failures != previous+1) {
+		return nil, t.delay(failure.Failures - 1), nil
+	}
+	return &LoginAttempt{username: subject, ip: ip, failure: failure}, 0, nil
+}
+
+// check returns how long the client must wait before trying to log in as
+// username from ip, or zero with the failures of username counting towards
+// the next delay when it may try now
+func (t *LoginThrottle) check(ctx context.Context, username, ip string) (time.Duration, int, error) {
+	now := t.now().UTC()
+
+	if ip != "" {
+		failure, err := t.getFailure(ctx, loginScopeIP, ip)
+		if err != nil {
+			return 0, 0, err
+		}
+		if wait := t.lockedFor(failure, now); wait > 0 {
+			return wait, 0, nil
+		}
+	}
+
+	failure, err := t.getFailure(ctx, loginScopeUsername, normalizeLoginUsername(username))
+	if err != nil || failure == nil {
+		return 0, 0, err
+	}
+	if wait := t.lockedFor(failure, now); wait > 0 {
+		return wait, 0, nil
+	}
+	if failure.LastFailedAt.Before(now.Add(-t.window)) {
+		return 0, 0, nil
+	}
+	if failure.Failures < t.delayAfter {
+		return 0, failure.Failures, nil
+	}
+	if wait := failure.LastFailedAt.Add(t.delay(failure.Failures)).Sub(now); wait > 0 {
+		return wait, 0, nil
+	}
+	return 0, failure.Failures, nil
+}
+
+// RecordFailure reports that the password of attempt was wrong, locking its
+// username or IP out once they reach their threshold
+func (t *LoginThrottle) RecordFailure(ctx context.Context, attempt *LoginAttempt) error {
+	if err := t.lockIfReached(ctx, attempt.failure, t.userThreshold); err != nil {
+		return err
+	}
+	if attempt.ip == "" {
+		return nil
+	}
+
+	now := t.now().UTC()
+	failure, err := t.repo.RecordFailure(ctx, loginScopeIP, attempt.ip, now, now.Add(-t.window))
+	if err != nil {
+		return err
+	}
+	return t.lockIfReached(ctx, failure, t.ipThreshold)
+}
+
+// RecordSuccess forgets the failures of the attempt's username, including
+// the attempt itself. Failures of the IP are kept, so one valid account does
+// not reset an attack on others.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, attempt *LoginAttempt) error {
+	return t.repo.ClearFailures(ctx, loginScopeUsername, attempt.username)
+}
+
+// Lockouts returns the lockouts since the given time, newest first
+func (t *LoginThrottle) Lockouts(ctx context.Context, since time.Time) ([]LoginLockout, error) {
+	return t.repo.GetLockouts(ctx, since)
+}
+
+// lockIfReached locks the subject of failure out once its count reaches
+// threshold, unless it is locked out already
+func (t *LoginThrottle) lockIfReached(ctx context.Context, failure *LoginFailure, threshold int) error {
+	now := t.now().UTC()
+	if failure.Failures < threshold || t.lockedFor(failure, now) > 0 {
+		return nil
+	}
+
+	lockedUntil := now.Add(t.lockoutDuration)
+	if err := t.repo.Lock(ctx, failure, lockedUntil, now); err != nil {
+		return err
+	}
+	t.logger.WarnContext(ctx, "Login locked out",
+		"scope", failure.Scope,
+		"subject", failure.Subject,
+		"failures", failure.Failures,
+		"locked_until", lockedUntil,
+	)
+	return nil
+}
+
+func (t *LoginThrottle) getFailure(ctx context.Context, scope, subject string) (*LoginFailure, error) {
+	failure, err := t.repo.GetFailure(ctx, scope, subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return failure, err
+}
+
+// lockedFor returns how much longer failure is locked out
+func (t *LoginThrottle) lockedFor(failure *LoginFailure, now time.Time) time.Duration {
+	if failure == nil || failure.LockedUntil == nil || !failure.LockedUntil.After(now) {
+		return 0
+	}
+	return failure.LockedUntil.Sub(now)
+}
+
+// delay returns the wait after the given number of failures, doubling from
+// baseDelay at delayAfter up to maxDelay
+func (t *LoginThrottle) delay(failures int) time.Duration {
+	delay := t.baseDelay
+	for i := t.delayAfter; i < failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		return t.maxDelay
+	}
+	return delay
+}
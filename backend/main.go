@@ -1,86 +1,272 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func main() {
 	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using system environment variables")
+	envErr := godotenv.Load()
+
+	logger := setupLogger()
+	if envErr != nil {
+		logger.Info("No .env file found, using system environment variables")
+	}
+
+	// Initialize tracing
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		logger.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
 	}
+	defer shutdownTracing(context.Background())
 
 	// Initialize database
-	db, err := initDatabase()
+	store, err := openStore()
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		logger.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	// `main migrate up|down [steps]|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(context.Background(), store, os.Args[2:]); err != nil {
+			logger.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Apply pending migrations on start when enabled; a SQLite file is
+	// migrated by default so the binary runs standalone
+	migrateDefault := "false"
+	if store.Dialect == sqliteDialect {
+		migrateDefault = "true"
+	}
+	if store.DB != nil && getEnv("MIGRATE_ON_START", migrateDefault) == "true" {
+		migrator, err := NewMigrator(store.DB, store.Dialect)
+		if err != nil {
+			logger.Error("Failed to load migrations", "error", err)
+			os.Exit(1)
+		}
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			logger.Error("Failed to apply migrations", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Database migrations up to date", "applied", len(applied))
+	}
+
+	if store.DB != nil {
+		registerDBMetrics(store.DB)
 	}
-	defer db.Close()
 
 	// Initialize repositories
-	urlRepo := NewURLRepository(db)
-	analysisRepo := NewAnalysisRepository(db)
-	userRepo := NewUserRepository(db)
+	urlRepo := store.URLs
+	analysisRepo := store.Analysis
+	userRepo := store.Users
+	webhookRepo := store.Webhooks
 
 	// Initialize services
 	authService := NewAuthService(userRepo)
-	crawlerService := NewCrawlerService(urlRepo, analysisRepo)
+	userService := NewUserService(userRepo, NewPasswordPolicy())
+	workspaceService := NewWorkspaceService(store.Workspaces, store.UnitOfWork)
+	apiKeyService := NewAPIKeyService(store.APIKeys, userRepo)
+	eventHub := NewEventHub()
+	crawlerService := NewCrawlerService(urlRepo, store.UnitOfWork, eventHub)
 	
-	// Start the crawler service
+	webhookService := NewWebhookService(webhookRepo)
+
+	statsCacheTTL, err := time.ParseDuration(getEnv("STATS_CACHE_TTL", "30s"))
+	if err != nil {
+		logger.Error("Invalid STATS_CACHE_TTL", "error", err)
+		os.Exit(1)
+	}
+	statsService := NewStatsService(store.Stats, statsCacheTTL)
+
+	// Rate limits are kept in memory unless replicas share them in the database
+	rateLimitRepo := RateLimitRepository(NewMemoryRateLimitRepository())
+	switch backend := getEnv("RATE_LIMIT_STORE", "memory"); backend {
+	case "memory":
+	case "database":
+		rateLimitRepo = store.RateLimits
+	default:
+		logger.Error("Invalid RATE_LIMIT_STORE, expected memory or database", "value", backend)
+		os.Exit(1)
+	}
+	rateLimiter, err := NewRateLimiter(rateLimitRepo)
+	if err != nil {
+		logger.Error("Invalid rate limit", "error", err)
+		os.Exit(1)
+	}
+
+	// Start the crawler and webhook delivery services
 	crawlerService.Start()
+	webhookService.Start()
 
 	// Initialize handlers
-	authHandler := NewAuthHandler(authService)
-	urlHandler := NewURLHandler(urlRepo, crawlerService)
+	loginThrottle := NewLoginThrottle(store.Logins)
+	authHandler := NewAuthHandler(authService, loginThrottle)
+	userHandler := NewUserHandler(userRepo, userService, loginThrottle)
+	workspaceHandler := NewWorkspaceHandler(store.Workspaces, workspaceService)
+	apiKeyHandler := NewAPIKeyHandler(store.APIKeys, apiKeyService)
+	urlHandler := NewURLHandler(urlRepo, crawlerService, NewURLCanonicalizer(), NewURLValidator())
 	analysisHandler := NewAnalysisHandler(analysisRepo, urlRepo)
+	eventHandler := NewEventHandler(eventHub)
+	webhookHandler := NewWebhookHandler(webhookRepo, webhookService)
+	statsHandler := NewStatsHandler(statsService)
 
 	// Setup Gin router
-	r := gin.Default()
+	r := gin.New()
+
+	// Only trust X-Forwarded-For from these proxies, so clients cannot pick
+	// the IP their failed logins are counted against
+	trustedProxies := strings.Split(getEnv("TRUSTED_PROXIES", "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,::1/128,fc00::/7"), ",")
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		logger.Error("Invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
 
-	// CORS middleware
+	// Tracing, request ID, logging, recovery, CORS and metrics middleware
+	r.Use(otelgin.Middleware(serviceName))
+	r.Use(requestIDMiddleware())
+	r.Use(loggingMiddleware())
+	r.Use(errorMiddleware())
 	r.Use(corsMiddleware())
+	r.Use(metricsMiddleware())
 
 	// API routes
 	api := r.Group("/api")
 	{
-		// Auth routes
+		// Auth routes, rate limited per client IP
 		auth := api.Group("/auth")
+		auth.Use(rateLimitMiddleware(rateLimiter, "auth"))
 		{
 			auth.POST("/login", authHandler.Login)
+			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/logout", authHandler.Logout)
+			auth.POST("/password-reset", userHandler.ResetPassword)
 		}
 
-		// Protected routes
+		// Event stream, authenticated by header or single-use ticket
+		api.GET("/events", streamAuthMiddleware(authService, apiKeyService), rateLimitMiddleware(rateLimiter, "api"), workspaceMiddleware(workspaceService), requirePermission(PermURLsRead), eventHandler.Stream)
+
+		// Protected routes, rate limited per user or API key, each requiring a
+		// permission of the user's role. Routes that queue crawls have a
+		// stricter limit of their own.
 		protected := api.Group("/")
-		protected.Use(authMiddleware(authService))
+		protected.Use(authMiddleware(authService, apiKeyService), rateLimitMiddleware(rateLimiter, "api"))
 		{
+			// Workspace data, in the workspace chosen by the X-Workspace-ID
+			// header or workspace_id query parameter and checked against the
+			// user's role in it
+			scoped := protected.Group("/")
+			scoped.Use(workspaceMiddleware(workspaceService))
+
 			// URL management
-			urls := protected.Group("/urls")
+			urls := scoped.Group("/urls")
 			{
-				urls.GET("", urlHandler.GetURLs)
-				urls.POST("", urlHandler.CreateURL)
-				urls.PUT("/:id/status", urlHandler.UpdateStatus)
-				urls.DELETE("/:id", urlHandler.DeleteURL)
-				urls.POST("/bulk-delete", urlHandler.BulkDelete)
-				urls.POST("/bulk-rerun", urlHandler.BulkRerun)
+				urls.GET("", requirePermission(PermURLsRead), urlHandler.GetURLs)
+				urls.POST("", requirePermission(PermURLsWrite), rateLimitMiddleware(rateLimiter, "crawl"), urlHandler.CreateURL)
+				urls.PUT("/:id/status", requirePermission(PermURLsWrite), rateLimitMiddleware(rateLimiter, "crawl"), urlHandler.UpdateStatus)
+				urls.DELETE("/:id", requirePermission(PermURLsDelete), urlHandler.DeleteURL)
+				urls.POST("/bulk-delete", requirePermission(PermURLsDelete), urlHandler.BulkDelete)
+				urls.POST("/bulk-rerun", requirePermission(PermURLsWrite), rateLimitMiddleware(rateLimiter, "crawl"), urlHandler.BulkRerun)
 			}
 
 			// Analysis routes
-			analysis := protected.Group("/analysis")
+			analysis := scoped.Group("/analysis")
+			analysis.Use(requirePermission(PermAnalysisRead))
 			{
 				analysis.GET("/:id", analysisHandler.GetAnalysis)
 				analysis.GET("/:id/links", analysisHandler.GetBrokenLinks)
 			}
+
+			// The authenticated user and self-service password change
+			protected.GET("/auth/me", authHandler.Me)
+			protected.PUT("/auth/password", requireSession(), userHandler.ChangePassword)
+			protected.POST("/events/ticket", requireSession(), authHandler.CreateStreamTicket)
+
+			// API keys of the authenticated user, created in the request's
+			// workspace. Keys cannot manage keys.
+			apiKeys := protected.Group("/api-keys")
+			apiKeys.Use(requireSession())
+			{
+				apiKeys.GET("", apiKeyHandler.GetAPIKeys)
+				apiKeys.POST("", workspaceMiddleware(workspaceService), apiKeyHandler.CreateAPIKey)
+				apiKeys.DELETE("/:id", apiKeyHandler.DeleteAPIKey)
+			}
+
+			// Workspaces of the user, and joining one with an invitation
+			protected.GET("/workspaces", workspaceHandler.GetWorkspaces)
+			protected.POST("/workspaces", requirePermission(PermWorkspacesCreate), workspaceHandler.CreateWorkspace)
+			protected.POST("/invitations/accept", requireSession(), workspaceHandler.AcceptInvitation)
+
+			// Members and invitations, managed by the workspace's admins
+			workspace := protected.Group("/workspaces/:workspaceId")
+			workspace.Use(workspaceMiddleware(workspaceService))
+			{
+				workspace.GET("", workspaceHandler.GetWorkspace)
+				workspace.GET("/members", workspaceHandler.GetMembers)
+				workspace.PUT("/members/:userId", requirePermission(PermMembersManage), workspaceHandler.UpdateMember)
+				workspace.DELETE("/members/:userId", requirePermission(PermMembersManage), workspaceHandler.RemoveMember)
+				workspace.GET("/invitations", requirePermission(PermMembersManage), workspaceHandler.GetInvitations)
+				workspace.POST("/invitations", requirePermission(PermMembersManage), workspaceHandler.CreateInvitation)
+				workspace.DELETE("/invitations/:id", requirePermission(PermMembersManage), workspaceHandler.DeleteInvitation)
+			}
+
+			// User management, for admins
+			users := protected.Group("/users")
+			users.Use(requirePermission(PermUsersManage))
+			{
+				users.GET("", userHandler.GetUsers)
+				users.GET("/lockouts", authHandler.GetLockouts)
+				users.POST("", userHandler.CreateUser)
+				users.GET("/:id", userHandler.GetUser)
+				users.PUT("/:id", userHandler.UpdateUser)
+				users.POST("/:id/disable", userHandler.DisableUser)
+				users.POST("/:id/enable", userHandler.EnableUser)
+				users.POST("/:id/password-reset", userHandler.IssuePasswordReset)
+			}
+
+			// Dashboard aggregates
+			scoped.GET("/stats", requirePermission(PermStatsRead), statsHandler.GetStats)
+
+			// Webhook subscriptions
+			webhooks := scoped.Group("/webhooks")
+			webhooks.Use(requirePermission(PermWebhooksManage))
+			{
+				webhooks.GET("", webhookHandler.GetWebhooks)
+				webhooks.POST("", webhookHandler.CreateWebhook)
+				webhooks.GET("/:id", webhookHandler.GetWebhook)
+				webhooks.PUT("/:id", webhookHandler.UpdateWebhook)
+				webhooks.DELETE("/:id", webhookHandler.DeleteWebhook)
+				webhooks.GET("/:id/deliveries", webhookHandler.GetDeliveries)
+				webhooks.POST("/:id/deliveries/:deliveryId/redeliver", webhookHandler.Redeliver)
+			}
 		}
 	}
 
-	// Health check
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	// Health checks
+	healthHandler := NewHealthHandler(store, crawlerService)
+	r.GET("/health", healthHandler.Live)
+	r.GET("/health/live", healthHandler.Live)
+	r.GET("/health/ready", healthHandler.Ready)
+
+	// Prometheus metrics
+	r.GET("/metrics", metricsHandler())
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -88,8 +274,38 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	// Event streams stay open until the client leaves; end them so Shutdown
+	// does not wait for them
+	srv.RegisterOnShutdown(eventHub.Close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("Server starting", "port", port)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		logger.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Finish in-flight requests, which may queue crawls, then let the crawler
+	// and webhook workers finish their current jobs
+	shutdownTimeout := envPositiveDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	logger.Info("Shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Failed to shut down server", "error", err)
 	}
+	crawlerService.Stop()
+	webhookService.Stop()
+	logger.Info("Server stopped")
 } 
\ No newline at end of file
@@ -1,7 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestGetEnv(t *testing.T) {
@@ -67,4 +92,2093 @@ func TestDetectLoginForm(t *testing.T) {
 			t.Error("Basic test structure should pass")
 		}
 	})
-} 
\ No newline at end of file
+}
+
+func TestCanonicalizeURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		trailingSlash string
+		expected      string
+	}{
+		{
+			name:     "should lowercase scheme and host",
+			input:    "HTTPS://Example.COM/Path",
+			expected: "https://example.com/Path",
+		},
+		{
+			name:     "should add root path and default scheme",
+			input:    "example.com",
+			expected: "https://example.com/",
+		},
+		{
+			name:     "should remove default port and fragment",
+			input:    "https://example.com:443/#top",
+			expected: "https://example.com/",
+		},
+		{
+			name:     "should keep non-default port",
+			input:    "http://example.com:8080/",
+			expected: "http://example.com:8080/",
+		},
+		{
+			name:     "should convert IDN host to punycode",
+			input:    "https://bücher.de/",
+			expected: "https://xn--bcher-kva.de/",
+		},
+		{
+			name:     "should strip tracking parameters and sort the rest",
+			input:    "https://example.com/?utm_source=x&b=2&gclid=y&a=1",
+			expected: "https://example.com/?a=1&b=2",
+		},
+		{
+			name:          "should strip trailing slash when configured",
+			input:         "https://example.com/docs/",
+			trailingSlash: TrailingSlashStrip,
+			expected:      "https://example.com/docs",
+		},
+		{
+			name:          "should add trailing slash when configured",
+			input:         "https://example.com/docs",
+			trailingSlash: TrailingSlashAdd,
+			expected:      "https://example.com/docs/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &URLCanonicalizer{StripTrackingParams: true, TrailingSlash: TrailingSlashKeep}
+			if tt.trailingSlash != "" {
+				c.TrailingSlash = tt.trailingSlash
+			}
+
+			result, err := c.Canonicalize(tt.input)
+			if err != nil {
+				t.Fatalf("Canonicalize(%s) returned error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("Canonicalize(%s) = %s, want %s", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	t.Run("should hash equivalent URLs identically", func(t *testing.T) {
+		c := &URLCanonicalizer{TrailingSlash: TrailingSlashKeep}
+		a, _ := c.Canonicalize("HTTPS://Example.com/")
+		b, _ := c.Canonicalize("https://example.com:443/#top")
+		if URLHash(a) != URLHash(b) {
+			t.Errorf("URLHash(%s) != URLHash(%s)", a, b)
+		}
+	})
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		expectValid bool
+		expectField string
+	}{
+		{
+			name:        "should accept a domain with a TLD",
+			url:         "https://example.com/",
+			expectValid: true,
+		},
+		{
+			name:        "should accept an IP address",
+			url:         "http://127.0.0.1:8080/",
+			expectValid: true,
+		},
+		{
+			name:        "should accept a punycode TLD",
+			url:         "https://example.xn--p1ai/",
+			expectValid: true,
+		},
+		{
+			name:        "should reject unsupported schemes",
+			url:         "ftp://example.com/",
+			expectField: "url.scheme",
+		},
+		{
+			name:        "should reject hosts without a TLD",
+			url:         "https://x/",
+			expectField: "url.host",
+		},
+		{
+			name:        "should reject numeric TLDs",
+			url:         "https://example.123/",
+			expectField: "url.host",
+		},
+		{
+			name:        "should reject URLs over the length limit",
+			url:         "https://example.com/" + strings.Repeat("a", 2048),
+			expectField: "url",
+		},
+	}
+
+	v := &URLValidator{MaxLength: 2048}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := v.Validate(tt.url)
+			if tt.expectValid {
+				if len(errs) > 0 {
+					t.Errorf("Validate(%s) = %v, want no errors", tt.url, errs)
+				}
+				return
+			}
+			if len(errs) == 0 || errs[0].Field != tt.expectField {
+				t.Errorf("Validate(%s) = %v, want error on %s", tt.url, errs, tt.expectField)
+			}
+		})
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	t.Run("should deliver published events to every subscriber", func(t *testing.T) {
+		hub := NewEventHub()
+		first, cancelFirst := hub.Subscribe(1)
+		defer cancelFirst()
+		second, cancelSecond := hub.Subscribe(1)
+		defer cancelSecond()
+
+		hub.Publish(URLEvent{Type: EventURLStatus, URLID: 1, Status: "running"})
+
+		for _, ch := range []<-chan URLEvent{first, second} {
+			event := <-ch
+			if event.URLID != 1 || event.Status != "running" {
+				t.Errorf("received %+v, want url 1 running", event)
+			}
+			if event.Timestamp.IsZero() {
+				t.Error("expected timestamp to be set")
+			}
+		}
+	})
+
+	t.Run("should not block on slow subscribers", func(t *testing.T) {
+		hub := NewEventHub()
+		_, cancel := hub.Subscribe(0)
+		defer cancel()
+
+		hub.Publish(URLEvent{Type: EventURLStatus, URLID: 1})
+	})
+
+	t.Run("should close the channel on cancel", func(t *testing.T) {
+		hub := NewEventHub()
+		ch, cancel := hub.Subscribe(1)
+		cancel()
+		cancel()
+
+		if _, ok := <-ch; ok {
+			t.Error("expected channel to be closed")
+		}
+		hub.Publish(URLEvent{Type: EventURLStatus, URLID: 1})
+	})
+}
+
+func TestClassifyFetchError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "should classify DNS failures",
+			err:      &neturl.Error{Op: "Get", URL: "https://example.invalid", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}},
+			expected: "dns",
+		},
+		{
+			name:     "should classify refused connections",
+			err:      &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+			expected: "connection_refused",
+		},
+		{
+			name:     "should fall back to other",
+			err:      errors.New("boom"),
+			expected: "other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := classifyFetchError(tt.err); result != tt.expected {
+				t.Errorf("classifyFetchError(%v) = %s, want %s", tt.err, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	t.Run("should return nil without an active span", func(t *testing.T) {
+		if result := traceParent(context.Background()); result != nil {
+			t.Errorf("traceParent() = %s, want nil", *result)
+		}
+	})
+
+	t.Run("should restore the span context of a queued job", func(t *testing.T) {
+		provider := sdktrace.NewTracerProvider()
+		defer provider.Shutdown(context.Background())
+
+		ctx, span := provider.Tracer("test").Start(context.Background(), "request")
+		defer span.End()
+
+		saved := traceParent(ctx)
+		if saved == nil {
+			t.Fatal("traceParent() = nil, want a traceparent")
+		}
+
+		restored := trace.SpanContextFromContext(contextWithTraceParent(context.Background(), saved))
+		if restored.TraceID() != span.SpanContext().TraceID() || restored.SpanID() != span.SpanContext().SpanID() {
+			t.Errorf("restored span context %v, want %v", restored, span.SpanContext())
+		}
+	})
+}
+
+func TestCrawlerHealth(t *testing.T) {
+	t.Run("should be unhealthy before start", func(t *testing.T) {
+		s := NewCrawlerService(nil, nil, NewEventHub())
+		if health := s.Health(); health.Healthy || health.Running {
+			t.Errorf("Health() = %+v, want not running", health)
+		}
+	})
+
+	t.Run("should be healthy once all workers are running", func(t *testing.T) {
+		s := NewCrawlerService(nil, nil, NewEventHub())
+		s.Start()
+		defer s.Stop()
+
+		deadline := time.Now().Add(time.Second)
+		for s.Health().AliveWorkers < s.workerCount && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if health := s.Health(); !health.Healthy {
+			t.Errorf("Health() = %+v, want healthy", health)
+		}
+	})
+
+	t.Run("should be unhealthy when the queue poller stalls", func(t *testing.T) {
+		s := NewCrawlerService(nil, nil, NewEventHub())
+		s.Start()
+		defer s.Stop()
+
+		s.lastPollAt.Store(time.Now().Add(-time.Hour).UnixNano())
+		if health := s.Health(); health.Healthy {
+			t.Errorf("Health() = %+v, want unhealthy", health)
+		}
+	})
+}
+
+// failingQueueStats is a URLRepository whose queue stats cannot be read
+type failingQueueStats struct {
+	URLRepository
+}
+
+func (failingQueueStats) QueueStats(ctx context.Context) (int64, *time.Time, error) {
+	return 0, nil, errors.New("failed to get queue stats: table urls is locked")
+}
+
+func TestHealthHandlerReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	logs := captureLogs(t)
+
+	db, err := initSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("initSQLite() error = %v", err)
+	}
+	defer db.Close()
+	store := migratedTestStore(t, db, sqliteDialect)
+	crawler := NewCrawlerService(store.URLs, store.UnitOfWork, NewEventHub())
+	handler := NewHealthHandler(store, crawler)
+
+	type component struct {
+		Status  string                 `json:"status"`
+		Error   string                 `json:"error"`
+		Details map[string]interface{} `json:"details"`
+	}
+	ready := func() (int, string, map[string]component) {
+		r := gin.New()
+		r.GET("/ready", handler.Ready)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+		var body struct {
+			Status     string               `json:"status"`
+			Components map[string]component `json:"components"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("response %q: %v", w.Body.String(), err)
+		}
+		return w.Code, body.Status, body.Components
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		crawler.Start()
+		defer crawler.Stop()
+		deadline := time.Now().Add(5 * time.Second)
+		for !crawler.Health().Healthy && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		code, status, components := ready()
+		if code != http.StatusOK || status != "ok" {
+			t.Fatalf("Ready() = %d %s %+v, want 200 ok", code, status, components)
+		}
+		for _, name := range []string{"database", "crawler", "queue"} {
+			if components[name].Status != "up" {
+				t.Errorf("components.%s = %+v, want up", name, components[name])
+			}
+		}
+		if depth := components["queue"].Details["depth"]; depth != float64(0) {
+			t.Errorf("queue depth = %v, want 0", depth)
+		}
+	})
+
+	t.Run("crawler stopped", func(t *testing.T) {
+		// URLs queued an hour ago, which the stopped crawler leaves waiting
+		for _, path := range []string{"/a", "/b"} {
+			if _, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com"+path, "https://example.com"+path); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+		}
+		queuedAt := time.Now().Add(-time.Hour)
+		if _, err := db.ExecContext(ctx, `UPDATE urls SET updated_at = ?`, sqliteDialect.timeArg(queuedAt)); err != nil {
+			t.Fatalf("update error = %v", err)
+		}
+
+		code, status, components := ready()
+		if code != http.StatusServiceUnavailable || status != "degraded" {
+			t.Fatalf("Ready() = %d %s, want 503 degraded", code, status)
+		}
+		if components["database"].Status != "up" {
+			t.Errorf("components.database = %+v, want up", components["database"])
+		}
+		if crawler := components["crawler"]; crawler.Status != "down" || crawler.Error == "" || crawler.Details["running"] != false {
+			t.Errorf("components.crawler = %+v, want down and not running", crawler)
+		}
+		queue := components["queue"].Details
+		if queue["depth"] != float64(2) || queue["oldest_queued_at"] == nil {
+			t.Errorf("queue = %+v, want depth 2 and the oldest queued time", queue)
+		}
+		if age, _ := queue["oldest_age_seconds"].(float64); age < time.Hour.Seconds() || age > time.Hour.Seconds()+60 {
+			t.Errorf("queue oldest_age_seconds = %v, want about 3600", queue["oldest_age_seconds"])
+		}
+	})
+
+	t.Run("queue stats fail", func(t *testing.T) {
+		handler.urlRepo = failingQueueStats{store.URLs}
+		defer func() { handler.urlRepo = store.URLs }()
+
+		code, _, components := ready()
+		if code != http.StatusServiceUnavailable || components["queue"].Status != "down" {
+			t.Errorf("Ready() = %d %+v, want 503 with the queue down", code, components)
+		}
+		if queue := components["queue"]; queue.Error != "queue stats are unavailable" {
+			t.Errorf("components.queue.error = %q, want the generic message", queue.Error)
+		}
+		if records := logRecords(t, logs, "Readiness check failed to read the queue"); len(records) != 1 ||
+			!strings.Contains(records[0]["error"].(string), "table urls is locked") {
+			t.Errorf("logged %v, want the queue error", records)
+		}
+	})
+
+	t.Run("database down", func(t *testing.T) {
+		db.Close()
+
+		code, status, components := ready()
+		if code != http.StatusServiceUnavailable || status != "degraded" {
+			t.Fatalf("Ready() = %d %s, want 503 degraded", code, status)
+		}
+		if database := components["database"]; database.Status != "down" || database.Error != "database is unreachable" {
+			t.Errorf("components.database = %+v, want down with the generic message", database)
+		}
+		if _, ok := components["queue"]; ok {
+			t.Errorf("components.queue = %+v, want it skipped while the database is down", components["queue"])
+		}
+		if records := logRecords(t, logs, "Readiness check failed to reach the database"); len(records) != 1 ||
+			!strings.Contains(records[0]["error"].(string), "closed") {
+			t.Errorf("logged %v, want the database error", records)
+		}
+	})
+}
+
+func TestCrawlerStop(t *testing.T) {
+	t.Run("should interrupt running crawls and queue their URLs again", func(t *testing.T) {
+		started := make(chan struct{})
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+		}))
+		defer site.Close()
+
+		store := NewMemoryStore()
+		url, err := store.URLs.Create(context.Background(), defaultWorkspaceID, site.URL, site.URL+"/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		s := NewCrawlerService(store.URLs, store.UnitOfWork, NewEventHub())
+		s.pollInterval = 10 * time.Millisecond
+		s.Start()
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			s.Stop()
+			t.Fatal("crawler did not fetch the queued URL")
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			s.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop() did not interrupt the running crawl")
+		}
+
+		stored, err := store.URLs.GetByID(context.Background(), defaultWorkspaceID, url.ID)
+		if err != nil {
+			t.Fatalf("GetByID() error = %v", err)
+		}
+		if stored.Status != "queued" || stored.ErrorMessage != nil {
+			t.Errorf("status = %s, error = %v; want queued without error", stored.Status, stored.ErrorMessage)
+		}
+	})
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level, format string
+		debug, info   bool
+		text          bool
+	}{
+		{"", "", false, true, false},
+		{"debug", "json", true, true, false},
+		{"WARN", "TEXT", false, false, true},
+		{"verbose", "yaml", false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("LOG_LEVEL", tt.level)
+		t.Setenv("LOG_FORMAT", tt.format)
+		var buf bytes.Buffer
+		logger := newLogger(&buf)
+		logger.Debug("debug record")
+		logger.Info("info record")
+		logger.Warn("warn record", "key", "value")
+
+		output := buf.String()
+		if strings.Contains(output, "debug record") != tt.debug || strings.Contains(output, "info record") != tt.info {
+			t.Errorf("LOG_LEVEL=%q logged %q", tt.level, output)
+		}
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		last := lines[len(lines)-1]
+		if tt.text && !strings.Contains(last, `level=WARN msg="warn record" key=value`) {
+			t.Errorf("LOG_FORMAT=%q logged %q, want text", tt.format, last)
+		}
+		var record map[string]interface{}
+		if !tt.text && (json.Unmarshal([]byte(last), &record) != nil || record["msg"] != "warn record" || record["key"] != "value") {
+			t.Errorf("LOG_FORMAT=%q logged %q, want JSON", tt.format, last)
+		}
+	}
+}
+
+// captureLogs makes the default logger write JSON records to the returned
+// buffer until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logRecords decodes the JSON records in buf with the given message
+func logRecords(t *testing.T, buf *bytes.Buffer, msg string) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	generated := regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"propagates a valid ID", "client-id_1.2:3", true},
+		{"generates a missing ID", "", false},
+		{"replaces an ID with unsafe characters", "bad id\"", false},
+		{"replaces an overlong ID", strings.Repeat("a", 129), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			var handlerID string
+			r := gin.New()
+			r.Use(requestIDMiddleware(), loggingMiddleware())
+			r.GET("/urls/:id", func(c *gin.Context) {
+				handlerID = c.GetString("request_id")
+				loggerFromContext(c.Request.Context()).Info("handler record")
+				c.Status(http.StatusNoContent)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/urls/7", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			r.ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			if tt.keep && id != tt.header {
+				t.Errorf("%s = %q, want %q", RequestIDHeader, id, tt.header)
+			}
+			if !tt.keep && !generated.MatchString(id) {
+				t.Errorf("%s = %q, want a generated ID", RequestIDHeader, id)
+			}
+			if handlerID != id {
+				t.Errorf("request_id in the handler = %q, want %q", handlerID, id)
+			}
+
+			for _, msg := range []string{"handler record", "http request"} {
+				records := logRecords(t, logs, msg)
+				if len(records) != 1 || records[0]["request_id"] != id {
+					t.Errorf("%q records = %v, want one with request_id %q", msg, records, id)
+				}
+			}
+			if records := logRecords(t, logs, "http request"); len(records) == 1 && records[0]["route"] != "/urls/:id" {
+				t.Errorf("http request route = %v, want /urls/:id", records[0]["route"])
+			}
+		})
+	}
+}
+
+func TestCrawlerJobLogs(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<!DOCTYPE html><html><head><title>Jobs</title></head><body><h1>Jobs</h1></body></html>`))
+	}))
+	defer site.Close()
+
+	logs := captureLogs(t)
+	store := NewMemoryStore()
+	s := NewCrawlerService(store.URLs, store.UnitOfWork, NewEventHub())
+	defer s.Stop()
+
+	var jobIDs []interface{}
+	for i := 0; i < 2; i++ {
+		url, err := store.URLs.Create(context.Background(), defaultWorkspaceID, site.URL+"/"+strconv.Itoa(i), site.URL+"/"+strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		s.processURL(url)
+
+		started, completed := logRecords(t, logs, "Analysis started"), logRecords(t, logs, "Analysis completed")
+		if len(started) != i+1 || len(completed) != i+1 {
+			t.Fatalf("logged %d starts and %d completions, want %d", len(started), len(completed), i+1)
+		}
+		jobID := started[i]["job_id"]
+		if id, _ := jobID.(string); id == "" || completed[i]["job_id"] != jobID || completed[i]["url_id"] != float64(url.ID) {
+			t.Errorf("job records = %v and %v, want the same job_id and url_id %d", started[i], completed[i], url.ID)
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	if jobIDs[0] == jobIDs[1] {
+		t.Errorf("both jobs logged job_id %v, want one per job", jobIDs[0])
+	}
+}
+
+// metricSamples returns the value of the counter, or the sample count of the
+// histogram, with the given name and labels in the default registry
+func metricSamples(t *testing.T, name, method, route, status string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	want := map[string]string{"method": method, "route": route, "status": status}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matches := true
+			for _, label := range metric.GetLabel() {
+				matches = matches && want[label.GetName()] == label.GetValue()
+			}
+			if !matches {
+				continue
+			}
+			if histogram := metric.GetHistogram(); histogram != nil {
+				return float64(histogram.GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/metrics-test/urls/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/metrics-test/events", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.String(http.StatusOK, "data: {}\n\n")
+	})
+
+	const requests, latencies = "crawler_http_requests_total", "crawler_http_request_duration_seconds"
+	unmatched := metricSamples(t, requests, "GET", "unmatched", "404")
+	for _, path := range []string{"/metrics-test/urls/1", "/metrics-test/urls/2", "/metrics-test/events", "/metrics-test/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// Requests are labelled with their route template, not their path
+	tests := []struct {
+		name, route string
+		want        float64
+	}{
+		{requests, "/metrics-test/urls/:id", 2},
+		{requests, "/metrics-test/urls/1", 0},
+		{requests, "/metrics-test/events", 1},
+		{latencies, "/metrics-test/urls/:id", 2},
+		// Event streams would skew the latencies
+		{latencies, "/metrics-test/events", 0},
+	}
+	for _, tt := range tests {
+		if got := metricSamples(t, tt.name, "GET", tt.route, "200"); got != tt.want {
+			t.Errorf("%s{route=%q} = %v, want %v", tt.name, tt.route, got, tt.want)
+		}
+	}
+	if got := metricSamples(t, requests, "GET", "unmatched", "404") - unmatched; got != 1 {
+		t.Errorf("unmatched requests = %v, want 1", got)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for _, dialect := range []*sqlDialect{mysqlDialect, postgresDialect, sqliteDialect} {
+		t.Run(dialect.name, func(t *testing.T) {
+			migrations, err := loadMigrations(migrationFiles, "migrations/"+dialect.name)
+			if err != nil {
+				t.Fatalf("loadMigrations() error = %v", err)
+			}
+			if len(migrations) == 0 {
+				t.Fatal("loadMigrations() returned no migrations")
+			}
+
+			for i, migration := range migrations {
+				if migration.Version != int64(i+1) {
+					t.Errorf("migration %d has version %d, want %d", i, migration.Version, i+1)
+				}
+				if migration.Down == "" {
+					t.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestMigratorFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{
+		{Version: 1, Name: "create_a", Up: "CREATE TABLE a (id INTEGER);", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "seed_a", Up: "CREATE TABLE b (id INTEGER);\nINSERT INTO a VALUES (1);\nINSERT INTO missing VALUES (1);"},
+		{Version: 3, Name: "never_applied", Up: "CREATE TABLE c (id INTEGER);"},
+	}
+
+	open := func(t *testing.T, dialect *sqlDialect) (*sql.DB, *Migrator) {
+		db, err := initSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("initSQLite() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db, &Migrator{db: db, dialect: dialect, migrations: append([]Migration(nil), migrations...), logger: slog.Default()}
+	}
+	tables := func(t *testing.T, db *sql.DB) []string {
+		rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name IN ('a', 'b', 'c') ORDER BY name`)
+		if err != nil {
+			t.Fatalf("select error = %v", err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			names = append(names, name)
+		}
+		return names
+	}
+
+	t.Run("transactional", func(t *testing.T) {
+		db, migrator := open(t, sqliteDialect)
+		applied, err := migrator.Up(ctx)
+		if err == nil || len(applied) != 1 {
+			t.Fatalf("Up() = %d migrations, %v; want 1 and an error", len(applied), err)
+		}
+
+		// The failed migration is rolled back whole
+		if got := tables(t, db); strings.Join(got, ",") != "a" {
+			t.Errorf("tables = %v, want [a]", got)
+		}
+		var rows int
+		db.QueryRowContext(ctx, `SELECT COUNT(*) FROM a`).Scan(&rows)
+		if rows != 0 {
+			t.Errorf("a has %d rows, want 0", rows)
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil || statuses[1].Dirty {
+			t.Errorf("Status() = %+v, %v; want only migration 1 applied", statuses, err)
+		}
+
+		// A failing Go part rolls back the script before it
+		migrator.migrations = []Migration{migrations[0], {Version: 2, Name: "go_part", Up: "CREATE TABLE b (id INTEGER);",
+			UpFunc: func(ctx context.Context, db queryer, logger *slog.Logger) error { return errors.New("boom") }}}
+		if _, err := migrator.Up(ctx); err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Errorf("Up() error = %v, want boom", err)
+		}
+		if got := tables(t, db); strings.Join(got, ",") != "a" {
+			t.Errorf("tables = %v, want [a]", got)
+		}
+	})
+
+	t.Run("dirty", func(t *testing.T) {
+		// Like MySQL, which commits schema changes as they run
+		dialect := *sqliteDialect
+		dialect.transactionalDDL = false
+		db, migrator := open(t, &dialect)
+		if _, err := migrator.Up(ctx); err == nil {
+			t.Fatal("Up() error = nil, want the failed migration")
+		}
+
+		statuses, err := migrator.Status(ctx)
+		if err != nil || !statuses[1].Dirty || statuses[0].Dirty {
+			t.Fatalf("Status() = %+v, %v; want migration 2 dirty", statuses, err)
+		}
+		for name, run := range map[string]func() error{
+			"Up":   func() error { _, err := migrator.Up(ctx); return err },
+			"Down": func() error { _, err := migrator.Down(ctx, 1); return err },
+		} {
+			if err := run(); err == nil || !strings.Contains(err.Error(), "migration 2_seed_a failed partway") {
+				t.Errorf("%s() error = %v, want the dirty migration refused", name, err)
+			}
+		}
+		if got := tables(t, db); strings.Join(got, ",") != "a,b" {
+			t.Errorf("tables = %v, want [a b]", got)
+		}
+
+		// Once the operator repairs the schema and clears the row, Up resumes
+		if _, err := db.ExecContext(ctx, `DROP TABLE b`); err != nil {
+			t.Fatalf("drop error = %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = 2`); err != nil {
+			t.Fatalf("delete error = %v", err)
+		}
+		migrator.migrations[1].Up = "CREATE TABLE b (id INTEGER);"
+		if applied, err := migrator.Up(ctx); err != nil || len(applied) != 2 {
+			t.Errorf("Up() after repair = %d migrations, %v; want 2", len(applied), err)
+		}
+		if statuses, _ := migrator.Status(ctx); statuses[1].Dirty || statuses[2].AppliedAt == nil {
+			t.Errorf("Status() after repair = %+v, want every migration applied", statuses)
+		}
+	})
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- create a table
+CREATE TABLE a (
+    id INT -- inline comments are kept
+);
+
+-- seed
+INSERT INTO a VALUES (1);
+CREATE TRIGGER a_copy AFTER INSERT ON a BEGIN
+    INSERT INTO b VALUES (new.id);
+    UPDATE c SET n = n + 1;
+END;
+UPDATE a SET id = 2`
+
+	statements := splitStatements(script)
+	if len(statements) != 4 {
+		t.Fatalf("splitStatements() returned %d statements, want 4: %q", len(statements), statements)
+	}
+	if !strings.HasPrefix(statements[0], "CREATE TABLE a (") || strings.HasSuffix(statements[0], ";") {
+		t.Errorf("statements[0] = %q", statements[0])
+	}
+	if statements[1] != "INSERT INTO a VALUES (1)" {
+		t.Errorf("statements[1] = %q", statements[1])
+	}
+	if !strings.HasPrefix(statements[2], "CREATE TRIGGER") || !strings.HasSuffix(statements[2], "END") || strings.Count(statements[2], ";") != 2 {
+		t.Errorf("statements[2] = %q", statements[2])
+	}
+	if statements[3] != "UPDATE a SET id = 2" {
+		t.Errorf("statements[3] = %q", statements[3])
+	}
+}
+
+func TestCanonicalizeURLs(t *testing.T) {
+	ctx := context.Background()
+	db, err := initSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("initSQLite() error = %v", err)
+	}
+	defer db.Close()
+
+	// The urls columns as migration 0002 leaves them before its Go part
+	if _, err := db.ExecContext(ctx, `CREATE TABLE urls (id INTEGER PRIMARY KEY, url TEXT NOT NULL, url_hash TEXT NOT NULL UNIQUE)`); err != nil {
+		t.Fatalf("create table error = %v", err)
+	}
+	stored := []string{
+		"HTTPS://Example.com:443/a",
+		"https://example.com/a",
+		"http://Example.com/b?gclid=1",
+		"http://[::1",
+		"https://example.com/c?fbclid=x",
+		"example.com/c",
+	}
+	for i, url := range stored {
+		if _, err := db.ExecContext(ctx, `INSERT INTO urls (id, url, url_hash) VALUES (?, ?, ?)`, i+1, url, URLHash(url)); err != nil {
+			t.Fatalf("insert error = %v", err)
+		}
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	defer conn.Close()
+	if err := canonicalizeURLs(ctx, conn, slog.Default()); err != nil {
+		t.Fatalf("canonicalizeURLs() error = %v", err)
+	}
+
+	want := []string{
+		// Collides with the canonical URL stored already
+		"HTTPS://Example.com:443/a",
+		"https://example.com/a",
+		"http://example.com/b",
+		"http://[::1",
+		"https://example.com/c",
+		// Collides with the URL above, which was canonicalized first
+		"example.com/c",
+	}
+	for i, url := range want {
+		var got, hash string
+		if err := db.QueryRowContext(ctx, `SELECT url, url_hash FROM urls WHERE id = ?`, i+1).Scan(&got, &hash); err != nil {
+			t.Fatalf("select error = %v", err)
+		}
+		if got != url || hash != URLHash(url) {
+			t.Errorf("URL %d = %q with hash %s, want %q", i+1, got, hash, url)
+		}
+	}
+}
+
+func TestRespondDatabaseError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		respond  func(c *gin.Context, err error, message string)
+		err      error
+		wantCode int
+		wantErr  string
+	}{
+		{"database error", respondDatabaseError, errors.New("boom"), http.StatusInternalServerError, "database_error"},
+		{"query timeout", respondDatabaseError, fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "database_timeout"},
+		{"client canceled", respondDatabaseError, context.Canceled, StatusClientClosedRequest, "request_canceled"},
+		{"missing row", respondLookupError, sql.ErrNoRows, http.StatusNotFound, "not_found"},
+		{"lookup timeout", respondLookupError, context.DeadlineExceeded, http.StatusServiceUnavailable, "database_timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			tt.respond(c, tt.err, "Something failed")
+
+			var body ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response body: %v", err)
+			}
+			if w.Code != tt.wantCode || body.Error != tt.wantErr || body.Code != tt.wantCode {
+				t.Errorf("response = %d %+v, want %d %s", w.Code, body, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		input    string
+		mysql    []string
+		postgres []string
+		fts5     []string
+	}{
+		{"Login", []string{"login"}, []string{"login"}, []string{`"login"`}},
+		{"crawl*", []string{"crawl*"}, []string{"crawl:*"}, []string{`"crawl"*`}},
+		{`"sign in" now`, []string{`"sign in"`, "now"}, []string{"sign <-> in", "now"}, []string{`"sign in"`, `"now"`}},
+		{"example.com", []string{`"example com"`}, []string{"example <-> com"}, []string{`"example com"`}},
+		{`+-"' * ()`, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var mysql, postgres, fts5 []string
+			for _, term := range parseSearchQuery(tt.input) {
+				mysql = append(mysql, term.mysql())
+				postgres = append(postgres, term.postgres())
+				fts5 = append(fts5, term.fts5())
+			}
+			if strings.Join(mysql, "|") != strings.Join(tt.mysql, "|") ||
+				strings.Join(postgres, "|") != strings.Join(tt.postgres, "|") ||
+				strings.Join(fts5, "|") != strings.Join(tt.fts5, "|") {
+				t.Errorf("parseSearchQuery(%q) = %q, %q, %q; want %q, %q, %q", tt.input, mysql, postgres, fts5, tt.mysql, tt.postgres, tt.fts5)
+			}
+		})
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	tests := []struct {
+		query    string
+		text     string
+		expected string
+	}{
+		{"login", "Please <b>Login</b> first", "Please &lt;b&gt;<mark>Login</mark>&lt;/b&gt; first"},
+		{"log*", "Log in or logout", "<mark>Log</mark> in or <mark>logout</mark>"},
+		{`"sign in"`, "sign up or sign in", "sign up or <mark>sign</mark> <mark>in</mark>"},
+		{"missing", "Nothing here", ""},
+		{"end", strings.Repeat("word ", 20) + "end", "…word word word word word word word word <mark>end</mark>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := parseSearchQuery(tt.query).highlight(tt.text); got != tt.expected {
+				t.Errorf("highlight() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseURLListOptions(t *testing.T) {
+	cursor, err := URLCursor{Sort: "broken_links_count", Value: int64(3), ID: 42, Before: true}.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		errorFields []string
+		check       func(opts URLListOptions) bool
+	}{
+		{
+			name:  "should default to the newest URLs first",
+			query: "",
+			check: func(opts URLListOptions) bool {
+				return opts.Page == 1 && opts.PageSize == 10 && opts.Sort == "" && !opts.Ascending
+			},
+		},
+		{
+			name:  "should sort ascending unless desc is requested",
+			query: "sort=broken_links_count",
+			check: func(opts URLListOptions) bool { return opts.Sort == "broken_links_count" && opts.Ascending },
+		},
+		{
+			name:  "should parse filters",
+			query: "sort=title&order=desc&created_after=2024-01-02&completed_before=2024-02-01T10:00:00%2B02:00&has_login_form=true&min_broken_links=1&max_broken_links=5&html_version=HTML5&host=Example.com",
+			check: func(opts URLListOptions) bool {
+				return !opts.Ascending &&
+					opts.CreatedAfter.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) &&
+					opts.CompletedBefore.Equal(time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)) &&
+					*opts.HasLoginForm && *opts.MinBrokenLinks == 1 && *opts.MaxBrokenLinks == 5 &&
+					opts.HTMLVersion == "HTML5" && opts.Host == "example.com"
+			},
+		},
+		{
+			name:        "should reject columns outside the allowlist",
+			query:       "sort=id%3BDROP+TABLE+urls&order=sideways",
+			errorFields: []string{"order", "sort"},
+		},
+		{
+			name:        "should reject invalid filter values",
+			query:       "status=done&created_before=yesterday&has_login_form=maybe&min_broken_links=-1&host=evil.com/%25&html_version=HTML5-or-later",
+			errorFields: []string{"created_before", "has_login_form", "host", "html_version", "min_broken_links", "status"},
+		},
+		{
+			name:        "should reject an empty broken links range",
+			query:       "min_broken_links=5&max_broken_links=2",
+			errorFields: []string{"max_broken_links"},
+		},
+		{
+			name:  "should take the sort order from a cursor",
+			query: "cursor=" + cursor + "&include_total=true",
+			check: func(opts URLListOptions) bool {
+				return opts.Sort == "broken_links_count" && !opts.Ascending && opts.IncludeTotal &&
+					opts.Cursor.Value == int64(3) && opts.Cursor.ID == 42 && opts.backward() && opts.offset() == 0
+			},
+		},
+		{
+			name:        "should reject a cursor for a different sort order",
+			query:       "cursor=" + cursor + "&sort=broken_links_count&order=asc",
+			errorFields: []string{"cursor"},
+		},
+		{
+			name:  "should include analysis summaries",
+			query: "include=analysis",
+			check: func(opts URLListOptions) bool { return opts.IncludeAnalysis },
+		},
+		{
+			name:        "should reject unknown includes",
+			query:       "include=analysis,links",
+			errorFields: []string{"include"},
+		},
+		{
+			name:        "should reject a malformed cursor",
+			query:       "cursor=bm90LWpzb24&include_total=sometimes",
+			errorFields: []string{"cursor", "include_total"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := neturl.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("invalid test query: %v", err)
+			}
+
+			opts, errs := ParseURLListOptions(values)
+			var fields []string
+			for _, fieldErr := range errs {
+				fields = append(fields, fieldErr.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.errorFields, ",") {
+				t.Errorf("ParseURLListOptions() error fields = %v, want %v", fields, tt.errorFields)
+			}
+			if tt.check != nil && !tt.check(opts) {
+				t.Errorf("ParseURLListOptions() = %+v", opts)
+			}
+		})
+	}
+}
+
+func TestParseStatsOptions(t *testing.T) {
+	now := time.Date(2024, 3, 15, 18, 30, 0, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name        string
+		query       string
+		from, to    time.Time
+		errorFields []string
+	}{
+		{"should default to the last 30 days", "", day(2, 15), day(3, 16), nil},
+		{"should include both dates", "from=2024-03-01&to=2024-03-01", day(3, 1), day(3, 2), nil},
+		{"should count back from to", "to=2024-01-30", day(1, 1), day(1, 31), nil},
+		{"should reject invalid dates", "from=yesterday&to=2024-02-30", time.Time{}, time.Time{}, []string{"from", "to"}},
+		{"should reject a reversed range", "from=2024-03-02&to=2024-03-01", time.Time{}, time.Time{}, []string{"from"}},
+		{"should reject more than a year", "from=2023-01-01&to=2024-03-01", time.Time{}, time.Time{}, []string{"from"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := neturl.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("invalid test query: %v", err)
+			}
+
+			opts, errs := ParseStatsOptions(values, now)
+			var fields []string
+			for _, fieldErr := range errs {
+				fields = append(fields, fieldErr.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.errorFields, ",") {
+				t.Errorf("ParseStatsOptions() error fields = %v, want %v", fields, tt.errorFields)
+			}
+			if tt.errorFields == nil && (!opts.From.Equal(tt.from) || !opts.To.Equal(tt.to)) {
+				t.Errorf("ParseStatsOptions() = %v to %v, want %v to %v", opts.From, opts.To, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestPercentileRank(t *testing.T) {
+	tests := []struct {
+		n    int64
+		p    float64
+		want int64
+	}{
+		{1, 50, 1},
+		{1, 99, 1},
+		{4, 50, 2},
+		{10, 90, 9},
+		{10, 95, 10},
+		{200, 99, 198},
+	}
+
+	for _, tt := range tests {
+		if got := percentileRank(tt.n, tt.p); got != tt.want {
+			t.Errorf("percentileRank(%d, %v) = %d, want %d", tt.n, tt.p, got, tt.want)
+		}
+	}
+}
+
+// countingStatsRepository counts the stats it computes
+type countingStatsRepository struct {
+	calls int
+}
+
+func (r *countingStatsRepository) Get(ctx context.Context, opts StatsOptions) (*Stats, error) {
+	r.calls++
+	return newStats(opts), nil
+}
+
+func TestStatsServiceCache(t *testing.T) {
+	ctx := context.Background()
+	march := StatsOptions{WorkspaceID: defaultWorkspaceID, From: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}
+	april := StatsOptions{WorkspaceID: defaultWorkspaceID, From: march.To, To: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+
+	repo := &countingStatsRepository{}
+	service := NewStatsService(repo, time.Minute)
+	for _, opts := range []StatsOptions{march, march, april, march} {
+		if _, err := service.Get(ctx, opts); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+	}
+	if repo.calls != 2 {
+		t.Errorf("cached service computed stats %d times, want 2", repo.calls)
+	}
+
+	repo = &countingStatsRepository{}
+	service = NewStatsService(repo, 0)
+	service.Get(ctx, march)
+	service.Get(ctx, march)
+	if repo.calls != 2 {
+		t.Errorf("uncached service computed stats %d times, want 2", repo.calls)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 10, RequireMixedCase: true, RequireDigit: true, RequireSymbol: true}
+
+	tests := []struct {
+		password string
+		errors   int
+	}{
+		{"Correct-Horse-42", 0},
+		{"Sh0rt!", 1},
+		{"alllowercase-42", 1},
+		{"NoDigitsHere!", 1},
+		{"NoSymbols42abc", 1},
+		{"password", 4},
+		{strings.Repeat("Aa1!", 19), 1},
+	}
+
+	for _, tt := range tests {
+		if errs := policy.Validate("password", tt.password); len(errs) != tt.errors {
+			t.Errorf("Validate(%q) = %v, want %d errors", tt.password, errs, tt.errors)
+		}
+	}
+}
+
+func TestUserHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	handler := NewUserHandler(store.Users, NewUserService(store.Users, &PasswordPolicy{MinLength: 8, RequireDigit: true}), NewLoginThrottle(store.Logins))
+
+	admin, err := store.Users.GetByUsername(ctx, "admin")
+	if err != nil {
+		t.Fatalf("GetByUsername() error = %v", err)
+	}
+	var as *User
+	r := gin.New()
+	r.POST("/auth/password-reset", handler.ResetPassword)
+	protected := r.Group("/", func(c *gin.Context) {
+		user, _ := store.Users.GetByID(ctx, as.ID)
+		c.Set("user", user)
+	})
+	protected.PUT("/auth/password", handler.ChangePassword)
+	users := protected.Group("/users", requirePermission(PermUsersManage))
+	users.GET("", handler.GetUsers)
+	users.POST("", handler.CreateUser)
+	users.PUT("/:id", handler.UpdateUser)
+	users.POST("/:id/password-reset", handler.IssuePasswordReset)
+
+	request := func(method, path, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	as = admin
+	if code, body := request("POST", "/users", `{"username": "jane", "password": "short", "email": "not an email"}`); code != http.StatusUnprocessableEntity || len(body["details"].([]interface{})) != 3 {
+		t.Errorf("create with invalid fields = %d %v", code, body)
+	}
+	code, body := request("POST", "/users", `{"username": "jane", "password": "jane-password-1", "email": "jane@example.com"}`)
+	if code != http.StatusCreated || body["username"] != "jane" || body["role"] != RoleViewer {
+		t.Fatalf("create = %d %v", code, body)
+	}
+	janeID := int64(body["id"].(float64))
+	if code, body := request("POST", "/users", `{"username": "joe", "password": "joe-password-1", "role": "owner"}`); code != http.StatusUnprocessableEntity || len(body["details"].([]interface{})) != 1 {
+		t.Errorf("create with unknown role = %d %v", code, body)
+	}
+	if code, _ := request("POST", "/users", `{"username": "jane", "password": "jane-password-1"}`); code != http.StatusConflict {
+		t.Errorf("create duplicate = %d, want 409", code)
+	}
+	if code, body := request("PUT", fmt.Sprintf("/users/%d", admin.ID), `{"role": "editor"}`); code != http.StatusConflict || body["error"] != "self_lockout" {
+		t.Errorf("demote self = %d %v", code, body)
+	}
+
+	auth := NewAuthService(store.Users)
+	// Changing or resetting a password ends every session of the user
+	assertSessionEnded := func(action string, session *LoginResponse) {
+		t.Helper()
+		if _, err := auth.ValidateToken(ctx, session.Token); err == nil {
+			t.Errorf("access token still valid after %s", action)
+		}
+		if _, err := auth.Refresh(ctx, session.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("Refresh() after %s error = %v, want ErrInvalidRefreshToken", action, err)
+		}
+	}
+	session, err := auth.Login(ctx, "jane", "jane-password-1")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	as = &User{ID: janeID}
+	if code, _ := request("GET", "/users", ""); code != http.StatusForbidden {
+		t.Errorf("list users as non-admin = %d, want 403", code)
+	}
+	if code, _ := request("PUT", "/auth/password", `{"current_password": "wrong", "new_password": "jane-password-2"}`); code != http.StatusForbidden {
+		t.Errorf("change password with wrong current = %d, want 403", code)
+	}
+	if code, _ := request("PUT", "/auth/password", `{"current_password": "jane-password-1", "new_password": "jane-password-2"}`); code != http.StatusOK {
+		t.Errorf("change password = %d, want 200", code)
+	}
+	assertSessionEnded("changing the password", session)
+	if session, err = auth.Login(ctx, "jane", "jane-password-2"); err != nil {
+		t.Fatalf("Login() with changed password error = %v", err)
+	}
+
+	as = admin
+	code, body = request("POST", fmt.Sprintf("/users/%d/password-reset", janeID), "")
+	if code != http.StatusCreated || body["token"] == "" {
+		t.Fatalf("issue password reset = %d %v", code, body)
+	}
+	reset := fmt.Sprintf(`{"token": %q, "new_password": "jane-password-3"}`, body["token"])
+	if code, _ := request("POST", "/auth/password-reset", reset); code != http.StatusOK {
+		t.Errorf("reset password = %d, want 200", code)
+	}
+	assertSessionEnded("resetting the password", session)
+	if code, _ := request("POST", "/auth/password-reset", reset); code != http.StatusBadRequest {
+		t.Errorf("reuse reset token = %d, want 400", code)
+	}
+
+	if _, err := auth.Login(ctx, "jane", "jane-password-3"); err != nil {
+		t.Errorf("Login() with reset password error = %v", err)
+	}
+	if code, _ := request("PUT", fmt.Sprintf("/users/%d", janeID), `{"disabled": true}`); code != http.StatusOK {
+		t.Errorf("disable user = %d, want 200", code)
+	}
+	if _, err := auth.Login(ctx, "jane", "jane-password-3"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login() as disabled user error = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		role       string
+		permission Permission
+		want       int
+	}{
+		{RoleViewer, PermURLsRead, http.StatusOK},
+		{RoleViewer, PermAnalysisRead, http.StatusOK},
+		{RoleViewer, PermStatsRead, http.StatusOK},
+		{RoleViewer, PermURLsWrite, http.StatusForbidden},
+		{RoleViewer, PermURLsDelete, http.StatusForbidden},
+		{RoleEditor, PermURLsWrite, http.StatusOK},
+		{RoleEditor, PermURLsDelete, http.StatusForbidden},
+		{RoleEditor, PermWebhooksManage, http.StatusForbidden},
+		{RoleEditor, PermUsersManage, http.StatusForbidden},
+		{RoleAdmin, PermURLsDelete, http.StatusOK},
+		{RoleAdmin, PermWebhooksManage, http.StatusOK},
+		{RoleAdmin, PermUsersManage, http.StatusOK},
+		{"", PermURLsRead, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		role := tt.role
+		r := gin.New()
+		r.GET("/", func(c *gin.Context) {
+			c.Set("user", &User{ID: 1, Role: role})
+		}, requirePermission(tt.permission), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.want {
+			t.Errorf("%q with %s = %d, want %d", tt.role, tt.permission, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWorkspaceHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	service := NewWorkspaceService(store.Workspaces, store.UnitOfWork)
+	handler := NewWorkspaceHandler(store.Workspaces, service)
+
+	admin, err := store.Users.GetByUsername(ctx, "admin")
+	if err != nil {
+		t.Fatalf("GetByUsername() error = %v", err)
+	}
+	jane, err := store.Users.Create(ctx, &User{Username: "jane", PasswordHash: "hash", Role: RoleEditor})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	var as *User
+	r := gin.New()
+	protected := r.Group("/", func(c *gin.Context) { c.Set("user", as) })
+	protected.GET("/workspaces", handler.GetWorkspaces)
+	protected.POST("/workspaces", requirePermission(PermWorkspacesCreate), handler.CreateWorkspace)
+	protected.POST("/invitations/accept", handler.AcceptInvitation)
+	protected.GET("/current", workspaceMiddleware(service), requirePermission(PermURLsWrite), handler.GetWorkspace)
+	workspace := protected.Group("/workspaces/:workspaceId", workspaceMiddleware(service))
+	workspace.GET("/members", handler.GetMembers)
+	workspace.PUT("/members/:userId", requirePermission(PermMembersManage), handler.UpdateMember)
+	workspace.POST("/invitations", requirePermission(PermMembersManage), handler.CreateInvitation)
+
+	request := func(method, path, workspaceID, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if workspaceID != "" {
+			req.Header.Set("X-Workspace-ID", workspaceID)
+		}
+		r.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	as = jane
+	if code, body := request("GET", "/current", "", ""); code != http.StatusForbidden || body["error"] != "no_workspace" {
+		t.Errorf("current without workspaces = %d %v", code, body)
+	}
+	if code, _ := request("GET", "/current", strconv.FormatInt(defaultWorkspaceID, 10), ""); code != http.StatusNotFound {
+		t.Errorf("current in workspace of others = %d, want 404", code)
+	}
+	if code, body := request("POST", "/workspaces", "", `{"name": "  "}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("create with blank name = %d %v", code, body)
+	}
+	code, body := request("POST", "/workspaces", "", `{"name": " Team "}`)
+	if code != http.StatusCreated || body["name"] != "Team" || body["role"] != RoleAdmin {
+		t.Fatalf("create = %d %v", code, body)
+	}
+	team := strconv.FormatInt(int64(body["id"].(float64)), 10)
+	if code, body := request("PUT", "/workspaces/"+team+"/members/"+strconv.FormatInt(jane.ID, 10), "", `{"role": "viewer"}`); code != http.StatusConflict || body["error"] != "last_admin" {
+		t.Errorf("demote last admin = %d %v", code, body)
+	}
+
+	code, body = request("POST", "/workspaces/"+team+"/invitations", "", `{"email": "admin@example.com"}`)
+	if code != http.StatusCreated || body["token"] == "" {
+		t.Fatalf("invite = %d %v", code, body)
+	}
+	accept := fmt.Sprintf(`{"token": %q}`, body["token"])
+
+	as = admin
+	if code, body := request("POST", "/invitations/accept", "", accept); code != http.StatusForbidden || body["error"] != "invitation_email_mismatch" {
+		t.Errorf("accept without the invited email = %d %v", code, body)
+	}
+	email := "Admin@Example.com"
+	admin.Email = &email
+	if err := store.Users.Update(ctx, admin); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if code, body := request("POST", "/invitations/accept", "", accept); code != http.StatusOK || body["role"] != RoleViewer {
+		t.Errorf("accept = %d %v", code, body)
+	}
+	if code, _ := request("POST", "/invitations/accept", "", accept); code != http.StatusBadRequest {
+		t.Errorf("accept again = %d, want 400", code)
+	}
+	if code, body := request("GET", "/workspaces", "", ""); code != http.StatusOK || len(body["workspaces"].([]interface{})) != 2 {
+		t.Errorf("list workspaces = %d %v", code, body)
+	}
+	// The workspace role, not the global admin role, applies within it
+	if code, _ := request("GET", "/current", team, ""); code != http.StatusForbidden {
+		t.Errorf("write as workspace viewer = %d, want 403", code)
+	}
+	if code, body := request("GET", "/current", "", ""); code != http.StatusOK || body["id"] != float64(defaultWorkspaceID) {
+		t.Errorf("current by default = %d %v", code, body)
+	}
+	if code, body := request("GET", "/workspaces/"+team+"/members", "", ""); code != http.StatusOK || len(body["members"].([]interface{})) != 2 {
+		t.Errorf("list members = %d %v", code, body)
+	}
+}
+
+func TestCrossWorkspaceAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	// Everything below belongs to another workspace than the requests'
+	other, err := store.Workspaces.Create(ctx, "Other")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	url, err := store.URLs.Create(ctx, other.ID, "https://other.example.com", "https://other.example.com/")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := store.URLs.UpdateStatus(ctx, other.ID, url.ID, "completed"); err != nil {
+		t.Fatalf("UpdateStatus() error = %v", err)
+	}
+	if err := store.Analysis.Create(ctx, url.ID, &AnalysisResult{BrokenLinksCount: 1}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	webhook, err := store.Webhooks.Create(ctx, &Webhook{WorkspaceID: other.ID, URL: "https://hooks.example.com", Secret: "s",
+		EventTypes: WebhookEventTypes, Active: true})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	delivery, err := store.Webhooks.CreateDelivery(ctx, webhook.ID, WebhookAnalysisCompleted, `{}`)
+	if err != nil {
+		t.Fatalf("CreateDelivery() error = %v", err)
+	}
+	own, err := store.Webhooks.Create(ctx, &Webhook{WorkspaceID: defaultWorkspaceID, URL: "https://hooks.example.com", Secret: "s",
+		EventTypes: WebhookEventTypes, Active: true})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	crawler := NewCrawlerService(store.URLs, store.UnitOfWork, NewEventHub())
+	urlHandler := NewURLHandler(store.URLs, crawler, NewURLCanonicalizer(), NewURLValidator())
+	analysisHandler := NewAnalysisHandler(store.Analysis, store.URLs)
+	webhookHandler := NewWebhookHandler(store.Webhooks, NewWebhookService(store.Webhooks))
+
+	r := gin.New()
+	api := r.Group("/", func(c *gin.Context) { c.Set("workspace", &Workspace{ID: defaultWorkspaceID}) })
+	api.PUT("/urls/:id/status", urlHandler.UpdateStatus)
+	api.POST("/urls/bulk-rerun", urlHandler.BulkRerun)
+	api.GET("/analysis/:id", analysisHandler.GetAnalysis)
+	api.GET("/analysis/:id/links", analysisHandler.GetBrokenLinks)
+	api.GET("/webhooks/:id", webhookHandler.GetWebhook)
+	api.PUT("/webhooks/:id", webhookHandler.UpdateWebhook)
+	api.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook)
+	api.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", webhookHandler.Redeliver)
+
+	request := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	urlPath := fmt.Sprintf("/urls/%d", url.ID)
+	webhookPath := fmt.Sprintf("/webhooks/%d", webhook.ID)
+	for _, tt := range []struct {
+		method, path, body string
+	}{
+		{"PUT", urlPath + "/status", `{"status": "queued"}`},
+		{"GET", fmt.Sprintf("/analysis/%d", url.ID), ""},
+		{"GET", fmt.Sprintf("/analysis/%d/links", url.ID), ""},
+		{"GET", webhookPath, ""},
+		{"PUT", webhookPath, `{"url": "https://attacker.example.com", "event_types": ["analysis.failed"]}`},
+		{"DELETE", webhookPath, ""},
+		{"POST", fmt.Sprintf("/webhooks/%d/deliveries/%d/redeliver", own.ID, delivery.ID), ""},
+	} {
+		if code := request(tt.method, tt.path, tt.body); code != http.StatusNotFound {
+			t.Errorf("%s %s in another workspace = %d, want 404", tt.method, tt.path, code)
+		}
+	}
+	// Bulk re-runs skip IDs outside the workspace
+	if code := request("POST", "/urls/bulk-rerun", fmt.Sprintf(`{"ids": [%d]}`, url.ID)); code != http.StatusOK {
+		t.Errorf("bulk rerun = %d, want 200", code)
+	}
+
+	if stored, err := store.URLs.GetByID(ctx, other.ID, url.ID); err != nil || stored.Status != "completed" {
+		t.Errorf("URL of the other workspace = %+v, %v; want it completed", stored, err)
+	}
+	if stored, err := store.Webhooks.GetByID(ctx, other.ID, webhook.ID); err != nil || stored.URL != webhook.URL {
+		t.Errorf("webhook of the other workspace = %+v, %v; want it unchanged", stored, err)
+	}
+	if deliveries, _ := store.Webhooks.GetDeliveries(ctx, own.ID, 10); len(deliveries) != 0 {
+		t.Errorf("deliveries of own webhook = %+v, want none", deliveries)
+	}
+}
+
+func TestAuthServiceRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	auth := NewAuthService(store.Users)
+	if _, err := NewUserService(store.Users, &PasswordPolicy{}).CreateUser(ctx, &User{Username: "jane"}, "jane-password"); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	login, err := auth.Login(ctx, "jane", "jane-password")
+	if err != nil || login.Token == "" || login.RefreshToken == "" || !login.ExpiresAt.After(time.Now()) {
+		t.Fatalf("Login() = %+v, %v", login, err)
+	}
+	if user, err := auth.ValidateToken(ctx, login.Token); err != nil || user.Username != "jane" {
+		t.Errorf("ValidateToken() = %+v, %v", user, err)
+	}
+
+	refreshed, err := auth.Refresh(ctx, login.RefreshToken)
+	if err != nil || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("Refresh() = %+v, %v", refreshed, err)
+	}
+	if _, err := auth.ValidateToken(ctx, refreshed.Token); err != nil {
+		t.Errorf("ValidateToken(refreshed) error = %v", err)
+	}
+
+	// Presenting the rotated token again revokes the family, including the
+	// access and refresh tokens issued after it
+	if _, err := auth.Refresh(ctx, login.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(reused) error = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, err := auth.Refresh(ctx, refreshed.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(after reuse) error = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, err := auth.ValidateToken(ctx, refreshed.Token); err == nil {
+		t.Error("ValidateToken() after reuse succeeded, want error")
+	}
+
+	// Logout revokes only its own login
+	other, err := auth.Login(ctx, "jane", "jane-password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	third, err := auth.Login(ctx, "jane", "jane-password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := auth.Logout(ctx, other.RefreshToken); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	if _, err := auth.ValidateToken(ctx, other.Token); err == nil {
+		t.Error("ValidateToken() after logout succeeded, want error")
+	}
+	if _, err := auth.Refresh(ctx, other.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh() after logout error = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, err := auth.ValidateToken(ctx, third.Token); err != nil {
+		t.Errorf("ValidateToken(other login) error = %v", err)
+	}
+	if err := auth.Logout(ctx, "unknown"); err != nil {
+		t.Errorf("Logout(unknown) error = %v", err)
+	}
+}
+
+func TestStreamTicket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	authService := NewAuthService(store.Users)
+	apiKeyService := NewAPIKeyService(store.APIKeys, store.Users)
+	handler := NewAuthHandler(authService, nil)
+
+	login, err := authService.Login(ctx, "admin", "password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/events/ticket", authMiddleware(authService, apiKeyService), requireSession(), handler.CreateStreamTicket)
+	r.GET("/events", streamAuthMiddleware(authService, apiKeyService), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"username": currentUser(c).Username})
+	})
+
+	request := func(method, path, authorization string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		r.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	code, body := request("POST", "/events/ticket", "Bearer "+login.Token)
+	ticket, _ := body["ticket"].(string)
+	if code != http.StatusCreated || ticket == "" || body["expires_at"] == nil {
+		t.Fatalf("create ticket = %d %v", code, body)
+	}
+	if code, body := request("GET", "/events?ticket="+neturl.QueryEscape(ticket), ""); code != http.StatusOK || body["username"] != "admin" {
+		t.Errorf("stream with ticket = %d %v", code, body)
+	}
+	if code, body := request("GET", "/events?ticket="+neturl.QueryEscape(ticket), ""); code != http.StatusUnauthorized || body["error"] != "invalid_ticket" {
+		t.Errorf("stream with used ticket = %d %v", code, body)
+	}
+	if code, body := request("GET", "/events", "Bearer "+login.Token); code != http.StatusOK || body["username"] != "admin" {
+		t.Errorf("stream with header = %d %v", code, body)
+	}
+	// Access tokens are not accepted in the URL
+	if code, _ := request("GET", "/events?access_token="+login.Token, ""); code != http.StatusUnauthorized {
+		t.Errorf("stream with access_token = %d, want 401", code)
+	}
+}
+
+func TestEventStreamWorkspaceIsolation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	authService := NewAuthService(store.Users)
+	apiKeyService := NewAPIKeyService(store.APIKeys, store.Users)
+	workspaceService := NewWorkspaceService(store.Workspaces, store.UnitOfWork)
+	hub := NewEventHub()
+	defer hub.Close()
+
+	login, err := authService.Login(ctx, "admin", "password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	team, err := workspaceService.Create(ctx, "Team", &login.User)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	ticket, err := authService.IssueStreamTicket(ctx, &login.User)
+	if err != nil {
+		t.Fatalf("IssueStreamTicket() error = %v", err)
+	}
+
+	r := gin.New()
+	r.GET("/events", streamAuthMiddleware(authService, apiKeyService), workspaceMiddleware(workspaceService),
+		requirePermission(PermURLsRead), NewEventHandler(hub).Stream)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(requestCtx, "GET",
+		server.URL+"/events?ticket="+neturl.QueryEscape(ticket.Ticket)+"&workspace_id="+strconv.FormatInt(team.ID, 10), nil)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("GET /events error = %v", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+
+	// Headers are only sent with the first event, so wait for the handler
+	// to subscribe before publishing
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		hub.mu.RLock()
+		subscribed := len(hub.subscribers) == 1
+		hub.mu.RUnlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event handler did not subscribe")
+		}
+	}
+	published := []URLEvent{
+		{Type: "url.status", WorkspaceID: defaultWorkspaceID, URLID: 1, Status: "running"},
+		{Type: "url.status", WorkspaceID: team.ID, URLID: 2, Status: "running"},
+		{Type: "url.status", WorkspaceID: defaultWorkspaceID, URLID: 1, Status: "completed"},
+		{Type: "url.status", WorkspaceID: team.ID, URLID: 2, Status: "completed"},
+	}
+	for _, event := range published {
+		hub.Publish(event)
+	}
+
+	resp, ok := <-responses
+	if !ok {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events = %d, want 200", resp.StatusCode)
+	}
+
+	// Events are streamed in order, so once the team's last event arrives
+	// the other workspace's events have been filtered out
+	var received []URLEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var event URLEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("event %q: %v", data, err)
+		}
+		received = append(received, event)
+		if event.WorkspaceID == team.ID && event.Status == "completed" {
+			break
+		}
+	}
+	if len(received) != 2 {
+		t.Fatalf("received %+v, want the team's 2 events", received)
+	}
+	for _, event := range received {
+		if event.WorkspaceID != team.ID || event.URLID != 2 {
+			t.Errorf("received %+v from workspace %d, want only workspace %d", event, event.WorkspaceID, team.ID)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	authService := NewAuthService(store.Users)
+	apiKeyService := NewAPIKeyService(store.APIKeys, store.Users)
+	workspaceService := NewWorkspaceService(store.Workspaces, store.UnitOfWork)
+	handler := NewAPIKeyHandler(store.APIKeys, apiKeyService)
+
+	login, err := authService.Login(ctx, "admin", "password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	team, err := workspaceService.Create(ctx, "Team", &login.User)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r := gin.New()
+	protected := r.Group("/", authMiddleware(authService, apiKeyService))
+	protected.PUT("/auth/password", requireSession(), ok)
+	protected.POST("/api-keys", requireSession(), workspaceMiddleware(workspaceService), handler.CreateAPIKey)
+	protected.DELETE("/api-keys/:id", requireSession(), handler.DeleteAPIKey)
+	scoped := protected.Group("/", workspaceMiddleware(workspaceService))
+	scoped.GET("/urls", requirePermission(PermURLsRead), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"workspace_id": currentWorkspaceID(c)})
+	})
+	scoped.POST("/urls", requirePermission(PermURLsWrite), ok)
+	scoped.DELETE("/urls/:id", requirePermission(PermURLsDelete), ok)
+
+	request := func(method, path, authorization, workspaceID, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		if workspaceID != "" {
+			req.Header.Set("X-Workspace-ID", workspaceID)
+		}
+		r.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	bearer := "Bearer " + login.Token
+	teamID := strconv.FormatInt(team.ID, 10)
+
+	if code, body := request("POST", "/api-keys", bearer, teamID, `{"name": "CI", "scopes": ["urls:read", "urls:delete", "urls:read"]}`); code != http.StatusUnprocessableEntity || len(body["details"].([]interface{})) != 2 {
+		t.Errorf("create with invalid scopes = %d %v", code, body)
+	}
+	code, body := request("POST", "/api-keys", bearer, teamID, `{"name": "CI", "scopes": ["urls:read"]}`)
+	if code != http.StatusCreated || !strings.HasPrefix(body["key"].(string), apiKeyPrefix) {
+		t.Fatalf("create = %d %v", code, body)
+	}
+	apiKey := "ApiKey " + body["key"].(string)
+	keyID := strconv.FormatInt(int64(body["api_key"].(map[string]interface{})["id"].(float64)), 10)
+
+	if code, body := request("GET", "/urls", apiKey, "", ""); code != http.StatusOK || body["workspace_id"] != float64(team.ID) {
+		t.Errorf("read with key = %d %v", code, body)
+	}
+	if code, _ := request("POST", "/urls", apiKey, "", ""); code != http.StatusForbidden {
+		t.Errorf("write with read-only key = %d, want 403", code)
+	}
+	if code, _ := request("GET", "/urls", apiKey, strconv.FormatInt(defaultWorkspaceID, 10), ""); code != http.StatusForbidden {
+		t.Errorf("read other workspace with key = %d, want 403", code)
+	}
+	if code, body := request("PUT", "/auth/password", apiKey, "", ""); code != http.StatusForbidden || body["error"] != "session_required" {
+		t.Errorf("change password with key = %d %v", code, body)
+	}
+	if code, _ := request("GET", "/urls", "ApiKey crk_unknown", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("unknown key = %d, want 401", code)
+	}
+
+	// Keys follow the user's current role in their workspace
+	jane, err := store.Users.Create(ctx, &User{Username: "jane", PasswordHash: "hash", Role: RoleEditor})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := store.Workspaces.AddMember(ctx, team.ID, jane.ID, RoleEditor); err != nil {
+		t.Fatalf("AddMember() error = %v", err)
+	}
+	_, janeKey, err := apiKeyService.Create(ctx, jane, team.ID, "CI", []string{"urls:read", "urls:write"}, nil)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if code, _ := request("POST", "/urls", "ApiKey "+janeKey, "", ""); code != http.StatusOK {
+		t.Errorf("write as editor = %d, want 200", code)
+	}
+	if err := store.Workspaces.UpdateMemberRole(ctx, team.ID, jane.ID, RoleViewer); err != nil {
+		t.Fatalf("UpdateMemberRole() error = %v", err)
+	}
+	if code, _ := request("POST", "/urls", "ApiKey "+janeKey, "", ""); code != http.StatusForbidden {
+		t.Errorf("write after demotion = %d, want 403", code)
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	_, expiredKey, err := apiKeyService.Create(ctx, jane, team.ID, "Old", []string{"urls:read"}, &expired)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if code, _ := request("GET", "/urls", "ApiKey "+expiredKey, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("expired key = %d, want 401", code)
+	}
+
+	if code, _ := request("DELETE", "/api-keys/"+keyID, bearer, "", ""); code != http.StatusOK {
+		t.Errorf("revoke = %d, want 200", code)
+	}
+	if code, _ := request("GET", "/urls", apiKey, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("revoked key = %d, want 401", code)
+	}
+	if code, _ := request("DELETE", "/api-keys/"+keyID, bearer, "", ""); code != http.StatusNotFound {
+		t.Errorf("revoke again = %d, want 404", code)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := NewMemoryStore()
+	throttle := NewLoginThrottle(store.Logins)
+	throttle.delayAfter, throttle.userThreshold, throttle.ipThreshold = 2, 4, 6
+	throttle.maxDelay, throttle.lockoutDuration = 3*time.Second, time.Hour
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+	handler := NewAuthHandler(NewAuthService(store.Users), throttle)
+	userHandler := NewUserHandler(store.Users, NewUserService(store.Users, &PasswordPolicy{}), throttle)
+	admin, err := store.Users.GetByUsername(context.Background(), "admin")
+	if err != nil {
+		t.Fatalf("GetByUsername() error = %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/auth/login", handler.Login)
+	r.GET("/users/lockouts", handler.GetLockouts)
+	r.PUT("/auth/password", func(c *gin.Context) { c.Set("user", admin) }, userHandler.ChangePassword)
+
+	login := func(username, password, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"username": "`+username+`", "password": "`+password+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown usernames fail like wrong passwords
+	if w := login("nobody", "password", "192.0.2.1"); w.Code != http.StatusUnauthorized {
+		t.Errorf("login(unknown) = %d %s", w.Code, w.Body)
+	}
+
+	// From the second failure each attempt waits twice as long as the last,
+	// whatever the case of the username
+	for i, delay := range []string{"", "1", "2"} {
+		if w := login("admin", "wrong", "192.0.2.2"); w.Code != http.StatusUnauthorized {
+			t.Errorf("login(wrong) #%d = %d %s", i+1, w.Code, w.Body)
+		}
+		if delay == "" {
+			continue
+		}
+		if w := login("Admin", "password", "192.0.2.2"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != delay {
+			t.Errorf("login(delayed) = %d Retry-After %q, want %s", w.Code, w.Header().Get("Retry-After"), delay)
+		}
+		now = now.Add(time.Duration(i) * time.Second)
+	}
+	if got := throttle.delay(10); got != 3*time.Second {
+		t.Errorf("delay(10) = %v, want the 3s maximum", got)
+	}
+
+	// The fourth failure locks the username out, even for the right password
+	if w := login("admin", "wrong", "192.0.2.3"); w.Code != http.StatusUnauthorized {
+		t.Errorf("login(wrong) #4 = %d %s", w.Code, w.Body)
+	}
+	if w := login("admin", "password", "192.0.2.3"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("login(locked) = %d Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Changing the password checks the current one, so it is locked out too
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/auth/password", strings.NewReader(`{"current_password": "password", "new_password": "new-password"}`))
+	req.RemoteAddr = "192.0.2.3:1234"
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("change password while locked = %d %s", w.Code, w.Body)
+	}
+
+	// A success after the lockout clears the username's failures
+	now = now.Add(time.Hour)
+	if w := login("admin", "password", "192.0.2.3"); w.Code != http.StatusOK {
+		t.Errorf("login(after lockout) = %d %s", w.Code, w.Body)
+	}
+	if w := login("admin", "wrong", "192.0.2.3"); w.Code != http.StatusUnauthorized {
+		t.Errorf("login(wrong) = %d %s", w.Code, w.Body)
+	}
+	if w := login("admin", "password", "192.0.2.3"); w.Code != http.StatusOK {
+		t.Errorf("login(after one failure) = %d %s", w.Code, w.Body)
+	}
+
+	// Failures across usernames lock the IP
+	for i := 0; i < 6; i++ {
+		login("user"+strconv.Itoa(i), "wrong", "192.0.2.4")
+	}
+	if w := login("admin", "password", "192.0.2.4"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login(locked IP) = %d %s", w.Code, w.Body)
+	}
+	if w := login("admin", "password", "192.0.2.5"); w.Code != http.StatusOK {
+		t.Errorf("login(other IP) = %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/users/lockouts?since="+now.Add(-2*time.Hour).UTC().Format(time.RFC3339), nil))
+	var response struct {
+		Lockouts []LoginLockout `json:"lockouts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK || len(response.Lockouts) != 2 ||
+		response.Lockouts[0].Subject != "192.0.2.4" || response.Lockouts[1].Subject != "admin" {
+		t.Errorf("GetLockouts() = %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/users/lockouts?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GetLockouts(invalid since) = %d, want 400", w.Code)
+	}
+}
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	throttle := NewLoginThrottle(store.Logins)
+	throttle.delayAfter, throttle.userThreshold = 2, 10
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		attempt, wait, err := throttle.Attempt(ctx, "admin", "")
+		if err != nil || wait > 0 {
+			t.Fatalf("Attempt() #%d = %v, %v", i+1, wait, err)
+		}
+		if err := throttle.RecordFailure(ctx, attempt); err != nil {
+			t.Fatalf("RecordFailure() error = %v", err)
+		}
+	}
+	now = now.Add(time.Second)
+
+	// Attempts started together after the delay all pass the check on the
+	// same count, but only one of them may go on to try a password
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, wait, err := throttle.Attempt(ctx, "admin", "")
+			if err != nil {
+				t.Errorf("Attempt() error = %v", err)
+			}
+			if attempt != nil && wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 1 {
+		t.Errorf("%d concurrent attempts allowed, want 1", got)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("RATE_LIMIT_CRAWL", "2/1m")
+	t.Setenv("RATE_LIMIT_AUTH", "off")
+	limiter, err := NewRateLimiter(NewMemoryRateLimitRepository())
+	if err != nil {
+		t.Fatalf("NewRateLimiter() error = %v", err)
+	}
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	t.Setenv("RATE_LIMIT_API", "100")
+	if _, err := NewRateLimiter(NewMemoryRateLimitRepository()); err == nil {
+		t.Error("NewRateLimiter(100) error = nil, want an error")
+	}
+
+	asUser := func(id int64) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if id != 0 {
+				c.Set("user", &User{ID: id})
+			}
+		}
+	}
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r := gin.New()
+	r.POST("/urls", asUser(1), rateLimitMiddleware(limiter, "crawl"), ok)
+	r.POST("/other-user/urls", asUser(2), rateLimitMiddleware(limiter, "crawl"), ok)
+	r.POST("/anonymous/urls", asUser(0), rateLimitMiddleware(limiter, "crawl"), ok)
+	r.POST("/auth/login", rateLimitMiddleware(limiter, "auth"), ok)
+
+	request := func(path, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, remaining := range []string{"1", "0"} {
+		w := request("/urls", "192.0.2.1")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != remaining ||
+			w.Header().Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("request = %d %v", w.Code, w.Header())
+		}
+	}
+	w := request("/urls", "192.0.2.2")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" || w.Header().Get("RateLimit-Reset") != "60" {
+		t.Errorf("request over the limit = %d %v", w.Code, w.Header())
+	}
+
+	// Users are limited apart, whatever their IP, and anonymous clients by IP
+	if w := request("/other-user/urls", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("request of other user = %d", w.Code)
+	}
+	request("/anonymous/urls", "192.0.2.1")
+	request("/anonymous/urls", "192.0.2.1")
+	if w := request("/anonymous/urls", "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("anonymous request over the limit = %d", w.Code)
+	}
+	if w := request("/anonymous/urls", "192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("anonymous request from other IP = %d", w.Code)
+	}
+
+	// Half a window later the bucket holds one request again
+	now = now.Add(30 * time.Second)
+	if w := request("/urls", "192.0.2.1"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("request after refill = %d %v", w.Code, w.Header())
+	}
+
+	// Disabled groups are not limited and send no headers
+	for i := 0; i < 25; i++ {
+		if w := request("/auth/login", "192.0.2.1"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("request to unlimited group = %d %v", w.Code, w.Header())
+		}
+	}
+}
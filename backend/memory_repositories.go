@@ -0,0 +1,1582 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	neturl "net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultAdminPasswordHash is the bcrypt hash of "password", matching the
+// admin user seeded by the SQL migrations
+const defaultAdminPasswordHash = "$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi"
+
+// memoryDB holds the tables of the in-memory store. Repositories share it so
+// deleting a URL can cascade to its analysis like the SQL schema does.
+type memoryDB struct {
+	mu         sync.RWMutex
+	lastID     int64
+	urls       map[int64]*URL
+	analyses   []AnalysisResult
+	pageLinks  map[string][]memoryLink
+	links      []BrokenLink
+	users      map[int64]*User
+	resets     []memoryPasswordReset
+	tickets    []memoryStreamTicket
+	refresh    []RefreshToken
+	webhooks   map[int64]*Webhook
+	deliveries map[int64]*WebhookDelivery
+
+	workspaces  map[int64]*Workspace
+	members     []WorkspaceMember
+	invitations map[int64]*WorkspaceInvitation
+	apiKeys     map[int64]*APIKey
+
+	loginFailures map[string]*LoginFailure
+	lockouts      []LoginLockout
+}
+
+// memoryPasswordReset is a row of the password reset tokens table
+type memoryPasswordReset struct {
+	UserID    int64
+	TokenHash string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// memoryStreamTicket is a row of the stream tickets table
+type memoryStreamTicket struct {
+	UserID    int64
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// memoryLink is a row of the internal or external links table
+type memoryLink struct {
+	URLID int64
+	Link  Link
+}
+
+// nextID returns a new row ID; callers hold mu
+func (m *memoryDB) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+// NewMemoryStore returns a store that keeps everything in process memory,
+// for tests and demos. It is seeded with the default admin user, who is the
+// admin of the default workspace.
+func NewMemoryStore() *Store {
+	now := time.Now().UTC()
+	m := &memoryDB{
+		urls:        map[int64]*URL{},
+		pageLinks:   map[string][]memoryLink{},
+		users:       map[int64]*User{},
+		webhooks:    map[int64]*Webhook{},
+		deliveries:  map[int64]*WebhookDelivery{},
+		workspaces:  map[int64]*Workspace{},
+		invitations: map[int64]*WorkspaceInvitation{},
+		apiKeys:     map[int64]*APIKey{},
+
+		loginFailures: map[string]*LoginFailure{},
+	}
+	m.workspaces[defaultWorkspaceID] = &Workspace{ID: defaultWorkspaceID, Name: "Default", CreatedAt: now, UpdatedAt: now}
+	admin := &User{ID: m.nextID(), Username: "admin", PasswordHash: defaultAdminPasswordHash, Role: RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	m.users[admin.ID] = admin
+	m.members = append(m.members, WorkspaceMember{WorkspaceID: defaultWorkspaceID, UserID: admin.ID, Role: RoleAdmin, CreatedAt: now, UpdatedAt: now})
+
+	return &Store{
+		URLs:       &MemoryURLRepository{m: m},
+		Analysis:   &MemoryAnalysisRepository{m: m},
+		Users:      &MemoryUserRepository{m: m},
+		Webhooks:   &MemoryWebhookRepository{m: m},
+		Stats:      &MemoryStatsRepository{m: m},
+		Workspaces: &MemoryWorkspaceRepository{m: m},
+		APIKeys:    &MemoryAPIKeyRepository{m: m},
+		Logins:     &MemoryLoginThrottleRepository{m: m},
+		RateLimits: NewMemoryRateLimitRepository(),
+		UnitOfWork: &MemoryUnitOfWork{m: m},
+	}
+}
+
+// MemoryURLRepository implements URLRepository in memory
+type MemoryURLRepository struct {
+	m *memoryDB
+}
+
+func (r *MemoryURLRepository) Create(ctx context.Context, workspaceID int64, originalURL, canonicalURL string) (*URL, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	hash := URLHash(canonicalURL)
+	for _, url := range r.m.urls {
+		if url.WorkspaceID == workspaceID && url.URLHash == hash {
+			return nil, ErrDuplicateURL
+		}
+	}
+
+	now := time.Now().UTC()
+	url := &URL{
+		ID:          r.m.nextID(),
+		WorkspaceID: workspaceID,
+		URL:         canonicalURL,
+		OriginalURL: originalURL,
+		URLHash:     hash,
+		Status:      "queued",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		TraceParent: traceParent(ctx),
+	}
+	r.m.urls[url.ID] = url
+
+	copied := *url
+	return &copied, nil
+}
+
+func (r *MemoryURLRepository) GetByID(ctx context.Context, workspaceID, id int64) (*URL, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	url, ok := r.m.urls[id]
+	if !ok || url.WorkspaceID != workspaceID {
+		return nil, fmt.Errorf("failed to get URL by ID: %w", sql.ErrNoRows)
+	}
+
+	copied := *url
+	return &copied, nil
+}
+
+func (r *MemoryURLRepository) GetByCanonicalURL(ctx context.Context, workspaceID int64, canonicalURL string) (*URL, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	hash := URLHash(canonicalURL)
+	for _, url := range r.m.urls {
+		if url.WorkspaceID == workspaceID && url.URLHash == hash {
+			copied := *url
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to get URL by canonical URL: %w", sql.ErrNoRows)
+}
+
+// sortedURLs returns copies of the URLs matching keep, oldest first; callers hold mu
+func (r *MemoryURLRepository) sortedURLs(keep func(*URL) bool) []URL {
+	var urls []URL
+	for _, url := range r.m.urls {
+		if keep(url) {
+			urls = append(urls, *url)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if !urls[i].CreatedAt.Equal(urls[j].CreatedAt) {
+			return urls[i].CreatedAt.Before(urls[j].CreatedAt)
+		}
+		return urls[i].ID < urls[j].ID
+	})
+	return urls
+}
+
+func (r *MemoryURLRepository) GetAll(ctx context.Context, opts URLListOptions) (*URLListResponse, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	analyses := map[int64]*AnalysisResult{}
+	for i := range r.m.analyses {
+		analyses[r.m.analyses[i].URLID] = &r.m.analyses[i]
+	}
+
+	query := parseSearchQuery(opts.Search)
+	matched := r.sortedURLs(func(url *URL) bool {
+		return opts.matches(url, analyses[url.ID]) &&
+			(len(query) == 0 || query.matches(r.searchText(url)...))
+	})
+	values := make(map[int64]interface{}, len(matched))
+	for i := range matched {
+		values[matched[i].ID] = opts.sortValue(&matched[i], analyses[matched[i].ID])
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		return opts.compare(values[a.ID], a.ID, values[b.ID], b.ID) < 0
+	})
+
+	// Take up to one row more than a page, in the direction of travel
+	var urls []URL
+	if opts.backward() {
+		for i := len(matched) - 1; i >= 0 && len(urls) <= opts.PageSize; i-- {
+			if opts.compare(values[matched[i].ID], matched[i].ID, opts.Cursor.Value, opts.Cursor.ID) < 0 {
+				urls = append(urls, matched[i])
+			}
+		}
+	} else {
+		skipped := 0
+		for i := 0; i < len(matched) && len(urls) <= opts.PageSize; i++ {
+			if opts.Cursor != nil && opts.compare(values[matched[i].ID], matched[i].ID, opts.Cursor.Value, opts.Cursor.ID) <= 0 {
+				continue
+			}
+			if skipped < opts.offset() {
+				skipped++
+				continue
+			}
+			urls = append(urls, matched[i])
+		}
+	}
+
+	if len(query) > 0 {
+		for i := range urls {
+			if analysis := analyses[urls[i].ID]; analysis != nil {
+				urls[i].Highlights = query.highlights(searchFields(urls[i].URL, analysis.PageTitle, analysis.MetaDescription, analysis.ExtractedText))
+			} else {
+				urls[i].Highlights = query.highlights(searchFields(urls[i].URL, nil, nil, nil))
+			}
+		}
+	}
+
+	if opts.IncludeAnalysis {
+		for i := range urls {
+			if analysis := analyses[urls[i].ID]; analysis != nil {
+				urls[i].Analysis = NewAnalysisSummary(analysis)
+			}
+		}
+	}
+
+	rowValues := make([]interface{}, len(urls))
+	for i := range urls {
+		rowValues[i] = values[urls[i].ID]
+	}
+	response, err := opts.listPage(urls, rowValues)
+	if err != nil {
+		return nil, err
+	}
+	if opts.countTotal() {
+		response.setTotal(int64(len(matched)), opts.PageSize)
+	}
+	return response, nil
+}
+
+// analysisOf returns the analysis of a URL, or nil; callers hold mu
+func (r *MemoryURLRepository) analysisOf(urlID int64) *AnalysisResult {
+	for i := range r.m.analyses {
+		if r.m.analyses[i].URLID == urlID {
+			return &r.m.analyses[i]
+		}
+	}
+	return nil
+}
+
+// searchText returns the searchable fields of a URL; callers hold mu
+func (r *MemoryURLRepository) searchText(url *URL) []string {
+	text := []string{url.URL}
+	analysis := r.analysisOf(url.ID)
+	if analysis == nil {
+		return text
+	}
+	for _, field := range []*string{analysis.PageTitle, analysis.MetaDescription, analysis.ExtractedText} {
+		if field != nil {
+			text = append(text, *field)
+		}
+	}
+	return text
+}
+
+func (r *MemoryURLRepository) UpdateStatus(ctx context.Context, workspaceID, id int64, status string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	url, ok := r.m.urls[id]
+	if !ok || url.WorkspaceID != workspaceID {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	url.Status = status
+	url.UpdatedAt = now
+	switch status {
+	case "running":
+		url.StartedAt = &now
+	case "completed", "failed":
+		url.CompletedAt = &now
+	case "queued":
+		url.TraceParent = traceParent(ctx)
+	}
+
+	return nil
+}
+
+func (r *MemoryURLRepository) ClaimQueued(ctx context.Context, workspaceID, id int64) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	url, ok := r.m.urls[id]
+	if !ok || url.WorkspaceID != workspaceID || url.Status != "queued" {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	url.Status = "running"
+	url.StartedAt = &now
+	url.UpdatedAt = now
+	return true, nil
+}
+
+func (r *MemoryURLRepository) UpdateErrorMessage(ctx context.Context, workspaceID, id int64, errorMessage string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if url, ok := r.m.urls[id]; ok && url.WorkspaceID == workspaceID {
+		url.ErrorMessage = &errorMessage
+		url.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (r *MemoryURLRepository) ClearErrorMessage(ctx context.Context, workspaceID, id int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if url, ok := r.m.urls[id]; ok && url.WorkspaceID == workspaceID {
+		url.ErrorMessage = nil
+		url.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (r *MemoryURLRepository) Delete(ctx context.Context, workspaceID, id int64) error {
+	return r.BulkDelete(ctx, workspaceID, []int64{id})
+}
+
+func (r *MemoryURLRepository) BulkDelete(ctx context.Context, workspaceID int64, ids []int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	deleted := map[int64]bool{}
+	for _, id := range ids {
+		if url, ok := r.m.urls[id]; ok && url.WorkspaceID == workspaceID {
+			delete(r.m.urls, id)
+			deleted[id] = true
+		}
+	}
+
+	analyses := r.m.analyses[:0]
+	for _, analysis := range r.m.analyses {
+		if !deleted[analysis.URLID] {
+			analyses = append(analyses, analysis)
+		}
+	}
+	r.m.analyses = analyses
+	r.m.deleteLinks(func(urlID int64) bool { return deleted[urlID] })
+
+	return nil
+}
+
+func (r *MemoryURLRepository) GetQueuedURLs(ctx context.Context) ([]URL, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	return r.sortedURLs(func(url *URL) bool { return url.Status == "queued" }), nil
+}
+
+func (r *MemoryURLRepository) QueueStats(ctx context.Context) (int64, *time.Time, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	var depth int64
+	var oldest *time.Time
+	for _, url := range r.m.urls {
+		if url.Status != "queued" {
+			continue
+		}
+		depth++
+		if oldest == nil || url.UpdatedAt.Before(*oldest) {
+			updatedAt := url.UpdatedAt
+			oldest = &updatedAt
+		}
+	}
+
+	return depth, oldest, nil
+}
+
+// MemoryAnalysisRepository implements AnalysisRepository in memory
+type MemoryAnalysisRepository struct {
+	m *memoryDB
+}
+
+func (r *MemoryAnalysisRepository) Create(ctx context.Context, urlID int64, analysis *AnalysisResult) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	now := time.Now().UTC()
+	stored := *analysis
+	stored.ID = r.m.nextID()
+	stored.URLID = urlID
+	stored.CreatedAt = now
+	stored.UpdatedAt = now
+	r.m.analyses = append(r.m.analyses, stored)
+
+	return nil
+}
+
+// inWorkspace reports whether a URL belongs to a workspace; callers hold mu
+func (m *memoryDB) inWorkspace(workspaceID, urlID int64) bool {
+	url, ok := m.urls[urlID]
+	return ok && url.WorkspaceID == workspaceID
+}
+
+func (r *MemoryAnalysisRepository) GetByURLID(ctx context.Context, workspaceID, urlID int64) (*AnalysisResult, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, analysis := range r.m.analyses {
+		if analysis.URLID == urlID && r.m.inWorkspace(workspaceID, urlID) {
+			copied := analysis
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to get analysis result: %w", sql.ErrNoRows)
+}
+
+// deleteLinks removes the links and broken links of the URLs matching drop;
+// callers hold mu
+func (m *memoryDB) deleteLinks(drop func(urlID int64) bool) {
+	for linkType, pageLinks := range m.pageLinks {
+		kept := pageLinks[:0]
+		for _, link := range pageLinks {
+			if !drop(link.URLID) {
+				kept = append(kept, link)
+			}
+		}
+		m.pageLinks[linkType] = kept
+	}
+
+	links := m.links[:0]
+	for _, link := range m.links {
+		if !drop(link.URLID) {
+			links = append(links, link)
+		}
+	}
+	m.links = links
+}
+
+func (r *MemoryAnalysisRepository) DeleteByURLID(ctx context.Context, urlID int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	analyses := r.m.analyses[:0]
+	for _, analysis := range r.m.analyses {
+		if analysis.URLID != urlID {
+			analyses = append(analyses, analysis)
+		}
+	}
+	r.m.analyses = analyses
+	r.m.deleteLinks(func(id int64) bool { return id == urlID })
+
+	return nil
+}
+
+func (r *MemoryAnalysisRepository) AddLinks(ctx context.Context, urlID int64, linkType string, links []Link) error {
+	if _, err := linkTable(linkType); err != nil {
+		return err
+	}
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, link := range links {
+		if text := linkText(link); text != nil {
+			link.Text = *text
+		}
+		link.IsBroken = false
+		r.m.pageLinks[linkType] = append(r.m.pageLinks[linkType], memoryLink{URLID: urlID, Link: link})
+	}
+	return nil
+}
+
+func (r *MemoryAnalysisRepository) GetLinks(ctx context.Context, workspaceID, urlID int64, linkType string) ([]Link, error) {
+	if _, err := linkTable(linkType); err != nil {
+		return nil, err
+	}
+
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	if !r.m.inWorkspace(workspaceID, urlID) {
+		return []Link{}, nil
+	}
+
+	broken := map[string]bool{}
+	for _, link := range r.m.links {
+		if link.URLID == urlID {
+			broken[link.LinkURL] = true
+		}
+	}
+
+	links := []Link{}
+	for _, stored := range r.m.pageLinks[linkType] {
+		if stored.URLID == urlID {
+			link := stored.Link
+			link.IsBroken = broken[link.URL]
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (r *MemoryAnalysisRepository) AddBrokenLink(ctx context.Context, urlID int64, linkURL string, statusCode *int, errorMessage *string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.links = append(r.m.links, BrokenLink{
+		ID:           r.m.nextID(),
+		URLID:        urlID,
+		LinkURL:      linkURL,
+		StatusCode:   statusCode,
+		ErrorMessage: errorMessage,
+		CreatedAt:    time.Now().UTC(),
+	})
+	return nil
+}
+
+func (r *MemoryAnalysisRepository) GetBrokenLinks(ctx context.Context, workspaceID, urlID int64) ([]BrokenLink, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	if !r.m.inWorkspace(workspaceID, urlID) {
+		return nil, nil
+	}
+
+	// Newest first
+	var links []BrokenLink
+	for i := len(r.m.links) - 1; i >= 0; i-- {
+		if r.m.links[i].URLID == urlID {
+			links = append(links, r.m.links[i])
+		}
+	}
+	return links, nil
+}
+
+// MemoryUnitOfWork implements UnitOfWork in memory. A unit of work holds the
+// store's lock throughout, so other writes wait for it, and works on a copy of
+// the URL, analysis, workspace and webhook delivery tables that replaces them
+// only when it succeeds. A failed or panicking unit leaves the store untouched.
+type MemoryUnitOfWork struct {
+	m *memoryDB
+}
+
+func (u *MemoryUnitOfWork) Do(ctx context.Context, fn func(tx *TxRepositories) error) error {
+	u.m.mu.Lock()
+	defer u.m.mu.Unlock()
+
+	// Repositories inside the unit lock the copy, which nothing else sees
+	tx := u.m.copyForUnit()
+	txRepos := &TxRepositories{
+		URLs:       &MemoryURLRepository{m: tx},
+		Analysis:   &MemoryAnalysisRepository{m: tx},
+		Workspaces: &MemoryWorkspaceRepository{m: tx},
+		Webhooks:   &MemoryWebhookRepository{m: tx},
+	}
+	if err := fn(txRepos); err != nil {
+		return err
+	}
+	u.m.apply(tx)
+	return nil
+}
+
+// copyForUnit returns a memoryDB with copies of the tables a unit of work can
+// change, sharing the other tables, which units only read; callers hold mu
+func (m *memoryDB) copyForUnit() *memoryDB {
+	copied := &memoryDB{
+		lastID:        m.lastID,
+		urls:          make(map[int64]*URL, len(m.urls)),
+		analyses:      append([]AnalysisResult(nil), m.analyses...),
+		pageLinks:     make(map[string][]memoryLink, len(m.pageLinks)),
+		links:         append([]BrokenLink(nil), m.links...),
+		users:         m.users,
+		resets:        m.resets,
+		tickets:       m.tickets,
+		refresh:       m.refresh,
+		webhooks:      m.webhooks,
+		deliveries:    make(map[int64]*WebhookDelivery, len(m.deliveries)),
+		workspaces:    make(map[int64]*Workspace, len(m.workspaces)),
+		members:       append([]WorkspaceMember(nil), m.members...),
+		invitations:   make(map[int64]*WorkspaceInvitation, len(m.invitations)),
+		apiKeys:       m.apiKeys,
+		loginFailures: m.loginFailures,
+		lockouts:      m.lockouts,
+	}
+	for id, url := range m.urls {
+		stored := *url
+		copied.urls[id] = &stored
+	}
+	for id, delivery := range m.deliveries {
+		stored := *delivery
+		copied.deliveries[id] = &stored
+	}
+	for id, workspace := range m.workspaces {
+		stored := *workspace
+		copied.workspaces[id] = &stored
+	}
+	for id, invitation := range m.invitations {
+		stored := *invitation
+		copied.invitations[id] = &stored
+	}
+	for linkType, links := range m.pageLinks {
+		copied.pageLinks[linkType] = append([]memoryLink(nil), links...)
+	}
+	return copied
+}
+
+// apply makes the tables of a unit of work's copy the store's; callers hold mu
+func (m *memoryDB) apply(tx *memoryDB) {
+	m.lastID = tx.lastID
+	m.urls = tx.urls
+	m.analyses = tx.analyses
+	m.pageLinks = tx.pageLinks
+	m.links = tx.links
+	m.deliveries = tx.deliveries
+	m.workspaces = tx.workspaces
+	m.members = tx.members
+	m.invitations = tx.invitations
+}
+
+// MemoryUserRepository implements UserRepository in memory
+type MemoryUserRepository struct {
+	m *memoryDB
+}
+
+func copyUser(user *User) *User {
+	copied := *user
+	if user.Email != nil {
+		email := *user.Email
+		copied.Email = &email
+	}
+	return &copied
+}
+
+func (r *MemoryUserRepository) GetByUsername(ctx context.Context, username string) (*User, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, user := range r.m.users {
+		if user.Username == username {
+			return copyUser(user), nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get user by username: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryUserRepository) GetByID(ctx context.Context, id int64) (*User, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	user, ok := r.m.users[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user by ID: %w", sql.ErrNoRows)
+	}
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) GetAll(ctx context.Context) ([]User, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	users := []User{}
+	for _, user := range r.m.users {
+		users = append(users, *copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users, nil
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *User) (*User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, existing := range r.m.users {
+		if existing.Username == user.Username {
+			return nil, ErrDuplicateUsername
+		}
+	}
+
+	now := time.Now().UTC()
+	stored := copyUser(user)
+	stored.ID = r.m.nextID()
+	stored.CreatedAt = now
+	stored.UpdatedAt = now
+	r.m.users[stored.ID] = stored
+
+	return copyUser(stored), nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, user *User) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored, ok := r.m.users[user.ID]
+	if !ok {
+		return nil
+	}
+	updated := copyUser(stored)
+	updated.Email = copyUser(user).Email
+	updated.Role = user.Role
+	updated.Disabled = user.Disabled
+	updated.UpdatedAt = time.Now().UTC()
+	r.m.users[user.ID] = updated
+
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdatePassword(ctx context.Context, id int64, passwordHash string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if user, ok := r.m.users[id]; ok {
+		user.PasswordHash = passwordHash
+		user.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.resets[:0]
+	for _, reset := range r.m.resets {
+		if reset.UserID != userID || reset.Used {
+			kept = append(kept, reset)
+		}
+	}
+	r.m.resets = append(kept, memoryPasswordReset{UserID: userID, TokenHash: tokenHash, ExpiresAt: expiresAt})
+	return nil
+}
+
+func (r *MemoryUserRepository) ConsumePasswordReset(ctx context.Context, tokenHash string, now time.Time) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.resets {
+		reset := &r.m.resets[i]
+		if reset.TokenHash == tokenHash && !reset.Used && now.Before(reset.ExpiresAt) {
+			reset.Used = true
+			return reset.UserID, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to consume password reset token: %w", sql.ErrNoRows)
+}
+func (r *MemoryUserRepository) CreateStreamTicket(ctx context.Context, userID int64, tokenHash string, expiresAt, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	kept := r.m.tickets[:0]
+	for _, ticket := range r.m.tickets {
+		if ticket.UserID != userID || now.Before(ticket.ExpiresAt) {
+			kept = append(kept, ticket)
+		}
+	}
+	r.m.tickets = append(kept, memoryStreamTicket{UserID: userID, TokenHash: tokenHash, ExpiresAt: expiresAt})
+	return nil
+}
+
+func (r *MemoryUserRepository) ConsumeStreamTicket(ctx context.Context, tokenHash string, now time.Time) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i, ticket := range r.m.tickets {
+		if ticket.TokenHash == tokenHash && now.Before(ticket.ExpiresAt) {
+			r.m.tickets = append(r.m.tickets[:i], r.m.tickets[i+1:]...)
+			return ticket.UserID, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to consume stream ticket: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryUserRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored := *token
+	stored.ID = r.m.nextID()
+	stored.CreatedAt = time.Now().UTC()
+	r.m.refresh = append(r.m.refresh, stored)
+	token.ID = stored.ID
+	return nil
+}
+
+func (r *MemoryUserRepository) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, token := range r.m.refresh {
+		if token.TokenHash == tokenHash {
+			found := token
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get refresh token: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryUserRepository) UseRefreshToken(ctx context.Context, id int64, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.refresh {
+		token := &r.m.refresh[i]
+		if token.ID == id && token.UsedAt == nil && token.RevokedAt == nil {
+			usedAt := now.UTC()
+			token.UsedAt = &usedAt
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to use refresh token: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryUserRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.refresh {
+		token := &r.m.refresh[i]
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			revokedAt := now.UTC()
+			token.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) RevokeUserRefreshTokens(ctx context.Context, userID int64, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.refresh {
+		token := &r.m.refresh[i]
+		if token.UserID == userID && token.RevokedAt == nil {
+			revokedAt := now.UTC()
+			token.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) IsRefreshTokenFamilyRevoked(ctx context.Context, familyID string) (bool, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	found := false
+	for _, token := range r.m.refresh {
+		if token.FamilyID == familyID {
+			if token.RevokedAt != nil {
+				return true, nil
+			}
+			found = true
+		}
+	}
+	return !found, nil
+}
+
+// MemoryWebhookRepository implements WebhookRepository in memory
+type MemoryWebhookRepository struct {
+	m *memoryDB
+}
+
+func copyWebhook(webhook *Webhook) *Webhook {
+	copied := *webhook
+	copied.EventTypes = append([]string(nil), webhook.EventTypes...)
+	return &copied
+}
+
+func (r *MemoryWebhookRepository) Create(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	now := time.Now().UTC()
+	stored := copyWebhook(webhook)
+	stored.ID = r.m.nextID()
+	stored.CreatedAt = now
+	stored.UpdatedAt = now
+	r.m.webhooks[stored.ID] = stored
+
+	return copyWebhook(stored), nil
+}
+
+func (r *MemoryWebhookRepository) GetByID(ctx context.Context, workspaceID, id int64) (*Webhook, error) {
+	webhook, err := r.GetForDelivery(ctx, id)
+	if err == nil && webhook.WorkspaceID != workspaceID {
+		return nil, fmt.Errorf("failed to get webhook by ID: %w", sql.ErrNoRows)
+	}
+	return webhook, err
+}
+
+func (r *MemoryWebhookRepository) GetForDelivery(ctx context.Context, id int64) (*Webhook, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	webhook, ok := r.m.webhooks[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get webhook by ID: %w", sql.ErrNoRows)
+	}
+	return copyWebhook(webhook), nil
+}
+
+func (r *MemoryWebhookRepository) GetAll(ctx context.Context, workspaceID int64) ([]Webhook, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	for _, webhook := range r.m.webhooks {
+		if webhook.WorkspaceID == workspaceID {
+			webhooks = append(webhooks, *copyWebhook(webhook))
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID > webhooks[j].ID })
+
+	return webhooks, nil
+}
+
+// GetActiveForEvent returns the active webhooks of a workspace subscribed to
+// eventType
+func (r *MemoryWebhookRepository) GetActiveForEvent(ctx context.Context, workspaceID int64, eventType string) ([]Webhook, error) {
+	webhooks, err := r.GetAll(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterWebhooksForEvent(webhooks, eventType), nil
+}
+
+func (r *MemoryWebhookRepository) Update(ctx context.Context, webhook *Webhook) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored, ok := r.m.webhooks[webhook.ID]
+	if !ok || stored.WorkspaceID != webhook.WorkspaceID {
+		return nil
+	}
+
+	updated := copyWebhook(webhook)
+	updated.CreatedAt = stored.CreatedAt
+	updated.UpdatedAt = time.Now().UTC()
+	r.m.webhooks[webhook.ID] = updated
+
+	return nil
+}
+
+func (r *MemoryWebhookRepository) Delete(ctx context.Context, workspaceID, id int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if webhook, ok := r.m.webhooks[id]; !ok || webhook.WorkspaceID != workspaceID {
+		return nil
+	}
+	delete(r.m.webhooks, id)
+	for deliveryID, delivery := range r.m.deliveries {
+		if delivery.WebhookID == id {
+			delete(r.m.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+// CreateDelivery queues a pending delivery that is due immediately
+func (r *MemoryWebhookRepository) CreateDelivery(ctx context.Context, webhookID int64, eventType, payload string) (*WebhookDelivery, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{
+		ID:            r.m.nextID(),
+		WebhookID:     webhookID,
+		EventType:     eventType,
+		Payload:       payload,
+		Status:        "pending",
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	r.m.deliveries[delivery.ID] = delivery
+
+	copied := *delivery
+	return &copied, nil
+}
+
+func (r *MemoryWebhookRepository) GetDeliveryByID(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	delivery, ok := r.m.deliveries[id]
+	if !ok || delivery.WebhookID != webhookID {
+		return nil, fmt.Errorf("failed to get webhook delivery by ID: %w", sql.ErrNoRows)
+	}
+
+	copied := *delivery
+	return &copied, nil
+}
+
+// queryDeliveries returns up to limit deliveries matching keep, ordered by less
+func (r *MemoryWebhookRepository) queryDeliveries(keep func(*WebhookDelivery) bool, less func(a, b *WebhookDelivery) bool, limit int) []WebhookDelivery {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range r.m.deliveries {
+		if keep(delivery) {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return less(&deliveries[i], &deliveries[j]) })
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
+
+// GetDeliveries returns the most recent deliveries of a webhook
+func (r *MemoryWebhookRepository) GetDeliveries(ctx context.Context, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	return r.queryDeliveries(
+		func(d *WebhookDelivery) bool { return d.WebhookID == webhookID },
+		func(a, b *WebhookDelivery) bool { return a.ID > b.ID },
+		limit,
+	), nil
+}
+
+// ClaimDueDeliveries claims up to limit pending deliveries whose next attempt
+// is due and that no one else has claimed, until lockedUntil
+func (r *MemoryWebhookRepository) ClaimDueDeliveries(ctx context.Context, limit int, now, lockedUntil time.Time) ([]WebhookDelivery, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	due := []*WebhookDelivery{}
+	for _, delivery := range r.m.deliveries {
+		if deliveryClaimable(delivery, now) && delivery.NextAttemptAt != nil && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]WebhookDelivery, 0, len(due))
+	for _, delivery := range due {
+		until := lockedUntil
+		delivery.LockedUntil = &until
+		claimed = append(claimed, *delivery)
+	}
+	return claimed, nil
+}
+
+// ClaimDelivery claims a pending delivery until lockedUntil, unless someone
+// else holds a claim on it
+func (r *MemoryWebhookRepository) ClaimDelivery(ctx context.Context, id int64, now, lockedUntil time.Time) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delivery, ok := r.m.deliveries[id]
+	if !ok || !deliveryClaimable(delivery, now) {
+		return false, nil
+	}
+	delivery.LockedUntil = &lockedUntil
+	return true, nil
+}
+
+// deliveryClaimable reports whether delivery is pending and unclaimed at now
+func deliveryClaimable(delivery *WebhookDelivery, now time.Time) bool {
+	return delivery.Status == "pending" && (delivery.LockedUntil == nil || !delivery.LockedUntil.After(now))
+}
+
+// UpdateDelivery stores the outcome of a delivery attempt and releases its
+// claim
+func (r *MemoryWebhookRepository) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.deliveries[delivery.ID]; !ok {
+		return nil
+	}
+
+	updated := *delivery
+	updated.LockedUntil = nil
+	updated.UpdatedAt = time.Now().UTC()
+	r.m.deliveries[delivery.ID] = &updated
+
+	return nil
+}
+
+// MemoryStatsRepository implements StatsRepository in memory
+type MemoryStatsRepository struct {
+	m *memoryDB
+}
+
+func (r *MemoryStatsRepository) Get(ctx context.Context, opts StatsOptions) (*Stats, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	stats := newStats(opts)
+	var durations []float64
+	failures := map[string]int64{}
+	for _, url := range r.m.urls {
+		if url.WorkspaceID != opts.WorkspaceID {
+			continue
+		}
+		stats.StatusCounts[url.Status]++
+
+		finished := url.CompletedAt != nil && !url.CompletedAt.Before(opts.From) && url.CompletedAt.Before(opts.To)
+		if !finished || (url.Status != "completed" && url.Status != "failed") {
+			continue
+		}
+		if entry := stats.day(url.CompletedAt.UTC().Format("2006-01-02")); entry != nil {
+			if url.Status == "completed" {
+				entry.Completed++
+			} else {
+				entry.Failed++
+			}
+		}
+		if url.Status == "completed" && url.StartedAt != nil && !url.StartedAt.After(*url.CompletedAt) {
+			durations = append(durations, url.CompletedAt.Sub(*url.StartedAt).Seconds())
+		}
+		if url.Status == "failed" && url.ErrorMessage != nil {
+			failures[*url.ErrorMessage]++
+		}
+	}
+
+	stats.CrawlDuration.Count = int64(len(durations))
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		total := 0.0
+		for _, seconds := range durations {
+			total += seconds
+		}
+		average := total / float64(len(durations))
+		stats.CrawlDuration.AverageSeconds = &average
+		for _, p := range statsPercentiles {
+			stats.CrawlDuration.setPercentile(p, durations[percentileRank(stats.CrawlDuration.Count, p)-1])
+		}
+	}
+	stats.TopFailures = topFailures(failures)
+
+	domains := map[string]*DomainBrokenLinks{}
+	for _, analysis := range r.m.analyses {
+		url, ok := r.m.urls[analysis.URLID]
+		if !ok || url.WorkspaceID != opts.WorkspaceID {
+			continue
+		}
+
+		stats.TotalBrokenLinks += int64(analysis.BrokenLinksCount)
+		stats.LoginForms.Analyzed++
+		if analysis.HasLoginForm {
+			stats.LoginForms.WithLoginForm++
+		}
+
+		parsed, err := neturl.Parse(url.URL)
+		if err != nil {
+			continue
+		}
+		domain, ok := domains[parsed.Hostname()]
+		if !ok {
+			domain = &DomainBrokenLinks{Domain: parsed.Hostname()}
+			domains[domain.Domain] = domain
+		}
+		domain.BrokenLinks += int64(analysis.BrokenLinksCount)
+		domain.URLs++
+	}
+	for _, domain := range domains {
+		if domain.BrokenLinks > 0 {
+			stats.TopBrokenDomains = append(stats.TopBrokenDomains, *domain)
+		}
+	}
+	sort.Slice(stats.TopBrokenDomains, func(i, j int) bool {
+		a, b := stats.TopBrokenDomains[i], stats.TopBrokenDomains[j]
+		if a.BrokenLinks != b.BrokenLinks {
+			return a.BrokenLinks > b.BrokenLinks
+		}
+		return a.Domain < b.Domain
+	})
+	if len(stats.TopBrokenDomains) > statsTopLimit {
+		stats.TopBrokenDomains = stats.TopBrokenDomains[:statsTopLimit]
+	}
+
+	stats.finish()
+	return stats, nil
+}
+
+// MemoryWorkspaceRepository implements WorkspaceRepository in memory
+type MemoryWorkspaceRepository struct {
+	m *memoryDB
+}
+
+func (r *MemoryWorkspaceRepository) Create(ctx context.Context, name string) (*Workspace, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	now := time.Now().UTC()
+	workspace := &Workspace{ID: r.m.nextID(), Name: name, CreatedAt: now, UpdatedAt: now}
+	r.m.workspaces[workspace.ID] = workspace
+
+	copied := *workspace
+	return &copied, nil
+}
+
+func (r *MemoryWorkspaceRepository) GetByID(ctx context.Context, id int64) (*Workspace, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	workspace, ok := r.m.workspaces[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get workspace by ID: %w", sql.ErrNoRows)
+	}
+	copied := *workspace
+	return &copied, nil
+}
+
+// Lock does nothing, a memory unit of work holds the whole store already
+func (r *MemoryWorkspaceRepository) Lock(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (r *MemoryWorkspaceRepository) GetForUser(ctx context.Context, userID int64) ([]Workspace, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	workspaces := []Workspace{}
+	for _, member := range r.m.members {
+		if workspace, ok := r.m.workspaces[member.WorkspaceID]; ok && member.UserID == userID {
+			copied := *workspace
+			copied.Role = member.Role
+			workspaces = append(workspaces, copied)
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].ID < workspaces[j].ID })
+
+	return workspaces, nil
+}
+
+// member returns a membership with the user's details filled in; callers hold mu
+func (r *MemoryWorkspaceRepository) member(stored WorkspaceMember) WorkspaceMember {
+	if user, ok := r.m.users[stored.UserID]; ok {
+		stored.Username = user.Username
+		stored.Email = user.Email
+	}
+	return stored
+}
+
+func (r *MemoryWorkspaceRepository) GetMember(ctx context.Context, workspaceID, userID int64) (*WorkspaceMember, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, member := range r.m.members {
+		if member.WorkspaceID == workspaceID && member.UserID == userID {
+			found := r.member(member)
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get workspace member: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryWorkspaceRepository) GetMembers(ctx context.Context, workspaceID int64) ([]WorkspaceMember, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	members := []WorkspaceMember{}
+	for _, member := range r.m.members {
+		if member.WorkspaceID == workspaceID {
+			members = append(members, r.member(member))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+
+	return members, nil
+}
+
+func (r *MemoryWorkspaceRepository) AddMember(ctx context.Context, workspaceID, userID int64, role string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, member := range r.m.members {
+		if member.WorkspaceID == workspaceID && member.UserID == userID {
+			return ErrAlreadyMember
+		}
+	}
+
+	now := time.Now().UTC()
+	r.m.members = append(r.m.members, WorkspaceMember{WorkspaceID: workspaceID, UserID: userID, Role: role, CreatedAt: now, UpdatedAt: now})
+	return nil
+}
+
+func (r *MemoryWorkspaceRepository) UpdateMemberRole(ctx context.Context, workspaceID, userID int64, role string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.members {
+		if member := &r.m.members[i]; member.WorkspaceID == workspaceID && member.UserID == userID {
+			member.Role = role
+			member.UpdatedAt = time.Now().UTC()
+		}
+	}
+	return nil
+}
+
+func (r *MemoryWorkspaceRepository) RemoveMember(ctx context.Context, workspaceID, userID int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	members := r.m.members[:0]
+	for _, member := range r.m.members {
+		if member.WorkspaceID != workspaceID || member.UserID != userID {
+			members = append(members, member)
+		}
+	}
+	r.m.members = members
+	return nil
+}
+
+func (r *MemoryWorkspaceRepository) CreateInvitation(ctx context.Context, invitation *WorkspaceInvitation) (*WorkspaceInvitation, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored := *invitation
+	stored.ID = r.m.nextID()
+	stored.ExpiresAt = invitation.ExpiresAt.UTC()
+	stored.CreatedAt = time.Now().UTC()
+	r.m.invitations[stored.ID] = &stored
+
+	copied := stored
+	return &copied, nil
+}
+
+func (r *MemoryWorkspaceRepository) GetInvitations(ctx context.Context, workspaceID int64) ([]WorkspaceInvitation, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	invitations := []WorkspaceInvitation{}
+	for _, invitation := range r.m.invitations {
+		if invitation.WorkspaceID == workspaceID && invitation.AcceptedAt == nil {
+			invitations = append(invitations, *invitation)
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].ID > invitations[j].ID })
+
+	return invitations, nil
+}
+
+func (r *MemoryWorkspaceRepository) DeleteInvitation(ctx context.Context, workspaceID, id int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if invitation, ok := r.m.invitations[id]; ok && invitation.WorkspaceID == workspaceID {
+		delete(r.m.invitations, id)
+	}
+	return nil
+}
+
+func (r *MemoryWorkspaceRepository) ConsumeInvitation(ctx context.Context, tokenHash string, userID int64, now time.Time) (*WorkspaceInvitation, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, invitation := range r.m.invitations {
+		if invitation.TokenHash == tokenHash && invitation.AcceptedAt == nil && now.Before(invitation.ExpiresAt) {
+			acceptedAt := now.UTC()
+			invitation.AcceptedAt = &acceptedAt
+			invitation.AcceptedBy = &userID
+			copied := *invitation
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to consume workspace invitation: %w", sql.ErrNoRows)
+}
+
+// MemoryAPIKeyRepository implements APIKeyRepository in memory
+type MemoryAPIKeyRepository struct {
+	m *memoryDB
+}
+
+func copyAPIKey(key *APIKey) *APIKey {
+	copied := *key
+	copied.Scopes = append([]string(nil), key.Scopes...)
+	return &copied
+}
+
+func (r *MemoryAPIKeyRepository) Create(ctx context.Context, key *APIKey) (*APIKey, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored := copyAPIKey(key)
+	stored.ID = r.m.nextID()
+	stored.CreatedAt = time.Now().UTC()
+	r.m.apiKeys[stored.ID] = stored
+
+	return copyAPIKey(stored), nil
+}
+
+func (r *MemoryAPIKeyRepository) GetByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	for _, key := range r.m.apiKeys {
+		if key.KeyHash == keyHash {
+			return copyAPIKey(key), nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get API key: %w", sql.ErrNoRows)
+}
+
+func (r *MemoryAPIKeyRepository) GetForUser(ctx context.Context, userID int64) ([]APIKey, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range r.m.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, *copyAPIKey(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+	return keys, nil
+}
+
+func (r *MemoryAPIKeyRepository) Delete(ctx context.Context, userID, id int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if key, ok := r.m.apiKeys[id]; !ok || key.UserID != userID {
+		return fmt.Errorf("failed to delete API key: %w", sql.ErrNoRows)
+	}
+	delete(r.m.apiKeys, id)
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) UpdateLastUsed(ctx context.Context, id int64, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if key, ok := r.m.apiKeys[id]; ok {
+		lastUsedAt := now.UTC()
+		key.LastUsedAt = &lastUsedAt
+	}
+	return nil
+}
+
+// MemoryLoginThrottleRepository implements LoginThrottleRepository in memory
+type MemoryLoginThrottleRepository struct {
+	m *memoryDB
+}
+
+func loginFailureKey(scope, subject string) string {
+	return scope + "\x00" + subject
+}
+
+func (r *MemoryLoginThrottleRepository) GetFailure(ctx context.Context, scope, subject string) (*LoginFailure, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	failure, ok := r.m.loginFailures[loginFailureKey(scope, subject)]
+	if !ok {
+		return nil, fmt.Errorf("failed to get login failures: %w", sql.ErrNoRows)
+	}
+	copied := *failure
+	return &copied, nil
+}
+
+func (r *MemoryLoginThrottleRepository) RecordFailure(ctx context.Context, scope, subject string, now, windowStart time.Time) (*LoginFailure, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	key := loginFailureKey(scope, subject)
+	failure, ok := r.m.loginFailures[key]
+	if !ok {
+		failure = &LoginFailure{Scope: scope, Subject: subject}
+		r.m.loginFailures[key] = failure
+	}
+	if failure.LastFailedAt.Before(windowStart) {
+		failure.Failures = 1
+	} else {
+		failure.Failures++
+	}
+	failure.LastFailedAt = now.UTC()
+
+	copied := *failure
+	return &copied, nil
+}
+
+func (r *MemoryLoginThrottleRepository) Lock(ctx context.Context, failure *LoginFailure, lockedUntil, now time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if stored, ok := r.m.loginFailures[loginFailureKey(failure.Scope, failure.Subject)]; ok {
+		until := lockedUntil.UTC()
+		stored.LockedUntil = &until
+	}
+	r.m.lockouts = append(r.m.lockouts, LoginLockout{
+		ID:          r.m.nextID(),
+		Scope:       failure.Scope,
+		Subject:     failure.Subject,
+		Failures:    failure.Failures,
+		LockedUntil: lockedUntil.UTC(),
+		CreatedAt:   now.UTC(),
+	})
+	return nil
+}
+
+func (r *MemoryLoginThrottleRepository) ClearFailures(ctx context.Context, scope, subject string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delete(r.m.loginFailures, loginFailureKey(scope, subject))
+	return nil
+}
+
+func (r *MemoryLoginThrottleRepository) GetLockouts(ctx context.Context, since time.Time) ([]LoginLockout, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	lockouts := []LoginLockout{}
+	for i := len(r.m.lockouts) - 1; i >= 0; i-- {
+		if !r.m.lockouts[i].CreatedAt.Before(since) {
+			lockouts = append(lockouts, r.m.lockouts[i])
+		}
+	}
+	return lockouts, nil
+}
+
+// MemoryRateLimitRepository keeps token buckets in the process. It is the
+// default even with a SQL database, since limits need not survive restarts;
+// replicas sharing limits use the SQL repository instead.
+type MemoryRateLimitRepository struct {
+	mu      sync.Mutex
+	buckets map[string]rateLimitBucket
+}
+
+func NewMemoryRateLimitRepository() *MemoryRateLimitRepository {
+	return &MemoryRateLimitRepository{buckets: map[string]rateLimitBucket{}}
+}
+
+func (r *MemoryRateLimitRepository) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stored *rateLimitBucket
+	if bucket, ok := r.buckets[key]; ok {
+		stored = &bucket
+	}
+	bucket, result := limit.take(stored, now)
+	r.buckets[key] = bucket
+	return result, nil
+}
+
+func (r *MemoryRateLimitRepository) Prune(ctx context.Context, before time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, bucket := range r.buckets {
+		if bucket.RefilledAt.Before(before) {
+			delete(r.buckets, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "crawler_http_requests_total",
+		Help: "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "crawler_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	crawlerQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "crawler_queue_depth",
+		Help: "URLs waiting in the queued state as of the last queue poll.",
+	})
+
+	crawlerJobsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "crawler_jobs_in_flight",
+		Help: "URLs currently being analyzed by workers.",
+	})
+
+	crawlerAnalysisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "crawler_analysis_duration_seconds",
+		Help:    "Time to analyze a URL, by result.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"result"})
+
+	crawlerFetchErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "crawler_fetch_errors_total",
+		Help: "Page fetch failures, by error class.",
+	}, []string{"class"})
+
+	crawlerLinkChecksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "crawler_link_checks_total",
+		Help: "Link checks performed, by result.",
+	}, []string{"result"})
+)
+
+// registerDBMetrics exposes sql.DB pool statistics
+func registerDBMetrics(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "crawler"))
+}
+
+// metricsMiddleware records request counts and latencies per Gin route.
+// Event streams last as long as their client listens, so they are counted
+// but kept out of the latency histogram.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, status).Inc()
+		if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves the Prometheus exposition format
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// classifyFetchError buckets an HTTP client error into a low cardinality class
+func classifyFetchError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr):
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// classifyHTTPStatus buckets a non-200 page response into an error class
+func classifyHTTPStatus(code int) string {
+	switch {
+	case code >= 500:
+		return "http_5xx"
+	case code >= 400:
+		return "http_4xx"
+	default:
+		return "http_other"
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// authMiddleware validates JWT tokens for protected routes
-func authMiddleware(authService *AuthService) gin.HandlerFunc {
+// authMiddleware authenticates a request by a JWT access token in an
+// "Authorization: Bearer <token>" header or an API key in an
+// "Authorization: ApiKey <key>" header
+func authMiddleware(authService *AuthService, apiKeyService *APIKeyService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -22,22 +33,45 @@ func authMiddleware(authService *AuthService) gin.HandlerFunc {
 			return
 		}
 
-		// Extract token from "Bearer <token>" format
+		// Extract token from "Bearer <token>" or "ApiKey <key>" format
 		tokenParts := strings.Split(authHeader, " ")
-		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		if len(tokenParts) != 2 || (tokenParts[0] != "Bearer" && tokenParts[0] != "ApiKey") {
 			c.JSON(http.StatusUnauthorized, ErrorResponse{
 				Error:   "invalid_token_format",
-				Message: "Token must be in 'Bearer <token>' format",
+				Message: "Token must be in 'Bearer <token>' or 'ApiKey <key>' format",
 				Code:    http.StatusUnauthorized,
 			})
 			c.Abort()
 			return
 		}
 
+		if tokenParts[0] == "ApiKey" {
+			apiKey, user, err := apiKeyService.Authenticate(c.Request.Context(), tokenParts[1])
+			if errors.Is(err, ErrInvalidAPIKey) {
+				c.JSON(http.StatusUnauthorized, ErrorResponse{
+					Error:   "invalid_api_key",
+					Message: "Invalid or expired API key",
+					Code:    http.StatusUnauthorized,
+				})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				respondDatabaseError(c, err, "Failed to check API key")
+				c.Abort()
+				return
+			}
+
+			c.Set("user", user)
+			c.Set("api_key", apiKey)
+			c.Next()
+			return
+		}
+
 		token := tokenParts[1]
 
 		// Validate token
-		user, err := authService.ValidateToken(token)
+		user, err := authService.ValidateToken(c.Request.Context(), token)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, ErrorResponse{
 				Error:   "invalid_token",
@@ -54,6 +88,240 @@ func authMiddleware(authService *AuthService) gin.HandlerFunc {
 	}
 }
 
+// currentAPIKey returns the API key a request was authenticated with, or nil
+// for a login
+func currentAPIKey(c *gin.Context) *APIKey {
+	apiKey, _ := c.Get("api_key")
+	k, _ := apiKey.(*APIKey)
+	return k
+}
+
+// requireSession restricts a route to requests authenticated by a login,
+// for account changes that API keys must not make
+func requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentAPIKey(c) != nil {
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error:   "session_required",
+				Message: "This endpoint cannot be used with an API key",
+				Code:    http.StatusForbidden,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the user authenticated by authMiddleware
+func currentUser(c *gin.Context) *User {
+	user, _ := c.Get("user")
+	u, _ := user.(*User)
+	return u
+}
+
+// requirePermission restricts a route to users whose role grants permission;
+// it runs after authMiddleware. Inside a workspace, the role is the user's
+// membership role there. Requests made with an API key also need the
+// permission among the key's scopes.
+func requirePermission(permission Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		role := c.GetString("workspace_role")
+		if role == "" && user != nil {
+			role = user.Role
+		}
+		if user == nil || !roleCan(role, permission) {
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error:   "forbidden",
+				Message: fmt.Sprintf("The %s permission is required", permission),
+				Code:    http.StatusForbidden,
+			})
+			c.Abort()
+			return
+		}
+		if apiKey := currentAPIKey(c); apiKey != nil && !apiKey.Allows(permission) {
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error:   "forbidden",
+				Message: fmt.Sprintf("The API key lacks the %s scope", permission),
+				Code:    http.StatusForbidden,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// workspaceMiddleware selects the workspace of a request and the user's
+// membership role in it; it runs after authMiddleware. The workspace comes
+// from the :workspaceId route parameter, the X-Workspace-ID header or the
+// workspace_id query parameter, in that order, and defaults to the first
+// workspace the user joined. API keys are limited to their own workspace.
+func workspaceMiddleware(workspaceService *WorkspaceService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := c.Param("workspaceId")
+		if requested == "" {
+			requested = c.GetHeader("X-Workspace-ID")
+		}
+		if requested == "" {
+			requested = c.Query("workspace_id")
+		}
+
+		var workspaceID int64
+		if requested != "" {
+			id, err := strconv.ParseInt(requested, 10, 64)
+			if err != nil || id < 1 {
+				c.JSON(http.StatusBadRequest, ErrorResponse{
+					Error:   "validation_error",
+					Message: "Invalid workspace ID",
+					Code:    http.StatusBadRequest,
+				})
+				c.Abort()
+				return
+			}
+			workspaceID = id
+		}
+
+		user := currentUser(c)
+		if user == nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if apiKey := currentAPIKey(c); apiKey != nil {
+			if workspaceID != 0 && workspaceID != apiKey.WorkspaceID {
+				c.JSON(http.StatusForbidden, ErrorResponse{
+					Error:   "forbidden",
+					Message: "The API key belongs to another workspace",
+					Code:    http.StatusForbidden,
+				})
+				c.Abort()
+				return
+			}
+			workspaceID = apiKey.WorkspaceID
+		}
+		workspace, err := workspaceService.Resolve(c.Request.Context(), user.ID, workspaceID)
+		if errors.Is(err, ErrNoWorkspace) {
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error:   "no_workspace",
+				Message: "You are not a member of any workspace",
+				Code:    http.StatusForbidden,
+			})
+			c.Abort()
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			// Workspaces the user is not a member of are reported as missing
+			respondLookupError(c, err, "Workspace not found")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			respondDatabaseError(c, err, "Failed to load workspace")
+			c.Abort()
+			return
+		}
+
+		c.Set("workspace", workspace)
+		c.Set("workspace_role", workspace.Role)
+		c.Next()
+	}
+}
+
+// currentWorkspaceID returns the ID of the workspace selected by
+// workspaceMiddleware
+func currentWorkspaceID(c *gin.Context) int64 {
+	workspace, _ := c.Get("workspace")
+	if w, ok := workspace.(*Workspace); ok {
+		return w.ID
+	}
+	return 0
+}
+
+// streamAuthMiddleware authenticates the event stream with a ticket query
+// parameter from POST /api/events/ticket, for clients that cannot set
+// headers such as the browser EventSource API, and with authMiddleware
+// otherwise
+func streamAuthMiddleware(authService *AuthService, apiKeyService *APIKeyService) gin.HandlerFunc {
+	headerAuth := authMiddleware(authService, apiKeyService)
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" {
+			headerAuth(c)
+			return
+		}
+
+		user, err := authService.RedeemStreamTicket(c.Request.Context(), ticket)
+		if errors.Is(err, ErrInvalidStreamTicket) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{
+				Error:   "invalid_ticket",
+				Message: "Stream ticket is invalid, used or expired",
+				Code:    http.StatusUnauthorized,
+			})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			respondDatabaseError(c, err, "Failed to check stream ticket")
+			c.Abort()
+			return
+		}
+
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// rateLimitMiddleware limits the requests of each client to a route group.
+// Clients are the API key or user a request was authenticated with, so it runs
+// after authMiddleware on protected routes, or the client IP otherwise.
+// Responses carry RateLimit-* headers for the group's bucket, and refused
+// requests get 429 with Retry-After. When the bucket store fails, requests are
+// let through rather than failing the API.
+func rateLimitMiddleware(limiter *RateLimiter, group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := "ip:" + c.ClientIP()
+		if apiKey := currentAPIKey(c); apiKey != nil {
+			client = "api_key:" + strconv.FormatInt(apiKey.ID, 10)
+		} else if user := currentUser(c); user != nil {
+			client = "user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		limit, result, ok, err := limiter.Take(c.Request.Context(), group, client)
+		if err != nil {
+			loggerFromContext(c.Request.Context()).Error("Failed to check rate limit", "group", group, "error", err)
+			c.Next()
+			return
+		}
+		if !ok {
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(result.Reset))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limit.Limit, ceilSeconds(limit.Window)))
+
+		if !result.Allowed {
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			c.JSON(http.StatusTooManyRequests, ErrorResponse{
+				Error:   "rate_limited",
+				Message: "Too many requests, try again later",
+				Code:    http.StatusTooManyRequests,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ceilSeconds formats d as whole seconds, rounded up, for headers
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
 // corsMiddleware handles CORS headers
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -61,7 +329,8 @@ func corsMiddleware() gin.HandlerFunc {
 		
 		c.Header("Access-Control-Allow-Origin", origin)
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Request-ID, X-Workspace-ID")
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
 		c.Header("Access-Control-Allow-Credentials", "true")
 
 		// Handle preflight requests
@@ -74,34 +343,74 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-// loggingMiddleware logs HTTP requests
+// requestIDMiddleware assigns every request a correlation ID, reusing a valid
+// incoming X-Request-ID, and attaches a logger carrying it to the request context
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newCorrelationID()
+		}
+
+		c.Set("request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+			logger = logger.With("trace_id", spanContext.TraceID().String())
+		}
+		c.Request = c.Request.WithContext(withLogger(c.Request.Context(), logger))
+
+		c.Next()
+	}
+}
+
+// loggingMiddleware logs HTTP requests, including errors attached by handlers
 func loggingMiddleware() gin.HandlerFunc {
-	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		// Custom log format
-		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-			param.ClientIP,
-			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-			param.Method,
-			param.Path,
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.Request.UserAgent(),
-			param.ErrorMessage,
-		)
-	})
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("user_agent", c.Request.UserAgent()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+
+		loggerFromContext(c.Request.Context()).LogAttrs(c.Request.Context(), level, "http request", attrs...)
+	}
 }
 
-// errorMiddleware handles panics and errors
+// errorMiddleware handles panics and errors. Gin's own panic output is
+// discarded in favour of a structured log entry.
 func errorMiddleware() gin.HandlerFunc {
-	return gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
-		if _, ok := recovered.(string); ok {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Error:   "internal_error",
-				Message: "An internal error occurred",
-				Code:    http.StatusInternalServerError,
-			})
-		}
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered interface{}) {
+		loggerFromContext(c.Request.Context()).Error("panic recovered",
+			"panic", fmt.Sprint(recovered),
+			"stack", string(debug.Stack()),
+		)
+
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "internal_error",
+			Message: "An internal error occurred",
+			Code:    http.StatusInternalServerError,
+		})
 		c.Abort()
 	})
-} 
\ No newline at end of file
+}
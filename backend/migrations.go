@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// migrationFiles holds one directory of migrations per SQL dialect
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationFilename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change with its up and down SQL
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// UpFunc, when set, runs after the up SQL for changes SQL cannot make
+	UpFunc migrationFunc
+}
+
+// migrationFunc is the Go part of a migration. It runs in the transaction
+// that records the migration.
+type migrationFunc func(ctx context.Context, db queryer, logger *slog.Logger) error
+
+// migrationFuncs holds the Go parts of migrations by dialect and version
+var migrationFuncs = map[string]map[int64]migrationFunc{
+	"mysql": {2: canonicalizeURLs},
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+	// Dirty is set when the migration failed partway on a database that
+	// cannot roll back schema changes
+	Dirty bool
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Name      string
+	AppliedAt time.Time
+	Dirty     bool
+}
+
+// loadMigrations reads NNNN_name.up.sql / NNNN_name.down.sql pairs from dir
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := migrationFilename.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		contents, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// splitStatements splits a migration script into single statements. Lines
+// starting with -- are comments; statements end with a semicolon at the end
+// of a line, except inside a trigger body between a line ending in BEGIN and
+// a line reading END;.
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	inBody := false
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		upper := strings.ToUpper(trimmed)
+		if strings.HasSuffix(upper, "BEGIN") {
+			inBody = true
+		} else if upper == "END;" {
+			inBody = false
+		}
+
+		if !inBody && strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Migrator applies the embedded migrations and records them in schema_migrations
+type Migrator struct {
+	db         *sql.DB
+	dialect    *sqlDialect
+	migrations []Migration
+	logger     *slog.Logger
+}
+
+func NewMigrator(db *sql.DB, dialect *sqlDialect) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", dialect.name))
+	if err != nil {
+		return nil, err
+	}
+	for i := range migrations {
+		migrations[i].UpFunc = migrationFuncs[dialect.name][migrations[i].Version]
+	}
+
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+		logger:     slog.Default().With("component", "migrations"),
+	}, nil
+}
+
+// dirtyMigrationMessage explains how to recover from a migration that failed
+// partway through
+const dirtyMigrationMessage = "migration %d_%s failed partway and left the schema half changed; " +
+	"repair the schema by hand, then delete its schema_migrations row to run it again " +
+	"or set its dirty column to false if it completed"
+
+// withLock runs fn on a single connection holding the migration lock, so
+// replicas starting together do not apply the same migration twice
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	unlock, err := m.dialect.lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		dirty BOOLEAN NOT NULL DEFAULT FALSE
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at, dirty FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var version int64
+		var migration appliedMigration
+		if err := rows.Scan(&version, &migration.Name, &migration.AppliedAt, &migration.Dirty); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		applied[version] = migration
+	}
+	return applied, rows.Err()
+}
+
+// checkClean refuses to migrate a database a failed migration left dirty
+func checkClean(applied map[int64]appliedMigration) error {
+	for version, migration := range applied {
+		if migration.Dirty {
+			return fmt.Errorf(dirtyMigrationMessage, version, migration.Name)
+		}
+	}
+	return nil
+}
+
+func execScript(ctx context.Context, db queryer, script string) error {
+	for _, statement := range splitStatements(script) {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply runs script, then fn when set, then record, which updates
+// schema_migrations. Where the database can roll back schema changes they run
+// in one transaction, so a failed migration leaves the database unchanged.
+// MySQL commits every schema change as it runs, so there the script runs
+// first, between mark and record: mark flags the migration dirty and record
+// clears the flag once fn succeeded.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, fn migrationFunc, mark, record func(db queryer) error) error {
+	if !m.dialect.transactionalDDL {
+		if err := mark(conn); err != nil {
+			return err
+		}
+		if err := execScript(ctx, conn, script); err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if m.dialect.transactionalDDL {
+		if err := execScript(ctx, tx, script); err != nil {
+			return err
+		}
+	}
+	if fn != nil {
+		if err := fn(ctx, tx, m.logger); err != nil {
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Up applies every pending migration in version order and returns them
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkClean(done); err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+
+			m.logger.Info("Applying migration", "version", migration.Version, "name", migration.Name)
+			mark := func(db queryer) error {
+				if _, err := db.ExecContext(ctx, m.dialect.rebind(`INSERT INTO schema_migrations (version, name, dirty) VALUES (?, ?, TRUE)`),
+					migration.Version, migration.Name); err != nil {
+					return fmt.Errorf("failed to mark migration %d dirty: %w", migration.Version, err)
+				}
+				return nil
+			}
+			record := func(db queryer) error {
+				query := `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`
+				if !m.dialect.transactionalDDL {
+					query = `UPDATE schema_migrations SET dirty = FALSE, applied_at = CURRENT_TIMESTAMP WHERE version = ? AND name = ?`
+				}
+				if _, err := db.ExecContext(ctx, m.dialect.rebind(query), migration.Version, migration.Name); err != nil {
+					return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+				}
+				return nil
+			}
+			if err := m.apply(ctx, conn, migration.Up, migration.UpFunc, mark, record); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the most recently applied migrations, up to steps of them
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkClean(done); err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s cannot be reverted", migration.Version, migration.Name)
+			}
+
+			m.logger.Info("Reverting migration", "version", migration.Version, "name", migration.Name)
+			mark := func(db queryer) error {
+				if _, err := db.ExecContext(ctx, m.dialect.rebind(`UPDATE schema_migrations SET dirty = TRUE WHERE version = ?`), migration.Version); err != nil {
+					return fmt.Errorf("failed to mark migration %d dirty: %w", migration.Version, err)
+				}
+				return nil
+			}
+			record := func(db queryer) error {
+				if _, err := db.ExecContext(ctx, m.dialect.rebind(`DELETE FROM schema_migrations WHERE version = ?`), migration.Version); err != nil {
+					return fmt.Errorf("failed to unrecord migration %d: %w", migration.Version, err)
+				}
+				return nil
+			}
+			if err := m.apply(ctx, conn, migration.Down, nil, mark, record); err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+			if applied, ok := done[migration.Version]; ok {
+				status.AppliedAt = &applied.AppliedAt
+				status.Dirty = applied.Dirty
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// canonicalizeURLs rewrites the URLs stored before canonicalization into
+// their canonical form and hashes them again. When several URLs share a
+// canonical form only one of them, preferably one stored canonical already,
+// is rewritten; the others and URLs that cannot be canonicalized are kept as
+// they are and logged.
+func canonicalizeURLs(ctx context.Context, db queryer, logger *slog.Logger) error {
+	type storedURL struct {
+		id  int64
+		url string
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, url FROM urls ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to read URLs: %w", err)
+	}
+	defer rows.Close()
+
+	canonicalizer := NewURLCanonicalizer()
+	var order []string
+	byCanonical := map[string][]storedURL{}
+	for rows.Next() {
+		var stored storedURL
+		if err := rows.Scan(&stored.id, &stored.url); err != nil {
+			return fmt.Errorf("failed to scan URL: %w", err)
+		}
+		canonical, err := canonicalizer.Canonicalize(stored.url)
+		if err != nil {
+			logger.Warn("Keeping URL that cannot be canonicalized", "url_id", stored.id, "url", stored.url, "error", err)
+			continue
+		}
+		if _, ok := byCanonical[canonical]; !ok {
+			order = append(order, canonical)
+		}
+		byCanonical[canonical] = append(byCanonical[canonical], stored)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read URLs: %w", err)
+	}
+	rows.Close()
+
+	rewritten, collisions := 0, 0
+	for _, canonical := range order {
+		urls := byCanonical[canonical]
+		kept := 0
+		for i, stored := range urls {
+			if stored.url == canonical {
+				kept = i
+				break
+			}
+		}
+
+		if urls[kept].url != canonical {
+			if _, err := db.ExecContext(ctx, `UPDATE urls SET url = ?, url_hash = ? WHERE id = ?`,
+				canonical, URLHash(canonical), urls[kept].id); err != nil {
+				return fmt.Errorf("failed to canonicalize URL %d: %w", urls[kept].id, err)
+			}
+			rewritten++
+		}
+		for i, stored := range urls {
+			if i == kept {
+				continue
+			}
+			collisions++
+			logger.Warn("Keeping URL whose canonical form is stored already", "url_id", stored.id, "url", stored.url,
+				"canonical_url", canonical, "canonical_url_id", urls[kept].id)
+		}
+	}
+
+	logger.Info("Canonicalized URLs", "rewritten", rewritten, "collisions", collisions)
+	return nil
+}
+
+// runMigrateCommand implements `migrate up|down [steps]|status`
+func runMigrateCommand(ctx context.Context, store *Store, args []string) error {
+	if store.DB == nil {
+		return fmt.Errorf("the in-memory store has no migrations")
+	}
+
+	migrator, err := NewMigrator(store.DB, store.Dialect)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		fmt.Printf("Applied %d migration(s)\n", len(applied))
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		fmt.Printf("Reverted %d migration(s)\n", len(reverted))
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Dirty {
+				appliedAt = "dirty"
+			} else if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS external_links;
+DROP TABLE IF EXISTS internal_links;
+DROP TABLE IF EXISTS broken_links;
+DROP TABLE IF EXISTS analysis_results;
+DROP TABLE IF EXISTS urls;
@@ -1,7 +1,5 @@
--- Database schema for Website Crawler application
-
-CREATE DATABASE IF NOT EXISTS crawler_db;
-USE crawler_db;
+-- Initial schema, matching the original database/schema.sql so databases
+-- created by it are adopted without changes
 
 -- URLs table to store websites to be crawled
 CREATE TABLE IF NOT EXISTS urls (
@@ -15,6 +13,7 @@ CREATE TABLE IF NOT EXISTS urls (
     error_message TEXT NULL,
     INDEX idx_status (status),
     INDEX idx_created_at (created_at),
+    INDEX idx_urls_status_created (status, created_at),
     UNIQUE KEY unique_url (url(255))
 );
 
@@ -84,11 +83,6 @@ CREATE TABLE IF NOT EXISTS users (
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 
--- Insert default user for testing
-INSERT INTO users (username, password_hash) VALUES 
-('admin', '$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi'); -- password: password
-
--- Create indexes for better performance
-CREATE INDEX idx_urls_status_created ON urls(status, created_at);
-CREATE INDEX idx_analysis_url_id ON analysis_results(url_id);
-CREATE INDEX idx_broken_links_url_id ON broken_links(url_id); 
\ No newline at end of file
+-- Insert default user for testing, password: password
+INSERT IGNORE INTO users (username, password_hash) VALUES
+('admin', '$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi');
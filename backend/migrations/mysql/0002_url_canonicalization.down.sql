@@ -0,0 +1,7 @@
+UPDATE urls SET url = original_url;
+
+ALTER TABLE urls
+    DROP INDEX unique_url_hash,
+    DROP COLUMN url_hash,
+    DROP COLUMN original_url,
+    ADD UNIQUE KEY unique_url (url(255));
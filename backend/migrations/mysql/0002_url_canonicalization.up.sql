@@ -0,0 +1,15 @@
+-- url now holds the canonical form, original_url the user's input and
+-- url_hash the SHA-256 of url, which enforces uniqueness. The hash of the
+-- stored URL is a placeholder: the Go part of this migration rewrites url
+-- and url_hash into the canonical form afterwards.
+ALTER TABLE urls
+    ADD COLUMN original_url VARCHAR(2048) NULL AFTER url,
+    ADD COLUMN url_hash CHAR(64) NULL AFTER original_url;
+
+UPDATE urls SET original_url = url, url_hash = SHA2(url, 256);
+
+ALTER TABLE urls
+    MODIFY original_url VARCHAR(2048) NOT NULL,
+    MODIFY url_hash CHAR(64) NOT NULL,
+    DROP INDEX unique_url,
+    ADD UNIQUE KEY unique_url_hash (url_hash);
@@ -0,0 +1,29 @@
+-- Webhook subscriptions; event_types is a comma separated list
+CREATE TABLE webhooks (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(255) NOT NULL,
+    active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Webhook delivery log and retry queue
+CREATE TABLE webhook_deliveries (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id BIGINT NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    status ENUM('pending', 'succeeded', 'failed') DEFAULT 'pending',
+    attempts INT DEFAULT 0,
+    next_attempt_at TIMESTAMP NULL,
+    response_status INT NULL,
+    error_message TEXT NULL,
+    delivered_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE,
+    INDEX idx_webhook_id (webhook_id),
+    INDEX idx_status_next_attempt (status, next_attempt_at)
+);
@@ -0,0 +1,2 @@
+-- W3C trace context of the request that last queued the URL
+ALTER TABLE urls ADD COLUMN trace_parent VARCHAR(55) NULL AFTER error_message;
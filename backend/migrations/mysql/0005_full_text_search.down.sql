@@ -0,0 +1,8 @@
+ALTER TABLE analysis_results DROP INDEX ft_analysis_results_content;
+ALTER TABLE urls DROP INDEX ft_urls_url;
+
+ALTER TABLE analysis_results
+    DROP COLUMN extracted_text,
+    DROP COLUMN meta_description;
+
+ALTER TABLE analysis_results DROP INDEX unique_analysis_results_url_id;
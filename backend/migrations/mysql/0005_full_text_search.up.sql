@@ -0,0 +1,15 @@
+-- Reruns used to add an analysis per run; keep the latest so a URL joins
+-- exactly one analysis
+DELETE older FROM analysis_results older
+JOIN analysis_results newer ON newer.url_id = older.url_id AND newer.id > older.id;
+
+ALTER TABLE analysis_results ADD UNIQUE KEY unique_analysis_results_url_id (url_id);
+
+-- Page content used by search: the meta description and the visible text
+ALTER TABLE analysis_results
+    ADD COLUMN meta_description TEXT NULL AFTER page_title,
+    ADD COLUMN extracted_text MEDIUMTEXT NULL AFTER meta_description;
+
+-- Full-text indexes queried in boolean mode by URL search
+ALTER TABLE urls ADD FULLTEXT INDEX ft_urls_url (url);
+ALTER TABLE analysis_results ADD FULLTEXT INDEX ft_analysis_results_content (page_title, meta_description, extracted_text);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS password_reset_tokens;
+
+ALTER TABLE users
+    DROP COLUMN disabled,
+    DROP COLUMN is_admin,
+    DROP COLUMN email;
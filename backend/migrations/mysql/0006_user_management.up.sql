@@ -0,0 +1,19 @@
+-- Account details managed by admins; the seeded admin user keeps admin rights
+ALTER TABLE users
+    ADD COLUMN email VARCHAR(255) NULL AFTER username,
+    ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE AFTER password_hash,
+    ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE AFTER is_admin;
+
+UPDATE users SET is_admin = TRUE WHERE username = 'admin';
+
+-- One-time password reset tokens, stored as SHA-256 hashes
+CREATE TABLE password_reset_tokens (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_password_reset_tokens_user_id (user_id)
+);
@@ -0,0 +1,14 @@
+-- Fails if the same URL was added to more than one workspace
+ALTER TABLE webhooks
+    DROP FOREIGN KEY fk_webhooks_workspace,
+    DROP COLUMN workspace_id;
+
+ALTER TABLE urls
+    ADD UNIQUE KEY unique_url_hash (url_hash),
+    DROP FOREIGN KEY fk_urls_workspace,
+    DROP INDEX unique_workspace_url_hash,
+    DROP COLUMN workspace_id;
+
+DROP TABLE workspace_invitations;
+DROP TABLE workspace_members;
+DROP TABLE workspaces;
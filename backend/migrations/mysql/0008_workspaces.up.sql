@@ -0,0 +1,61 @@
+-- Workspaces own URLs and webhooks. Everything that existed before moves to
+-- the first workspace, id 1, with every user as a member in their user role.
+CREATE TABLE workspaces (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+INSERT INTO workspaces (name) VALUES ('Default');
+
+CREATE TABLE workspace_members (
+    workspace_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    role ENUM('admin', 'editor', 'viewer') NOT NULL DEFAULT 'viewer',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, user_id),
+    FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_workspace_members_user_id (user_id)
+);
+
+INSERT INTO workspace_members (workspace_id, user_id, role) SELECT 1, id, role FROM users;
+
+-- One-time invitations to join a workspace, stored as SHA-256 hashes
+CREATE TABLE workspace_invitations (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    workspace_id BIGINT NOT NULL,
+    role ENUM('admin', 'editor', 'viewer') NOT NULL DEFAULT 'viewer',
+    email VARCHAR(255) NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    invited_by BIGINT NULL,
+    expires_at DATETIME NOT NULL,
+    accepted_at DATETIME NULL,
+    accepted_by BIGINT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (accepted_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_workspace_invitations_workspace_id (workspace_id)
+);
+
+-- A URL is unique within its workspace, so teams can add the same URL
+ALTER TABLE urls ADD COLUMN workspace_id BIGINT NULL AFTER id;
+
+UPDATE urls SET workspace_id = 1;
+
+ALTER TABLE urls
+    MODIFY workspace_id BIGINT NOT NULL,
+    ADD CONSTRAINT fk_urls_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    ADD UNIQUE KEY unique_workspace_url_hash (workspace_id, url_hash),
+    DROP INDEX unique_url_hash;
+
+ALTER TABLE webhooks ADD COLUMN workspace_id BIGINT NULL AFTER id;
+
+UPDATE webhooks SET workspace_id = 1;
+
+ALTER TABLE webhooks
+    MODIFY workspace_id BIGINT NOT NULL,
+    ADD CONSTRAINT fk_webhooks_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
@@ -0,0 +1,17 @@
+-- Rotating refresh tokens, stored as SHA-256 hashes. Every login starts a
+-- family; each refresh marks its token used and issues the next one in the
+-- same family. Access tokens carry their family ID, so revoking a family
+-- signs its access tokens out too.
+CREATE TABLE refresh_tokens (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    family_id CHAR(32) NOT NULL,
+    user_id BIGINT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_refresh_tokens_family_id (family_id),
+    INDEX idx_refresh_tokens_user_id (user_id)
+);
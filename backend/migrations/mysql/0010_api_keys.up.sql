@@ -0,0 +1,18 @@
+-- API keys for machine clients, stored as SHA-256 hashes. A key acts for the
+-- user who created it in one workspace, limited to its scopes, a comma
+-- separated list. prefix is the start of the key, shown to tell keys apart.
+CREATE TABLE api_keys (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    workspace_id BIGINT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    expires_at DATETIME NULL,
+    last_used_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    INDEX idx_api_keys_user_id (user_id)
+);
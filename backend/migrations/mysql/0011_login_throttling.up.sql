@@ -0,0 +1,21 @@
+-- Recent failed logins per username and per client IP (scope 'username' or
+-- 'ip'); counts restart once the last failure is older than the window
+CREATE TABLE login_failures (
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failed_at DATETIME NOT NULL,
+    locked_until DATETIME NULL,
+    PRIMARY KEY (scope, subject)
+);
+
+-- Every lockout, for admins to review
+CREATE TABLE login_lockouts (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INT NOT NULL,
+    locked_until DATETIME NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_login_lockouts_created_at (created_at)
+);
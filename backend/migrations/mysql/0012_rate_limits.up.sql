@@ -0,0 +1,8 @@
+-- Token buckets of the API rate limiter, shared by all replicas. refilled_at is
+-- in Unix microseconds, so replicas can compare and swap it exactly.
+CREATE TABLE rate_limit_buckets (
+    bucket_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    tokens DOUBLE NOT NULL,
+    refilled_at BIGINT NOT NULL,
+    INDEX idx_rate_limit_buckets_refilled_at (refilled_at)
+);
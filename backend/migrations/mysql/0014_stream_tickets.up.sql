@@ -0,0 +1,12 @@
+-- Short-lived, single-use tickets that authenticate an event stream, so
+-- browsers need not put their access token in the URL; stored as SHA-256
+-- hashes
+CREATE TABLE stream_tickets (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_stream_tickets_user_id (user_id)
+);
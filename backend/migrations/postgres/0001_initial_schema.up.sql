@@ -0,0 +1,122 @@
+-- PostgreSQL schema, equivalent to MySQL migrations 0001-0004
+
+-- URLs to be crawled; url is the canonical form, original_url the user's
+-- input and url_hash the SHA-256 of url, which enforces uniqueness
+CREATE TABLE IF NOT EXISTS urls (
+    id BIGSERIAL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    original_url VARCHAR(2048) NOT NULL,
+    url_hash CHAR(64) NOT NULL,
+    status VARCHAR(16) DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'completed', 'failed')),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMPTZ NULL,
+    completed_at TIMESTAMPTZ NULL,
+    error_message TEXT NULL,
+    trace_parent VARCHAR(55) NULL,
+    CONSTRAINT unique_url_hash UNIQUE (url_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls (created_at);
+CREATE INDEX IF NOT EXISTS idx_urls_status_created ON urls (status, created_at);
+
+-- Analysis results table
+CREATE TABLE IF NOT EXISTS analysis_results (
+    id BIGSERIAL PRIMARY KEY,
+    url_id BIGINT NOT NULL REFERENCES urls(id) ON DELETE CASCADE,
+    html_version VARCHAR(10) NULL,
+    page_title VARCHAR(500) NULL,
+    h1_count INT DEFAULT 0,
+    h2_count INT DEFAULT 0,
+    h3_count INT DEFAULT 0,
+    h4_count INT DEFAULT 0,
+    h5_count INT DEFAULT 0,
+    h6_count INT DEFAULT 0,
+    internal_links_count INT DEFAULT 0,
+    external_links_count INT DEFAULT 0,
+    broken_links_count INT DEFAULT 0,
+    has_login_form BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_analysis_results_url_id ON analysis_results (url_id);
+
+-- Broken links table
+CREATE TABLE IF NOT EXISTS broken_links (
+    id BIGSERIAL PRIMARY KEY,
+    url_id BIGINT NOT NULL REFERENCES urls(id) ON DELETE CASCADE,
+    link_url VARCHAR(2048) NOT NULL,
+    status_code INT NULL,
+    error_message TEXT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_broken_links_url_id ON broken_links (url_id);
+CREATE INDEX IF NOT EXISTS idx_broken_links_status_code ON broken_links (status_code);
+
+-- Internal links table for detailed tracking
+CREATE TABLE IF NOT EXISTS internal_links (
+    id BIGSERIAL PRIMARY KEY,
+    url_id BIGINT NOT NULL REFERENCES urls(id) ON DELETE CASCADE,
+    link_url VARCHAR(2048) NOT NULL,
+    link_text VARCHAR(500) NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_internal_links_url_id ON internal_links (url_id);
+
+-- External links table for detailed tracking
+CREATE TABLE IF NOT EXISTS external_links (
+    id BIGSERIAL PRIMARY KEY,
+    url_id BIGINT NOT NULL REFERENCES urls(id) ON DELETE CASCADE,
+    link_url VARCHAR(2048) NOT NULL,
+    link_text VARCHAR(500) NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_external_links_url_id ON external_links (url_id);
+
+-- Users table for authentication (simple implementation)
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    username VARCHAR(50) NOT NULL UNIQUE,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Insert default user for testing, password: password
+INSERT INTO users (username, password_hash) VALUES
+('admin', '$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi')
+ON CONFLICT (username) DO NOTHING;
+
+-- Webhook subscriptions; event_types is a comma separated list
+CREATE TABLE IF NOT EXISTS webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(255) NOT NULL,
+    active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Webhook delivery log and retry queue
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(16) DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    attempts INT DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NULL,
+    response_status INT NULL,
+    error_message TEXT NULL,
+    delivered_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status_next_attempt ON webhook_deliveries (status, next_attempt_at);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_analysis_results_search;
+DROP INDEX IF EXISTS idx_urls_search;
+
+ALTER TABLE analysis_results
+    DROP COLUMN extracted_text,
+    DROP COLUMN meta_description;
+
+DROP INDEX IF EXISTS unique_analysis_results_url_id;
@@ -0,0 +1,18 @@
+-- Reruns used to add an analysis per run; keep the latest so a URL joins
+-- exactly one analysis
+DELETE FROM analysis_results
+WHERE id NOT IN (SELECT MAX(id) FROM analysis_results GROUP BY url_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_analysis_results_url_id ON analysis_results (url_id);
+
+-- Page content used by search: the meta description and the visible text
+ALTER TABLE analysis_results
+    ADD COLUMN meta_description TEXT NULL,
+    ADD COLUMN extracted_text TEXT NULL;
+
+-- GIN indexes over the tsvector expressions used by URL search. The URL is
+-- split on punctuation so host and path segments are searchable words.
+CREATE INDEX IF NOT EXISTS idx_urls_search ON urls
+    USING GIN (to_tsvector('simple', translate(url, '/.:-_?=&#%+~', '            ')));
+CREATE INDEX IF NOT EXISTS idx_analysis_results_search ON analysis_results
+    USING GIN (to_tsvector('simple', coalesce(page_title, '') || ' ' || coalesce(meta_description, '') || ' ' || coalesce(extracted_text, '')));
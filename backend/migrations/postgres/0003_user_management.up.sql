@@ -0,0 +1,19 @@
+-- Account details managed by admins; the seeded admin user keeps admin rights
+ALTER TABLE users
+    ADD COLUMN email VARCHAR(255) NULL,
+    ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users SET is_admin = TRUE WHERE username = 'admin';
+
+-- One-time password reset tokens, stored as SHA-256 hashes
+CREATE TABLE password_reset_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
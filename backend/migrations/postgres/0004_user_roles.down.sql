@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users SET is_admin = (role = 'admin');
+
+ALTER TABLE users DROP COLUMN role;
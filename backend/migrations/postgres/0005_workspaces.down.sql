@@ -0,0 +1,10 @@
+-- Fails if the same URL was added to more than one workspace
+ALTER TABLE webhooks DROP COLUMN workspace_id;
+
+ALTER TABLE urls DROP CONSTRAINT unique_workspace_url_hash;
+ALTER TABLE urls ADD CONSTRAINT unique_url_hash UNIQUE (url_hash);
+ALTER TABLE urls DROP COLUMN workspace_id;
+
+DROP TABLE workspace_invitations;
+DROP TABLE workspace_members;
+DROP TABLE workspaces;
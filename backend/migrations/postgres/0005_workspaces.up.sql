@@ -0,0 +1,50 @@
+-- Workspaces own URLs and webhooks. Everything that existed before moves to
+-- the first workspace, id 1, with every user as a member in their user role.
+CREATE TABLE workspaces (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO workspaces (name) VALUES ('Default');
+
+CREATE TABLE workspace_members (
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL DEFAULT 'viewer' CHECK (role IN ('admin', 'editor', 'viewer')),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX idx_workspace_members_user_id ON workspace_members (user_id);
+
+INSERT INTO workspace_members (workspace_id, user_id, role) SELECT 1, id, role FROM users;
+
+-- One-time invitations to join a workspace, stored as SHA-256 hashes
+CREATE TABLE workspace_invitations (
+    id BIGSERIAL PRIMARY KEY,
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL DEFAULT 'viewer' CHECK (role IN ('admin', 'editor', 'viewer')),
+    email VARCHAR(255) NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    invited_by BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ NULL,
+    accepted_by BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_workspace_invitations_workspace_id ON workspace_invitations (workspace_id);
+
+-- A URL is unique within its workspace, so teams can add the same URL
+ALTER TABLE urls ADD COLUMN workspace_id BIGINT NOT NULL DEFAULT 1 REFERENCES workspaces(id) ON DELETE CASCADE;
+ALTER TABLE urls ALTER COLUMN workspace_id DROP DEFAULT;
+ALTER TABLE urls DROP CONSTRAINT unique_url_hash;
+ALTER TABLE urls ADD CONSTRAINT unique_workspace_url_hash UNIQUE (workspace_id, url_hash);
+
+ALTER TABLE webhooks ADD COLUMN workspace_id BIGINT NOT NULL DEFAULT 1 REFERENCES workspaces(id) ON DELETE CASCADE;
+ALTER TABLE webhooks ALTER COLUMN workspace_id DROP DEFAULT;
+
+CREATE INDEX idx_webhooks_workspace_id ON webhooks (workspace_id);
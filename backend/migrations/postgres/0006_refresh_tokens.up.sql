@@ -0,0 +1,17 @@
+-- Rotating refresh tokens, stored as SHA-256 hashes. Every login starts a
+-- family; each refresh marks its token used and issues the next one in the
+-- same family. Access tokens carry their family ID, so revoking a family
+-- signs its access tokens out too.
+CREATE TABLE refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    family_id CHAR(32) NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ NULL,
+    revoked_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens (user_id);
@@ -0,0 +1,22 @@
+-- Recent failed logins per username and per client IP (scope 'username' or
+-- 'ip'); counts restart once the last failure is older than the window
+CREATE TABLE login_failures (
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ NULL,
+    PRIMARY KEY (scope, subject)
+);
+
+-- Every lockout, for admins to review
+CREATE TABLE login_lockouts (
+    id BIGSERIAL PRIMARY KEY,
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INT NOT NULL,
+    locked_until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_lockouts_created_at ON login_lockouts (created_at);
@@ -0,0 +1,3 @@
+-- A replica claims a due delivery by setting locked_until before sending it,
+-- so other replicas skip it until the claim expires
+ALTER TABLE webhook_deliveries ADD COLUMN locked_until TIMESTAMPTZ NULL;
@@ -0,0 +1,12 @@
+-- Short-lived, single-use tickets that authenticate an event stream, so
+-- browsers need not put their access token in the URL; stored as SHA-256
+-- hashes
+CREATE TABLE stream_tickets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_stream_tickets_user_id ON stream_tickets (user_id);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS external_links;
+DROP TABLE IF EXISTS internal_links;
+DROP TABLE IF EXISTS broken_links;
+DROP TABLE IF EXISTS analysis_results;
+DROP TABLE IF EXISTS urls;
@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS url_search_analysis_delete;
+DROP TRIGGER IF EXISTS url_search_analysis_insert;
+DROP TRIGGER IF EXISTS url_search_urls_delete;
+DROP TRIGGER IF EXISTS url_search_urls_insert;
+DROP TABLE IF EXISTS url_search;
+
+ALTER TABLE analysis_results DROP COLUMN extracted_text;
+ALTER TABLE analysis_results DROP COLUMN meta_description;
+
+DROP INDEX IF EXISTS unique_analysis_results_url_id;
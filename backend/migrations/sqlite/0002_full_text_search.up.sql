@@ -0,0 +1,36 @@
+-- Reruns used to add an analysis per run; keep the latest so a URL joins
+-- exactly one analysis
+DELETE FROM analysis_results
+WHERE id NOT IN (SELECT MAX(id) FROM analysis_results GROUP BY url_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_analysis_results_url_id ON analysis_results (url_id);
+
+-- Page content used by search: the meta description and the visible text
+ALTER TABLE analysis_results ADD COLUMN meta_description TEXT NULL;
+ALTER TABLE analysis_results ADD COLUMN extracted_text TEXT NULL;
+
+-- FTS5 index with one row per URL, keyed by the URL's id and kept in sync by
+-- the triggers below
+CREATE VIRTUAL TABLE IF NOT EXISTS url_search USING fts5(url, page_title, meta_description, extracted_text);
+
+INSERT INTO url_search (rowid, url, page_title, meta_description, extracted_text)
+SELECT u.id, u.url, a.page_title, a.meta_description, a.extracted_text
+FROM urls u LEFT JOIN analysis_results a ON a.url_id = u.id;
+
+CREATE TRIGGER IF NOT EXISTS url_search_urls_insert AFTER INSERT ON urls BEGIN
+    INSERT INTO url_search (rowid, url) VALUES (new.id, new.url);
+END;
+
+CREATE TRIGGER IF NOT EXISTS url_search_urls_delete AFTER DELETE ON urls BEGIN
+    DELETE FROM url_search WHERE rowid = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS url_search_analysis_insert AFTER INSERT ON analysis_results BEGIN
+    UPDATE url_search SET page_title = new.page_title, meta_description = new.meta_description,
+        extracted_text = new.extracted_text WHERE rowid = new.url_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS url_search_analysis_delete AFTER DELETE ON analysis_results BEGIN
+    UPDATE url_search SET page_title = NULL, meta_description = NULL, extracted_text = NULL
+        WHERE rowid = old.url_id;
+END;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS password_reset_tokens;
+
+ALTER TABLE users DROP COLUMN disabled;
+ALTER TABLE users DROP COLUMN is_admin;
+ALTER TABLE users DROP COLUMN email;
@@ -0,0 +1,7 @@
+-- Roles replace the admin flag. Existing users could already add and delete
+-- URLs, so non-admins become editors; new users default to viewers.
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('admin', 'editor', 'viewer'));
+
+UPDATE users SET role = CASE WHEN is_admin THEN 'admin' ELSE 'editor' END;
+
+ALTER TABLE users DROP COLUMN is_admin;
@@ -0,0 +1,11 @@
+-- Fails if the same URL was added to more than one workspace
+DROP INDEX idx_webhooks_workspace_id;
+ALTER TABLE webhooks DROP COLUMN workspace_id;
+
+DROP INDEX unique_workspace_url_hash;
+CREATE UNIQUE INDEX unique_url_hash ON urls (url_hash);
+ALTER TABLE urls DROP COLUMN workspace_id;
+
+DROP TABLE workspace_invitations;
+DROP TABLE workspace_members;
+DROP TABLE workspaces;
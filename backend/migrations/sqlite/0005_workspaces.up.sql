@@ -0,0 +1,51 @@
+-- Workspaces own URLs and webhooks. Everything that existed before moves to
+-- the first workspace, id 1, with every user as a member in their user role.
+CREATE TABLE workspaces (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO workspaces (name) VALUES ('Default');
+
+CREATE TABLE workspace_members (
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('admin', 'editor', 'viewer')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX idx_workspace_members_user_id ON workspace_members (user_id);
+
+INSERT INTO workspace_members (workspace_id, user_id, role) SELECT 1, id, role FROM users;
+
+-- One-time invitations to join a workspace, stored as SHA-256 hashes
+CREATE TABLE workspace_invitations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('admin', 'editor', 'viewer')),
+    email VARCHAR(255) NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    invited_by INTEGER NULL REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP NULL,
+    accepted_by INTEGER NULL REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_workspace_invitations_workspace_id ON workspace_invitations (workspace_id);
+
+-- A URL is unique within its workspace, so teams can add the same URL. SQLite
+-- cannot add a column with both a foreign key and a non-NULL default, so the
+-- workspace columns go without one.
+ALTER TABLE urls ADD COLUMN workspace_id INTEGER NOT NULL DEFAULT 1;
+
+DROP INDEX unique_url_hash;
+CREATE UNIQUE INDEX unique_workspace_url_hash ON urls (workspace_id, url_hash);
+
+ALTER TABLE webhooks ADD COLUMN workspace_id INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX idx_webhooks_workspace_id ON webhooks (workspace_id);
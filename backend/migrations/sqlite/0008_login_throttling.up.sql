@@ -0,0 +1,22 @@
+-- Recent failed logins per username and per client IP (scope 'username' or
+-- 'ip'); counts restart once the last failure is older than the window
+CREATE TABLE login_failures (
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP NULL,
+    PRIMARY KEY (scope, subject)
+);
+
+-- Every lockout, for admins to review
+CREATE TABLE login_lockouts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL,
+    locked_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_lockouts_created_at ON login_lockouts (created_at);
@@ -0,0 +1,9 @@
+-- Token buckets of the API rate limiter, shared by all replicas. refilled_at is
+-- in Unix microseconds, so replicas can compare and swap it exactly.
+CREATE TABLE rate_limit_buckets (
+    bucket_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    tokens REAL NOT NULL,
+    refilled_at INTEGER NOT NULL
+);
+
+CREATE INDEX idx_rate_limit_buckets_refilled_at ON rate_limit_buckets (refilled_at);
@@ -0,0 +1,12 @@
+-- Short-lived, single-use tickets that authenticate an event stream, so
+-- browsers need not put their access token in the URL; stored as SHA-256
+-- hashes
+CREATE TABLE stream_tickets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_stream_tickets_user_id ON stream_tickets (user_id);
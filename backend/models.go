@@ -7,13 +7,25 @@ import (
 // URL represents a website URL to be crawled
 type URL struct {
 	ID           int64     `json:"id" db:"id"`
+	WorkspaceID  int64     `json:"workspace_id" db:"workspace_id"`
 	URL          string    `json:"url" db:"url"`
+	OriginalURL  string    `json:"original_url" db:"original_url"`
+	URLHash      string    `json:"-" db:"url_hash"`
 	Status       string    `json:"status" db:"status"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 	StartedAt    *time.Time `json:"started_at,omitempty" db:"started_at"`
 	CompletedAt  *time.Time `json:"completed_at,omitempty" db:"completed_at"`
 	ErrorMessage *string   `json:"error_message,omitempty" db:"error_message"`
+	TraceParent  *string   `json:"-" db:"trace_parent"`
+
+	// Highlights holds HTML snippets of the fields that matched a search,
+	// with the matched words in <mark> tags
+	Highlights map[string]string `json:"highlights,omitempty" db:"-"`
+
+	// Analysis summarizes the URL's analysis when the list is asked to
+	// include it
+	Analysis *AnalysisSummary `json:"analysis,omitempty" db:"-"`
 }
 
 // AnalysisResult represents the analysis results for a URL
@@ -22,6 +34,8 @@ type AnalysisResult struct {
 	URLID              int64     `json:"url_id" db:"url_id"`
 	HTMLVersion        *string   `json:"html_version,omitempty" db:"html_version"`
 	PageTitle          *string   `json:"page_title,omitempty" db:"page_title"`
+	MetaDescription    *string   `json:"meta_description,omitempty" db:"meta_description"`
+	ExtractedText      *string   `json:"-" db:"extracted_text"`
 	H1Count            int       `json:"h1_count" db:"h1_count"`
 	H2Count            int       `json:"h2_count" db:"h2_count"`
 	H3Count            int       `json:"h3_count" db:"h3_count"`
@@ -36,6 +50,21 @@ type AnalysisResult struct {
 	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// AnalysisReport is everything one crawl of a URL produces. It is saved in a
+// single transaction so a URL never has partial results.
+type AnalysisReport struct {
+	Result        *AnalysisResult
+	InternalLinks []Link
+	ExternalLinks []Link
+	BrokenLinks   []BrokenLink
+}
+
+// Link types, naming the table a link is stored in
+const (
+	LinkInternal = "internal"
+	LinkExternal = "external"
+)
+
 // BrokenLink represents a broken link found during analysis
 type BrokenLink struct {
 	ID          int64     `json:"id" db:"id"`
@@ -50,11 +79,80 @@ type BrokenLink struct {
 type User struct {
 	ID           int64     `json:"id" db:"id"`
 	Username     string    `json:"username" db:"username"`
+	Email        *string   `json:"email,omitempty" db:"email"`
 	PasswordHash string    `json:"-" db:"password_hash"`
+	Role         string    `json:"role" db:"role"`
+	Disabled     bool      `json:"disabled" db:"disabled"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// Webhook is a subscription that receives signed POSTs for analysis events
+type Webhook struct {
+	ID          int64     `json:"id" db:"id"`
+	WorkspaceID int64     `json:"workspace_id" db:"workspace_id"`
+	URL         string    `json:"url" db:"url"`
+	Secret      string    `json:"-" db:"secret"`
+	EventTypes  []string  `json:"event_types" db:"event_types"`
+	Active      bool      `json:"active" db:"active"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Workspace is a team that owns URLs and webhooks
+type Workspace struct {
+	ID        int64     `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+
+	// Role is the current user's role in the workspace, when listing theirs
+	Role string `json:"role,omitempty" db:"-"`
+}
+
+// WorkspaceMember is a user's membership of a workspace
+type WorkspaceMember struct {
+	WorkspaceID int64     `json:"workspace_id" db:"workspace_id"`
+	UserID      int64     `json:"user_id" db:"user_id"`
+	Username    string    `json:"username" db:"-"`
+	Email       *string   `json:"email,omitempty" db:"-"`
+	Role        string    `json:"role" db:"role"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// WorkspaceInvitation lets whoever holds its token join a workspace once;
+// with an Email, only the user with that address
+type WorkspaceInvitation struct {
+	ID          int64      `json:"id" db:"id"`
+	WorkspaceID int64      `json:"workspace_id" db:"workspace_id"`
+	Role        string     `json:"role" db:"role"`
+	Email       *string    `json:"email,omitempty" db:"email"`
+	TokenHash   string     `json:"-" db:"token_hash"`
+	InvitedBy   *int64     `json:"invited_by,omitempty" db:"invited_by"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty" db:"accepted_at"`
+	AcceptedBy  *int64     `json:"accepted_by,omitempty" db:"accepted_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// WebhookDelivery records one event sent to a webhook and its attempts
+type WebhookDelivery struct {
+	ID             int64      `json:"id" db:"id"`
+	WebhookID      int64      `json:"webhook_id" db:"webhook_id"`
+	EventType      string     `json:"event_type" db:"event_type"`
+	Payload        string     `json:"payload" db:"payload"`
+	Status         string     `json:"status" db:"status"`
+	Attempts       int        `json:"attempts" db:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty" db:"next_attempt_at"`
+	ResponseStatus *int       `json:"response_status,omitempty" db:"response_status"`
+	ErrorMessage   *string    `json:"error_message,omitempty" db:"error_message"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty" db:"delivered_at"`
+	LockedUntil    *time.Time `json:"-" db:"locked_until"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
 // API Request/Response structures
 
 // CreateURLRequest represents the request to create a new URL
@@ -72,25 +170,185 @@ type BulkActionRequest struct {
 	IDs []int64 `json:"ids" binding:"required"`
 }
 
+// WebhookRequest represents the request to create or update a webhook
+type WebhookRequest struct {
+	URL        string   `json:"url" binding:"required"`
+	EventTypes []string `json:"event_types" binding:"required"`
+	Secret     string   `json:"secret"`
+	Active     *bool    `json:"active"`
+}
+
+// CreateWebhookResponse returns the signing secret, which is only shown once
+type CreateWebhookResponse struct {
+	Webhook *Webhook `json:"webhook"`
+	Secret  string   `json:"secret"`
+}
+
+// APIKey lets a machine client act for the user who created it in one
+// workspace, limited to its scopes. Only a hash of the key is stored.
+type APIKey struct {
+	ID          int64      `json:"id" db:"id"`
+	UserID      int64      `json:"user_id" db:"user_id"`
+	WorkspaceID int64      `json:"workspace_id" db:"workspace_id"`
+	Name        string     `json:"name" db:"name"`
+	Prefix      string     `json:"prefix" db:"prefix"`
+	KeyHash     string     `json:"-" db:"key_hash"`
+	Scopes      []string   `json:"scopes" db:"scopes"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// CreateAPIKeyRequest creates an API key in the request's workspace
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyResponse returns the key, which is only shown once
+type CreateAPIKeyResponse struct {
+	APIKey *APIKey `json:"api_key"`
+	Key    string  `json:"key"`
+}
+
+// LoginFailure counts the recent failed logins for a username or client IP
+type LoginFailure struct {
+	Scope        string     `json:"scope" db:"scope"`
+	Subject      string     `json:"subject" db:"subject"`
+	Failures     int        `json:"failures" db:"failures"`
+	LastFailedAt time.Time  `json:"last_failed_at" db:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty" db:"locked_until"`
+}
+
+// LoginLockout records a username or client IP being locked out of login
+type LoginLockout struct {
+	ID          int64     `json:"id" db:"id"`
+	Scope       string    `json:"scope" db:"scope"`
+	Subject     string    `json:"subject" db:"subject"`
+	Failures    int       `json:"failures" db:"failures"`
+	LockedUntil time.Time `json:"locked_until" db:"locked_until"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// CreateWorkspaceRequest is a user's request to start a workspace
+type CreateWorkspaceRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// UpdateMemberRequest changes a member's role in a workspace
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// CreateInvitationRequest invites someone to a workspace. With an Email only
+// the user with that email address can join with the token; without one
+// anyone holding the token can.
+type CreateInvitationRequest struct {
+	// Role defaults to viewer
+	Role  string  `json:"role"`
+	Email *string `json:"email"`
+}
+
+// CreateInvitationResponse returns the invitation token, which is only shown once
+type CreateInvitationResponse struct {
+	Invitation *WorkspaceInvitation `json:"invitation"`
+	Token      string               `json:"token"`
+}
+
+// AcceptInvitationRequest joins the workspace of an invitation token
+type AcceptInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
 // LoginRequest represents the login request
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
 
-// LoginResponse represents the login response
+// CreateUserRequest is an admin's request to add a user
+type CreateUserRequest struct {
+	Username string  `json:"username" binding:"required"`
+	Password string  `json:"password" binding:"required"`
+	Email    *string `json:"email"`
+	// Role defaults to viewer
+	Role string `json:"role"`
+}
+
+// UpdateUserRequest changes the fields of a user that are set
+type UpdateUserRequest struct {
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// ChangePasswordRequest is a user's request to change their own password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ResetPasswordRequest sets a new password with a one-time reset token
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// PasswordResetResponse returns a reset token, which is only shown once
+type PasswordResetResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginResponse represents the login response. Token is a short-lived
+// access token; RefreshToken gets the next pair from /auth/refresh once.
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	User         User      `json:"user"`
+}
+
+// StreamTicketResponse returns a single-use ticket for the event stream
+type StreamTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
-// URLListResponse represents the paginated URL list response
+// RefreshRequest exchanges a refresh token for a new token pair
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// LogoutRequest ends the session of a refresh token
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshToken is a stored refresh token. Tokens issued from one login share
+// a family, which is revoked as a whole on logout or reuse.
+type RefreshToken struct {
+	ID        int64      `db:"id"`
+	FamilyID  string     `db:"family_id"`
+	UserID    int64      `db:"user_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// URLListResponse represents the paginated URL list response. Page and the
+// totals are left out when paging by cursor, unless the total was requested.
 type URLListResponse struct {
-	URLs       []URL `json:"urls"`
-	Total      int64 `json:"total"`
-	Page       int   `json:"page"`
-	PageSize   int   `json:"page_size"`
-	TotalPages int   `json:"total_pages"`
+	URLs       []URL  `json:"urls"`
+	Total      *int64 `json:"total,omitempty"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"page_size"`
+	TotalPages *int   `json:"total_pages,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
 
 // AnalysisDetailResponse represents the detailed analysis response
@@ -111,7 +369,14 @@ type Link struct {
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
-	Code    int    `json:"code"`
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Code    int          `json:"code"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// DuplicateURLResponse is returned when a URL has already been added
+type DuplicateURLResponse struct {
+	ErrorResponse
+	URL *URL `json:"url"`
 } 
\ No newline at end of file
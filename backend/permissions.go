@@ -0,0 +1,71 @@
+package main
+
+// User roles, from most to least privileged. Workspace memberships use the
+// same roles.
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Roles lists the valid user roles
+var Roles = []string{RoleAdmin, RoleEditor, RoleViewer}
+
+// Permission is an action a route requires
+type Permission string
+
+const (
+	PermURLsRead         Permission = "urls:read"
+	PermURLsWrite        Permission = "urls:write"
+	PermURLsDelete       Permission = "urls:delete"
+	PermAnalysisRead     Permission = "analysis:read"
+	PermStatsRead        Permission = "stats:read"
+	PermWebhooksManage   Permission = "webhooks:manage"
+	PermMembersManage    Permission = "members:manage"
+	PermWorkspacesCreate Permission = "workspaces:create"
+	PermUsersManage      Permission = "users:manage"
+)
+
+// rolePermissions grants viewers read access, editors adding and rerunning
+// URLs, and admins everything, including deletes and user management
+var rolePermissions = map[string][]Permission{
+	RoleViewer: {PermURLsRead, PermAnalysisRead, PermStatsRead},
+	RoleEditor: {PermURLsRead, PermAnalysisRead, PermStatsRead, PermURLsWrite, PermWorkspacesCreate},
+	RoleAdmin: {PermURLsRead, PermAnalysisRead, PermStatsRead, PermURLsWrite, PermWorkspacesCreate,
+		PermURLsDelete, PermWebhooksManage, PermMembersManage, PermUsersManage},
+}
+
+// APIKeyScopes are the permissions an API key can be given; anything else,
+// such as managing users or keys, needs a login
+var APIKeyScopes = []Permission{PermURLsRead, PermURLsWrite, PermAnalysisRead}
+
+// isValidRole reports whether role is one of Roles
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// roleCan reports whether role grants permission
+func roleCan(role string, permission Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the user's role grants permission
+func (u *User) Can(permission Permission) bool {
+	return roleCan(u.Role, permission)
+}
+
+// Allows reports whether the key's scopes include permission
+func (k *APIKey) Allows(permission Permission) bool {
+	for _, scope := range k.Scopes {
+		if Permission(scope) == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route groups with their own rate limit, and the default of each as
+// requests per window
+var defaultRateLimits = map[string]string{
+	// Login, refresh, logout and password reset, per client IP
+	"auth": "20/1m",
+	// Every authenticated API request
+	"api": "600/1m",
+	// Requests that queue crawls: adding URLs, status updates and bulk re-runs
+	"crawl": "60/1m",
+}
+
+// rateLimitPruneInterval is how often buckets that have refilled are dropped
+const rateLimitPruneInterval = 5 * time.Minute
+
+// RateLimit is a token bucket: it holds up to Limit requests and refills
+// completely over Window, so short bursts are allowed while the average rate
+// stays at Limit per Window
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// parseRateLimit parses a limit of the form "<requests>/<window>", such as
+// "60/1m"
+func parseRateLimit(name, value string) (RateLimit, error) {
+	count, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q must look like 60/1m", value)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || limit <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must allow a positive number of requests", value)
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil || duration <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must have a positive window", value)
+	}
+	return RateLimit{Name: name, Limit: limit, Window: duration}, nil
+}
+
+// RateLimitResult is the outcome of taking a request from a bucket
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of requests left in the bucket
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, when this
+	// one was not
+	RetryAfter time.Duration
+}
+
+// rateLimitBucket is the stored state of a token bucket
+type rateLimitBucket struct {
+	Tokens     float64
+	RefilledAt time.Time
+}
+
+// take refills bucket up to now and takes one request from it. A nil bucket
+// is a new, full one. It returns the updated bucket, unchanged apart from the
+// refill when the request is refused.
+func (l RateLimit) take(bucket *rateLimitBucket, now time.Time) (rateLimitBucket, RateLimitResult) {
+	perSecond := float64(l.Limit) / l.Window.Seconds()
+
+	updated := rateLimitBucket{Tokens: float64(l.Limit), RefilledAt: now}
+	if bucket != nil {
+		// Clocks of replicas may disagree a little; never refill backwards
+		elapsed := now.Sub(bucket.RefilledAt).Seconds()
+		if elapsed < 0 {
+			elapsed, updated.RefilledAt = 0, bucket.RefilledAt
+		}
+		updated.Tokens = math.Min(float64(l.Limit), bucket.Tokens+elapsed*perSecond)
+	}
+
+	seconds := func(tokens float64) time.Duration {
+		return time.Duration(tokens / perSecond * float64(time.Second))
+	}
+	if updated.Tokens < 1 {
+		return updated, RateLimitResult{
+			Reset:      seconds(float64(l.Limit) - updated.Tokens),
+			RetryAfter: seconds(1 - updated.Tokens),
+		}
+	}
+
+	updated.Tokens--
+	return updated, RateLimitResult{
+		Allowed:   true,
+		Remaining: int(updated.Tokens),
+		Reset:     seconds(float64(l.Limit) - updated.Tokens),
+	}
+}
+
+// RateLimiter applies the configured limit of each route group to the
+// requests of each client
+type RateLimiter struct {
+	repo   RateLimitRepository
+	limits map[string]RateLimit
+	logger *slog.Logger
+	now    func() time.Time
+
+	pruneMu   sync.Mutex
+	lastPrune time.Time
+}
+
+// NewRateLimiter reads the limit of each route group from RATE_LIMIT_<GROUP>,
+// such as RATE_LIMIT_CRAWL=60/1m. "off" disables a group's limit.
+func NewRateLimiter(repo RateLimitRepository) (*RateLimiter, error) {
+	limits := map[string]RateLimit{}
+	for name, defaultValue := range defaultRateLimits {
+		key := "RATE_LIMIT_" + strings.ToUpper(name)
+		value := getEnv(key, defaultValue)
+		if value == "off" {
+			continue
+		}
+		limit, err := parseRateLimit(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		limits[name] = limit
+	}
+
+	return &RateLimiter{
+		repo:   repo,
+		limits: limits,
+		logger: slog.Default().With("component", "rate_limiter"),
+		now:    time.Now,
+	}, nil
+}
+
+// Take counts a request of client against the limit of group. ok is false
+// when the group has no limit.
+func (l *RateLimiter) Take(ctx context.Context, group, client string) (limit RateLimit, result RateLimitResult, ok bool, err error) {
+	limit, ok = l.limits[group]
+	if !ok {
+		return limit, result, false, nil
+	}
+
+	now := l.now()
+	l.prune(now)
+	result, err = l.repo.Take(ctx, group+":"+client, limit, now)
+	return limit, result, true, err
+}
+
+// prune drops, at most every rateLimitPruneInterval, the buckets untouched
+// for longer than the longest window. They have refilled, so dropping them
+// changes nothing.
+func (l *RateLimiter) prune(now time.Time) {
+	l.pruneMu.Lock()
+	defer l.pruneMu.Unlock()
+
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	var longest time.Duration
+	for _, limit := range l.limits {
+		if limit.Window > longest {
+			longest = limit.Window
+		}
+	}
+	go func() {
+		if err := l.repo.Prune(context.Background(), now.Add(-longest)); err != nil {
+			l.logger.Error("Failed to prune rate limit buckets", "error", err)
+		}
+	}()
+}
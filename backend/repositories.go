@@ -1,123 +1,420 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
-// URLRepository handles URL database operations
-type URLRepository struct {
-	db *sql.DB
+// ErrDuplicateURL is returned when a URL with the same canonical form already
+// exists in the workspace
+var ErrDuplicateURL = errors.New("URL already exists")
+
+// ErrAlreadyMember is returned when adding a user to a workspace they are in
+var ErrAlreadyMember = errors.New("user is already a member of the workspace")
+
+// ErrDuplicateUsername is returned when creating a user whose username is taken
+var ErrDuplicateUsername = errors.New("username already exists")
+
+// URLRepository stores the URLs to crawl and their crawl status. Lookups,
+// updates and deletes are limited to one workspace; the queue methods serve
+// the crawler, which works across workspaces.
+type URLRepository interface {
+	Create(ctx context.Context, workspaceID int64, originalURL, canonicalURL string) (*URL, error)
+	GetByID(ctx context.Context, workspaceID, id int64) (*URL, error)
+	GetByCanonicalURL(ctx context.Context, workspaceID int64, canonicalURL string) (*URL, error)
+	GetAll(ctx context.Context, opts URLListOptions) (*URLListResponse, error)
+	UpdateStatus(ctx context.Context, workspaceID, id int64, status string) error
+	// ClaimQueued moves a queued URL to running and reports whether it did,
+	// so a URL handed to several workers or replicas is crawled once
+	ClaimQueued(ctx context.Context, workspaceID, id int64) (bool, error)
+	UpdateErrorMessage(ctx context.Context, workspaceID, id int64, errorMessage string) error
+	ClearErrorMessage(ctx context.Context, workspaceID, id int64) error
+	Delete(ctx context.Context, workspaceID, id int64) error
+	BulkDelete(ctx context.Context, workspaceID int64, ids []int64) error
+	GetQueuedURLs(ctx context.Context) ([]URL, error)
+	QueueStats(ctx context.Context) (int64, *time.Time, error)
+}
+
+// AnalysisRepository stores analysis results and the links found on each
+// page. Reads are limited to the workspace of the URL; writes serve the
+// crawler, which works across workspaces on URLs it has already loaded.
+type AnalysisRepository interface {
+	Create(ctx context.Context, urlID int64, analysis *AnalysisResult) error
+	GetByURLID(ctx context.Context, workspaceID, urlID int64) (*AnalysisResult, error)
+	DeleteByURLID(ctx context.Context, urlID int64) error
+	AddLinks(ctx context.Context, urlID int64, linkType string, links []Link) error
+	GetLinks(ctx context.Context, workspaceID, urlID int64, linkType string) ([]Link, error)
+	AddBrokenLink(ctx context.Context, urlID int64, linkURL string, statusCode *int, errorMessage *string) error
+	GetBrokenLinks(ctx context.Context, workspaceID, urlID int64) ([]BrokenLink, error)
+}
+
+// TxRepositories are the repositories available inside a unit of work
+type TxRepositories struct {
+	URLs       URLRepository
+	Analysis   AnalysisRepository
+	Workspaces WorkspaceRepository
+	Webhooks   WebhookRepository
+}
+
+// UnitOfWork runs repository calls that must succeed or fail together
+type UnitOfWork interface {
+	// Do calls fn with repositories bound to one transaction, which is
+	// committed when fn returns nil and rolled back otherwise
+	Do(ctx context.Context, fn func(tx *TxRepositories) error) error
+}
+
+// UserRepository stores users and their password reset tokens
+type UserRepository interface {
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetByID(ctx context.Context, id int64) (*User, error)
+	GetAll(ctx context.Context) ([]User, error)
+	Create(ctx context.Context, user *User) (*User, error)
+	// Update saves the email, role and disabled flag of user
+	Update(ctx context.Context, user *User) error
+	UpdatePassword(ctx context.Context, id int64, passwordHash string) error
+	// CreatePasswordReset stores a reset token for a user, replacing any
+	// unused ones
+	CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error
+	// ConsumePasswordReset marks an unused, unexpired token as used and
+	// returns its user ID, or sql.ErrNoRows when there is no such token
+	ConsumePasswordReset(ctx context.Context, tokenHash string, now time.Time) (int64, error)
+	// CreateStreamTicket stores an event stream ticket for a user, dropping
+	// their expired ones
+	CreateStreamTicket(ctx context.Context, userID int64, tokenHash string, expiresAt, now time.Time) error
+	// ConsumeStreamTicket deletes an unexpired ticket and returns its user ID,
+	// or sql.ErrNoRows when there is no such ticket
+	ConsumeStreamTicket(ctx context.Context, tokenHash string, now time.Time) (int64, error)
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	// GetRefreshToken returns a refresh token by hash whether or not it is
+	// used, revoked or expired, or sql.ErrNoRows when there is none
+	GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// UseRefreshToken marks an unused, unrevoked token as used, returning
+	// sql.ErrNoRows when it is not
+	UseRefreshToken(ctx context.Context, id int64, now time.Time) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string, now time.Time) error
+	// RevokeUserRefreshTokens revokes every token family of a user, ending
+	// all of their sessions
+	RevokeUserRefreshTokens(ctx context.Context, userID int64, now time.Time) error
+	// IsRefreshTokenFamilyRevoked reports whether a family was revoked. A
+	// family without tokens counts as revoked.
+	IsRefreshTokenFamilyRevoked(ctx context.Context, familyID string) (bool, error)
+}
+
+// WebhookRepository stores webhook subscriptions and their deliveries.
+// Webhooks are looked up, updated and deleted within a workspace, and
+// deliveries within their webhook; GetForDelivery and the claim methods serve
+// the delivery worker, which works across workspaces.
+type WebhookRepository interface {
+	Create(ctx context.Context, webhook *Webhook) (*Webhook, error)
+	GetByID(ctx context.Context, workspaceID, id int64) (*Webhook, error)
+	// GetForDelivery returns the webhook a delivery is sent to, whatever its
+	// workspace
+	GetForDelivery(ctx context.Context, id int64) (*Webhook, error)
+	GetAll(ctx context.Context, workspaceID int64) ([]Webhook, error)
+	GetActiveForEvent(ctx context.Context, workspaceID int64, eventType string) ([]Webhook, error)
+	// Update saves the URL, secret, event types and active flag of a webhook
+	// of webhook.WorkspaceID
+	Update(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, workspaceID, id int64) error
+	CreateDelivery(ctx context.Context, webhookID int64, eventType, payload string) (*WebhookDelivery, error)
+	GetDeliveryByID(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error)
+	GetDeliveries(ctx context.Context, webhookID int64, limit int) ([]WebhookDelivery, error)
+	ClaimDueDeliveries(ctx context.Context, limit int, now, lockedUntil time.Time) ([]WebhookDelivery, error)
+	ClaimDelivery(ctx context.Context, id int64, now, lockedUntil time.Time) (bool, error)
+	UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error
+}
+
+// StatsRepository computes the aggregates of GET /api/stats
+type StatsRepository interface {
+	Get(ctx context.Context, opts StatsOptions) (*Stats, error)
+}
+
+// WorkspaceRepository stores workspaces, their members and invitations
+type WorkspaceRepository interface {
+	Create(ctx context.Context, name string) (*Workspace, error)
+	GetByID(ctx context.Context, id int64) (*Workspace, error)
+	// Lock holds a workspace until the unit of work ends, so membership
+	// changes of one workspace run one after another
+	Lock(ctx context.Context, id int64) error
+	// GetForUser returns the workspaces a user is a member of, oldest first,
+	// with Role set to the user's role in each
+	GetForUser(ctx context.Context, userID int64) ([]Workspace, error)
+	// GetMember returns a membership, or sql.ErrNoRows when the user is not
+	// a member of the workspace
+	GetMember(ctx context.Context, workspaceID, userID int64) (*WorkspaceMember, error)
+	GetMembers(ctx context.Context, workspaceID int64) ([]WorkspaceMember, error)
+	// AddMember returns ErrAlreadyMember when the user is a member already
+	AddMember(ctx context.Context, workspaceID, userID int64, role string) error
+	UpdateMemberRole(ctx context.Context, workspaceID, userID int64, role string) error
+	RemoveMember(ctx context.Context, workspaceID, userID int64) error
+	CreateInvitation(ctx context.Context, invitation *WorkspaceInvitation) (*WorkspaceInvitation, error)
+	// GetInvitations returns the invitations of a workspace not accepted yet
+	GetInvitations(ctx context.Context, workspaceID int64) ([]WorkspaceInvitation, error)
+	DeleteInvitation(ctx context.Context, workspaceID, id int64) error
+	// ConsumeInvitation marks an unaccepted, unexpired invitation as accepted
+	// by a user and returns it, or sql.ErrNoRows when there is no such one
+	ConsumeInvitation(ctx context.Context, tokenHash string, userID int64, now time.Time) (*WorkspaceInvitation, error)
+}
+
+// LoginThrottleRepository stores failed logins and lockouts
+type LoginThrottleRepository interface {
+	// GetFailure returns the failures of a subject, or sql.ErrNoRows when
+	// there are none
+	GetFailure(ctx context.Context, scope, subject string) (*LoginFailure, error)
+	// RecordFailure counts a failed login at now and returns the new count.
+	// Counting restarts when the last failure was before windowStart.
+	RecordFailure(ctx context.Context, scope, subject string, now, windowStart time.Time) (*LoginFailure, error)
+	// Lock locks a subject out until lockedUntil and records the lockout
+	Lock(ctx context.Context, failure *LoginFailure, lockedUntil, now time.Time) error
+	ClearFailures(ctx context.Context, scope, subject string) error
+	// GetLockouts returns the lockouts since a time, newest first
+	GetLockouts(ctx context.Context, since time.Time) ([]LoginLockout, error)
+}
+
+// RateLimitRepository stores the token buckets of the rate limiter
+type RateLimitRepository interface {
+	// Take refills the bucket with key up to now and takes one request from
+	// it when it can, atomically with other takes from the same bucket
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	// Prune drops the buckets last refilled before a time
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// APIKeyRepository stores the API keys of users
+type APIKeyRepository interface {
+	Create(ctx context.Context, key *APIKey) (*APIKey, error)
+	// GetByHash returns a key by hash whether or not it expired, or
+	// sql.ErrNoRows when there is none
+	GetByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	// GetForUser returns a user's keys, newest first
+	GetForUser(ctx context.Context, userID int64) ([]APIKey, error)
+	// Delete removes a key of a user, returning sql.ErrNoRows when the user
+	// has no such key
+	Delete(ctx context.Context, userID, id int64) error
+	UpdateLastUsed(ctx context.Context, id int64, now time.Time) error
+}
+
+// sqlRepository holds what the SQL repositories share
+type sqlRepository struct {
+	db      queryer
+	dialect *sqlDialect
+	timeout time.Duration
+}
+
+// startQuery starts the tracing span of a repository call and bounds ctx by
+// the query timeout. The returned function ends both, recording err.
+func (r *sqlRepository) startQuery(ctx context.Context, name, query string) (context.Context, func(err error)) {
+	ctx, span := startDBSpan(ctx, r.dialect.system, name, query)
+
+	cancel := func() {}
+	if r.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+	}
+
+	return ctx, func(err error) {
+		cancel()
+		endSpan(span, err)
+	}
+}
+
+// SQLURLRepository implements URLRepository on a SQL database
+type SQLURLRepository struct {
+	sqlRepository
+}
+
+func NewSQLURLRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLURLRepository {
+	return &SQLURLRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
 }
 
-func NewURLRepository(db *sql.DB) *URLRepository {
-	return &URLRepository{db: db}
+// urlColumns is the column list matched by scanURL
+const urlColumns = `id, workspace_id, url, original_url, url_hash, status, created_at, updated_at, started_at, completed_at, error_message, trace_parent`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func (r *URLRepository) Create(url string) (*URL, error) {
-	query := `INSERT INTO urls (url) VALUES (?)`
-	result, err := r.db.Exec(query, url)
+// qualifiedURLColumns is urlColumns for queries that alias urls as u
+const qualifiedURLColumns = `u.id, u.workspace_id, u.url, u.original_url, u.url_hash, u.status, u.created_at, u.updated_at, u.started_at, u.completed_at, u.error_message, u.trace_parent`
+
+// scanURL scans the urlColumns of row, followed by any extra columns
+func scanURL(row rowScanner, extra ...interface{}) (*URL, error) {
+	var url URL
+	dest := []interface{}{
+		&url.ID, &url.WorkspaceID, &url.URL, &url.OriginalURL, &url.URLHash, &url.Status, &url.CreatedAt, &url.UpdatedAt,
+		&url.StartedAt, &url.CompletedAt, &url.ErrorMessage, &url.TraceParent,
+	}
+	err := row.Scan(append(dest, extra...)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create URL: %w", err)
+		return nil, err
 	}
+	return &url, nil
+}
 
-	id, err := result.LastInsertId()
+// Create stores a URL in a workspace by its canonical form, keeping the
+// user's original input. The trace context of ctx is saved so the crawl joins
+// the request's trace.
+func (r *SQLURLRepository) Create(ctx context.Context, workspaceID int64, originalURL, canonicalURL string) (url *URL, err error) {
+	query := `INSERT INTO urls (workspace_id, url, original_url, url_hash, trace_parent) VALUES (?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "URLRepository.Create", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, workspaceID, canonicalURL, originalURL, URLHash(canonicalURL), traceParent(ctx))
+	if r.dialect.isDuplicate(err) {
+		return nil, ErrDuplicateURL
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last insert ID: %w", err)
+		return nil, fmt.Errorf("failed to create URL: %w", err)
 	}
 
-	return r.GetByID(id)
+	return r.GetByID(ctx, workspaceID, id)
 }
 
-func (r *URLRepository) GetByID(id int64) (*URL, error) {
-	query := `SELECT id, url, status, created_at, updated_at, started_at, completed_at, error_message 
-			  FROM urls WHERE id = ?`
-	
-	var url URL
-	err := r.db.QueryRow(query, id).Scan(
-		&url.ID, &url.URL, &url.Status, &url.CreatedAt, &url.UpdatedAt,
-		&url.StartedAt, &url.CompletedAt, &url.ErrorMessage,
-	)
+func (r *SQLURLRepository) GetByID(ctx context.Context, workspaceID, id int64) (url *URL, err error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "URLRepository.GetByID", query)
+	defer func() { done(err) }()
+
+	url, err = scanURL(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id, workspaceID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get URL by ID: %w", err)
 	}
 
-	return &url, nil
+	return url, nil
 }
 
-func (r *URLRepository) GetAll(page, pageSize int, status, search string) (*URLListResponse, error) {
-	offset := (page - 1) * pageSize
-	
+// GetByCanonicalURL looks a URL up in a workspace by the hash of its
+// canonical form
+func (r *SQLURLRepository) GetByCanonicalURL(ctx context.Context, workspaceID int64, canonicalURL string) (url *URL, err error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE workspace_id = ? AND url_hash = ?`
+	ctx, done := r.startQuery(ctx, "URLRepository.GetByCanonicalURL", query)
+	defer func() { done(err) }()
+
+	url, err = scanURL(r.db.QueryRowContext(ctx, r.dialect.rebind(query), workspaceID, URLHash(canonicalURL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get URL by canonical URL: %w", err)
+	}
+
+	return url, nil
+}
+
+// GetAll returns a page of URLs filtered and ordered by opts, including a
+// full-text search of their URL and page content. Search results carry
+// highlighted snippets of the fields that matched. Pages are fetched by
+// offset, or by keyset when opts has a cursor.
+func (r *SQLURLRepository) GetAll(ctx context.Context, opts URLListOptions) (response *URLListResponse, err error) {
 	// Build WHERE clause
-	whereClause := "WHERE 1=1"
-	args := []interface{}{}
-	
-	if status != "" {
-		whereClause += " AND status = ?"
-		args = append(args, status)
+	where, args := opts.filter(r.dialect, []string{"u.workspace_id = ?"}, []interface{}{opts.WorkspaceID})
+
+	query := parseSearchQuery(opts.Search)
+	for _, term := range query {
+		condition, termArgs := r.dialect.matchTerm(term)
+		where = append(where, condition)
+		args = append(args, termArgs...)
 	}
-	
-	if search != "" {
-		whereClause += " AND (url LIKE ? OR page_title LIKE ?)"
-		searchTerm := "%" + search + "%"
-		args = append(args, searchTerm, searchTerm)
+
+	from := "FROM urls u LEFT JOIN analysis_results a ON a.url_id = u.id"
+	countQuery := "SELECT COUNT(*) " + from + " WHERE " + strings.Join(where, " AND ")
+	countArgs := args
+
+	if opts.Cursor != nil {
+		condition, cursorArgs := opts.cursorCondition(r.dialect)
+		where = append(where, condition)
+		args = append(args[:len(args):len(args)], cursorArgs...)
 	}
 
-	// Get total count
-	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM urls %s", whereClause)
-	var total int64
-	err := r.db.QueryRow(countQuery, args...).Scan(&total)
-	if err != nil {
-		return nil, fmt.Errorf("failed to count URLs: %w", err)
+	// Get URLs with their sort value for cursors, and the page content to
+	// highlight when searching. One extra row tells whether more follow.
+	columns := qualifiedURLColumns + ", NULL, NULL, NULL"
+	if len(query) > 0 {
+		columns = qualifiedURLColumns + ", a.page_title, a.meta_description, a.extracted_text"
+	}
+	columns += ", " + urlSortFields[opts.sortKey()].column
+	if opts.IncludeAnalysis {
+		columns += ", " + analysisSummaryColumns
 	}
+	listQuery := "SELECT " + columns + " " + from + " WHERE " + strings.Join(where, " AND ") + " " + opts.orderBy() + " LIMIT ? OFFSET ?"
+	args = append(args, opts.PageSize+1, opts.offset())
 
-	// Get URLs
-	query := fmt.Sprintf(`SELECT id, url, status, created_at, updated_at, started_at, completed_at, error_message 
-						 FROM urls %s ORDER BY created_at DESC LIMIT ? OFFSET ?`, whereClause)
-	args = append(args, pageSize, offset)
+	ctx, done := r.startQuery(ctx, "URLRepository.GetAll", listQuery)
+	defer func() { done(err) }()
 
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(listQuery), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get URLs: %w", err)
 	}
 	defer rows.Close()
 
 	var urls []URL
+	var values []interface{}
 	for rows.Next() {
-		var url URL
-		err := rows.Scan(
-			&url.ID, &url.URL, &url.Status, &url.CreatedAt, &url.UpdatedAt,
-			&url.StartedAt, &url.CompletedAt, &url.ErrorMessage,
-		)
+		var pageTitle, metaDescription, extractedText *string
+		sortDest, sortValue := opts.scanSortValue()
+		extra := []interface{}{&pageTitle, &metaDescription, &extractedText, sortDest}
+		var summary analysisSummaryRow
+		if opts.IncludeAnalysis {
+			extra = append(extra, summary.dest()...)
+		}
+		url, err := scanURL(rows, extra...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan URL: %w", err)
 		}
-		urls = append(urls, url)
+		if opts.IncludeAnalysis {
+			url.Analysis = summary.summary()
+		}
+		if len(query) > 0 {
+			url.Highlights = query.highlights(searchFields(url.URL, pageTitle, metaDescription, extractedText))
+		}
+		urls = append(urls, *url)
+		values = append(values, sortValue())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get URLs: %w", err)
+	}
+
+	response, err = opts.listPage(urls, values)
+	if err != nil {
+		return nil, err
 	}
 
-	totalPages := int((total + int64(pageSize) - 1) / int64(pageSize))
+	// Counting is skipped in cursor mode unless asked for, as it scans every
+	// matching row
+	if opts.countTotal() {
+		var total int64
+		err = r.db.QueryRowContext(ctx, r.dialect.rebind(countQuery), countArgs...).Scan(&total)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count URLs: %w", err)
+		}
+		response.setTotal(total, opts.PageSize)
+	}
 
-	return &URLListResponse{
-		URLs:       urls,
-		Total:      total,
-		Page:       page,
-		PageSize:   pageSize,
-		TotalPages: totalPages,
-	}, nil
+	return response, nil
 }
 
-func (r *URLRepository) UpdateStatus(id int64, status string) error {
-	query := `UPDATE urls SET status = ?, updated_at = NOW()`
+// UpdateStatus moves a URL to status. Queuing a URL also records the trace
+// context of ctx for the worker that will pick it up.
+func (r *SQLURLRepository) UpdateStatus(ctx context.Context, workspaceID, id int64, status string) (err error) {
+	query := `UPDATE urls SET status = ?, updated_at = CURRENT_TIMESTAMP`
+	args := []interface{}{status}
 	
 	if status == "running" {
-		query += `, started_at = NOW()`
+		query += `, started_at = CURRENT_TIMESTAMP`
 	} else if status == "completed" || status == "failed" {
-		query += `, completed_at = NOW()`
+		query += `, completed_at = CURRENT_TIMESTAMP`
+	} else if status == "queued" {
+		query += `, trace_parent = ?`
+		args = append(args, traceParent(ctx))
 	}
 	
-	query += ` WHERE id = ?`
+	query += ` WHERE id = ? AND workspace_id = ?`
+	args = append(args, id, workspaceID)
+	ctx, done := r.startQuery(ctx, "URLRepository.UpdateStatus", query)
+	defer func() { done(err) }()
 	
-	_, err := r.db.Exec(query, status, id)
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), args...)
 	if err != nil {
 		return fmt.Errorf("failed to update URL status: %w", err)
 	}
@@ -125,84 +422,145 @@ func (r *URLRepository) UpdateStatus(id int64, status string) error {
 	return nil
 }
 
-func (r *URLRepository) UpdateErrorMessage(id int64, errorMessage string) error {
-	query := `UPDATE urls SET error_message = ?, updated_at = NOW() WHERE id = ?`
-	_, err := r.db.Exec(query, errorMessage, id)
+func (r *SQLURLRepository) ClaimQueued(ctx context.Context, workspaceID, id int64) (claimed bool, err error) {
+	query := `UPDATE urls SET status = 'running', started_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND workspace_id = ? AND status = 'queued'`
+	ctx, done := r.startQuery(ctx, "URLRepository.ClaimQueued", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), id, workspaceID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim URL: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim URL: %w", err)
+	}
+	return updated == 1, nil
+}
+
+func (r *SQLURLRepository) UpdateErrorMessage(ctx context.Context, workspaceID, id int64, errorMessage string) (err error) {
+	query := `UPDATE urls SET error_message = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "URLRepository.UpdateErrorMessage", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), errorMessage, id, workspaceID)
 	if err != nil {
 		return fmt.Errorf("failed to update error message: %w", err)
 	}
 	return nil
 }
 
-func (r *URLRepository) Delete(id int64) error {
-	query := `DELETE FROM urls WHERE id = ?`
-	_, err := r.db.Exec(query, id)
+func (r *SQLURLRepository) ClearErrorMessage(ctx context.Context, workspaceID, id int64) (err error) {
+	query := `UPDATE urls SET error_message = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "URLRepository.ClearErrorMessage", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to clear error message: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLURLRepository) Delete(ctx context.Context, workspaceID, id int64) (err error) {
+	query := `DELETE FROM urls WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "URLRepository.Delete", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), id, workspaceID)
 	if err != nil {
 		return fmt.Errorf("failed to delete URL: %w", err)
 	}
 	return nil
 }
 
-func (r *URLRepository) BulkDelete(ids []int64) error {
-	query := `DELETE FROM urls WHERE id IN (`
-	args := make([]interface{}, len(ids))
+func (r *SQLURLRepository) BulkDelete(ctx context.Context, workspaceID int64, ids []int64) (err error) {
+	query := `DELETE FROM urls WHERE workspace_id = ? AND id IN (`
+	args := []interface{}{workspaceID}
 	for i, id := range ids {
 		if i > 0 {
 			query += ","
 		}
 		query += "?"
-		args[i] = id
+		args = append(args, id)
 	}
 	query += ")"
+	ctx, done := r.startQuery(ctx, "URLRepository.BulkDelete", query)
+	defer func() { done(err) }()
 
-	_, err := r.db.Exec(query, args...)
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), args...)
 	if err != nil {
 		return fmt.Errorf("failed to bulk delete URLs: %w", err)
 	}
 	return nil
 }
 
-func (r *URLRepository) GetQueuedURLs() ([]URL, error) {
-	query := `SELECT id, url, status, created_at, updated_at, started_at, completed_at, error_message 
-			  FROM urls WHERE status = 'queued' ORDER BY created_at ASC`
-	
-	rows, err := r.db.Query(query)
+func (r *SQLURLRepository) GetQueuedURLs(ctx context.Context) (urls []URL, err error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE status = 'queued' ORDER BY created_at ASC`
+	ctx, done := r.startQuery(ctx, "URLRepository.GetQueuedURLs", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get queued URLs: %w", err)
 	}
 	defer rows.Close()
 
-	var urls []URL
 	for rows.Next() {
-		var url URL
-		err := rows.Scan(
-			&url.ID, &url.URL, &url.Status, &url.CreatedAt, &url.UpdatedAt,
-			&url.StartedAt, &url.CompletedAt, &url.ErrorMessage,
-		)
+		url, err := scanURL(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan URL: %w", err)
 		}
-		urls = append(urls, url)
+		urls = append(urls, *url)
 	}
 
 	return urls, nil
 }
 
-// AnalysisRepository handles analysis results database operations
-type AnalysisRepository struct {
-	db *sql.DB
+// QueueStats returns the number of queued URLs and when the longest waiting
+// one was queued, or nil when the queue is empty
+func (r *SQLURLRepository) QueueStats(ctx context.Context) (depth int64, oldest *time.Time, err error) {
+	query := `SELECT COUNT(*) FROM urls WHERE status = 'queued'`
+	ctx, done := r.startQuery(ctx, "URLRepository.QueueStats", query)
+	defer func() { done(err) }()
+
+	if err = r.db.QueryRowContext(ctx, r.dialect.rebind(query)).Scan(&depth); err != nil {
+		return 0, nil, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+	if depth == 0 {
+		return 0, nil, nil
+	}
+
+	// Selected as a plain column rather than MIN() so drivers that type
+	// values by column declaration still return a time
+	var oldestQueued time.Time
+	err = r.db.QueryRowContext(ctx, `SELECT updated_at FROM urls WHERE status = 'queued' ORDER BY updated_at ASC LIMIT 1`).Scan(&oldestQueued)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+
+	return depth, &oldestQueued, nil
+}
+
+// SQLAnalysisRepository implements AnalysisRepository on a SQL database
+type SQLAnalysisRepository struct {
+	sqlRepository
 }
 
-func NewAnalysisRepository(db *sql.DB) *AnalysisRepository {
-	return &AnalysisRepository{db: db}
+func NewSQLAnalysisRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLAnalysisRepository {
+	return &SQLAnalysisRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
 }
 
-func (r *AnalysisRepository) Create(urlID int64, analysis *AnalysisResult) error {
-	query := `INSERT INTO analysis_results (url_id, html_version, page_title, h1_count, h2_count, h3_count, 
+func (r *SQLAnalysisRepository) Create(ctx context.Context, urlID int64, analysis *AnalysisResult) (err error) {
+	query := `INSERT INTO analysis_results (url_id, html_version, page_title, meta_description, extracted_text, h1_count, h2_count, h3_count, 
 			  h4_count, h5_count, h6_count, internal_links_count, external_links_count, broken_links_count, has_login_form) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.Create", query)
+	defer func() { done(err) }()
 	
-	_, err := r.db.Exec(query, urlID, analysis.HTMLVersion, analysis.PageTitle, analysis.H1Count,
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), urlID, analysis.HTMLVersion, analysis.PageTitle,
+		analysis.MetaDescription, analysis.ExtractedText, analysis.H1Count,
 		analysis.H2Count, analysis.H3Count, analysis.H4Count, analysis.H5Count, analysis.H6Count,
 		analysis.InternalLinksCount, analysis.ExternalLinksCount, analysis.BrokenLinksCount, analysis.HasLoginForm)
 	
@@ -213,15 +571,19 @@ func (r *AnalysisRepository) Create(urlID int64, analysis *AnalysisResult) error
 	return nil
 }
 
-func (r *AnalysisRepository) GetByURLID(urlID int64) (*AnalysisResult, error) {
-	query := `SELECT id, url_id, html_version, page_title, h1_count, h2_count, h3_count, h4_count, h5_count, h6_count,
-			  internal_links_count, external_links_count, broken_links_count, has_login_form, created_at, updated_at
-			  FROM analysis_results WHERE url_id = ?`
+func (r *SQLAnalysisRepository) GetByURLID(ctx context.Context, workspaceID, urlID int64) (result *AnalysisResult, err error) {
+	query := `SELECT a.id, a.url_id, a.html_version, a.page_title, a.meta_description, a.extracted_text,
+			  a.h1_count, a.h2_count, a.h3_count, a.h4_count, a.h5_count, a.h6_count,
+			  a.internal_links_count, a.external_links_count, a.broken_links_count, a.has_login_form, a.created_at, a.updated_at
+			  FROM analysis_results a JOIN urls u ON u.id = a.url_id
+			  WHERE a.url_id = ? AND u.workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.GetByURLID", query)
+	defer func() { done(err) }()
 	
 	var analysis AnalysisResult
-	err := r.db.QueryRow(query, urlID).Scan(
+	err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), urlID, workspaceID).Scan(
 		&analysis.ID, &analysis.URLID, &analysis.HTMLVersion, &analysis.PageTitle,
-		&analysis.H1Count, &analysis.H2Count, &analysis.H3Count, &analysis.H4Count,
+		&analysis.MetaDescription, &analysis.ExtractedText, &analysis.H1Count, &analysis.H2Count, &analysis.H3Count, &analysis.H4Count,
 		&analysis.H5Count, &analysis.H6Count, &analysis.InternalLinksCount,
 		&analysis.ExternalLinksCount, &analysis.BrokenLinksCount, &analysis.HasLoginForm,
 		&analysis.CreatedAt, &analysis.UpdatedAt,
@@ -234,26 +596,190 @@ func (r *AnalysisRepository) GetByURLID(urlID int64) (*AnalysisResult, error) {
 	return &analysis, nil
 }
 
-func (r *AnalysisRepository) AddBrokenLink(urlID int64, linkURL string, statusCode *int, errorMessage *string) error {
+// DeleteByURLID removes the analysis of a URL with its links and broken links
+func (r *SQLAnalysisRepository) DeleteByURLID(ctx context.Context, urlID int64) error {
+	for _, table := range []string{"analysis_results", "internal_links", "external_links", "broken_links"} {
+		if err := r.deleteFrom(ctx, table, urlID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLAnalysisRepository) deleteFrom(ctx context.Context, table string, urlID int64) (err error) {
+	query := `DELETE FROM ` + table + ` WHERE url_id = ?`
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.DeleteByURLID", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), urlID)
+	if err != nil {
+		return fmt.Errorf("failed to delete from %s: %w", table, err)
+	}
+	return nil
+}
+
+// linkTable returns the table that stores links of linkType
+func linkTable(linkType string) (string, error) {
+	switch linkType {
+	case LinkInternal:
+		return "internal_links", nil
+	case LinkExternal:
+		return "external_links", nil
+	}
+	return "", fmt.Errorf("unknown link type %q", linkType)
+}
+
+// analysisSummaryColumns are the columns of an AnalysisSummary, read from the
+// analysis_results a joined to the URL list
+const analysisSummaryColumns = "a.id, a.html_version, a.page_title, a.internal_links_count, a.external_links_count, a.broken_links_count, a.has_login_form"
+
+// analysisSummaryRow scans analysisSummaryColumns, which are all NULL for a
+// URL without an analysis
+type analysisSummaryRow struct {
+	id                 sql.NullInt64
+	htmlVersion        *string
+	pageTitle          *string
+	internalLinksCount sql.NullInt64
+	externalLinksCount sql.NullInt64
+	brokenLinksCount   sql.NullInt64
+	hasLoginForm       sql.NullBool
+}
+
+func (s *analysisSummaryRow) dest() []interface{} {
+	return []interface{}{&s.id, &s.htmlVersion, &s.pageTitle, &s.internalLinksCount, &s.externalLinksCount, &s.brokenLinksCount, &s.hasLoginForm}
+}
+
+// summary returns the scanned summary, or nil when the URL has no analysis
+func (s *analysisSummaryRow) summary() *AnalysisSummary {
+	if !s.id.Valid {
+		return nil
+	}
+	return &AnalysisSummary{
+		HTMLVersion:        s.htmlVersion,
+		PageTitle:          s.pageTitle,
+		InternalLinksCount: int(s.internalLinksCount.Int64),
+		ExternalLinksCount: int(s.externalLinksCount.Int64),
+		BrokenLinksCount:   int(s.brokenLinksCount.Int64),
+		HasLoginForm:       s.hasLoginForm.Bool,
+	}
+}
+
+// maxLinkTextLength matches the size of the link_text columns
+const maxLinkTextLength = 500
+
+// linkText returns the text of a link as stored, or nil when it has none
+func linkText(link Link) *string {
+	text := link.Text
+	if runes := []rune(text); len(runes) > maxLinkTextLength {
+		text = string(runes[:maxLinkTextLength])
+	}
+	if text == "" {
+		return nil
+	}
+	return &text
+}
+
+// linkInsertBatchSize bounds the rows, and so the placeholders, per INSERT
+const linkInsertBatchSize = 100
+
+// AddLinks stores the internal or external links found on a URL
+func (r *SQLAnalysisRepository) AddLinks(ctx context.Context, urlID int64, linkType string, links []Link) error {
+	table, err := linkTable(linkType)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(links); start += linkInsertBatchSize {
+		end := start + linkInsertBatchSize
+		if end > len(links) {
+			end = len(links)
+		}
+		if err := r.insertLinks(ctx, table, urlID, links[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLAnalysisRepository) insertLinks(ctx context.Context, table string, urlID int64, links []Link) (err error) {
+	rows := make([]string, len(links))
+	args := make([]interface{}, 0, 3*len(links))
+	for i, link := range links {
+		rows[i] = "(?, ?, ?)"
+		args = append(args, urlID, link.URL, linkText(link))
+	}
+
+	query := `INSERT INTO ` + table + ` (url_id, link_url, link_text) VALUES ` + strings.Join(rows, ", ")
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.AddLinks", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to add links: %w", err)
+	}
+	return nil
+}
+
+// GetLinks returns the internal or external links of a URL in page order,
+// flagging those that were found to be broken
+func (r *SQLAnalysisRepository) GetLinks(ctx context.Context, workspaceID, urlID int64, linkType string) (links []Link, err error) {
+	table, err := linkTable(linkType)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT l.link_url, l.link_text,
+			  EXISTS (SELECT 1 FROM broken_links b WHERE b.url_id = l.url_id AND b.link_url = l.link_url)
+			  FROM ` + table + ` l JOIN urls u ON u.id = l.url_id
+			  WHERE l.url_id = ? AND u.workspace_id = ? ORDER BY l.id`
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.GetLinks", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), urlID, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get links: %w", err)
+	}
+	defer rows.Close()
+
+	links = []Link{}
+	for rows.Next() {
+		var link Link
+		var text sql.NullString
+		if err := rows.Scan(&link.URL, &text, &link.IsBroken); err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		link.Text = text.String
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+func (r *SQLAnalysisRepository) AddBrokenLink(ctx context.Context, urlID int64, linkURL string, statusCode *int, errorMessage *string) (err error) {
 	query := `INSERT INTO broken_links (url_id, link_url, status_code, error_message) VALUES (?, ?, ?, ?)`
-	_, err := r.db.Exec(query, urlID, linkURL, statusCode, errorMessage)
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.AddBrokenLink", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), urlID, linkURL, statusCode, errorMessage)
 	if err != nil {
 		return fmt.Errorf("failed to add broken link: %w", err)
 	}
 	return nil
 }
 
-func (r *AnalysisRepository) GetBrokenLinks(urlID int64) ([]BrokenLink, error) {
-	query := `SELECT id, url_id, link_url, status_code, error_message, created_at 
-			  FROM broken_links WHERE url_id = ? ORDER BY created_at DESC`
+func (r *SQLAnalysisRepository) GetBrokenLinks(ctx context.Context, workspaceID, urlID int64) (links []BrokenLink, err error) {
+	query := `SELECT b.id, b.url_id, b.link_url, b.status_code, b.error_message, b.created_at
+			  FROM broken_links b JOIN urls u ON u.id = b.url_id
+			  WHERE b.url_id = ? AND u.workspace_id = ? ORDER BY b.created_at DESC`
+	ctx, done := r.startQuery(ctx, "AnalysisRepository.GetBrokenLinks", query)
+	defer func() { done(err) }()
 	
-	rows, err := r.db.Query(query, urlID)
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), urlID, workspaceID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get broken links: %w", err)
 	}
 	defer rows.Close()
 
-	var links []BrokenLink
 	for rows.Next() {
 		var link BrokenLink
 		err := rows.Scan(&link.ID, &link.URLID, &link.LinkURL, &link.StatusCode, &link.ErrorMessage, &link.CreatedAt)
@@ -266,23 +792,1351 @@ func (r *AnalysisRepository) GetBrokenLinks(urlID int64) ([]BrokenLink, error) {
 	return links, nil
 }
 
-// UserRepository handles user database operations
-type UserRepository struct {
-	db *sql.DB
+// SQLUnitOfWork implements UnitOfWork with a database transaction
+type SQLUnitOfWork struct {
+	db      *sql.DB
+	dialect *sqlDialect
+	timeout time.Duration
 }
 
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{db: db}
+func NewSQLUnitOfWork(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLUnitOfWork {
+	return &SQLUnitOfWork{db: db, dialect: dialect, timeout: timeout}
 }
 
-func (r *UserRepository) GetByUsername(username string) (*User, error) {
-	query := `SELECT id, username, password_hash, created_at, updated_at FROM users WHERE username = ?`
-	
+func (u *SQLUnitOfWork) Do(ctx context.Context, fn func(tx *TxRepositories) error) (err error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		// Roll back on errors and panics; after a commit this is a no-op
+		if recovered := recover(); recovered != nil {
+			tx.Rollback()
+			panic(recovered)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	repo := sqlRepository{db: tx, dialect: u.dialect, timeout: u.timeout}
+	txRepos := &TxRepositories{
+		URLs:       &SQLURLRepository{repo},
+		Analysis:   &SQLAnalysisRepository{repo},
+		Workspaces: &SQLWorkspaceRepository{repo},
+		Webhooks:   &SQLWebhookRepository{repo},
+	}
+	if err := fn(txRepos); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SQLUserRepository implements UserRepository on a SQL database
+type SQLUserRepository struct {
+	sqlRepository
+}
+
+func NewSQLUserRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLUserRepository {
+	return &SQLUserRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+const userColumns = `id, username, email, password_hash, role, disabled, created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	err := r.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role, &user.Disabled,
+		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user by username: %w", err)
+		return nil, err
 	}
-	
 	return &user, nil
-} 
\ No newline at end of file
+}
+
+func (r *SQLUserRepository) GetByUsername(ctx context.Context, username string) (user *User, err error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.GetByUsername", query)
+	defer func() { done(err) }()
+
+	user, err = scanUser(r.db.QueryRowContext(ctx, r.dialect.rebind(query), username))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by username: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *SQLUserRepository) GetByID(ctx context.Context, id int64) (user *User, err error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.GetByID", query)
+	defer func() { done(err) }()
+
+	user, err = scanUser(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by ID: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *SQLUserRepository) GetAll(ctx context.Context) (users []User, err error) {
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username`
+	ctx, done := r.startQuery(ctx, "UserRepository.GetAll", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users = []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	return users, nil
+}
+
+func (r *SQLUserRepository) Create(ctx context.Context, user *User) (created *User, err error) {
+	query := `INSERT INTO users (username, email, password_hash, role, disabled) VALUES (?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "UserRepository.Create", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, user.Username, user.Email, user.PasswordHash, user.Role, user.Disabled)
+	if r.dialect.isDuplicate(err) {
+		return nil, ErrDuplicateUsername
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return r.GetByID(ctx, id)
+}
+
+func (r *SQLUserRepository) Update(ctx context.Context, user *User) (err error) {
+	query := `UPDATE users SET email = ?, role = ?, disabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.Update", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), user.Email, user.Role, user.Disabled, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) UpdatePassword(ctx context.Context, id int64, passwordHash string) (err error) {
+	query := `UPDATE users SET password_hash = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.UpdatePassword", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) (err error) {
+	query := `DELETE FROM password_reset_tokens WHERE user_id = ? AND used_at IS NULL`
+	ctx, done := r.startQuery(ctx, "UserRepository.CreatePasswordReset", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), userID); err != nil {
+		return fmt.Errorf("failed to replace password reset tokens: %w", err)
+	}
+
+	query = `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES (?, ?, ?)`
+	if _, err = r.dialect.insert(ctx, r.db, query, userID, tokenHash, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("failed to create password reset token: %w", err)
+	}
+	return nil
+}
+
+// ConsumePasswordReset claims the token with a conditional update, so two
+// concurrent resets cannot both use it
+func (r *SQLUserRepository) ConsumePasswordReset(ctx context.Context, tokenHash string, now time.Time) (userID int64, err error) {
+	query := `UPDATE password_reset_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.ConsumePasswordReset", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), tokenHash, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume password reset token: %w", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume password reset token: %w", err)
+	}
+	if claimed == 0 {
+		return 0, fmt.Errorf("failed to consume password reset token: %w", sql.ErrNoRows)
+	}
+
+	query = `SELECT user_id FROM password_reset_tokens WHERE token_hash = ?`
+	if err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), tokenHash).Scan(&userID); err != nil {
+		return 0, fmt.Errorf("failed to consume password reset token: %w", err)
+	}
+	return userID, nil
+}
+func (r *SQLUserRepository) CreateStreamTicket(ctx context.Context, userID int64, tokenHash string, expiresAt, now time.Time) (err error) {
+	query := `DELETE FROM stream_tickets WHERE user_id = ? AND expires_at <= ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.CreateStreamTicket", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), userID, now.UTC()); err != nil {
+		return fmt.Errorf("failed to delete expired stream tickets: %w", err)
+	}
+
+	query = `INSERT INTO stream_tickets (user_id, token_hash, expires_at) VALUES (?, ?, ?)`
+	if _, err = r.dialect.insert(ctx, r.db, query, userID, tokenHash, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("failed to create stream ticket: %w", err)
+	}
+	return nil
+}
+
+// ConsumeStreamTicket claims the ticket by deleting it, so two concurrent
+// streams cannot both use it
+func (r *SQLUserRepository) ConsumeStreamTicket(ctx context.Context, tokenHash string, now time.Time) (userID int64, err error) {
+	query := `SELECT user_id FROM stream_tickets WHERE token_hash = ? AND expires_at > ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.ConsumeStreamTicket", query)
+	defer func() { done(err) }()
+
+	if err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), tokenHash, now.UTC()).Scan(&userID); err != nil {
+		return 0, fmt.Errorf("failed to consume stream ticket: %w", err)
+	}
+
+	query = `DELETE FROM stream_tickets WHERE token_hash = ?`
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), tokenHash)
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume stream ticket: %w", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume stream ticket: %w", err)
+	}
+	if claimed == 0 {
+		return 0, fmt.Errorf("failed to consume stream ticket: %w", sql.ErrNoRows)
+	}
+	return userID, nil
+}
+
+func (r *SQLUserRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) (err error) {
+	query := `INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at) VALUES (?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "UserRepository.CreateRefreshToken", query)
+	defer func() { done(err) }()
+
+	token.ID, err = r.dialect.insert(ctx, r.db, query, token.FamilyID, token.UserID, token.TokenHash, token.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) GetRefreshToken(ctx context.Context, tokenHash string) (token *RefreshToken, err error) {
+	query := `SELECT id, family_id, user_id, token_hash, expires_at, used_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.GetRefreshToken", query)
+	defer func() { done(err) }()
+
+	var t RefreshToken
+	err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), tokenHash).Scan(&t.ID, &t.FamilyID, &t.UserID, &t.TokenHash,
+		&t.ExpiresAt, &t.UsedAt, &t.RevokedAt, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+	return &t, nil
+}
+
+// UseRefreshToken claims the token with a conditional update, so two
+// concurrent refreshes cannot both rotate it
+func (r *SQLUserRepository) UseRefreshToken(ctx context.Context, id int64, now time.Time) (err error) {
+	query := `UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL`
+	ctx, done := r.startQuery(ctx, "UserRepository.UseRefreshToken", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to use refresh token: %w", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to use refresh token: %w", err)
+	}
+	if claimed == 0 {
+		return fmt.Errorf("failed to use refresh token: %w", sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string, now time.Time) (err error) {
+	query := `UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`
+	ctx, done := r.startQuery(ctx, "UserRepository.RevokeRefreshTokenFamily", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), familyID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) RevokeUserRefreshTokens(ctx context.Context, userID int64, now time.Time) (err error) {
+	query := `UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`
+	ctx, done := r.startQuery(ctx, "UserRepository.RevokeUserRefreshTokens", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), userID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) IsRefreshTokenFamilyRevoked(ctx context.Context, familyID string) (revoked bool, err error) {
+	query := `SELECT COUNT(*), COUNT(revoked_at) FROM refresh_tokens WHERE family_id = ?`
+	ctx, done := r.startQuery(ctx, "UserRepository.IsRefreshTokenFamilyRevoked", query)
+	defer func() { done(err) }()
+
+	var tokens, revokedTokens int64
+	if err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), familyID).Scan(&tokens, &revokedTokens); err != nil {
+		return false, fmt.Errorf("failed to check refresh token family: %w", err)
+	}
+	return tokens == 0 || revokedTokens > 0, nil
+}
+
+
+// SQLWebhookRepository implements WebhookRepository on a SQL database
+type SQLWebhookRepository struct {
+	sqlRepository
+}
+
+func NewSQLWebhookRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLWebhookRepository {
+	return &SQLWebhookRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+const webhookColumns = `id, workspace_id, url, secret, event_types, active, created_at, updated_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var webhook Webhook
+	var eventTypes string
+	err := row.Scan(&webhook.ID, &webhook.WorkspaceID, &webhook.URL, &webhook.Secret, &eventTypes, &webhook.Active,
+		&webhook.CreatedAt, &webhook.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	webhook.EventTypes = strings.Split(eventTypes, ",")
+	return &webhook, nil
+}
+
+func (r *SQLWebhookRepository) Create(ctx context.Context, webhook *Webhook) (created *Webhook, err error) {
+	query := `INSERT INTO webhooks (workspace_id, url, secret, event_types, active) VALUES (?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.Create", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, webhook.WorkspaceID, webhook.URL, webhook.Secret, strings.Join(webhook.EventTypes, ","), webhook.Active)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	return r.GetByID(ctx, webhook.WorkspaceID, id)
+}
+
+func (r *SQLWebhookRepository) GetByID(ctx context.Context, workspaceID, id int64) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ? AND workspace_id = ?`
+	return r.getWebhook(ctx, "WebhookRepository.GetByID", query, id, workspaceID)
+}
+
+func (r *SQLWebhookRepository) GetForDelivery(ctx context.Context, id int64) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	return r.getWebhook(ctx, "WebhookRepository.GetForDelivery", query, id)
+}
+
+func (r *SQLWebhookRepository) getWebhook(ctx context.Context, name, query string, args ...interface{}) (webhook *Webhook, err error) {
+	ctx, done := r.startQuery(ctx, name, query)
+	defer func() { done(err) }()
+
+	webhook, err = scanWebhook(r.db.QueryRowContext(ctx, r.dialect.rebind(query), args...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook by ID: %w", err)
+	}
+
+	return webhook, nil
+}
+
+func (r *SQLWebhookRepository) GetAll(ctx context.Context, workspaceID int64) (webhooks []Webhook, err error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE workspace_id = ? ORDER BY created_at DESC`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.GetAll", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks = []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+
+	return webhooks, nil
+}
+
+// GetActiveForEvent returns the active webhooks of a workspace subscribed to
+// eventType
+func (r *SQLWebhookRepository) GetActiveForEvent(ctx context.Context, workspaceID int64, eventType string) ([]Webhook, error) {
+	webhooks, err := r.GetAll(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterWebhooksForEvent(webhooks, eventType), nil
+}
+
+// filterWebhooksForEvent keeps the active webhooks subscribed to eventType
+func filterWebhooksForEvent(webhooks []Webhook, eventType string) []Webhook {
+	var subscribed []Webhook
+	for _, webhook := range webhooks {
+		if !webhook.Active {
+			continue
+		}
+		for _, t := range webhook.EventTypes {
+			if t == eventType {
+				subscribed = append(subscribed, webhook)
+				break
+			}
+		}
+	}
+
+	return subscribed
+}
+
+func (r *SQLWebhookRepository) Update(ctx context.Context, webhook *Webhook) (err error) {
+	query := `UPDATE webhooks SET url = ?, secret = ?, event_types = ?, active = ?, updated_at = CURRENT_TIMESTAMP
+			  WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.Update", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), webhook.URL, webhook.Secret, strings.Join(webhook.EventTypes, ","), webhook.Active,
+		webhook.ID, webhook.WorkspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLWebhookRepository) Delete(ctx context.Context, workspaceID, id int64) (err error) {
+	query := `DELETE FROM webhooks WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.Delete", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+	response_status, error_message, delivered_at, locked_until, created_at, updated_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventType, &delivery.Payload, &delivery.Status,
+		&delivery.Attempts, &delivery.NextAttemptAt, &delivery.ResponseStatus,
+		&delivery.ErrorMessage, &delivery.DeliveredAt, &delivery.LockedUntil, &delivery.CreatedAt, &delivery.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// CreateDelivery queues a pending delivery that is due immediately
+func (r *SQLWebhookRepository) CreateDelivery(ctx context.Context, webhookID int64, eventType, payload string) (delivery *WebhookDelivery, err error) {
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_at)
+			  VALUES (?, ?, ?, 'pending', ?)`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.CreateDelivery", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, webhookID, eventType, payload, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook delivery: %w", err)
+	}
+
+	return r.GetDeliveryByID(ctx, webhookID, id)
+}
+
+func (r *SQLWebhookRepository) GetDeliveryByID(ctx context.Context, webhookID, id int64) (delivery *WebhookDelivery, err error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = ? AND webhook_id = ?`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.GetDeliveryByID", query)
+	defer func() { done(err) }()
+
+	delivery, err = scanWebhookDelivery(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id, webhookID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook delivery by ID: %w", err)
+	}
+
+	return delivery, nil
+}
+
+// GetDeliveries returns the most recent deliveries of a webhook
+func (r *SQLWebhookRepository) GetDeliveries(ctx context.Context, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+			  WHERE webhook_id = ? ORDER BY created_at DESC, id DESC LIMIT ?`
+	return r.queryDeliveries(ctx, "WebhookRepository.GetDeliveries", query, webhookID, limit)
+}
+
+// ClaimDueDeliveries claims up to limit pending deliveries whose next attempt
+// is due and that no one else has claimed, until lockedUntil. Candidates
+// another replica claims first are left out.
+func (r *SQLWebhookRepository) ClaimDueDeliveries(ctx context.Context, limit int, now, lockedUntil time.Time) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+			  WHERE status = 'pending' AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until <= ?)
+			  ORDER BY next_attempt_at ASC LIMIT ?`
+	candidates, err := r.queryDeliveries(ctx, "WebhookRepository.ClaimDueDeliveries", query, now, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := []WebhookDelivery{}
+	for _, delivery := range candidates {
+		ok, err := r.ClaimDelivery(ctx, delivery.ID, now, lockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			until := lockedUntil
+			delivery.LockedUntil = &until
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed, nil
+}
+
+// ClaimDelivery claims a pending delivery until lockedUntil, unless someone
+// else holds a claim on it. The update is conditional, so of replicas racing
+// for a delivery exactly one gets it.
+func (r *SQLWebhookRepository) ClaimDelivery(ctx context.Context, id int64, now, lockedUntil time.Time) (claimed bool, err error) {
+	query := `UPDATE webhook_deliveries SET locked_until = ?
+			  WHERE id = ? AND status = 'pending' AND (locked_until IS NULL OR locked_until <= ?)`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.ClaimDelivery", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), lockedUntil.UTC(), id, now.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to claim webhook delivery: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim webhook delivery: %w", err)
+	}
+	return rows == 1, nil
+}
+
+func (r *SQLWebhookRepository) queryDeliveries(ctx context.Context, name, query string, args ...interface{}) (deliveries []WebhookDelivery, err error) {
+	ctx, done := r.startQuery(ctx, name, query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries = []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+
+	return deliveries, nil
+}
+
+// UpdateDelivery stores the outcome of a delivery attempt and releases its
+// claim
+func (r *SQLWebhookRepository) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) (err error) {
+	query := `UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, response_status = ?,
+			  error_message = ?, delivered_at = ?, locked_until = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	ctx, done := r.startQuery(ctx, "WebhookRepository.UpdateDelivery", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.ResponseStatus,
+		delivery.ErrorMessage, delivery.DeliveredAt, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// SQLStatsRepository implements StatsRepository with aggregate queries
+type SQLStatsRepository struct {
+	sqlRepository
+}
+
+func NewSQLStatsRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLStatsRepository {
+	return &SQLStatsRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+// query runs one of the stats queries, calling scan for each row
+func (r *SQLStatsRepository) query(ctx context.Context, name, query string, args []interface{}, scan func(rows *sql.Rows) error) (err error) {
+	ctx, done := r.startQuery(ctx, "StatsRepository."+name, query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to get %s stats: %w", name, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return fmt.Errorf("failed to scan %s stats: %w", name, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get %s stats: %w", name, err)
+	}
+	return nil
+}
+
+func (r *SQLStatsRepository) Get(ctx context.Context, opts StatsOptions) (*Stats, error) {
+	stats := newStats(opts)
+	d := r.dialect
+	workspaceArgs := []interface{}{opts.WorkspaceID}
+	inRange := "workspace_id = ? AND completed_at >= ? AND completed_at < ?"
+	rangeArgs := []interface{}{opts.WorkspaceID, d.timeArg(opts.From), d.timeArg(opts.To)}
+
+	err := r.query(ctx, "StatusCounts", `SELECT status, COUNT(*) FROM urls WHERE workspace_id = ? GROUP BY status`, workspaceArgs, func(rows *sql.Rows) error {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return err
+		}
+		stats.StatusCounts[status] = count
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	day := d.day("completed_at")
+	query := `SELECT ` + day + ` AS day,
+		SUM(CASE WHEN status = 'completed' THEN 1 ELSE 0 END),
+		SUM(CASE WHEN status = 'failed' THEN 1 ELSE 0 END)
+		FROM urls WHERE status IN ('completed', 'failed') AND ` + inRange + ` GROUP BY ` + day
+	err = r.query(ctx, "Daily", query, rangeArgs, func(rows *sql.Rows) error {
+		var date string
+		var completed, failed int64
+		if err := rows.Scan(&date, &completed, &failed); err != nil {
+			return err
+		}
+		if entry := stats.day(date); entry != nil {
+			entry.Completed, entry.Failed = completed, failed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Percentiles are read by rank, which works the same on every database
+	durations := `FROM urls WHERE status = 'completed' AND started_at IS NOT NULL AND started_at <= completed_at AND ` + inRange
+	seconds := d.seconds("started_at", "completed_at")
+	err = r.query(ctx, "CrawlDuration", `SELECT COUNT(*), AVG(`+seconds+`) `+durations, rangeArgs, func(rows *sql.Rows) error {
+		var average sql.NullFloat64
+		if err := rows.Scan(&stats.CrawlDuration.Count, &average); err != nil {
+			return err
+		}
+		if average.Valid {
+			stats.CrawlDuration.AverageSeconds = &average.Float64
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stats.CrawlDuration.Count > 0 {
+		query := `SELECT ` + seconds + ` AS seconds ` + durations + ` ORDER BY seconds LIMIT 1 OFFSET ?`
+		for _, p := range statsPercentiles {
+			p := p
+			args := append(rangeArgs[:len(rangeArgs):len(rangeArgs)], percentileRank(stats.CrawlDuration.Count, p)-1)
+			err = r.query(ctx, "CrawlDurationPercentile", query, args, func(rows *sql.Rows) error {
+				var value float64
+				if err := rows.Scan(&value); err != nil {
+					return err
+				}
+				stats.CrawlDuration.setPercentile(p, value)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	query = `SELECT COALESCE(SUM(a.broken_links_count), 0), COUNT(*), COALESCE(SUM(CASE WHEN a.has_login_form THEN 1 ELSE 0 END), 0)
+		FROM analysis_results a JOIN urls u ON u.id = a.url_id WHERE u.workspace_id = ?`
+	err = r.query(ctx, "Analysis", query, workspaceArgs, func(rows *sql.Rows) error {
+		return rows.Scan(&stats.TotalBrokenLinks, &stats.LoginForms.Analyzed, &stats.LoginForms.WithLoginForm)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `SELECT ` + d.host("u.url") + ` AS domain, SUM(a.broken_links_count) AS broken_links, COUNT(*)
+		FROM urls u JOIN analysis_results a ON a.url_id = u.id WHERE u.workspace_id = ?
+		GROUP BY 1 HAVING SUM(a.broken_links_count) > 0
+		ORDER BY broken_links DESC, domain LIMIT ?`
+	err = r.query(ctx, "TopBrokenDomains", query, []interface{}{opts.WorkspaceID, statsTopLimit}, func(rows *sql.Rows) error {
+		var domain DomainBrokenLinks
+		if err := rows.Scan(&domain.Domain, &domain.BrokenLinks, &domain.URLs); err != nil {
+			return err
+		}
+		stats.TopBrokenDomains = append(stats.TopBrokenDomains, domain)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `SELECT error_message, COUNT(*) AS failures FROM urls
+		WHERE status = 'failed' AND error_message IS NOT NULL AND ` + inRange + `
+		GROUP BY error_message ORDER BY failures DESC, error_message LIMIT ?`
+	err = r.query(ctx, "TopFailures", query, append(rangeArgs[:len(rangeArgs):len(rangeArgs)], statsTopLimit), func(rows *sql.Rows) error {
+		var failure FailureCount
+		if err := rows.Scan(&failure.Message, &failure.Count); err != nil {
+			return err
+		}
+		stats.TopFailures = append(stats.TopFailures, failure)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.finish()
+	return stats, nil
+}
+
+// SQLWorkspaceRepository implements WorkspaceRepository on a SQL database
+type SQLWorkspaceRepository struct {
+	sqlRepository
+}
+
+func NewSQLWorkspaceRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLWorkspaceRepository {
+	return &SQLWorkspaceRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+const workspaceColumns = `w.id, w.name, w.created_at, w.updated_at`
+
+func scanWorkspace(row rowScanner, extra ...interface{}) (*Workspace, error) {
+	var workspace Workspace
+	dest := []interface{}{&workspace.ID, &workspace.Name, &workspace.CreatedAt, &workspace.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &workspace, nil
+}
+
+func (r *SQLWorkspaceRepository) Create(ctx context.Context, name string) (workspace *Workspace, err error) {
+	query := `INSERT INTO workspaces (name) VALUES (?)`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.Create", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+
+	return r.GetByID(ctx, id)
+}
+
+func (r *SQLWorkspaceRepository) GetByID(ctx context.Context, id int64) (workspace *Workspace, err error) {
+	query := `SELECT ` + workspaceColumns + ` FROM workspaces w WHERE w.id = ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.GetByID", query)
+	defer func() { done(err) }()
+
+	workspace, err = scanWorkspace(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace by ID: %w", err)
+	}
+	return workspace, nil
+}
+
+func (r *SQLWorkspaceRepository) Lock(ctx context.Context, id int64) (err error) {
+	// SQLite has no row locks; any write takes the database write lock
+	query := `SELECT id FROM workspaces WHERE id = ? FOR UPDATE`
+	if r.dialect == sqliteDialect {
+		query = `UPDATE workspaces SET id = id WHERE id = ?`
+	}
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.Lock", query)
+	defer func() { done(err) }()
+
+	if r.dialect == sqliteDialect {
+		_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), id)
+	} else {
+		err = r.db.QueryRowContext(ctx, r.dialect.rebind(query), id).Scan(&id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock workspace: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLWorkspaceRepository) GetForUser(ctx context.Context, userID int64) (workspaces []Workspace, err error) {
+	query := `SELECT ` + workspaceColumns + `, m.role FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ? ORDER BY w.id`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.GetForUser", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	workspaces = []Workspace{}
+	for rows.Next() {
+		var role string
+		workspace, err := scanWorkspace(rows, &role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %w", err)
+		}
+		workspace.Role = role
+		workspaces = append(workspaces, *workspace)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+
+	return workspaces, nil
+}
+
+// memberColumns is the column list matched by scanMember
+const memberColumns = `m.workspace_id, m.user_id, u.username, u.email, m.role, m.created_at, m.updated_at`
+
+func scanMember(row rowScanner) (*WorkspaceMember, error) {
+	var member WorkspaceMember
+	err := row.Scan(&member.WorkspaceID, &member.UserID, &member.Username, &member.Email, &member.Role,
+		&member.CreatedAt, &member.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (r *SQLWorkspaceRepository) GetMember(ctx context.Context, workspaceID, userID int64) (member *WorkspaceMember, err error) {
+	query := `SELECT ` + memberColumns + ` FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ? AND m.user_id = ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.GetMember", query)
+	defer func() { done(err) }()
+
+	member, err = scanMember(r.db.QueryRowContext(ctx, r.dialect.rebind(query), workspaceID, userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace member: %w", err)
+	}
+	return member, nil
+}
+
+func (r *SQLWorkspaceRepository) GetMembers(ctx context.Context, workspaceID int64) (members []WorkspaceMember, err error) {
+	query := `SELECT ` + memberColumns + ` FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ? ORDER BY u.username`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.GetMembers", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace members: %w", err)
+	}
+	defer rows.Close()
+
+	members = []WorkspaceMember{}
+	for rows.Next() {
+		member, err := scanMember(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workspace member: %w", err)
+		}
+		members = append(members, *member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get workspace members: %w", err)
+	}
+
+	return members, nil
+}
+
+func (r *SQLWorkspaceRepository) AddMember(ctx context.Context, workspaceID, userID int64, role string) (err error) {
+	query := `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES (?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.AddMember", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), workspaceID, userID, role)
+	if r.dialect.isDuplicate(err) {
+		return ErrAlreadyMember
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add workspace member: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLWorkspaceRepository) UpdateMemberRole(ctx context.Context, workspaceID, userID int64, role string) (err error) {
+	query := `UPDATE workspace_members SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE workspace_id = ? AND user_id = ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.UpdateMemberRole", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), role, workspaceID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update workspace member: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLWorkspaceRepository) RemoveMember(ctx context.Context, workspaceID, userID int64) (err error) {
+	query := `DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.RemoveMember", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), workspaceID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove workspace member: %w", err)
+	}
+	return nil
+}
+
+const invitationColumns = `id, workspace_id, role, email, token_hash, invited_by, expires_at, accepted_at, accepted_by, created_at`
+
+func scanInvitation(row rowScanner) (*WorkspaceInvitation, error) {
+	var invitation WorkspaceInvitation
+	err := row.Scan(&invitation.ID, &invitation.WorkspaceID, &invitation.Role, &invitation.Email, &invitation.TokenHash,
+		&invitation.InvitedBy, &invitation.ExpiresAt, &invitation.AcceptedAt, &invitation.AcceptedBy, &invitation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func (r *SQLWorkspaceRepository) CreateInvitation(ctx context.Context, invitation *WorkspaceInvitation) (created *WorkspaceInvitation, err error) {
+	query := `INSERT INTO workspace_invitations (workspace_id, role, email, token_hash, invited_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.CreateInvitation", query)
+	defer func() { done(err) }()
+
+	id, err := r.dialect.insert(ctx, r.db, query, invitation.WorkspaceID, invitation.Role, invitation.Email,
+		invitation.TokenHash, invitation.InvitedBy, invitation.ExpiresAt.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace invitation: %w", err)
+	}
+
+	query = `SELECT ` + invitationColumns + ` FROM workspace_invitations WHERE id = ?`
+	created, err = scanInvitation(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace invitation: %w", err)
+	}
+	return created, nil
+}
+
+func (r *SQLWorkspaceRepository) GetInvitations(ctx context.Context, workspaceID int64) (invitations []WorkspaceInvitation, err error) {
+	query := `SELECT ` + invitationColumns + ` FROM workspace_invitations
+		WHERE workspace_id = ? AND accepted_at IS NULL ORDER BY created_at DESC, id DESC`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.GetInvitations", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace invitations: %w", err)
+	}
+	defer rows.Close()
+
+	invitations = []WorkspaceInvitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workspace invitation: %w", err)
+		}
+		invitations = append(invitations, *invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get workspace invitations: %w", err)
+	}
+
+	return invitations, nil
+}
+
+func (r *SQLWorkspaceRepository) DeleteInvitation(ctx context.Context, workspaceID, id int64) (err error) {
+	query := `DELETE FROM workspace_invitations WHERE id = ? AND workspace_id = ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.DeleteInvitation", query)
+	defer func() { done(err) }()
+
+	_, err = r.db.ExecContext(ctx, r.dialect.rebind(query), id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace invitation: %w", err)
+	}
+	return nil
+}
+
+// ConsumeInvitation claims the invitation with a conditional update, so it
+// can only be accepted once
+func (r *SQLWorkspaceRepository) ConsumeInvitation(ctx context.Context, tokenHash string, userID int64, now time.Time) (invitation *WorkspaceInvitation, err error) {
+	query := `UPDATE workspace_invitations SET accepted_at = ?, accepted_by = ? WHERE token_hash = ? AND accepted_at IS NULL AND expires_at > ?`
+	ctx, done := r.startQuery(ctx, "WorkspaceRepository.ConsumeInvitation", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), userID, tokenHash, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume workspace invitation: %w", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume workspace invitation: %w", err)
+	}
+	if claimed == 0 {
+		return nil, fmt.Errorf("failed to consume workspace invitation: %w", sql.ErrNoRows)
+	}
+
+	query = `SELECT ` + invitationColumns + ` FROM workspace_invitations WHERE token_hash = ?`
+	invitation, err = scanInvitation(r.db.QueryRowContext(ctx, r.dialect.rebind(query), tokenHash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume workspace invitation: %w", err)
+	}
+	return invitation, nil
+}
+
+// SQLAPIKeyRepository implements APIKeyRepository on a SQL database
+type SQLAPIKeyRepository struct {
+	sqlRepository
+}
+
+func NewSQLAPIKeyRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLAPIKeyRepository {
+	return &SQLAPIKeyRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+const apiKeyColumns = `id, user_id, workspace_id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	err := row.Scan(&key.ID, &key.UserID, &key.WorkspaceID, &key.Name, &key.Prefix, &key.KeyHash, &scopes,
+		&key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	return &key, nil
+}
+
+func (r *SQLAPIKeyRepository) Create(ctx context.Context, key *APIKey) (created *APIKey, err error) {
+	query := `INSERT INTO api_keys (user_id, workspace_id, name, prefix, key_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	ctx, done := r.startQuery(ctx, "APIKeyRepository.Create", query)
+	defer func() { done(err) }()
+
+	var expiresAt *time.Time
+	if key.ExpiresAt != nil {
+		utc := key.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	id, err := r.dialect.insert(ctx, r.db, query, key.UserID, key.WorkspaceID, key.Name, key.Prefix, key.KeyHash,
+		strings.Join(key.Scopes, ","), expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	query = `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = ?`
+	created, err = scanAPIKey(r.db.QueryRowContext(ctx, r.dialect.rebind(query), id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return created, nil
+}
+
+func (r *SQLAPIKeyRepository) GetByHash(ctx context.Context, keyHash string) (key *APIKey, err error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?`
+	ctx, done := r.startQuery(ctx, "APIKeyRepository.GetByHash", query)
+	defer func() { done(err) }()
+
+	key, err = scanAPIKey(r.db.QueryRowContext(ctx, r.dialect.rebind(query), keyHash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+func (r *SQLAPIKeyRepository) GetForUser(ctx context.Context, userID int64) (keys []APIKey, err error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = ? ORDER BY id DESC`
+	ctx, done := r.startQuery(ctx, "APIKeyRepository.GetForUser", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys = []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate API keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (r *SQLAPIKeyRepository) Delete(ctx context.Context, userID, id int64) (err error) {
+	query := `DELETE FROM api_keys WHERE id = ? AND user_id = ?`
+	ctx, done := r.startQuery(ctx, "APIKeyRepository.Delete", query)
+	defer func() { done(err) }()
+
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("failed to delete API key: %w", sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (r *SQLAPIKeyRepository) UpdateLastUsed(ctx context.Context, id int64, now time.Time) (err error) {
+	query := `UPDATE api_keys SET last_used_at = ? WHERE id = ?`
+	ctx, done := r.startQuery(ctx, "APIKeyRepository.UpdateLastUsed", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), now.UTC(), id); err != nil {
+		return fmt.Errorf("failed to update API key last use: %w", err)
+	}
+	return nil
+}
+
+// SQLLoginThrottleRepository implements LoginThrottleRepository on a SQL
+// database
+type SQLLoginThrottleRepository struct {
+	sqlRepository
+}
+
+func NewSQLLoginThrottleRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLLoginThrottleRepository {
+	return &SQLLoginThrottleRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+const loginFailureColumns = `scope, subject, failures, last_failed_at, locked_until`
+
+func scanLoginFailure(row rowScanner) (*LoginFailure, error) {
+	var failure LoginFailure
+	if err := row.Scan(&failure.Scope, &failure.Subject, &failure.Failures, &failure.LastFailedAt, &failure.LockedUntil); err != nil {
+		return nil, err
+	}
+	return &failure, nil
+}
+
+func (r *SQLLoginThrottleRepository) GetFailure(ctx context.Context, scope, subject string) (failure *LoginFailure, err error) {
+	query := `SELECT ` + loginFailureColumns + ` FROM login_failures WHERE scope = ? AND subject = ?`
+	ctx, done := r.startQuery(ctx, "LoginThrottleRepository.GetFailure", query)
+	defer func() { done(err) }()
+
+	failure, err = scanLoginFailure(r.db.QueryRowContext(ctx, r.dialect.rebind(query), scope, subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
+	}
+	return failure, nil
+}
+
+// RecordFailure increments the count in place, so concurrent failures are
+// all counted, and inserts the first failure of a subject
+func (r *SQLLoginThrottleRepository) RecordFailure(ctx context.Context, scope, subject string, now, windowStart time.Time) (failure *LoginFailure, err error) {
+	query := `UPDATE login_failures
+		SET failures = CASE WHEN last_failed_at < ? THEN 1 ELSE failures + 1 END, last_failed_at = ?
+		WHERE scope = ? AND subject = ?`
+	ctx, done := r.startQuery(ctx, "LoginThrottleRepository.RecordFailure", query)
+	defer func() { done(err) }()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := r.db.ExecContext(ctx, r.dialect.rebind(query), windowStart.UTC(), now.UTC(), scope, subject)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record login failure: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("failed to record login failure: %w", err)
+		}
+		if updated > 0 {
+			break
+		}
+
+		// A concurrent first failure may insert the row first; the update
+		// then counts this one
+		insert := `INSERT INTO login_failures (scope, subject, failures, last_failed_at) VALUES (?, ?, 1, ?)`
+		_, err = r.db.ExecContext(ctx, r.dialect.rebind(insert), scope, subject, now.UTC())
+		if err == nil {
+			break
+		}
+		if !r.dialect.isDuplicate(err) {
+			return nil, fmt.Errorf("failed to record login failure: %w", err)
+		}
+	}
+
+	get := `SELECT ` + loginFailureColumns + ` FROM login_failures WHERE scope = ? AND subject = ?`
+	failure, err = scanLoginFailure(r.db.QueryRowContext(ctx, r.dialect.rebind(get), scope, subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
+	}
+	return failure, nil
+}
+
+func (r *SQLLoginThrottleRepository) Lock(ctx context.Context, failure *LoginFailure, lockedUntil, now time.Time) (err error) {
+	query := `UPDATE login_failures SET locked_until = ? WHERE scope = ? AND subject = ?`
+	ctx, done := r.startQuery(ctx, "LoginThrottleRepository.Lock", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), lockedUntil.UTC(), failure.Scope, failure.Subject); err != nil {
+		return fmt.Errorf("failed to lock login: %w", err)
+	}
+
+	query = `INSERT INTO login_lockouts (scope, subject, failures, locked_until, created_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err = r.dialect.insert(ctx, r.db, query, failure.Scope, failure.Subject, failure.Failures, lockedUntil.UTC(), now.UTC()); err != nil {
+		return fmt.Errorf("failed to record login lockout: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLLoginThrottleRepository) ClearFailures(ctx context.Context, scope, subject string) (err error) {
+	query := `DELETE FROM login_failures WHERE scope = ? AND subject = ?`
+	ctx, done := r.startQuery(ctx, "LoginThrottleRepository.ClearFailures", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), scope, subject); err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLLoginThrottleRepository) GetLockouts(ctx context.Context, since time.Time) (lockouts []LoginLockout, err error) {
+	query := `SELECT id, scope, subject, failures, locked_until, created_at FROM login_lockouts
+		WHERE created_at >= ? ORDER BY created_at DESC, id DESC`
+	ctx, done := r.startQuery(ctx, "LoginThrottleRepository.GetLockouts", query)
+	defer func() { done(err) }()
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login lockouts: %w", err)
+	}
+	defer rows.Close()
+
+	lockouts = []LoginLockout{}
+	for rows.Next() {
+		var lockout LoginLockout
+		if err := rows.Scan(&lockout.ID, &lockout.Scope, &lockout.Subject, &lockout.Failures, &lockout.LockedUntil, &lockout.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan login lockout: %w", err)
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate login lockouts: %w", err)
+	}
+
+	return lockouts, nil
+}
+
+// SQLRateLimitRepository implements RateLimitRepository on a SQL database,
+// so replicas share their limits
+type SQLRateLimitRepository struct {
+	sqlRepository
+}
+
+func NewSQLRateLimitRepository(db *sql.DB, dialect *sqlDialect, timeout time.Duration) *SQLRateLimitRepository {
+	return &SQLRateLimitRepository{sqlRepository{db: db, dialect: dialect, timeout: timeout}}
+}
+
+// rateLimitTakeAttempts is how often Take retries when another replica
+// changed the bucket between reading and writing it
+const rateLimitTakeAttempts = 5
+
+// Take reads the bucket and writes it back only if no one else has since,
+// comparing refilled_at, which every write moves forward
+func (r *SQLRateLimitRepository) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (result RateLimitResult, err error) {
+	query := `SELECT tokens, refilled_at FROM rate_limit_buckets WHERE bucket_key = ?`
+	ctx, done := r.startQuery(ctx, "RateLimitRepository.Take", query)
+	defer func() { done(err) }()
+
+	for attempt := 0; attempt < rateLimitTakeAttempts; attempt++ {
+		var tokens float64
+		var refilledAt int64
+		err := r.db.QueryRowContext(ctx, r.dialect.rebind(query), key).Scan(&tokens, &refilledAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			bucket, result := limit.take(nil, now)
+			insert := `INSERT INTO rate_limit_buckets (bucket_key, tokens, refilled_at) VALUES (?, ?, ?)`
+			_, err = r.db.ExecContext(ctx, r.dialect.rebind(insert), key, bucket.Tokens, bucket.RefilledAt.UnixMicro())
+			if r.dialect.isDuplicate(err) {
+				continue
+			}
+			if err != nil {
+				return RateLimitResult{}, fmt.Errorf("failed to create rate limit bucket: %w", err)
+			}
+			return result, nil
+		}
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("failed to get rate limit bucket: %w", err)
+		}
+
+		bucket, result := limit.take(&rateLimitBucket{Tokens: tokens, RefilledAt: time.UnixMicro(refilledAt)}, now)
+		if !result.Allowed {
+			// Refused requests leave the bucket as it was
+			return result, nil
+		}
+		next := bucket.RefilledAt.UnixMicro()
+		if next <= refilledAt {
+			next = refilledAt + 1
+		}
+
+		update := `UPDATE rate_limit_buckets SET tokens = ?, refilled_at = ? WHERE bucket_key = ? AND refilled_at = ?`
+		updated, err := r.db.ExecContext(ctx, r.dialect.rebind(update), bucket.Tokens, next, key, refilledAt)
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("failed to update rate limit bucket: %w", err)
+		}
+		count, err := updated.RowsAffected()
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("failed to update rate limit bucket: %w", err)
+		}
+		if count > 0 {
+			return result, nil
+		}
+	}
+
+	return RateLimitResult{}, fmt.Errorf("failed to update rate limit bucket %q: too many concurrent updates", key)
+}
+
+func (r *SQLRateLimitRepository) Prune(ctx context.Context, before time.Time) (err error) {
+	query := `DELETE FROM rate_limit_buckets WHERE refilled_at < ?`
+	ctx, done := r.startQuery(ctx, "RateLimitRepository.Prune", query)
+	defer func() { done(err) }()
+
+	if _, err = r.db.ExecContext(ctx, r.dialect.rebind(query), before.UnixMicro()); err != nil {
+		return fmt.Errorf("failed to prune rate limit buckets: %w", err)
+	}
+	return nil
+}
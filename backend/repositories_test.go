@@ -0,0 +1,1505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// forEachStore runs the repository conformance tests against a fresh store of
+// every backend. The in-memory and SQLite stores always run; MySQL and
+// PostgreSQL run when TEST_MYSQL_DSN or TEST_POSTGRES_DSN point at a
+// disposable database, which is reset by migrating it down and up again.
+func forEachStore(t *testing.T, test func(t *testing.T, store *Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := initSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("initSQLite() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, migratedTestStore(t, db, sqliteDialect))
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		dsn := os.Getenv("TEST_MYSQL_DSN")
+		if dsn == "" {
+			t.Skip("TEST_MYSQL_DSN is not set")
+		}
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			t.Fatalf("sql.Open() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, migratedTestStore(t, db, mysqlDialect))
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_DSN is not set")
+		}
+		db, err := openPostgres(dsn)
+		if err != nil {
+			t.Fatalf("openPostgres() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, migratedTestStore(t, db, postgresDialect))
+	})
+}
+
+func migratedTestStore(t *testing.T, db *sql.DB, dialect *sqlDialect) *Store {
+	t.Helper()
+	ctx := context.Background()
+
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		t.Fatalf("NewMigrator() error = %v", err)
+	}
+	if _, err := migrator.Down(ctx, len(migrator.migrations)); err != nil {
+		t.Fatalf("Down() error = %v", err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+
+	return NewSQLStore(db, dialect, 5*time.Second)
+}
+
+func TestURLRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		repo := store.URLs
+
+		depth, oldest, err := repo.QueueStats(ctx)
+		if err != nil || depth != 0 || oldest != nil {
+			t.Errorf("QueueStats() on empty store = %d, %v, %v", depth, oldest, err)
+		}
+
+		url, err := repo.Create(ctx, defaultWorkspaceID, "Example.com", "https://example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if url.ID == 0 || url.Status != "queued" || url.OriginalURL != "Example.com" {
+			t.Errorf("Create() = %+v", url)
+		}
+
+		if _, err := repo.Create(ctx, defaultWorkspaceID, "example.com", "https://example.com/"); !errors.Is(err, ErrDuplicateURL) {
+			t.Errorf("Create() duplicate error = %v, want ErrDuplicateURL", err)
+		}
+
+		found, err := repo.GetByCanonicalURL(ctx, defaultWorkspaceID, "https://example.com/")
+		if err != nil || found.ID != url.ID {
+			t.Errorf("GetByCanonicalURL() = %+v, %v", found, err)
+		}
+
+		depth, oldest, err = repo.QueueStats(ctx)
+		if err != nil || depth != 1 || oldest == nil {
+			t.Errorf("QueueStats() = %d, %v, %v; want 1 queued", depth, oldest, err)
+		}
+
+		queued, err := repo.GetQueuedURLs(ctx)
+		if err != nil || len(queued) != 1 || queued[0].ID != url.ID {
+			t.Errorf("GetQueuedURLs() = %+v, %v", queued, err)
+		}
+
+		// Only one claim of a queued URL succeeds, and only in its workspace
+		otherWorkspace := defaultWorkspaceID + 1000
+		if claimed, err := repo.ClaimQueued(ctx, otherWorkspace, url.ID); err != nil || claimed {
+			t.Errorf("ClaimQueued(other workspace) = %v, %v, want false", claimed, err)
+		}
+		if claimed, err := repo.ClaimQueued(ctx, url.WorkspaceID, url.ID); err != nil || !claimed {
+			t.Fatalf("ClaimQueued() = %v, %v, want true", claimed, err)
+		}
+		if claimed, err := repo.ClaimQueued(ctx, url.WorkspaceID, url.ID); err != nil || claimed {
+			t.Errorf("ClaimQueued(running) = %v, %v, want false", claimed, err)
+		}
+		if err := repo.UpdateErrorMessage(ctx, url.WorkspaceID, url.ID, "boom"); err != nil {
+			t.Fatalf("UpdateErrorMessage() error = %v", err)
+		}
+		// Updates naming another workspace change nothing
+		if err := repo.UpdateStatus(ctx, otherWorkspace, url.ID, "failed"); err != nil {
+			t.Fatalf("UpdateStatus() error = %v", err)
+		}
+		if err := repo.ClearErrorMessage(ctx, otherWorkspace, url.ID); err != nil {
+			t.Fatalf("ClearErrorMessage() error = %v", err)
+		}
+		url, err = repo.GetByID(ctx, defaultWorkspaceID, url.ID)
+		if err != nil || url.Status != "running" || url.StartedAt == nil || url.ErrorMessage == nil || *url.ErrorMessage != "boom" {
+			t.Errorf("GetByID() after updates = %+v, %v", url, err)
+		}
+
+		other, err := repo.Create(ctx, defaultWorkspaceID, "https://example.org/", "https://example.org/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		list, err := repo.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 10, Status: "running"})
+		if err != nil || *list.Total != 1 || len(list.URLs) != 1 || list.URLs[0].ID != url.ID {
+			t.Errorf("GetAll(status) = %+v, %v", list, err)
+		}
+
+		list, err = repo.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 2, PageSize: 1})
+		if err != nil || *list.Total != 2 || *list.TotalPages != 2 || len(list.URLs) != 1 {
+			t.Errorf("GetAll(page 2) = %+v, %v", list, err)
+		}
+
+		if err := repo.BulkDelete(ctx, defaultWorkspaceID, []int64{url.ID, other.ID}); err != nil {
+			t.Fatalf("BulkDelete() error = %v", err)
+		}
+		if _, err := repo.GetByID(ctx, defaultWorkspaceID, other.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByID() after BulkDelete error = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestURLRepositorySearch(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		pages := []struct {
+			url         string
+			title       string
+			description string
+			text        string
+		}{
+			{"https://shop.example.com/", "Example Shop", "Buy crawling gear", "Sign in to see your orders"},
+			{"https://blog.example.org/posts", "Engineering Blog", "", "We crawled the web and signed up for everything"},
+			{"https://queued.example.net/", "", "", ""},
+		}
+		for _, page := range pages {
+			url, err := store.URLs.Create(ctx, defaultWorkspaceID, page.url, page.url)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if page.title == "" {
+				continue
+			}
+			title, description, text := page.title, page.description, page.text
+			analysis := &AnalysisResult{PageTitle: &title, ExtractedText: &text}
+			if description != "" {
+				analysis.MetaDescription = &description
+			}
+			if err := store.Analysis.Create(ctx, url.ID, analysis); err != nil {
+				t.Fatalf("Analysis.Create() error = %v", err)
+			}
+		}
+
+		tests := []struct {
+			search string
+			want   []string
+		}{
+			{"shop", []string{"https://shop.example.com/"}},
+			{"crawl*", []string{"https://blog.example.org/posts", "https://shop.example.com/"}},
+			{`"sign in"`, []string{"https://shop.example.com/"}},
+			{"example.net", []string{"https://queued.example.net/"}},
+			{"blog signed", []string{"https://blog.example.org/posts"}},
+			{"blog orders", nil},
+		}
+		for _, tt := range tests {
+			list, err := store.URLs.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 10, Search: tt.search})
+			if err != nil {
+				t.Fatalf("GetAll(%q) error = %v", tt.search, err)
+			}
+			var got []string
+			for _, url := range list.URLs {
+				got = append(got, url.URL)
+				if len(url.Highlights) == 0 {
+					t.Errorf("GetAll(%q) returned %s without highlights", tt.search, url.URL)
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") || *list.Total != int64(len(tt.want)) {
+				t.Errorf("GetAll(%q) = %v (total %d), want %v", tt.search, got, *list.Total, tt.want)
+			}
+		}
+
+		list, err := store.URLs.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 10, Search: `"sign in"`})
+		if err != nil || len(list.URLs) != 1 || list.URLs[0].Highlights["extracted_text"] != "<mark>Sign</mark> <mark>in</mark> to see your orders" {
+			t.Errorf("GetAll() highlights = %+v, %v", list, err)
+		}
+	})
+}
+
+func TestURLRepositoryListOptions(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		html5, html4 := "HTML5", "HTML 4.01"
+		pages := []struct {
+			url      string
+			title    string
+			version  *string
+			broken   int
+			hasLogin bool
+		}{
+			{"https://b.example.com/", "Bravo", &html5, 3, true},
+			{"https://a.example.com:8080/x", "Alpha", &html4, 0, false},
+			{"https://c.example.org/", "Charlie", &html5, 7, false},
+			{"https://queued.example.org/", "", nil, 0, false},
+		}
+		ids := map[string]int64{}
+		for _, page := range pages {
+			url, err := store.URLs.Create(ctx, defaultWorkspaceID, page.url, page.url)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			ids[page.url] = url.ID
+			if page.version == nil {
+				continue
+			}
+			title := page.title
+			analysis := &AnalysisResult{PageTitle: &title, HTMLVersion: page.version, BrokenLinksCount: page.broken, HasLoginForm: page.hasLogin}
+			if err := store.Analysis.Create(ctx, url.ID, analysis); err != nil {
+				t.Fatalf("Analysis.Create() error = %v", err)
+			}
+			if err := store.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "completed"); err != nil {
+				t.Fatalf("UpdateStatus() error = %v", err)
+			}
+		}
+
+		hour := time.Hour
+		past, future := time.Now().UTC().Add(-hour), time.Now().UTC().Add(hour)
+		yes, no, one, five := true, false, 1, 5
+		tests := []struct {
+			name string
+			opts URLListOptions
+			want []string
+		}{
+			{"default newest first", URLListOptions{}, []string{"https://queued.example.org/", "https://c.example.org/", "https://a.example.com:8080/x", "https://b.example.com/"}},
+			{"broken links ascending, unanalyzed last", URLListOptions{Sort: "broken_links_count", Ascending: true}, []string{"https://a.example.com:8080/x", "https://b.example.com/", "https://c.example.org/", "https://queued.example.org/"}},
+			{"broken links descending, unanalyzed last", URLListOptions{Sort: "broken_links_count"}, []string{"https://c.example.org/", "https://b.example.com/", "https://a.example.com:8080/x", "https://queued.example.org/"}},
+			{"title", URLListOptions{Sort: "title", Ascending: true}, []string{"https://a.example.com:8080/x", "https://b.example.com/", "https://c.example.org/", "https://queued.example.org/"}},
+			{"has login form", URLListOptions{HasLoginForm: &yes}, []string{"https://b.example.com/"}},
+			{"no login form", URLListOptions{HasLoginForm: &no, Sort: "id", Ascending: true}, []string{"https://a.example.com:8080/x", "https://c.example.org/"}},
+			{"broken links range", URLListOptions{MinBrokenLinks: &one, MaxBrokenLinks: &five}, []string{"https://b.example.com/"}},
+			{"html version", URLListOptions{HTMLVersion: "HTML 4.01"}, []string{"https://a.example.com:8080/x"}},
+			{"host with port", URLListOptions{Host: "a.example.com"}, []string{"https://a.example.com:8080/x"}},
+			{"host", URLListOptions{Host: "c.example.org"}, []string{"https://c.example.org/"}},
+			{"created in range", URLListOptions{CreatedAfter: &past, CreatedBefore: &future, Status: "queued"}, []string{"https://queued.example.org/"}},
+			{"created in the future", URLListOptions{CreatedAfter: &future}, nil},
+			{"completed before now", URLListOptions{CompletedBefore: &future, Sort: "id", Ascending: true}, []string{"https://b.example.com/", "https://a.example.com:8080/x", "https://c.example.org/"}},
+		}
+		for _, tt := range tests {
+			tt.opts.WorkspaceID, tt.opts.Page, tt.opts.PageSize = defaultWorkspaceID, 1, 10
+			list, err := store.URLs.GetAll(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("%s: GetAll() error = %v", tt.name, err)
+			}
+			var got []string
+			for _, url := range list.URLs {
+				got = append(got, url.URL)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("%s: GetAll() = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestURLRepositoryCursorPagination(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		// Two URLs stay unanalyzed, so broken_links_count has NULLs to page
+		// past, and two share a count to exercise the ID tie break
+		broken := []int{4, -1, 1, 4, -1, 0, 2}
+		for i, count := range broken {
+			address := fmt.Sprintf("https://%d.example.com/", i)
+			url, err := store.URLs.Create(ctx, defaultWorkspaceID, address, address)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if count < 0 {
+				continue
+			}
+			if err := store.Analysis.Create(ctx, url.ID, &AnalysisResult{BrokenLinksCount: count}); err != nil {
+				t.Fatalf("Analysis.Create() error = %v", err)
+			}
+		}
+
+		for _, sortOpts := range []URLListOptions{
+			{},
+			{Sort: "broken_links_count"},
+			{Sort: "broken_links_count", Ascending: true},
+			{Sort: "title", Ascending: true},
+		} {
+			sortOpts.WorkspaceID = defaultWorkspaceID
+			full := sortOpts
+			full.Page, full.PageSize = 1, len(broken)
+			list, err := store.URLs.GetAll(ctx, full)
+			if err != nil {
+				t.Fatalf("GetAll(%+v) error = %v", full, err)
+			}
+			want := urlIDs(list.URLs)
+
+			// Walk forwards with next_cursor, then back with prev_cursor
+			opts := sortOpts
+			opts.Page, opts.PageSize = 1, 3
+			var forward [][]int64
+			for {
+				page, err := store.URLs.GetAll(ctx, opts)
+				if err != nil {
+					t.Fatalf("GetAll(%+v) error = %v", opts, err)
+				}
+				if opts.Cursor != nil && page.Total != nil {
+					t.Errorf("%s: cursor page counted a total without include_total", full.sortKey())
+				}
+				forward = append(forward, urlIDs(page.URLs))
+				if page.NextCursor == "" {
+					break
+				}
+				if opts.Cursor, err = DecodeURLCursor(page.NextCursor); err != nil {
+					t.Fatalf("DecodeURLCursor() error = %v", err)
+				}
+			}
+			var got []int64
+			for _, ids := range forward {
+				got = append(got, ids...)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) || len(forward) != 3 {
+				t.Errorf("%s ascending=%v: forward pages %v, want %v", full.sortKey(), full.Ascending, forward, want)
+			}
+
+			list, err = store.URLs.GetAll(ctx, opts)
+			if err != nil {
+				t.Fatalf("GetAll(%+v) error = %v", opts, err)
+			}
+			for i := len(forward) - 2; i >= 0; i-- {
+				if list.PrevCursor == "" {
+					t.Fatalf("%s: page %d has no prev_cursor", full.sortKey(), i+1)
+				}
+				if opts.Cursor, err = DecodeURLCursor(list.PrevCursor); err != nil {
+					t.Fatalf("DecodeURLCursor() error = %v", err)
+				}
+				if list, err = store.URLs.GetAll(ctx, opts); err != nil {
+					t.Fatalf("GetAll(%+v) error = %v", opts, err)
+				}
+				if fmt.Sprint(urlIDs(list.URLs)) != fmt.Sprint(forward[i]) {
+					t.Errorf("%s ascending=%v: backward page %d = %v, want %v", full.sortKey(), full.Ascending, i+1, urlIDs(list.URLs), forward[i])
+				}
+			}
+			if list.PrevCursor != "" || list.NextCursor == "" {
+				t.Errorf("%s: first page cursors prev=%q next=%q", full.sortKey(), list.PrevCursor, list.NextCursor)
+			}
+		}
+
+		opts := URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 3, IncludeTotal: true, Cursor: &URLCursor{Sort: defaultURLSort, Value: time.Now().UTC().Add(time.Hour), ID: 0}}
+		list, err := store.URLs.GetAll(ctx, opts)
+		if err != nil || list.Total == nil || *list.Total != int64(len(broken)) || *list.TotalPages != 3 {
+			t.Errorf("GetAll(include_total) = %+v, %v", list, err)
+		}
+	})
+}
+
+func TestURLRepositoryIncludeAnalysis(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		analyzed, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://analyzed.example.com/", "https://analyzed.example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if _, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://queued.example.com/", "https://queued.example.com/"); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		title, version := "Analyzed", "HTML5"
+		analysis := &AnalysisResult{PageTitle: &title, HTMLVersion: &version, InternalLinksCount: 3, ExternalLinksCount: 2, BrokenLinksCount: 1, HasLoginForm: true}
+		if err := store.Analysis.Create(ctx, analyzed.ID, analysis); err != nil {
+			t.Fatalf("Analysis.Create() error = %v", err)
+		}
+
+		list, err := store.URLs.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 10, IncludeAnalysis: true})
+		if err != nil || len(list.URLs) != 2 {
+			t.Fatalf("GetAll() = %+v, %v", list, err)
+		}
+		for _, url := range list.URLs {
+			if url.ID != analyzed.ID {
+				if url.Analysis != nil {
+					t.Errorf("unanalyzed URL has analysis %+v", url.Analysis)
+				}
+				continue
+			}
+			got := url.Analysis
+			if got == nil || got.PageTitle == nil || *got.PageTitle != title || got.HTMLVersion == nil || *got.HTMLVersion != version ||
+				got.InternalLinksCount != 3 || got.ExternalLinksCount != 2 || got.BrokenLinksCount != 1 || !got.HasLoginForm {
+				t.Errorf("analysis summary = %+v", got)
+			}
+		}
+
+		list, err = store.URLs.GetAll(ctx, URLListOptions{WorkspaceID: defaultWorkspaceID, Page: 1, PageSize: 10})
+		if err != nil {
+			t.Fatalf("GetAll() error = %v", err)
+		}
+		for _, url := range list.URLs {
+			if url.Analysis != nil {
+				t.Errorf("GetAll() without include has analysis %+v", url.Analysis)
+			}
+		}
+	})
+}
+
+func TestStatsRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		pages := []struct {
+			url      string
+			status   string
+			broken   int
+			hasLogin bool
+			failure  string
+		}{
+			{"https://a.example.com/", "completed", 3, true, ""},
+			{"https://a.example.com:8080/two", "completed", 2, false, ""},
+			{"https://b.example.org/", "completed", 4, false, ""},
+			{"https://c.example.net/", "completed", 0, true, ""},
+			{"https://down.example.com/", "failed", 0, false, "connection refused"},
+			{"https://gone.example.com/", "failed", 0, false, "HTTP 404"},
+			{"https://other.example.com/", "failed", 0, false, "connection refused"},
+			{"https://queued.example.com/", "queued", 0, false, ""},
+		}
+		for _, page := range pages {
+			url, err := store.URLs.Create(ctx, defaultWorkspaceID, page.url, page.url)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if page.status == "queued" {
+				continue
+			}
+			if err := store.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "running"); err != nil {
+				t.Fatalf("UpdateStatus() error = %v", err)
+			}
+			if page.status == "completed" {
+				analysis := &AnalysisResult{BrokenLinksCount: page.broken, HasLoginForm: page.hasLogin}
+				if err := store.Analysis.Create(ctx, url.ID, analysis); err != nil {
+					t.Fatalf("Analysis.Create() error = %v", err)
+				}
+			} else if err := store.URLs.UpdateErrorMessage(ctx, url.WorkspaceID, url.ID, page.failure); err != nil {
+				t.Fatalf("UpdateErrorMessage() error = %v", err)
+			}
+			if err := store.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, page.status); err != nil {
+				t.Fatalf("UpdateStatus() error = %v", err)
+			}
+		}
+
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		stats, err := store.Stats.Get(ctx, StatsOptions{WorkspaceID: defaultWorkspaceID, From: today.AddDate(0, 0, -6), To: today.AddDate(0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+
+		if stats.TotalURLs != 8 || stats.StatusCounts["completed"] != 4 || stats.StatusCounts["failed"] != 3 ||
+			stats.StatusCounts["queued"] != 1 || stats.StatusCounts["running"] != 0 {
+			t.Errorf("status counts = %v, total %d", stats.StatusCounts, stats.TotalURLs)
+		}
+		if len(stats.Daily) != 7 || stats.Daily[0].Completed != 0 {
+			t.Errorf("daily = %+v", stats.Daily)
+		}
+		if last := stats.Daily[len(stats.Daily)-1]; last.Date != today.Format("2006-01-02") || last.Completed != 4 || last.Failed != 3 {
+			t.Errorf("today = %+v", last)
+		}
+		duration := stats.CrawlDuration
+		if duration.Count != 4 || duration.AverageSeconds == nil || duration.P50Seconds == nil || duration.P99Seconds == nil || *duration.P99Seconds < 0 {
+			t.Errorf("crawl duration = %+v", duration)
+		}
+		if stats.TotalBrokenLinks != 9 {
+			t.Errorf("total broken links = %d, want 9", stats.TotalBrokenLinks)
+		}
+		wantDomains := []DomainBrokenLinks{{"a.example.com", 5, 2}, {"b.example.org", 4, 1}}
+		if fmt.Sprint(stats.TopBrokenDomains) != fmt.Sprint(wantDomains) {
+			t.Errorf("top broken domains = %v, want %v", stats.TopBrokenDomains, wantDomains)
+		}
+		wantFailures := []FailureCount{{"connection refused", 2}, {"HTTP 404", 1}}
+		if fmt.Sprint(stats.TopFailures) != fmt.Sprint(wantFailures) {
+			t.Errorf("top failures = %v, want %v", stats.TopFailures, wantFailures)
+		}
+		if stats.LoginForms.Analyzed != 4 || stats.LoginForms.WithLoginForm != 2 || stats.LoginForms.Share != 0.5 {
+			t.Errorf("login forms = %+v", stats.LoginForms)
+		}
+
+		stats, err = store.Stats.Get(ctx, StatsOptions{WorkspaceID: defaultWorkspaceID, From: today.AddDate(0, 0, -10), To: today.AddDate(0, 0, -5)})
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if stats.CrawlDuration.Count != 0 || stats.CrawlDuration.P50Seconds != nil || len(stats.TopFailures) != 0 || stats.TotalBrokenLinks != 9 {
+			t.Errorf("stats before any crawl = %+v", stats)
+		}
+	})
+}
+
+func urlIDs(urls []URL) []int64 {
+	var ids []int64
+	for _, url := range urls {
+		ids = append(ids, url.ID)
+	}
+	return ids
+}
+
+func TestAnalysisRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		url, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com/", "https://example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		title := "Example"
+		if err := store.Analysis.Create(ctx, url.ID, &AnalysisResult{PageTitle: &title, H1Count: 2, HasLoginForm: true}); err != nil {
+			t.Fatalf("Analysis.Create() error = %v", err)
+		}
+		statusCode := 404
+		if err := store.Analysis.AddBrokenLink(ctx, url.ID, "https://example.com/missing", &statusCode, nil); err != nil {
+			t.Fatalf("AddBrokenLink() error = %v", err)
+		}
+
+		analysis, err := store.Analysis.GetByURLID(ctx, url.WorkspaceID, url.ID)
+		if err != nil || analysis.H1Count != 2 || !analysis.HasLoginForm || analysis.PageTitle == nil || *analysis.PageTitle != title {
+			t.Errorf("GetByURLID() = %+v, %v", analysis, err)
+		}
+
+		links, err := store.Analysis.GetBrokenLinks(ctx, url.WorkspaceID, url.ID)
+		if err != nil || len(links) != 1 || links[0].StatusCode == nil || *links[0].StatusCode != 404 {
+			t.Errorf("GetBrokenLinks() = %+v, %v", links, err)
+		}
+
+		otherWorkspace := defaultWorkspaceID + 1000
+		if _, err := store.Analysis.GetByURLID(ctx, otherWorkspace, url.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByURLID(other workspace) error = %v, want sql.ErrNoRows", err)
+		}
+		if links, err := store.Analysis.GetBrokenLinks(ctx, otherWorkspace, url.ID); err != nil || len(links) != 0 {
+			t.Errorf("GetBrokenLinks(other workspace) = %+v, %v; want none", links, err)
+		}
+		if links, err := store.Analysis.GetLinks(ctx, otherWorkspace, url.ID, LinkInternal); err != nil || len(links) != 0 {
+			t.Errorf("GetLinks(other workspace) = %+v, %v; want none", links, err)
+		}
+
+		if err := store.URLs.Delete(ctx, defaultWorkspaceID, url.ID); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if _, err := store.Analysis.GetByURLID(ctx, url.WorkspaceID, url.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("analysis was not deleted with its URL: %v", err)
+		}
+		if links, _ := store.Analysis.GetBrokenLinks(ctx, url.WorkspaceID, url.ID); len(links) != 0 {
+			t.Errorf("broken links were not deleted with their URL: %+v", links)
+		}
+	})
+}
+
+func TestUnitOfWorkConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		url, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com/", "https://example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if err := store.URLs.UpdateErrorMessage(ctx, url.WorkspaceID, url.ID, "previous failure"); err != nil {
+			t.Fatalf("UpdateErrorMessage() error = %v", err)
+		}
+
+		save := func(tx *TxRepositories, result *AnalysisResult, internal []Link) error {
+			if err := tx.Analysis.DeleteByURLID(ctx, url.ID); err != nil {
+				return err
+			}
+			if err := tx.Analysis.Create(ctx, url.ID, result); err != nil {
+				return err
+			}
+			if err := tx.Analysis.AddLinks(ctx, url.ID, LinkInternal, internal); err != nil {
+				return err
+			}
+			if err := tx.Analysis.AddBrokenLink(ctx, url.ID, internal[0].URL, nil, nil); err != nil {
+				return err
+			}
+			if err := tx.URLs.ClearErrorMessage(ctx, url.WorkspaceID, url.ID); err != nil {
+				return err
+			}
+			return tx.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "completed")
+		}
+
+		links := []Link{{URL: "https://example.com/a", Text: "A"}, {URL: "https://example.com/b"}}
+		err = store.UnitOfWork.Do(ctx, func(tx *TxRepositories) error {
+			return save(tx, &AnalysisResult{H1Count: 1}, links)
+		})
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+
+		// A failing unit of work leaves the committed results untouched
+		errRollback := errors.New("rollback")
+		err = store.UnitOfWork.Do(ctx, func(tx *TxRepositories) error {
+			if err := save(tx, &AnalysisResult{H1Count: 9}, []Link{{URL: "https://example.com/c"}}); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("Do() error = %v, want %v", err, errRollback)
+		}
+
+		url, err = store.URLs.GetByID(ctx, defaultWorkspaceID, url.ID)
+		if err != nil || url.Status != "completed" || url.ErrorMessage != nil {
+			t.Errorf("GetByID() = %+v, %v; want completed without error", url, err)
+		}
+		analysis, err := store.Analysis.GetByURLID(ctx, url.WorkspaceID, url.ID)
+		if err != nil || analysis.H1Count != 1 {
+			t.Errorf("GetByURLID() = %+v, %v; want the committed analysis", analysis, err)
+		}
+		internal, err := store.Analysis.GetLinks(ctx, url.WorkspaceID, url.ID, LinkInternal)
+		if err != nil || len(internal) != 2 || internal[0].Text != "A" || !internal[0].IsBroken || internal[1].IsBroken {
+			t.Errorf("GetLinks(internal) = %+v, %v", internal, err)
+		}
+		if broken, _ := store.Analysis.GetBrokenLinks(ctx, url.WorkspaceID, url.ID); len(broken) != 1 {
+			t.Errorf("GetBrokenLinks() = %+v, want 1", broken)
+		}
+		if external, err := store.Analysis.GetLinks(ctx, url.WorkspaceID, url.ID, LinkExternal); err != nil || len(external) != 0 {
+			t.Errorf("GetLinks(external) = %+v, %v; want none", external, err)
+		}
+	})
+}
+
+func TestMemoryUnitOfWorkIsolation(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	url, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com", "https://example.com/")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// A write made while a unit of work runs waits for it, so a rollback
+	// cannot undo it
+	errRollback := errors.New("rollback")
+	written := make(chan error)
+	err = store.UnitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		go func() { written <- store.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "failed") }()
+		time.Sleep(10 * time.Millisecond)
+		if err := tx.URLs.UpdateErrorMessage(ctx, url.WorkspaceID, url.ID, "rolled back"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("Do() error = %v, want %v", err, errRollback)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("UpdateStatus() error = %v", err)
+	}
+	if got, err := store.URLs.GetByID(ctx, defaultWorkspaceID, url.ID); err != nil || got.Status != "failed" || got.ErrorMessage != nil {
+		t.Errorf("GetByID() = %+v, %v; want the concurrent write only", got, err)
+	}
+
+	// A panicking unit of work changes nothing and releases the store
+	func() {
+		defer func() { recover() }()
+		store.UnitOfWork.Do(ctx, func(tx *TxRepositories) error {
+			if err := tx.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "completed"); err != nil {
+				return err
+			}
+			panic("crawler bug")
+		})
+	}()
+	if got, err := store.URLs.GetByID(ctx, defaultWorkspaceID, url.ID); err != nil || got.Status != "failed" {
+		t.Errorf("GetByID() after panic = %+v, %v; want failed", got, err)
+	}
+}
+
+func TestUserRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		if user, err := store.Users.GetByUsername(ctx, "admin"); err != nil || user.Username != "admin" || user.PasswordHash == "" {
+			t.Errorf("GetByUsername(admin) = %+v, %v", user, err)
+		}
+		if _, err := store.Users.GetByUsername(ctx, "nobody"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByUsername(nobody) error = %v, want sql.ErrNoRows", err)
+		}
+
+		admin, err := store.Users.GetByUsername(ctx, "admin")
+		if err != nil || admin.Role != RoleAdmin || admin.Disabled {
+			t.Fatalf("seeded admin = %+v, %v", admin, err)
+		}
+
+		email := "jane@example.com"
+		jane, err := store.Users.Create(ctx, &User{Username: "jane", Email: &email, PasswordHash: "hash", Role: RoleViewer})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if jane.ID == 0 || jane.Role != RoleViewer || jane.Email == nil || *jane.Email != email || jane.PasswordHash != "hash" {
+			t.Errorf("Create() = %+v", jane)
+		}
+		if _, err := store.Users.Create(ctx, &User{Username: "jane", PasswordHash: "hash", Role: RoleViewer}); !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("Create(duplicate) error = %v, want ErrDuplicateUsername", err)
+		}
+
+		jane.Email, jane.Role, jane.Disabled = nil, RoleEditor, true
+		if err := store.Users.Update(ctx, jane); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		if err := store.Users.UpdatePassword(ctx, jane.ID, "new-hash"); err != nil {
+			t.Fatalf("UpdatePassword() error = %v", err)
+		}
+		got, err := store.Users.GetByID(ctx, jane.ID)
+		if err != nil || got.Email != nil || got.Role != RoleEditor || !got.Disabled || got.PasswordHash != "new-hash" {
+			t.Errorf("GetByID() = %+v, %v", got, err)
+		}
+		if _, err := store.Users.GetByID(ctx, jane.ID+100); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByID(missing) error = %v, want sql.ErrNoRows", err)
+		}
+
+		users, err := store.Users.GetAll(ctx)
+		if err != nil || len(users) != 2 || users[0].Username != "admin" || users[1].Username != "jane" {
+			t.Errorf("GetAll() = %+v, %v", users, err)
+		}
+
+		now := time.Now().UTC()
+		if err := store.Users.CreatePasswordReset(ctx, jane.ID, "first", now.Add(time.Hour)); err != nil {
+			t.Fatalf("CreatePasswordReset() error = %v", err)
+		}
+		if err := store.Users.CreatePasswordReset(ctx, jane.ID, "second", now.Add(time.Hour)); err != nil {
+			t.Fatalf("CreatePasswordReset() error = %v", err)
+		}
+		if err := store.Users.CreatePasswordReset(ctx, admin.ID, "expired", now.Add(-time.Minute)); err != nil {
+			t.Fatalf("CreatePasswordReset() error = %v", err)
+		}
+		for _, tt := range []struct {
+			token  string
+			userID int64
+		}{
+			{"first", 0},
+			{"expired", 0},
+			{"second", jane.ID},
+			{"second", 0},
+		} {
+			userID, err := store.Users.ConsumePasswordReset(ctx, tt.token, now)
+			if tt.userID == 0 && !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("ConsumePasswordReset(%q) = %d, %v, want sql.ErrNoRows", tt.token, userID, err)
+			}
+			if tt.userID != 0 && (err != nil || userID != tt.userID) {
+				t.Errorf("ConsumePasswordReset(%q) = %d, %v, want %d", tt.token, userID, err, tt.userID)
+			}
+		}
+
+		if err := store.Users.CreateStreamTicket(ctx, jane.ID, "ticket-old", now.Add(-time.Minute), now.Add(-2*time.Minute)); err != nil {
+			t.Fatalf("CreateStreamTicket() error = %v", err)
+		}
+		for _, hash := range []string{"ticket-1", "ticket-2"} {
+			if err := store.Users.CreateStreamTicket(ctx, jane.ID, hash, now.Add(time.Minute), now); err != nil {
+				t.Fatalf("CreateStreamTicket() error = %v", err)
+			}
+		}
+		for _, tt := range []struct {
+			ticket string
+			userID int64
+		}{
+			{"ticket-old", 0},
+			{"ticket-1", jane.ID},
+			{"ticket-1", 0},
+			{"ticket-2", jane.ID},
+			{"unknown", 0},
+		} {
+			userID, err := store.Users.ConsumeStreamTicket(ctx, tt.ticket, now)
+			if tt.userID == 0 && !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("ConsumeStreamTicket(%q) = %d, %v, want sql.ErrNoRows", tt.ticket, userID, err)
+			}
+			if tt.userID != 0 && (err != nil || userID != tt.userID) {
+				t.Errorf("ConsumeStreamTicket(%q) = %d, %v, want %d", tt.ticket, userID, err, tt.userID)
+			}
+		}
+
+		if revoked, err := store.Users.IsRefreshTokenFamilyRevoked(ctx, "family"); err != nil || !revoked {
+			t.Errorf("IsRefreshTokenFamilyRevoked(empty family) = %v, %v, want true", revoked, err)
+		}
+		first := &RefreshToken{FamilyID: "family", UserID: jane.ID, TokenHash: "refresh-1", ExpiresAt: now.Add(time.Hour)}
+		if err := store.Users.CreateRefreshToken(ctx, first); err != nil || first.ID == 0 {
+			t.Fatalf("CreateRefreshToken() = %+v, %v", first, err)
+		}
+		if err := store.Users.UseRefreshToken(ctx, first.ID, now); err != nil {
+			t.Fatalf("UseRefreshToken() error = %v", err)
+		}
+		if err := store.Users.UseRefreshToken(ctx, first.ID, now); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UseRefreshToken(used) error = %v, want sql.ErrNoRows", err)
+		}
+		stored, err := store.Users.GetRefreshToken(ctx, "refresh-1")
+		if err != nil || stored.ID != first.ID || stored.FamilyID != "family" || stored.UserID != jane.ID || stored.UsedAt == nil || stored.RevokedAt != nil {
+			t.Errorf("GetRefreshToken() = %+v, %v", stored, err)
+		}
+		if _, err := store.Users.GetRefreshToken(ctx, "unknown"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetRefreshToken(unknown) error = %v, want sql.ErrNoRows", err)
+		}
+		second := &RefreshToken{FamilyID: "family", UserID: jane.ID, TokenHash: "refresh-2", ExpiresAt: now.Add(time.Hour)}
+		if err := store.Users.CreateRefreshToken(ctx, second); err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		if revoked, err := store.Users.IsRefreshTokenFamilyRevoked(ctx, "family"); err != nil || revoked {
+			t.Errorf("IsRefreshTokenFamilyRevoked() = %v, %v, want false", revoked, err)
+		}
+		if err := store.Users.RevokeRefreshTokenFamily(ctx, "family", now); err != nil {
+			t.Fatalf("RevokeRefreshTokenFamily() error = %v", err)
+		}
+		if revoked, err := store.Users.IsRefreshTokenFamilyRevoked(ctx, "family"); err != nil || !revoked {
+			t.Errorf("IsRefreshTokenFamilyRevoked() after revoking = %v, %v, want true", revoked, err)
+		}
+		if err := store.Users.UseRefreshToken(ctx, second.ID, now); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UseRefreshToken(revoked) error = %v, want sql.ErrNoRows", err)
+		}
+
+		for i, token := range []*RefreshToken{
+			{FamilyID: "jane-laptop", UserID: jane.ID, TokenHash: "refresh-3", ExpiresAt: now.Add(time.Hour)},
+			{FamilyID: "jane-phone", UserID: jane.ID, TokenHash: "refresh-4", ExpiresAt: now.Add(time.Hour)},
+			{FamilyID: "admin", UserID: admin.ID, TokenHash: "refresh-5", ExpiresAt: now.Add(time.Hour)},
+		} {
+			if err := store.Users.CreateRefreshToken(ctx, token); err != nil {
+				t.Fatalf("CreateRefreshToken(%d) error = %v", i, err)
+			}
+		}
+		if err := store.Users.RevokeUserRefreshTokens(ctx, jane.ID, now); err != nil {
+			t.Fatalf("RevokeUserRefreshTokens() error = %v", err)
+		}
+		for family, want := range map[string]bool{"jane-laptop": true, "jane-phone": true, "admin": false} {
+			if revoked, err := store.Users.IsRefreshTokenFamilyRevoked(ctx, family); err != nil || revoked != want {
+				t.Errorf("IsRefreshTokenFamilyRevoked(%s) after revoking jane's tokens = %v, %v, want %v", family, revoked, err, want)
+			}
+		}
+	})
+}
+
+func TestCrawlerQueuesWebhookDeliveries(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		crawler := NewCrawlerService(store.URLs, store.UnitOfWork, NewEventHub())
+		webhook, err := store.Webhooks.Create(ctx, &Webhook{WorkspaceID: defaultWorkspaceID, URL: "https://hooks.example.com", Secret: "s",
+			EventTypes: WebhookEventTypes, Active: true})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		url, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com", "https://example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		analysis := &AnalysisResult{BrokenLinksCount: 1}
+		report := &AnalysisReport{Result: analysis, BrokenLinks: []BrokenLink{{LinkURL: "https://example.com/gone"}}}
+		if err := crawler.saveAnalysis(ctx, crawler.statusEvent(url, "completed", analysis, nil), report); err != nil {
+			t.Fatalf("saveAnalysis() error = %v", err)
+		}
+		crawler.markFailed(ctx, crawler.logger, url, "timeout")
+
+		deliveries, err := store.Webhooks.GetDeliveries(ctx, webhook.ID, 10)
+		if err != nil || len(deliveries) != 3 {
+			t.Fatalf("GetDeliveries() = %+v, %v; want 3", deliveries, err)
+		}
+		events := map[string]bool{}
+		for _, delivery := range deliveries {
+			events[delivery.EventType] = delivery.Status == "pending" && strings.Contains(delivery.Payload, `"url_id":`+strconv.FormatInt(url.ID, 10))
+		}
+		for _, eventType := range WebhookEventTypes {
+			if !events[eventType] {
+				t.Errorf("deliveries = %+v, want a pending %s delivery", deliveries, eventType)
+			}
+		}
+
+		// Deliveries are rolled back with the status change they announce
+		errRollback := errors.New("rollback")
+		err = store.UnitOfWork.Do(ctx, func(tx *TxRepositories) error {
+			if err := queueWebhookDeliveries(ctx, tx.Webhooks, crawler.statusEvent(url, "failed", nil, nil)); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("Do() error = %v, want %v", err, errRollback)
+		}
+		if deliveries, _ := store.Webhooks.GetDeliveries(ctx, webhook.ID, 10); len(deliveries) != 3 {
+			t.Errorf("GetDeliveries() after rollback = %d deliveries, want 3", len(deliveries))
+		}
+	})
+}
+
+func TestCrawlerDuplicateDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		var fetches atomic.Int32
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<!DOCTYPE html><html><head><title>Once</title></head><body></body></html>`))
+		}))
+		defer site.Close()
+
+		events := NewEventHub()
+		crawler := NewCrawlerService(store.URLs, store.UnitOfWork, events)
+		defer crawler.Stop()
+		received, unsubscribe := events.Subscribe(10)
+		defer unsubscribe()
+
+		webhook, err := store.Webhooks.Create(ctx, &Webhook{WorkspaceID: defaultWorkspaceID, URL: "https://hooks.example.com", Secret: "s",
+			EventTypes: WebhookEventTypes, Active: true})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		url, err := store.URLs.Create(ctx, defaultWorkspaceID, site.URL, site.URL+"/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		// The same queued URL reaches two workers, as when a poll re-sends a
+		// URL that is still waiting in the channel
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			dispatched := *url
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				crawler.processURL(&dispatched)
+			}()
+		}
+		wg.Wait()
+
+		if n := fetches.Load(); n != 1 {
+			t.Errorf("site fetched %d times, want 1", n)
+		}
+		if analysis, err := store.Analysis.GetByURLID(ctx, url.WorkspaceID, url.ID); err != nil || analysis == nil {
+			t.Errorf("GetAnalysis() = %+v, %v, want the analysis", analysis, err)
+		}
+		deliveries, err := store.Webhooks.GetDeliveries(ctx, webhook.ID, 10)
+		if err != nil || len(deliveries) != 1 || deliveries[0].EventType != WebhookAnalysisCompleted {
+			t.Errorf("GetDeliveries() = %+v, %v, want one %s delivery", deliveries, err, WebhookAnalysisCompleted)
+		}
+		statuses := map[string]int{}
+		for len(received) > 0 {
+			statuses[(<-received).Status]++
+		}
+		if statuses["running"] != 1 || statuses["completed"] != 1 {
+			t.Errorf("published statuses = %v, want one running and one completed", statuses)
+		}
+	})
+}
+
+func TestWebhookRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		repo := store.Webhooks
+
+		webhook, err := repo.Create(ctx, &Webhook{WorkspaceID: defaultWorkspaceID, URL: "https://hooks.example.com", Secret: "s", EventTypes: []string{WebhookAnalysisFailed}, Active: true})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		subscribed, err := repo.GetActiveForEvent(ctx, defaultWorkspaceID, WebhookAnalysisFailed)
+		if err != nil || len(subscribed) != 1 {
+			t.Errorf("GetActiveForEvent() = %+v, %v", subscribed, err)
+		}
+
+		webhook.Active = false
+		if err := repo.Update(ctx, webhook); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		if subscribed, _ := repo.GetActiveForEvent(ctx, defaultWorkspaceID, WebhookAnalysisFailed); len(subscribed) != 0 {
+			t.Errorf("GetActiveForEvent() after deactivating = %+v, want none", subscribed)
+		}
+
+		delivery, err := repo.CreateDelivery(ctx, webhook.ID, WebhookAnalysisFailed, `{}`)
+		if err != nil {
+			t.Fatalf("CreateDelivery() error = %v", err)
+		}
+
+		now := time.Now().UTC().Add(time.Second)
+		lockedUntil := now.Add(time.Minute)
+		due, err := repo.ClaimDueDeliveries(ctx, 10, now, lockedUntil)
+		if err != nil || len(due) != 1 || due[0].ID != delivery.ID {
+			t.Errorf("ClaimDueDeliveries() = %+v, %v", due, err)
+		}
+		if due, _ := repo.ClaimDueDeliveries(ctx, 10, now, lockedUntil); len(due) != 0 {
+			t.Errorf("ClaimDueDeliveries() of a claimed delivery = %+v, want none", due)
+		}
+		if claimed, err := repo.ClaimDelivery(ctx, delivery.ID, now, lockedUntil); err != nil || claimed {
+			t.Errorf("ClaimDelivery() of a claimed delivery = %v, %v, want false", claimed, err)
+		}
+
+		// A claim that expires, say because its replica died, can be taken over
+		expired := lockedUntil.Add(time.Second)
+		if due, _ := repo.ClaimDueDeliveries(ctx, 10, expired, expired.Add(time.Minute)); len(due) != 1 {
+			t.Errorf("ClaimDueDeliveries() after the claim expired = %+v, want the delivery", due)
+		}
+
+		// Storing the outcome of an attempt releases the claim
+		delivery.Attempts = 1
+		if err := repo.UpdateDelivery(ctx, delivery); err != nil {
+			t.Fatalf("UpdateDelivery() error = %v", err)
+		}
+		if due, _ := repo.ClaimDueDeliveries(ctx, 10, now, lockedUntil); len(due) != 1 {
+			t.Errorf("ClaimDueDeliveries() after releasing = %+v, want the delivery", due)
+		}
+
+		delivery.Status = "succeeded"
+		delivery.NextAttemptAt = nil
+		if err := repo.UpdateDelivery(ctx, delivery); err != nil {
+			t.Fatalf("UpdateDelivery() error = %v", err)
+		}
+		if due, _ := repo.ClaimDueDeliveries(ctx, 10, now, lockedUntil); len(due) != 0 {
+			t.Errorf("ClaimDueDeliveries() after success = %+v, want none", due)
+		}
+		if claimed, _ := repo.ClaimDelivery(ctx, delivery.ID, now, lockedUntil); claimed {
+			t.Error("ClaimDelivery() of a succeeded delivery = true, want false")
+		}
+
+		// Of replicas racing for a delivery exactly one claims it
+		racing, err := repo.CreateDelivery(ctx, webhook.ID, WebhookAnalysisFailed, `{}`)
+		if err != nil {
+			t.Fatalf("CreateDelivery() error = %v", err)
+		}
+		var wg sync.WaitGroup
+		var claims atomic.Int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				claimed, err := repo.ClaimDelivery(ctx, racing.ID, now, lockedUntil)
+				if err != nil {
+					t.Errorf("ClaimDelivery() error = %v", err)
+				}
+				if claimed {
+					claims.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if claims.Load() != 1 {
+			t.Errorf("%d racing ClaimDelivery() calls succeeded, want 1", claims.Load())
+		}
+
+		deliveries, err := repo.GetDeliveries(ctx, webhook.ID, 10)
+		if err != nil || len(deliveries) != 2 || deliveries[1].Status != "succeeded" || deliveries[1].Attempts != 1 {
+			t.Errorf("GetDeliveries() = %+v, %v", deliveries, err)
+		}
+
+		otherWorkspace := defaultWorkspaceID + 1000
+		if _, err := repo.GetByID(ctx, otherWorkspace, webhook.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByID(other workspace) error = %v, want sql.ErrNoRows", err)
+		}
+		if found, err := repo.GetForDelivery(ctx, webhook.ID); err != nil || found.ID != webhook.ID {
+			t.Errorf("GetForDelivery() = %+v, %v", found, err)
+		}
+		if _, err := repo.GetDeliveryByID(ctx, webhook.ID+1000, delivery.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetDeliveryByID(other webhook) error = %v, want sql.ErrNoRows", err)
+		}
+		moved := *webhook
+		moved.WorkspaceID, moved.URL = otherWorkspace, "https://attacker.example.com"
+		if err := repo.Update(ctx, &moved); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		if err := repo.Delete(ctx, otherWorkspace, webhook.ID); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if stored, err := repo.GetByID(ctx, defaultWorkspaceID, webhook.ID); err != nil || stored.URL != webhook.URL {
+			t.Errorf("webhook after update and delete in another workspace = %+v, %v; want it unchanged", stored, err)
+		}
+
+		if err := repo.Delete(ctx, webhook.WorkspaceID, webhook.ID); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if _, err := repo.GetDeliveryByID(ctx, webhook.ID, delivery.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("delivery was not deleted with its webhook: %v", err)
+		}
+	})
+}
+
+func TestWorkspaceRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		admin, err := store.Users.GetByUsername(ctx, "admin")
+		if err != nil {
+			t.Fatalf("GetByUsername() error = %v", err)
+		}
+		workspaces, err := store.Workspaces.GetForUser(ctx, admin.ID)
+		if err != nil || len(workspaces) != 1 || workspaces[0].ID != defaultWorkspaceID || workspaces[0].Role != RoleAdmin {
+			t.Fatalf("GetForUser(admin) = %+v, %v", workspaces, err)
+		}
+
+		jane, err := store.Users.Create(ctx, &User{Username: "jane", PasswordHash: "hash", Role: RoleEditor})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		team, err := store.Workspaces.Create(ctx, "Team")
+		if err != nil || team.ID == defaultWorkspaceID || team.Name != "Team" {
+			t.Fatalf("Create() = %+v, %v", team, err)
+		}
+		if err := store.Workspaces.AddMember(ctx, team.ID, jane.ID, RoleAdmin); err != nil {
+			t.Fatalf("AddMember() error = %v", err)
+		}
+		if err := store.Workspaces.AddMember(ctx, team.ID, jane.ID, RoleViewer); !errors.Is(err, ErrAlreadyMember) {
+			t.Errorf("AddMember(again) error = %v, want ErrAlreadyMember", err)
+		}
+		if err := store.Workspaces.AddMember(ctx, team.ID, admin.ID, RoleViewer); err != nil {
+			t.Fatalf("AddMember() error = %v", err)
+		}
+		if err := store.Workspaces.UpdateMemberRole(ctx, team.ID, admin.ID, RoleEditor); err != nil {
+			t.Fatalf("UpdateMemberRole() error = %v", err)
+		}
+		member, err := store.Workspaces.GetMember(ctx, team.ID, admin.ID)
+		if err != nil || member.Role != RoleEditor || member.Username != "admin" {
+			t.Errorf("GetMember() = %+v, %v", member, err)
+		}
+		if _, err := store.Workspaces.GetMember(ctx, defaultWorkspaceID, jane.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetMember(non-member) error = %v, want sql.ErrNoRows", err)
+		}
+		if members, err := store.Workspaces.GetMembers(ctx, team.ID); err != nil || len(members) != 2 {
+			t.Errorf("GetMembers() = %+v, %v", members, err)
+		}
+		if workspaces, err := store.Workspaces.GetForUser(ctx, admin.ID); err != nil || len(workspaces) != 2 || workspaces[1].Role != RoleEditor {
+			t.Errorf("GetForUser(admin) = %+v, %v", workspaces, err)
+		}
+		if err := store.Workspaces.RemoveMember(ctx, team.ID, admin.ID); err != nil {
+			t.Fatalf("RemoveMember() error = %v", err)
+		}
+		if _, err := store.Workspaces.GetMember(ctx, team.ID, admin.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetMember(removed) error = %v, want sql.ErrNoRows", err)
+		}
+
+		now := time.Now().UTC()
+		invitation, err := store.Workspaces.CreateInvitation(ctx, &WorkspaceInvitation{WorkspaceID: team.ID, Role: RoleViewer, TokenHash: "valid", InvitedBy: &jane.ID, ExpiresAt: now.Add(time.Hour)})
+		if err != nil || invitation.ID == 0 {
+			t.Fatalf("CreateInvitation() = %+v, %v", invitation, err)
+		}
+		if _, err := store.Workspaces.CreateInvitation(ctx, &WorkspaceInvitation{WorkspaceID: team.ID, Role: RoleViewer, TokenHash: "expired", ExpiresAt: now.Add(-time.Minute)}); err != nil {
+			t.Fatalf("CreateInvitation() error = %v", err)
+		}
+		if _, err := store.Workspaces.ConsumeInvitation(ctx, "expired", admin.ID, now); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("ConsumeInvitation(expired) error = %v, want sql.ErrNoRows", err)
+		}
+		consumed, err := store.Workspaces.ConsumeInvitation(ctx, "valid", admin.ID, now)
+		if err != nil || consumed.ID != invitation.ID || consumed.AcceptedBy == nil || *consumed.AcceptedBy != admin.ID {
+			t.Errorf("ConsumeInvitation() = %+v, %v", consumed, err)
+		}
+		if _, err := store.Workspaces.ConsumeInvitation(ctx, "valid", admin.ID, now); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("ConsumeInvitation(again) error = %v, want sql.ErrNoRows", err)
+		}
+		invitations, err := store.Workspaces.GetInvitations(ctx, team.ID)
+		if err != nil || len(invitations) != 1 || invitations[0].TokenHash != "expired" {
+			t.Fatalf("GetInvitations() = %+v, %v", invitations, err)
+		}
+		if err := store.Workspaces.DeleteInvitation(ctx, team.ID, invitations[0].ID); err != nil {
+			t.Fatalf("DeleteInvitation() error = %v", err)
+		}
+		if invitations, err := store.Workspaces.GetInvitations(ctx, team.ID); err != nil || len(invitations) != 0 {
+			t.Errorf("GetInvitations() after delete = %+v, %v", invitations, err)
+		}
+
+		// The same URL can be added to each workspace, and each only sees its own
+		url, err := store.URLs.Create(ctx, defaultWorkspaceID, "https://example.com/", "https://example.com/")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		teamURL, err := store.URLs.Create(ctx, team.ID, "https://example.com/", "https://example.com/")
+		if err != nil || teamURL.WorkspaceID != team.ID {
+			t.Fatalf("Create(other workspace) = %+v, %v", teamURL, err)
+		}
+		if _, err := store.URLs.GetByID(ctx, team.ID, url.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByID(other workspace) error = %v, want sql.ErrNoRows", err)
+		}
+		if err := store.URLs.BulkDelete(ctx, team.ID, []int64{url.ID}); err != nil {
+			t.Fatalf("BulkDelete() error = %v", err)
+		}
+		if _, err := store.URLs.GetByID(ctx, defaultWorkspaceID, url.ID); err != nil {
+			t.Errorf("GetByID() after deleting from other workspace error = %v", err)
+		}
+		list, err := store.URLs.GetAll(ctx, URLListOptions{WorkspaceID: team.ID, Page: 1, PageSize: 10})
+		if err != nil || len(list.URLs) != 1 || list.URLs[0].ID != teamURL.ID {
+			t.Errorf("GetAll(team) = %+v, %v", list, err)
+		}
+
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		stats, err := store.Stats.Get(ctx, StatsOptions{WorkspaceID: team.ID, From: today, To: today.AddDate(0, 0, 1)})
+		if err != nil || stats.TotalURLs != 1 {
+			t.Errorf("Stats.Get(team) = %+v, %v", stats, err)
+		}
+	})
+}
+
+func TestWorkspaceLastAdminRace(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		service := NewWorkspaceService(store.Workspaces, store.UnitOfWork)
+		team, err := store.Workspaces.Create(ctx, "Team")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		var admins []int64
+		for _, username := range []string{"jane", "john"} {
+			user, err := store.Users.Create(ctx, &User{Username: username, PasswordHash: "hash", Role: RoleEditor})
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if err := store.Workspaces.AddMember(ctx, team.ID, user.ID, RoleAdmin); err != nil {
+				t.Fatalf("AddMember() error = %v", err)
+			}
+			admins = append(admins, user.ID)
+		}
+
+		// Both admins demote themselves at once; one of them has to stay
+		errs := make(chan error, len(admins))
+		for _, userID := range admins {
+			go func(userID int64) {
+				errs <- service.UpdateMemberRole(ctx, team.ID, userID, RoleViewer)
+			}(userID)
+		}
+		demoted := 0
+		for range admins {
+			err := <-errs
+			switch {
+			case err == nil:
+				demoted++
+			case !errors.Is(err, ErrLastWorkspaceAdmin):
+				t.Fatalf("UpdateMemberRole() error = %v", err)
+			}
+		}
+		if demoted != 1 {
+			t.Errorf("demoted %d admins, want 1", demoted)
+		}
+
+		members, err := store.Workspaces.GetMembers(ctx, team.ID)
+		if err != nil {
+			t.Fatalf("GetMembers() error = %v", err)
+		}
+		remaining := 0
+		for _, member := range members {
+			if member.Role == RoleAdmin {
+				remaining++
+			}
+		}
+		if remaining != 1 {
+			t.Errorf("%d admins left, want 1", remaining)
+		}
+	})
+}
+
+func TestAPIKeyRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		admin, err := store.Users.GetByUsername(ctx, "admin")
+		if err != nil {
+			t.Fatalf("GetByUsername() error = %v", err)
+		}
+		expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+		key, err := store.APIKeys.Create(ctx, &APIKey{UserID: admin.ID, WorkspaceID: defaultWorkspaceID, Name: "CI", Prefix: "crk_abcdefgh",
+			KeyHash: "hash-1", Scopes: []string{"urls:read", "urls:write"}, ExpiresAt: &expiresAt})
+		if err != nil || key.ID == 0 || key.Name != "CI" || len(key.Scopes) != 2 || key.ExpiresAt == nil || !key.ExpiresAt.Equal(expiresAt) || key.LastUsedAt != nil {
+			t.Fatalf("Create() = %+v, %v", key, err)
+		}
+		if _, err := store.APIKeys.Create(ctx, &APIKey{UserID: admin.ID, WorkspaceID: defaultWorkspaceID, Name: "Other", Prefix: "crk_ijklmnop",
+			KeyHash: "hash-2", Scopes: []string{"analysis:read"}}); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+
+		now := time.Now().UTC()
+		if err := store.APIKeys.UpdateLastUsed(ctx, key.ID, now); err != nil {
+			t.Fatalf("UpdateLastUsed() error = %v", err)
+		}
+		found, err := store.APIKeys.GetByHash(ctx, "hash-1")
+		if err != nil || found.ID != key.ID || found.Scopes[1] != "urls:write" || found.LastUsedAt == nil {
+			t.Errorf("GetByHash() = %+v, %v", found, err)
+		}
+		if _, err := store.APIKeys.GetByHash(ctx, "unknown"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByHash(unknown) error = %v, want sql.ErrNoRows", err)
+		}
+		keys, err := store.APIKeys.GetForUser(ctx, admin.ID)
+		if err != nil || len(keys) != 2 || keys[0].Name != "Other" || keys[1].ExpiresAt == nil {
+			t.Errorf("GetForUser() = %+v, %v", keys, err)
+		}
+
+		if err := store.APIKeys.Delete(ctx, admin.ID+100, key.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Delete(other user) error = %v, want sql.ErrNoRows", err)
+		}
+		if err := store.APIKeys.Delete(ctx, admin.ID, key.ID); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if _, err := store.APIKeys.GetByHash(ctx, "hash-1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetByHash(deleted) error = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := `SELECT id FROM urls WHERE status = ? AND id IN (?, ?)`
+
+	if got := mysqlDialect.rebind(query); got != query {
+		t.Errorf("mysql rebind() = %q, want unchanged", got)
+	}
+	if got, want := postgresDialect.rebind(query), `SELECT id FROM urls WHERE status = $1 AND id IN ($2, $3)`; got != want {
+		t.Errorf("postgres rebind() = %q, want %q", got, want)
+	}
+
+	// Quoted literals, identifiers and comments keep their question marks
+	query = `SELECT translate(url, '?''?', '  ') AS "a?" FROM urls -- why?
+		WHERE id = ? /* or? */ AND url LIKE '%?' AND status = ?`
+	want := `SELECT translate(url, '?''?', '  ') AS "a?" FROM urls -- why?
+		WHERE id = $1 /* or? */ AND url LIKE '%?' AND status = $2`
+	if got := postgresDialect.rebind(query); got != want {
+		t.Errorf("postgres rebind() = %q, want %q", got, want)
+	}
+	if got := postgresDialect.rebind(`SELECT 'unterminated ?`); got != `SELECT 'unterminated ?` {
+		t.Errorf("postgres rebind(unterminated) = %q", got)
+	}
+}
+
+// TestPostgresSearchQuery checks the Postgres search conditions without a
+// database: their placeholders must match their arguments, and the URL
+// expression must stay the one the search index is built on
+func TestPostgresSearchQuery(t *testing.T) {
+	var where []string
+	var args []interface{}
+	for _, term := range parseSearchQuery(`crawler "broken links"`) {
+		condition, termArgs := postgresDialect.matchTerm(term)
+		where = append(where, condition)
+		args = append(args, termArgs...)
+	}
+	query := postgresDialect.rebind("SELECT u.id FROM urls u LEFT JOIN analysis_results a ON a.url_id = u.id WHERE " + strings.Join(where, " AND "))
+
+	placeholders := regexp.MustCompile(`\$\d+`).FindAllString(query, -1)
+	if len(placeholders) != len(args) || placeholders[len(placeholders)-1] != "$"+strconv.Itoa(len(args)) {
+		t.Errorf("rebound search query has placeholders %v for %d arguments: %s", placeholders, len(args), query)
+	}
+	if !strings.Contains(query, postgresURLVector) {
+		t.Errorf("rebound search query = %s, want the URL expression %s", query, postgresURLVector)
+	}
+
+	migration, err := migrationFiles.ReadFile("migrations/postgres/0002_full_text_search.up.sql")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if indexed := strings.ReplaceAll(postgresURLVector, "u.url", "url"); !strings.Contains(string(migration), indexed) {
+		t.Errorf("search index does not cover %s", indexed)
+	}
+}
+
+func TestLoginThrottleRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		if _, err := store.Logins.GetFailure(ctx, loginScopeUsername, "jane"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetFailure(unknown) error = %v, want sql.ErrNoRows", err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		windowStart := now.Add(-time.Minute)
+		for i := 1; i <= 3; i++ {
+			failure, err := store.Logins.RecordFailure(ctx, loginScopeUsername, "jane", now, windowStart)
+			if err != nil || failure.Failures != i || !failure.LastFailedAt.Equal(now) || failure.LockedUntil != nil {
+				t.Fatalf("RecordFailure() #%d = %+v, %v", i, failure, err)
+			}
+		}
+		if _, err := store.Logins.RecordFailure(ctx, loginScopeIP, "192.0.2.1", now, windowStart); err != nil {
+			t.Fatalf("RecordFailure(ip) error = %v", err)
+		}
+
+		// A failure after the window starts counting again
+		later := now.Add(2 * time.Minute)
+		failure, err := store.Logins.RecordFailure(ctx, loginScopeUsername, "jane", later, later.Add(-time.Minute))
+		if err != nil || failure.Failures != 1 || !failure.LastFailedAt.Equal(later) {
+			t.Fatalf("RecordFailure(after window) = %+v, %v", failure, err)
+		}
+
+		lockedUntil := later.Add(time.Hour)
+		if err := store.Logins.Lock(ctx, failure, lockedUntil, later); err != nil {
+			t.Fatalf("Lock() error = %v", err)
+		}
+		failure, err = store.Logins.GetFailure(ctx, loginScopeUsername, "jane")
+		if err != nil || failure.LockedUntil == nil || !failure.LockedUntil.Equal(lockedUntil) {
+			t.Errorf("GetFailure() = %+v, %v", failure, err)
+		}
+		ipFailure, err := store.Logins.GetFailure(ctx, loginScopeIP, "192.0.2.1")
+		if err != nil || ipFailure.Failures != 1 || ipFailure.LockedUntil != nil {
+			t.Errorf("GetFailure(ip) = %+v, %v", ipFailure, err)
+		}
+		if err := store.Logins.Lock(ctx, ipFailure, lockedUntil, later.Add(time.Second)); err != nil {
+			t.Fatalf("Lock(ip) error = %v", err)
+		}
+
+		lockouts, err := store.Logins.GetLockouts(ctx, now)
+		if err != nil || len(lockouts) != 2 || lockouts[0].Scope != loginScopeIP || lockouts[1].Subject != "jane" ||
+			lockouts[1].Failures != 1 || !lockouts[1].LockedUntil.Equal(lockedUntil) || !lockouts[1].CreatedAt.Equal(later) {
+			t.Errorf("GetLockouts() = %+v, %v", lockouts, err)
+		}
+		if lockouts, err := store.Logins.GetLockouts(ctx, later.Add(time.Minute)); err != nil || len(lockouts) != 0 {
+			t.Errorf("GetLockouts(future) = %+v, %v", lockouts, err)
+		}
+
+		if err := store.Logins.ClearFailures(ctx, loginScopeUsername, "jane"); err != nil {
+			t.Fatalf("ClearFailures() error = %v", err)
+		}
+		if _, err := store.Logins.GetFailure(ctx, loginScopeUsername, "jane"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetFailure(cleared) error = %v, want sql.ErrNoRows", err)
+		}
+		if _, err := store.Logins.GetFailure(ctx, loginScopeIP, "192.0.2.1"); err != nil {
+			t.Errorf("GetFailure(ip) error = %v", err)
+		}
+	})
+}
+
+func TestRateLimitRepositoryConformance(t *testing.T) {
+	ctx := context.Background()
+	limit := RateLimit{Name: "crawl", Limit: 3, Window: 3 * time.Second}
+
+	forEachStore(t, func(t *testing.T, store *Store) {
+		now := time.Now().Truncate(time.Microsecond)
+		for i, remaining := range []int{2, 1, 0} {
+			result, err := store.RateLimits.Take(ctx, "crawl:user:1", limit, now)
+			if err != nil || !result.Allowed || result.Remaining != remaining {
+				t.Fatalf("Take() #%d = %+v, %v", i+1, result, err)
+			}
+		}
+		result, err := store.RateLimits.Take(ctx, "crawl:user:1", limit, now)
+		if err != nil || result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+			t.Errorf("Take(empty) = %+v, %v", result, err)
+		}
+
+		// Other keys have their own bucket
+		if result, err := store.RateLimits.Take(ctx, "crawl:user:2", limit, now); err != nil || !result.Allowed || result.Remaining != 2 {
+			t.Errorf("Take(other key) = %+v, %v", result, err)
+		}
+
+		// The bucket refills one request per second. SQL stores move the
+		// refill time forward a microsecond on each write, so round.
+		later := now.Add(1500 * time.Millisecond)
+		result, err = store.RateLimits.Take(ctx, "crawl:user:1", limit, later)
+		if err != nil || !result.Allowed || result.Remaining != 0 || result.Reset.Round(time.Millisecond) != 2500*time.Millisecond {
+			t.Errorf("Take(refilled) = %+v, %v", result, err)
+		}
+		result, err = store.RateLimits.Take(ctx, "crawl:user:1", limit, later)
+		if err != nil || result.Allowed || result.RetryAfter.Round(time.Millisecond) != 500*time.Millisecond {
+			t.Errorf("Take(empty again) = %+v, %v", result, err)
+		}
+
+		if err := store.RateLimits.Prune(ctx, later); err != nil {
+			t.Fatalf("Prune() error = %v", err)
+		}
+		if result, err := store.RateLimits.Take(ctx, "crawl:user:2", limit, later); err != nil || result.Remaining != 2 {
+			t.Errorf("Take(pruned) = %+v, %v", result, err)
+		}
+		if result, err := store.RateLimits.Take(ctx, "crawl:user:1", limit, later); err != nil || result.Allowed {
+			t.Errorf("Take(kept) = %+v, %v", result, err)
+		}
+	})
+}
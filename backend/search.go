@@ -0,0 +1,232 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// searchWordPattern matches the words that search terms and indexed text are
+// split into, like the full-text parsers of the databases
+var searchWordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// searchTerm is a word or a phrase of consecutive words. A single word typed
+// with a trailing * matches as a prefix.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+// searchQuery is a parsed search; a URL matches when every term is found in
+// its URL, title, meta description or page text
+type searchQuery []searchTerm
+
+// parseSearchQuery splits input into terms. Text in double quotes is a
+// phrase, and so is a token that splits into several words, like example.com.
+func parseSearchQuery(input string) searchQuery {
+	var query searchQuery
+	add := func(token string, quoted bool) {
+		words := searchWords(token)
+		if len(words) == 0 {
+			return
+		}
+		prefix := !quoted && len(words) == 1 && strings.HasSuffix(token, "*")
+		query = append(query, searchTerm{words: words, prefix: prefix})
+	}
+
+	for i, part := range strings.Split(input, `"`) {
+		// Odd parts are inside quotes
+		if i%2 == 1 {
+			add(part, true)
+			continue
+		}
+		for _, token := range strings.Fields(part) {
+			add(token, false)
+		}
+	}
+	return query
+}
+
+// searchWords returns the lowercased words of text
+func searchWords(text string) []string {
+	words := searchWordPattern.FindAllString(text, -1)
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return words
+}
+
+// mysql renders the term for MATCH ... AGAINST in boolean mode
+func (t searchTerm) mysql() string {
+	if len(t.words) > 1 {
+		return `"` + strings.Join(t.words, " ") + `"`
+	}
+	if t.prefix {
+		return t.words[0] + "*"
+	}
+	return t.words[0]
+}
+
+// postgres renders the term for to_tsquery
+func (t searchTerm) postgres() string {
+	if t.prefix {
+		return t.words[0] + ":*"
+	}
+	return strings.Join(t.words, " <-> ")
+}
+
+// fts5 renders the term for an SQLite FTS5 MATCH
+func (t searchTerm) fts5() string {
+	phrase := `"` + strings.Join(t.words, " ") + `"`
+	if t.prefix {
+		return phrase + "*"
+	}
+	return phrase
+}
+
+// matchesAt reports whether the term matches words starting at index i
+func (t searchTerm) matchesAt(words []string, i int) bool {
+	if i+len(t.words) > len(words) {
+		return false
+	}
+	for j, word := range t.words {
+		if t.prefix && j == len(t.words)-1 {
+			if !strings.HasPrefix(words[i+j], word) {
+				return false
+			}
+		} else if words[i+j] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// marks returns which of words are part of a match of any term
+func (q searchQuery) marks(words []string) []bool {
+	marked := make([]bool, len(words))
+	for _, term := range q {
+		for i := range words {
+			if term.matchesAt(words, i) {
+				for j := range term.words {
+					marked[i+j] = true
+				}
+			}
+		}
+	}
+	return marked
+}
+
+// matches reports whether every term is found in one of fields
+func (q searchQuery) matches(fields ...string) bool {
+	fieldWords := make([][]string, len(fields))
+	for i, field := range fields {
+		fieldWords[i] = searchWords(field)
+	}
+
+	for _, term := range q {
+		found := false
+		for _, words := range fieldWords {
+			for i := range words {
+				if term.matchesAt(words, i) {
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Highlight windows: words of context before the first match and the most
+// words a snippet shows
+const (
+	highlightContextWords = 8
+	highlightMaxWords     = 30
+)
+
+// highlight returns an HTML snippet of text around its first match, with the
+// matched words wrapped in <mark> and everything else escaped, or "" when no
+// term matches
+func (q searchQuery) highlight(text string) string {
+	spans := searchWordPattern.FindAllStringIndex(text, -1)
+	words := make([]string, len(spans))
+	for i, span := range spans {
+		words[i] = strings.ToLower(text[span[0]:span[1]])
+	}
+
+	marked := q.marks(words)
+	first := -1
+	for i, isMarked := range marked {
+		if isMarked {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	start := first - highlightContextWords
+	if start < 0 {
+		start = 0
+	}
+	end := start + highlightMaxWords
+	if end > len(spans) {
+		end = len(spans)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := spans[start][0]
+	for i := start; i < end; i++ {
+		if !marked[i] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:spans[i][0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[spans[i][0]:spans[i][1]]))
+		b.WriteString("</mark>")
+		pos = spans[i][1]
+	}
+	b.WriteString(html.EscapeString(text[pos:spans[end-1][1]]))
+	if end < len(spans) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// highlights returns the snippets of the fields of a URL that match q, keyed
+// by field name
+func (q searchQuery) highlights(fields map[string]*string) map[string]string {
+	highlights := map[string]string{}
+	for name, value := range fields {
+		if value == nil {
+			continue
+		}
+		if snippet := q.highlight(*value); snippet != "" {
+			highlights[name] = snippet
+		}
+	}
+	if len(highlights) == 0 {
+		return nil
+	}
+	return highlights
+}
+
+// searchFields names the fields of a URL and its analysis for highlights
+func searchFields(url string, pageTitle, metaDescription, extractedText *string) map[string]*string {
+	return map[string]*string{
+		"url":              &url,
+		"page_title":       pageTitle,
+		"meta_description": metaDescription,
+		"extracted_text":   extractedText,
+	}
+}
@@ -1,56 +1,227 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// AuthService handles authentication logic
+// AuthService handles authentication logic. Logins get a short-lived access
+// token and a refresh token; each refresh token is used once and replaced,
+// and the tokens of one login form a family that logout revokes. A refresh
+// token used a second time means it was stolen, so its whole family is
+// revoked.
 type AuthService struct {
-	userRepo *UserRepository
-	jwtSecret string
+	userRepo   UserRepository
+	jwtSecret  string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	ticketTTL  time.Duration
+	logger     *slog.Logger
 }
 
-func NewAuthService(userRepo *UserRepository) *AuthService {
+func NewAuthService(userRepo UserRepository) *AuthService {
+	accessTTL, err := time.ParseDuration(getEnv("ACCESS_TOKEN_TTL", "15m"))
+	if err != nil || accessTTL <= 0 {
+		accessTTL = 15 * time.Minute
+	}
+	refreshTTL, err := time.ParseDuration(getEnv("REFRESH_TOKEN_TTL", "720h"))
+	if err != nil || refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+
 	return &AuthService{
-		userRepo:  userRepo,
-		jwtSecret: getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
+		userRepo:   userRepo,
+		jwtSecret:  getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		ticketTTL:  envPositiveDuration("STREAM_TICKET_TTL", 30*time.Second),
+		logger:     slog.Default().With("component", "auth"),
 	}
 }
 
-func (s *AuthService) Login(username, password string) (*LoginResponse, error) {
-	user, err := s.userRepo.GetByUsername(username)
+func (s *AuthService) Login(ctx context.Context, username, password string) (*LoginResponse, error) {
+	user, err := s.userRepo.GetByUsername(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Compare against a dummy hash so unknown usernames take as long as
+		// wrong passwords
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+		return nil, ErrInvalidCredentials
+	}
+
+	// Disabled users are refused like a wrong password, so an attacker cannot
+	// tell them apart
+	if user.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Start a token family for this login
+	familyID, err := newTokenFamilyID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token family: %w", err)
+	}
+	return s.issueTokens(ctx, user, familyID)
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token in
+// the same family. It returns ErrInvalidRefreshToken when the token is
+// unknown, expired, revoked or used before, revoking the family in the last
+// case.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*LoginResponse, error) {
+	now := time.Now().UTC()
+	token, err := s.userRepo.GetRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.RevokedAt != nil || !now.Before(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if token.UsedAt != nil {
+		return nil, s.revokeReused(ctx, token, now)
+	}
+
+	user, err := s.userRepo.GetByID(ctx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// A concurrent refresh with the same token is reuse as well
+	err = s.userRepo.UseRefreshToken(ctx, token.ID, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, s.revokeReused(ctx, token, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(ctx, user, token.FamilyID)
+}
+
+// revokeReused revokes the family of a refresh token presented after it was
+// used, returning ErrInvalidRefreshToken unless revoking fails
+func (s *AuthService) revokeReused(ctx context.Context, token *RefreshToken, now time.Time) error {
+	s.logger.Warn("Refresh token reused, revoking its family", "user_id", token.UserID, "family_id", token.FamilyID)
+	if err := s.userRepo.RevokeRefreshTokenFamily(ctx, token.FamilyID, now); err != nil {
+		return err
+	}
+	return ErrInvalidRefreshToken
+}
+
+// Logout revokes the family of a refresh token, which also rejects the
+// access tokens issued with it. Unknown tokens are ignored.
+func (s *AuthService) Logout(ctx context.Context, refreshToken string) error {
+	token, err := s.userRepo.GetRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.userRepo.RevokeRefreshTokenFamily(ctx, token.FamilyID, time.Now().UTC())
+}
+
+// IssueStreamTicket returns a single-use ticket authenticating user on the
+// event stream. Browsers cannot set headers on an EventSource, and a ticket
+// in the URL leaks far less than the access token would.
+func (s *AuthService) IssueStreamTicket(ctx context.Context, user *User) (*StreamTicketResponse, error) {
+	ticket, err := newOneTimeToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate stream ticket: %w", err)
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(s.ticketTTL)
+	if err := s.userRepo.CreateStreamTicket(ctx, user.ID, hashToken(ticket), expiresAt, now); err != nil {
+		return nil, err
+	}
+	return &StreamTicketResponse{Ticket: ticket, ExpiresAt: expiresAt}, nil
+}
+
+// RedeemStreamTicket uses up a stream ticket and returns its user
+func (s *AuthService) RedeemStreamTicket(ctx context.Context, ticket string) (*User, error) {
+	userID, err := s.userRepo.ConsumeStreamTicket(ctx, hashToken(ticket), time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidStreamTicket
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrInvalidStreamTicket
+	}
+	return user, nil
+}
+
+// issueTokens stores a new refresh token in a family and returns it with an
+// access token for user
+func (s *AuthService) issueTokens(ctx context.Context, user *User, familyID string) (*LoginResponse, error) {
+	refreshToken, err := newOneTimeToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	now := time.Now().UTC()
+	err = s.userRepo.CreateRefreshToken(ctx, &RefreshToken{
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(s.refreshTTL),
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Generate JWT token
-	token, err := s.generateToken(user)
+	expiresAt := now.Add(s.accessTTL)
+	token, err := s.generateToken(user, familyID, expiresAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
 	return &LoginResponse{
-		Token: token,
-		User:  *user,
+		Token:        token,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+		User:         *user,
 	}, nil
 }
 
-func (s *AuthService) ValidateToken(tokenString string) (*User, error) {
+// ValidateToken returns the user of an access token. Tokens whose family
+// was revoked are rejected, so logout takes effect before they expire.
+func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*User, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -63,18 +234,43 @@ func (s *AuthService) ValidateToken(tokenString string) (*User, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		username := claims["username"].(string)
-		return s.userRepo.GetByUsername(username)
+		username, _ := claims["username"].(string)
+		// Tokens issued before refresh tokens carry no family and cannot be
+		// revoked, so they are refused
+		familyID, _ := claims["sid"].(string)
+		if familyID == "" {
+			return nil, fmt.Errorf("invalid token: no token family")
+		}
+		revoked, err := s.userRepo.IsRefreshTokenFamilyRevoked(ctx, familyID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, fmt.Errorf("token family %s is revoked", familyID)
+		}
+
+		user, err := s.userRepo.GetByUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if user.Disabled {
+			return nil, fmt.Errorf("user %s is disabled", username)
+		}
+		// The role claim is informational; permissions follow the stored
+		// role, so a demotion applies before the token expires
+		return user, nil
 	}
 
 	return nil, fmt.Errorf("invalid token")
 }
 
-func (s *AuthService) generateToken(user *User) (string, error) {
+func (s *AuthService) generateToken(user *User, familyID string, expiresAt time.Time) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":  user.ID,
 		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
+		"role":     user.Role,
+		"sid":      familyID,
+		"exp":      expiresAt.Unix(),
 		"iat":      time.Now().Unix(),
 	}
 
@@ -84,23 +280,48 @@ func (s *AuthService) generateToken(user *User) (string, error) {
 
 // CrawlerService handles web crawling and analysis
 type CrawlerService struct {
-	urlRepo      *URLRepository
-	analysisRepo *AnalysisRepository
+	urlRepo      URLRepository
+	unitOfWork   UnitOfWork
+	events       EventBroker
+	logger       *slog.Logger
+	httpClient   *http.Client
 	workerCount  int
+	pollInterval time.Duration
 	queue        chan *URL
-	stopChan     chan bool
+	// ctx is the parent of every crawl; Stop cancels it
+	ctx          context.Context
+	cancel       context.CancelFunc
 	wg           sync.WaitGroup
 	running      bool
+	startedAt    time.Time
+	aliveWorkers atomic.Int32
+	lastPollAt   atomic.Int64
 	mu           sync.Mutex
 }
 
-func NewCrawlerService(urlRepo *URLRepository, analysisRepo *AnalysisRepository) *CrawlerService {
+// CrawlerHealth is a snapshot of the crawler used by the readiness probe
+type CrawlerHealth struct {
+	Running      bool       `json:"running"`
+	Workers      int        `json:"workers"`
+	AliveWorkers int        `json:"alive_workers"`
+	BufferedJobs int        `json:"buffered_jobs"`
+	LastPollAt   *time.Time `json:"last_poll_at,omitempty"`
+	Healthy      bool       `json:"-"`
+}
+
+func NewCrawlerService(urlRepo URLRepository, unitOfWork UnitOfWork, events EventBroker) *CrawlerService {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &CrawlerService{
 		urlRepo:      urlRepo,
-		analysisRepo: analysisRepo,
+		unitOfWork:   unitOfWork,
+		events:       events,
+		logger:       slog.Default().With("component", "crawler"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second, Transport: newTracedTransport()},
 		workerCount:  3,
+		pollInterval: 10 * time.Second,
 		queue:        make(chan *URL, 100),
-		stopChan:     make(chan bool),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
@@ -111,6 +332,7 @@ func (s *CrawlerService) Start() {
 		return
 	}
 	s.running = true
+	s.startedAt = time.Now()
 	s.mu.Unlock()
 
 	// Start workers
@@ -120,6 +342,7 @@ func (s *CrawlerService) Start() {
 	}
 
 	// Start queue processor
+	s.wg.Add(1)
 	go s.processQueue()
 }
 
@@ -132,29 +355,61 @@ func (s *CrawlerService) Stop() {
 	s.running = false
 	s.mu.Unlock()
 
-	close(s.stopChan)
+	// Interrupts running crawls, which put their URLs back in the queue
+	s.cancel()
 	s.wg.Wait()
 }
 
+// Health reports whether the crawler is running with all workers alive and
+// the queue poller still ticking
+func (s *CrawlerService) Health() CrawlerHealth {
+	s.mu.Lock()
+	running, startedAt := s.running, s.startedAt
+	s.mu.Unlock()
+
+	health := CrawlerHealth{
+		Running:      running,
+		Workers:      s.workerCount,
+		AliveWorkers: int(s.aliveWorkers.Load()),
+		BufferedJobs: len(s.queue),
+	}
+
+	lastActivity := startedAt
+	if nanos := s.lastPollAt.Load(); nanos != 0 {
+		lastPoll := time.Unix(0, nanos).UTC()
+		health.LastPollAt = &lastPoll
+		lastActivity = lastPoll
+	}
+
+	health.Healthy = running &&
+		health.AliveWorkers == health.Workers &&
+		time.Since(lastActivity) < 3*s.pollInterval
+	return health
+}
+
 func (s *CrawlerService) processQueue() {
-	ticker := time.NewTicker(10 * time.Second)
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.pollInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.stopChan:
+		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			urls, err := s.urlRepo.GetQueuedURLs()
+			urls, err := s.urlRepo.GetQueuedURLs(s.ctx)
 			if err != nil {
-				log.Printf("Error getting queued URLs: %v", err)
+				s.logger.Error("Failed to get queued URLs", "error", err)
 				continue
 			}
+			crawlerQueueDepth.Set(float64(len(urls)))
+			s.lastPollAt.Store(time.Now().UnixNano())
 
-			for _, url := range urls {
+			for i := range urls {
 				select {
-				case s.queue <- &url:
-				case <-s.stopChan:
+				case s.queue <- &urls[i]:
+				case <-s.ctx.Done():
 					return
 				default:
 					// Queue is full, skip for now
@@ -167,57 +422,210 @@ func (s *CrawlerService) processQueue() {
 
 func (s *CrawlerService) worker() {
 	defer s.wg.Done()
+	s.aliveWorkers.Add(1)
+	defer s.aliveWorkers.Add(-1)
 
 	for {
 		select {
 		case url := <-s.queue:
-			s.processURL(url)
-		case <-s.stopChan:
+			s.runJob(url)
+		case <-s.ctx.Done():
 			return
 		}
 	}
 }
 
+// runJob processes one URL, recovering from panics so a single bad page
+// cannot take a worker down
+func (s *CrawlerService) runJob(url *URL) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.logger.Error("Recovered from panic while processing URL",
+				"url_id", url.ID,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()),
+			)
+		}
+	}()
+
+	s.processURL(url)
+}
+
 func (s *CrawlerService) processURL(url *URL) {
-	// Update status to running
-	if err := s.urlRepo.UpdateStatus(url.ID, "running"); err != nil {
-		log.Printf("Error updating status to running: %v", err)
+	jobID := newCorrelationID()
+	logger := s.logger.With("job_id", jobID, "url_id", url.ID, "url", url.URL)
+
+	// Continue the trace of the request that queued the URL
+	ctx := contextWithTraceParent(s.ctx, url.TraceParent)
+	ctx, span := tracer.Start(ctx, "crawler.processURL",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(urlIDAttribute(url.ID), attribute.String("crawler.job_id", jobID)),
+	)
+	defer span.End()
+	if span.SpanContext().IsValid() {
+		logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+	}
+
+	// Claim the URL; when it was dispatched more than once, or another
+	// replica got it first, the other copy crawls it
+	claimed, err := s.urlRepo.ClaimQueued(ctx, url.WorkspaceID, url.ID)
+	if err != nil {
+		logger.Error("Failed to update status to running", "error", err)
 		return
 	}
+	if !claimed {
+		logger.Debug("URL was claimed by another job")
+		return
+	}
+	s.publishStatus(url, "running", nil, nil)
+	logger.Info("Analysis started")
+
+	crawlerJobsInFlight.Inc()
+	defer crawlerJobsInFlight.Dec()
+	start := time.Now()
 
 	// Perform analysis
-	analysis, err := s.analyzeURL(url.URL)
+	report, err := s.analyzeURL(ctx, url.URL)
+	if err != nil && s.ctx.Err() != nil {
+		s.requeue(ctx, logger, url)
+		return
+	}
+
+	// Stop waits for the job, so its outcome is recorded even when the
+	// crawler is stopping
+	ctx = context.WithoutCancel(ctx)
 	if err != nil {
+		crawlerAnalysisDuration.WithLabelValues("failed").Observe(time.Since(start).Seconds())
+		logger.Warn("Analysis failed", "error", err, "duration", time.Since(start))
+		span.SetStatus(codes.Error, err.Error())
 		errorMsg := err.Error()
-		s.urlRepo.UpdateErrorMessage(url.ID, errorMsg)
-		s.urlRepo.UpdateStatus(url.ID, "failed")
+		s.markFailed(ctx, logger, url, errorMsg)
+		return
+	}
+	crawlerAnalysisDuration.WithLabelValues("completed").Observe(time.Since(start).Seconds())
+
+	// Save analysis results and mark the URL completed
+	analysis := report.Result
+	event := s.statusEvent(url, "completed", analysis, nil)
+	if err := s.saveAnalysis(ctx, event, report); err != nil {
+		logger.Error("Failed to save analysis results", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		s.markFailed(ctx, logger, url, "failed to save analysis results")
+		return
+	}
+	s.events.Publish(event)
+	logger.Info("Analysis completed",
+		"duration", time.Since(start),
+		"internal_links", analysis.InternalLinksCount,
+		"external_links", analysis.ExternalLinksCount,
+		"broken_links", analysis.BrokenLinksCount,
+	)
+}
+
+// saveAnalysis replaces the stored analysis of the URL of a completed event
+// with report, clears its previous error, marks it completed and queues the
+// webhook deliveries of the event in one transaction, so a crash cannot leave
+// it running with results, completed without them or completed without its
+// webhooks
+func (s *CrawlerService) saveAnalysis(ctx context.Context, event URLEvent, report *AnalysisReport) error {
+	urlID := event.URLID
+	return s.unitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		if err := tx.Analysis.DeleteByURLID(ctx, urlID); err != nil {
+			return err
+		}
+		if err := tx.Analysis.Create(ctx, urlID, report.Result); err != nil {
+			return err
+		}
+		if err := tx.Analysis.AddLinks(ctx, urlID, LinkInternal, report.InternalLinks); err != nil {
+			return err
+		}
+		if err := tx.Analysis.AddLinks(ctx, urlID, LinkExternal, report.ExternalLinks); err != nil {
+			return err
+		}
+		for _, link := range report.BrokenLinks {
+			if err := tx.Analysis.AddBrokenLink(ctx, urlID, link.LinkURL, link.StatusCode, link.ErrorMessage); err != nil {
+				return err
+			}
+		}
+		if err := tx.URLs.ClearErrorMessage(ctx, event.WorkspaceID, urlID); err != nil {
+			return err
+		}
+		if err := tx.URLs.UpdateStatus(ctx, event.WorkspaceID, urlID, "completed"); err != nil {
+			return err
+		}
+		return queueWebhookDeliveries(ctx, tx.Webhooks, event)
+	})
+}
+
+// markFailed records errorMsg on the URL and moves it to the failed state,
+// queueing its webhook deliveries in the same transaction
+func (s *CrawlerService) markFailed(ctx context.Context, logger *slog.Logger, url *URL, errorMsg string) {
+	event := s.statusEvent(url, "failed", nil, &errorMsg)
+	err := s.unitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		if err := tx.URLs.UpdateErrorMessage(ctx, url.WorkspaceID, url.ID, errorMsg); err != nil {
+			return err
+		}
+		if err := tx.URLs.UpdateStatus(ctx, url.WorkspaceID, url.ID, "failed"); err != nil {
+			return err
+		}
+		return queueWebhookDeliveries(ctx, tx.Webhooks, event)
+	})
+	if err != nil {
+		logger.Error("Failed to mark URL as failed", "error", err)
 		return
 	}
+	s.events.Publish(event)
+}
+
+// requeue puts a URL whose crawl Stop interrupted back in the queue, so the
+// next start crawls it instead of leaving it running
+func (s *CrawlerService) requeue(ctx context.Context, logger *slog.Logger, url *URL) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
 
-	// Save analysis results
-	if err := s.analysisRepo.Create(url.ID, analysis); err != nil {
-		log.Printf("Error saving analysis results: %v", err)
-		s.urlRepo.UpdateStatus(url.ID, "failed")
+	if err := s.urlRepo.UpdateStatus(ctx, url.WorkspaceID, url.ID, "queued"); err != nil {
+		logger.Error("Failed to queue interrupted URL again", "error", err)
 		return
 	}
+	s.publishStatus(url, "queued", nil, nil)
+	logger.Info("Analysis interrupted, URL queued again")
+}
 
-	// Update status to completed
-	s.urlRepo.UpdateStatus(url.ID, "completed")
+// NotifyStatus announces a status change made outside the workers, such as a
+// URL being added or queued for a rerun
+func (s *CrawlerService) NotifyStatus(url *URL) {
+	s.publishStatus(url, url.Status, nil, url.ErrorMessage)
 }
 
-func (s *CrawlerService) analyzeURL(urlStr string) (*AnalysisResult, error) {
+func (s *CrawlerService) publishStatus(url *URL, status string, analysis *AnalysisResult, errorMsg *string) {
+	s.events.Publish(s.statusEvent(url, status, analysis, errorMsg))
+}
+
+// statusEvent describes url moving to status
+func (s *CrawlerService) statusEvent(url *URL, status string, analysis *AnalysisResult, errorMsg *string) URLEvent {
+	event := URLEvent{
+		Type:        EventURLStatus,
+		WorkspaceID: url.WorkspaceID,
+		URLID:       url.ID,
+		URL:         url.URL,
+		Status:      status,
+		Error:       errorMsg,
+		Timestamp:   time.Now().UTC(),
+	}
+	if analysis != nil {
+		event.Analysis = NewAnalysisSummary(analysis)
+	}
+	return event
+}
+
+func (s *CrawlerService) analyzeURL(ctx context.Context, urlStr string) (*AnalysisReport, error) {
 	// Normalize URL
 	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
 		urlStr = "https://" + urlStr
 	}
 
-	// Create a custom HTTP client with browser-like headers
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Create request with browser-like headers
-	req, err := http.NewRequest("GET", urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -231,19 +639,22 @@ func (s *CrawlerService) analyzeURL(urlStr string) (*AnalysisResult, error) {
 	req.Header.Set("Upgrade-Insecure-Requests", "1")
 
 	// Fetch the page
-	resp, err := client.Do(req)
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
+		crawlerFetchErrorsTotal.WithLabelValues(classifyFetchError(err)).Inc()
 		return nil, fmt.Errorf("failed to fetch URL: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		crawlerFetchErrorsTotal.WithLabelValues(classifyHTTPStatus(resp.StatusCode)).Inc()
 		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
 	}
 
 	// Parse HTML
 	doc, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
+		crawlerFetchErrorsTotal.WithLabelValues("parse").Inc()
 		return nil, fmt.Errorf("failed to parse HTML: %w", err)
 	}
 
@@ -258,6 +669,14 @@ func (s *CrawlerService) analyzeURL(urlStr string) (*AnalysisResult, error) {
 		analysis.PageTitle = &title
 	}
 
+	// Get the meta description and visible text for search
+	if description := strings.TrimSpace(doc.Find(`meta[name="description"]`).AttrOr("content", "")); description != "" {
+		analysis.MetaDescription = &description
+	}
+	if text := extractText(doc); text != "" {
+		analysis.ExtractedText = &text
+	}
+
 	// Count headings
 	analysis.H1Count = doc.Find("h1").Length()
 	analysis.H2Count = doc.Find("h2").Length()
@@ -268,7 +687,7 @@ func (s *CrawlerService) analyzeURL(urlStr string) (*AnalysisResult, error) {
 
 	// Analyze links
 	baseURL, _ := url.Parse(urlStr)
-	internalLinks, externalLinks, brokenLinks := s.analyzeLinks(doc, baseURL)
+	internalLinks, externalLinks, brokenLinks := s.analyzeLinks(ctx, doc, baseURL)
 
 	analysis.InternalLinksCount = len(internalLinks)
 	analysis.ExternalLinksCount = len(externalLinks)
@@ -277,7 +696,12 @@ func (s *CrawlerService) analyzeURL(urlStr string) (*AnalysisResult, error) {
 	// Check for login form
 	analysis.HasLoginForm = s.detectLoginForm(doc)
 
-	return analysis, nil
+	return &AnalysisReport{
+		Result:        analysis,
+		InternalLinks: internalLinks,
+		ExternalLinks: externalLinks,
+		BrokenLinks:   brokenLinks,
+	}, nil
 }
 
 func (s *CrawlerService) detectHTMLVersion(doc *goquery.Document) *string {
@@ -297,8 +721,28 @@ func (s *CrawlerService) detectHTMLVersion(doc *goquery.Document) *string {
 	return &version
 }
 
-func (s *CrawlerService) analyzeLinks(doc *goquery.Document, baseURL *url.URL) ([]string, []string, []string) {
-	var internalLinks, externalLinks, brokenLinks []string
+// maxExtractedTextLength bounds the page text stored for search, in bytes
+const maxExtractedTextLength = 60000
+
+// extractText returns the visible text of the page body with whitespace
+// collapsed, truncated to maxExtractedTextLength
+func extractText(doc *goquery.Document) string {
+	body := doc.Find("body").Clone()
+	body.Find("script, style, noscript, template").Remove()
+
+	text := strings.Join(strings.Fields(body.Text()), " ")
+	if len(text) > maxExtractedTextLength {
+		text = strings.ToValidUTF8(text[:maxExtractedTextLength], "")
+	}
+	return text
+}
+
+// analyzeLinks splits the links of a page into internal and external ones and
+// checks each of them, returning the broken ones with their status or error
+func (s *CrawlerService) analyzeLinks(ctx context.Context, doc *goquery.Document, baseURL *url.URL) ([]Link, []Link, []BrokenLink) {
+	var internalLinks, externalLinks []Link
+	var brokenLinks []BrokenLink
+	client := s.httpClient
 
 	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
 		href, exists := s.Attr("href")
@@ -309,7 +753,7 @@ func (s *CrawlerService) analyzeLinks(doc *goquery.Document, baseURL *url.URL) (
 		// Parse the link URL
 		linkURL, err := url.Parse(href)
 		if err != nil {
-			brokenLinks = append(brokenLinks, href)
+			brokenLinks = append(brokenLinks, *newBrokenLink(href, nil, err))
 			return
 		}
 
@@ -318,22 +762,57 @@ func (s *CrawlerService) analyzeLinks(doc *goquery.Document, baseURL *url.URL) (
 			linkURL = baseURL.ResolveReference(linkURL)
 		}
 
+		// Check if link is broken (simplified check)
+		link := Link{URL: linkURL.String(), Text: strings.TrimSpace(s.Text())}
+		if broken := checkLink(ctx, client, link.URL); broken != nil {
+			link.IsBroken = true
+			brokenLinks = append(brokenLinks, *broken)
+		}
+
 		// Check if it's internal or external
 		if linkURL.Hostname() == baseURL.Hostname() {
-			internalLinks = append(internalLinks, linkURL.String())
+			internalLinks = append(internalLinks, link)
 		} else {
-			externalLinks = append(externalLinks, linkURL.String())
-		}
-
-		// Check if link is broken (simplified check)
-		if resp, err := http.Head(linkURL.String()); err != nil || resp.StatusCode >= 400 {
-			brokenLinks = append(brokenLinks, linkURL.String())
+			externalLinks = append(externalLinks, link)
 		}
 	})
 
 	return internalLinks, externalLinks, brokenLinks
 }
 
+// checkLink sends a HEAD request to linkURL and describes the link if it is
+// broken, or returns nil if it answered successfully
+func checkLink(ctx context.Context, client *http.Client, linkURL string) *BrokenLink {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, linkURL, nil)
+	if err != nil {
+		crawlerLinkChecksTotal.WithLabelValues("error").Inc()
+		return newBrokenLink(linkURL, nil, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		crawlerLinkChecksTotal.WithLabelValues("error").Inc()
+		return newBrokenLink(linkURL, nil, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		crawlerLinkChecksTotal.WithLabelValues("broken").Inc()
+		return newBrokenLink(linkURL, &resp.StatusCode, nil)
+	}
+	crawlerLinkChecksTotal.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// newBrokenLink describes a link that answered with statusCode or failed with err
+func newBrokenLink(linkURL string, statusCode *int, err error) *BrokenLink {
+	link := &BrokenLink{LinkURL: linkURL, StatusCode: statusCode}
+	if err != nil {
+		message := err.Error()
+		link.ErrorMessage = &message
+	}
+	return link
+}
+
 func (s *CrawlerService) detectLoginForm(doc *goquery.Document) bool {
 	// Check for common login form indicators
 	selectors := []string{
@@ -354,16 +833,18 @@ func (s *CrawlerService) detectLoginForm(doc *goquery.Document) bool {
 	return false
 }
 
-func (s *CrawlerService) RerunAnalysis(urlID int64) error {
-	_, err := s.urlRepo.GetByID(urlID)
+func (s *CrawlerService) RerunAnalysis(ctx context.Context, workspaceID, urlID int64) error {
+	url, err := s.urlRepo.GetByID(ctx, workspaceID, urlID)
 	if err != nil {
 		return fmt.Errorf("URL not found: %w", err)
 	}
 
 	// Reset status to queued
-	if err := s.urlRepo.UpdateStatus(urlID, "queued"); err != nil {
+	if err := s.urlRepo.UpdateStatus(ctx, workspaceID, urlID, "queued"); err != nil {
 		return fmt.Errorf("failed to reset status: %w", err)
 	}
 
+	url.Status = "queued"
+	s.NotifyStatus(url)
 	return nil
 } 
\ No newline at end of file
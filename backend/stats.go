@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats are the aggregates shown in the dashboard header. Status counts,
+// broken links, top domains and login forms describe every URL as it is now;
+// the daily counts, crawl durations and failures cover crawls that finished
+// between From and To.
+type Stats struct {
+	From             string              `json:"from"`
+	To               string              `json:"to"`
+	StatusCounts     map[string]int64    `json:"status_counts"`
+	TotalURLs        int64               `json:"total_urls"`
+	Daily            []DailyCrawlStats   `json:"daily"`
+	CrawlDuration    CrawlDurationStats  `json:"crawl_duration"`
+	TotalBrokenLinks int64               `json:"total_broken_links"`
+	TopBrokenDomains []DomainBrokenLinks `json:"top_broken_domains"`
+	TopFailures      []FailureCount      `json:"top_failures"`
+	LoginForms       LoginFormStats      `json:"login_forms"`
+	GeneratedAt      time.Time           `json:"generated_at"`
+}
+
+// DailyCrawlStats counts the crawls that finished on a day, in UTC
+type DailyCrawlStats struct {
+	Date      string `json:"date"`
+	Completed int64  `json:"completed"`
+	Failed    int64  `json:"failed"`
+}
+
+// CrawlDurationStats summarizes the time from started_at to completed_at of
+// completed crawls. Percentiles use the nearest rank and are nil without
+// any crawls.
+type CrawlDurationStats struct {
+	Count          int64    `json:"count"`
+	AverageSeconds *float64 `json:"average_seconds,omitempty"`
+	P50Seconds     *float64 `json:"p50_seconds,omitempty"`
+	P90Seconds     *float64 `json:"p90_seconds,omitempty"`
+	P95Seconds     *float64 `json:"p95_seconds,omitempty"`
+	P99Seconds     *float64 `json:"p99_seconds,omitempty"`
+}
+
+// DomainBrokenLinks is a host with the broken links found on its pages
+type DomainBrokenLinks struct {
+	Domain      string `json:"domain"`
+	BrokenLinks int64  `json:"broken_links"`
+	URLs        int64  `json:"urls"`
+}
+
+// FailureCount is an error message shared by failed URLs
+type FailureCount struct {
+	Message string `json:"message"`
+	Count   int64  `json:"count"`
+}
+
+// LoginFormStats is the share of analyzed pages that have a login form
+type LoginFormStats struct {
+	Analyzed      int64   `json:"analyzed"`
+	WithLoginForm int64   `json:"with_login_form"`
+	Share         float64 `json:"share"`
+}
+
+// StatsOptions selects the workspace and the days covered by the ranged
+// stats: From is the start of the first day and To the start of the day
+// after the last
+type StatsOptions struct {
+	WorkspaceID int64
+	From        time.Time
+	To          time.Time
+}
+
+// Limits of the stats query: the default and longest date ranges, in days,
+// and the length of the top lists
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	statsTopLimit    = 10
+)
+
+// statsPercentiles are the crawl duration percentiles reported
+var statsPercentiles = []float64{50, 90, 95, 99}
+
+// ParseStatsOptions reads the from and to dates, both inclusive, of
+// GET /api/stats. The range defaults to the 30 days up to today.
+func ParseStatsOptions(query url.Values, now time.Time) (StatsOptions, []FieldError) {
+	var errs []FieldError
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	parseDay := func(field string, fallback time.Time) time.Time {
+		value := query.Get(field)
+		if value == "" {
+			return fallback
+		}
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: "must be a YYYY-MM-DD date"})
+			return fallback
+		}
+		return day
+	}
+
+	last := parseDay("to", today)
+	first := parseDay("from", last.AddDate(0, 0, 1-defaultStatsDays))
+	opts := StatsOptions{From: first, To: last.AddDate(0, 0, 1)}
+
+	if len(errs) == 0 {
+		days := opts.days()
+		if days < 1 {
+			errs = append(errs, FieldError{Field: "from", Message: "must not be after to"})
+		} else if days > maxStatsDays {
+			errs = append(errs, FieldError{Field: "from", Message: fmt.Sprintf("must be at most %d days before to", maxStatsDays)})
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return opts, errs
+}
+
+// days is the number of days in the range
+func (opts StatsOptions) days() int {
+	return int(opts.To.Sub(opts.From).Hours() / 24)
+}
+
+// newStats returns stats for opts with a zero count for every status and day,
+// for repositories to fill in
+func newStats(opts StatsOptions) *Stats {
+	stats := &Stats{
+		From:             opts.From.Format("2006-01-02"),
+		To:               opts.To.AddDate(0, 0, -1).Format("2006-01-02"),
+		StatusCounts:     map[string]int64{},
+		TopBrokenDomains: []DomainBrokenLinks{},
+		TopFailures:      []FailureCount{},
+		GeneratedAt:      time.Now().UTC(),
+	}
+	for _, status := range urlStatuses {
+		stats.StatusCounts[status] = 0
+	}
+	for day := opts.From; day.Before(opts.To); day = day.AddDate(0, 0, 1) {
+		stats.Daily = append(stats.Daily, DailyCrawlStats{Date: day.Format("2006-01-02")})
+	}
+	return stats
+}
+
+// day returns the entry of the daily counts for a YYYY-MM-DD date, or nil
+func (s *Stats) day(date string) *DailyCrawlStats {
+	for i := range s.Daily {
+		if s.Daily[i].Date == date {
+			return &s.Daily[i]
+		}
+	}
+	return nil
+}
+
+// finish derives the totals and shares from the counts
+func (s *Stats) finish() {
+	for _, count := range s.StatusCounts {
+		s.TotalURLs += count
+	}
+	if s.LoginForms.Analyzed > 0 {
+		s.LoginForms.Share = float64(s.LoginForms.WithLoginForm) / float64(s.LoginForms.Analyzed)
+	}
+}
+
+// percentileRank returns the 1-based nearest rank of percentile p among n
+// sorted values
+func percentileRank(n int64, p float64) int64 {
+	rank := int64(math.Ceil(p / 100 * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	return rank
+}
+
+// setPercentile stores the value of percentile p
+func (d *CrawlDurationStats) setPercentile(p float64, seconds float64) {
+	switch p {
+	case 50:
+		d.P50Seconds = &seconds
+	case 90:
+		d.P90Seconds = &seconds
+	case 95:
+		d.P95Seconds = &seconds
+	case 99:
+		d.P99Seconds = &seconds
+	}
+}
+
+// topFailures sorts failure counts by count, then message, and keeps the
+// first statsTopLimit
+func topFailures(counts map[string]int64) []FailureCount {
+	failures := []FailureCount{}
+	for message, count := range counts {
+		failures = append(failures, FailureCount{Message: message, Count: count})
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Count != failures[j].Count {
+			return failures[i].Count > failures[j].Count
+		}
+		return failures[i].Message < failures[j].Message
+	})
+	if len(failures) > statsTopLimit {
+		failures = failures[:statsTopLimit]
+	}
+	return failures
+}
+
+// StatsService serves stats from a short-lived cache, so a dashboard polling
+// them does not run the aggregate queries on every request
+type StatsService struct {
+	statsRepo StatsRepository
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[StatsOptions]*cachedStats
+}
+
+type cachedStats struct {
+	stats   *Stats
+	expires time.Time
+}
+
+// NewStatsService returns a service caching stats for ttl, or not at all if
+// it is zero
+func NewStatsService(statsRepo StatsRepository, ttl time.Duration) *StatsService {
+	return &StatsService{
+		statsRepo: statsRepo,
+		ttl:       ttl,
+		cache:     map[StatsOptions]*cachedStats{},
+	}
+}
+
+// Get returns the stats for opts. The result is shared with other callers
+// and must not be modified.
+func (s *StatsService) Get(ctx context.Context, opts StatsOptions) (*Stats, error) {
+	now := time.Now()
+	s.mu.Lock()
+	cached, ok := s.cache[opts]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.stats, nil
+	}
+
+	stats, err := s.statsRepo.Get(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if s.ttl <= 0 {
+		return stats, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.cache {
+		if !now.Before(entry.expires) {
+			delete(s.cache, key)
+		}
+	}
+	s.cache[opts] = &cachedStats{stats: stats, expires: now.Add(s.ttl)}
+	return stats, nil
+}
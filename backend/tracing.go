@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies the backend in traces
+const serviceName = "crawler-backend"
+
+var tracer = otel.Tracer(serviceName)
+
+// setupTracing installs the global tracer provider. OTEL_TRACES_EXPORTER
+// selects otlp, stdout or none (default); the OTLP exporter honours the
+// standard OTEL_EXPORTER_OTLP_* variables. The returned function flushes and
+// stops the provider.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(getEnv("OTEL_TRACES_EXPORTER", "none")) {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", getEnv("OTEL_TRACES_EXPORTER", ""))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(getEnv("OTEL_SERVICE_NAME", serviceName)),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// newTracedTransport wraps the default transport so every outbound request
+// gets a client span and propagates the trace context
+func newTracedTransport() http.RoundTripper {
+	return traceTransport(http.DefaultTransport)
+}
+
+// traceTransport wraps base so each request it sends is a client span
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method
+		}),
+	)
+}
+
+// startDBSpan starts a client span for a repository query against the
+// database identified by system
+func startDBSpan(ctx context.Context, system attribute.KeyValue, name, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			system,
+			semconv.DBStatement(query),
+		),
+	)
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceParent serializes the span context in ctx as a W3C traceparent so it
+// can be stored with a queued job, or returns nil when ctx is not traced
+func traceParent(ctx context.Context) *string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if value, ok := carrier["traceparent"]; ok {
+		return &value
+	}
+	return nil
+}
+
+// contextWithTraceParent restores a span context saved by traceParent
+func contextWithTraceParent(ctx context.Context, traceparent *string) context.Context {
+	if traceparent == nil {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": *traceparent})
+}
+
+// urlIDAttribute tags spans with the URL being processed
+func urlIDAttribute(id int64) attribute.KeyValue {
+	return attribute.Int64("crawler.url_id", id)
+}
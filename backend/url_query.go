@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLListOptions selects, filters and orders a page of the URL list of a
+// workspace. Zero values leave a filter off.
+type URLListOptions struct {
+	WorkspaceID int64
+
+	Page     int
+	PageSize int
+
+	Status string
+	Search string
+
+	// Sort is a key of urlSortFields; the zero value lists the newest first
+	Sort      string
+	Ascending bool
+
+	// Cursor switches to keyset pagination: the page starts after, or ends
+	// before, the row it marks, and Page is ignored. The total is only
+	// counted when IncludeTotal is set.
+	Cursor       *URLCursor
+	IncludeTotal bool
+
+	// IncludeAnalysis embeds a summary of each URL's analysis in the rows
+	IncludeAnalysis bool
+
+	CreatedAfter    *time.Time
+	CreatedBefore   *time.Time
+	CompletedAfter  *time.Time
+	CompletedBefore *time.Time
+	HasLoginForm    *bool
+	MinBrokenLinks  *int
+	MaxBrokenLinks  *int
+	HTMLVersion     string
+	Host            string
+}
+
+// Kinds of sort values, which decide how they are scanned and encoded in cursors
+const (
+	sortInt = iota
+	sortString
+	sortBool
+	sortTime
+)
+
+// urlSortField is a column the URL list can be ordered by
+type urlSortField struct {
+	// column is the SQL expression over urls u and analysis_results a
+	column string
+	kind   int
+	// value reads the field for the in-memory store as an int64, string, bool
+	// or time.Time; nil sorts last like NULL
+	value func(url *URL, analysis *AnalysisResult) interface{}
+}
+
+// analysisValue wraps an analysis field so it is nil for URLs not yet analyzed
+func analysisValue(field func(analysis *AnalysisResult) interface{}) func(*URL, *AnalysisResult) interface{} {
+	return func(url *URL, analysis *AnalysisResult) interface{} {
+		if analysis == nil {
+			return nil
+		}
+		return field(analysis)
+	}
+}
+
+// urlSortFields is the allowlist of sort keys. Only these column expressions
+// are ever written into an ORDER BY clause.
+var urlSortFields = map[string]urlSortField{
+	"id":           {"u.id", sortInt, func(url *URL, _ *AnalysisResult) interface{} { return url.ID }},
+	"url":          {"u.url", sortString, func(url *URL, _ *AnalysisResult) interface{} { return url.URL }},
+	"status":       {"u.status", sortString, func(url *URL, _ *AnalysisResult) interface{} { return url.Status }},
+	"created_at":   {"u.created_at", sortTime, func(url *URL, _ *AnalysisResult) interface{} { return url.CreatedAt }},
+	"updated_at":   {"u.updated_at", sortTime, func(url *URL, _ *AnalysisResult) interface{} { return url.UpdatedAt }},
+	"started_at":   {"u.started_at", sortTime, func(url *URL, _ *AnalysisResult) interface{} { return timeValue(url.StartedAt) }},
+	"completed_at": {"u.completed_at", sortTime, func(url *URL, _ *AnalysisResult) interface{} { return timeValue(url.CompletedAt) }},
+	"title": {"a.page_title", sortString, analysisValue(func(a *AnalysisResult) interface{} {
+		return stringValue(a.PageTitle)
+	})},
+	"html_version": {"a.html_version", sortString, analysisValue(func(a *AnalysisResult) interface{} {
+		return stringValue(a.HTMLVersion)
+	})},
+	"h1_count":             {"a.h1_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H1Count) })},
+	"h2_count":             {"a.h2_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H2Count) })},
+	"h3_count":             {"a.h3_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H3Count) })},
+	"h4_count":             {"a.h4_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H4Count) })},
+	"h5_count":             {"a.h5_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H5Count) })},
+	"h6_count":             {"a.h6_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.H6Count) })},
+	"internal_links_count": {"a.internal_links_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.InternalLinksCount) })},
+	"external_links_count": {"a.external_links_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.ExternalLinksCount) })},
+	"broken_links_count":   {"a.broken_links_count", sortInt, analysisValue(func(a *AnalysisResult) interface{} { return int64(a.BrokenLinksCount) })},
+	"has_login_form":       {"a.has_login_form", sortBool, analysisValue(func(a *AnalysisResult) interface{} { return a.HasLoginForm })},
+}
+
+// defaultURLSort lists the newest URLs first
+const defaultURLSort = "created_at"
+
+func timeValue(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+func stringValue(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+// compareSortValues orders two non-nil values read by the same urlSortField
+func compareSortValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		return compareInt64(a, b.(int64))
+	case string:
+		return strings.Compare(a, b.(string))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// urlStatuses are the states a URL moves through
+var urlStatuses = []string{"queued", "running", "completed", "failed"}
+
+// hostPattern matches the lowercase hostnames produced by URL canonicalization
+var hostPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// maxHTMLVersionLength matches the size of the html_version columns
+const maxHTMLVersionLength = 10
+
+// ParseURLListOptions reads the list options from the query string of
+// GET /api/urls, returning the problems with any invalid parameter
+func ParseURLListOptions(query url.Values) (URLListOptions, []FieldError) {
+	var errs []FieldError
+	fail := func(field, message string) {
+		errs = append(errs, FieldError{Field: field, Message: message})
+	}
+
+	opts := URLListOptions{
+		Search:      query.Get("search"),
+		HTMLVersion: query.Get("html_version"),
+		Host:        strings.ToLower(query.Get("host")),
+	}
+
+	// Page parameters are lenient, as they always were
+	opts.Page, _ = strconv.Atoi(query.Get("page"))
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	opts.PageSize, _ = strconv.Atoi(query.Get("page_size"))
+	if opts.PageSize < 1 || opts.PageSize > 100 {
+		opts.PageSize = 10
+	}
+
+	if status := query.Get("status"); status != "" {
+		if !containsString(urlStatuses, status) {
+			fail("status", "must be one of "+strings.Join(urlStatuses, ", "))
+		}
+		opts.Status = status
+	}
+
+	if sortKey := query.Get("sort"); sortKey != "" {
+		if _, ok := urlSortFields[sortKey]; !ok {
+			fail("sort", "must be one of "+strings.Join(urlSortKeys(), ", "))
+		}
+		opts.Sort = sortKey
+		opts.Ascending = true
+	}
+	switch order := query.Get("order"); order {
+	case "":
+	case "asc", "desc":
+		opts.Ascending = order == "asc"
+	default:
+		fail("order", "must be asc or desc")
+	}
+
+	for field, dest := range map[string]**time.Time{
+		"created_after":    &opts.CreatedAfter,
+		"created_before":   &opts.CreatedBefore,
+		"completed_after":  &opts.CompletedAfter,
+		"completed_before": &opts.CompletedBefore,
+	} {
+		if value := query.Get(field); value != "" {
+			t, err := parseListTime(value)
+			if err != nil {
+				fail(field, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+				continue
+			}
+			*dest = &t
+		}
+	}
+
+	if value := query.Get("has_login_form"); value != "" {
+		hasLoginForm, err := strconv.ParseBool(value)
+		if err != nil {
+			fail("has_login_form", "must be true or false")
+		} else {
+			opts.HasLoginForm = &hasLoginForm
+		}
+	}
+
+	for field, dest := range map[string]**int{
+		"min_broken_links": &opts.MinBrokenLinks,
+		"max_broken_links": &opts.MaxBrokenLinks,
+	} {
+		if value := query.Get(field); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				fail(field, "must be a non-negative integer")
+				continue
+			}
+			*dest = &n
+		}
+	}
+	if opts.MinBrokenLinks != nil && opts.MaxBrokenLinks != nil && *opts.MinBrokenLinks > *opts.MaxBrokenLinks {
+		fail("max_broken_links", "must not be less than min_broken_links")
+	}
+
+	if len(opts.HTMLVersion) > maxHTMLVersionLength {
+		fail("html_version", fmt.Sprintf("must be at most %d characters", maxHTMLVersionLength))
+	}
+	if opts.Host != "" && !hostPattern.MatchString(opts.Host) {
+		fail("host", "must be a hostname")
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := DecodeURLCursor(value)
+		switch {
+		case err != nil:
+			fail("cursor", "is invalid")
+		case (query.Get("sort") != "" && cursor.Sort != opts.sortKey()) || (query.Get("order") != "" && cursor.Ascending != opts.Ascending):
+			fail("cursor", "was issued for a different sort order")
+		default:
+			opts.Cursor = cursor
+			opts.Sort, opts.Ascending = cursor.Sort, cursor.Ascending
+		}
+	}
+	if value := query.Get("include_total"); value != "" {
+		includeTotal, err := strconv.ParseBool(value)
+		if err != nil {
+			fail("include_total", "must be true or false")
+		}
+		opts.IncludeTotal = includeTotal
+	}
+
+	for _, include := range strings.Split(query.Get("include"), ",") {
+		switch strings.TrimSpace(include) {
+		case "":
+		case "analysis":
+			opts.IncludeAnalysis = true
+		default:
+			fail("include", "must be a comma separated list of: analysis")
+		}
+	}
+
+	// Report errors in a stable order
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return opts, errs
+}
+
+// parseListTime accepts an RFC 3339 timestamp or a date, meaning its start in UTC
+func parseListTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func urlSortKeys() []string {
+	keys := make([]string, 0, len(urlSortFields))
+	for key := range urlSortFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKey returns the key of the sort field of opts
+func (opts URLListOptions) sortKey() string {
+	if _, ok := urlSortFields[opts.Sort]; ok {
+		return opts.Sort
+	}
+	return defaultURLSort
+}
+
+// offset is the number of rows skipped in page mode
+func (opts URLListOptions) offset() int {
+	if opts.Cursor != nil {
+		return 0
+	}
+	return (opts.Page - 1) * opts.PageSize
+}
+
+// countTotal reports whether the total number of matching URLs is needed
+func (opts URLListOptions) countTotal() bool {
+	return opts.Cursor == nil || opts.IncludeTotal
+}
+
+// backward reports whether the page is fetched backwards from a cursor
+func (opts URLListOptions) backward() bool {
+	return opts.Cursor != nil && opts.Cursor.Before
+}
+
+// filter appends the SQL conditions for the filters of opts, other than
+// search and the cursor, to where and args
+func (opts URLListOptions) filter(dialect *sqlDialect, where []string, args []interface{}) ([]string, []interface{}) {
+	add := func(condition string, values ...interface{}) {
+		where = append(where, condition)
+		args = append(args, values...)
+	}
+
+	if opts.Status != "" {
+		add("u.status = ?", opts.Status)
+	}
+	if opts.CreatedAfter != nil {
+		add("u.created_at >= ?", dialect.timeArg(*opts.CreatedAfter))
+	}
+	if opts.CreatedBefore != nil {
+		add("u.created_at < ?", dialect.timeArg(*opts.CreatedBefore))
+	}
+	if opts.CompletedAfter != nil {
+		add("u.completed_at >= ?", dialect.timeArg(*opts.CompletedAfter))
+	}
+	if opts.CompletedBefore != nil {
+		add("u.completed_at < ?", dialect.timeArg(*opts.CompletedBefore))
+	}
+	if opts.HasLoginForm != nil {
+		add("a.has_login_form = ?", *opts.HasLoginForm)
+	}
+	if opts.MinBrokenLinks != nil {
+		add("a.broken_links_count >= ?", *opts.MinBrokenLinks)
+	}
+	if opts.MaxBrokenLinks != nil {
+		add("a.broken_links_count <= ?", *opts.MaxBrokenLinks)
+	}
+	if opts.HTMLVersion != "" {
+		add("a.html_version = ?", opts.HTMLVersion)
+	}
+	if opts.Host != "" {
+		// The host is validated by hostPattern, so it holds no LIKE wildcards
+		add("(u.url LIKE ? OR u.url LIKE ? OR u.url LIKE ?)",
+			"%://"+opts.Host, "%://"+opts.Host+"/%", "%://"+opts.Host+":%")
+	}
+
+	return where, args
+}
+
+// cursorCondition returns the SQL condition selecting the rows after the
+// cursor of opts, or before it when paging backwards
+func (opts URLListOptions) cursorCondition(dialect *sqlDialect) (string, []interface{}) {
+	cursor := opts.Cursor
+	column := urlSortFields[opts.sortKey()].column
+
+	// Rows further along the list have greater values when ascending
+	op := ">"
+	if opts.Ascending == cursor.Before {
+		op = "<"
+	}
+
+	value := cursor.Value
+	if t, ok := value.(time.Time); ok {
+		value = dialect.timeArg(t)
+	}
+
+	// NULLs sort last, after every value
+	switch {
+	case value != nil && !cursor.Before:
+		return fmt.Sprintf("((%[1]s IS NOT NULL AND (%[1]s %[2]s ? OR (%[1]s = ? AND u.id %[2]s ?))) OR %[1]s IS NULL)", column, op),
+			[]interface{}{value, value, cursor.ID}
+	case value != nil:
+		return fmt.Sprintf("(%[1]s IS NOT NULL AND (%[1]s %[2]s ? OR (%[1]s = ? AND u.id %[2]s ?)))", column, op),
+			[]interface{}{value, value, cursor.ID}
+	case !cursor.Before:
+		return fmt.Sprintf("(%s IS NULL AND u.id %s ?)", column, op), []interface{}{cursor.ID}
+	default:
+		return fmt.Sprintf("(%[1]s IS NOT NULL OR u.id %[2]s ?)", column, op), []interface{}{cursor.ID}
+	}
+}
+
+// orderBy returns the ORDER BY clause for opts, reversed when paging
+// backwards. NULLs sort last in both directions and the URL ID breaks ties,
+// so pages are stable.
+func (opts URLListOptions) orderBy() string {
+	nulls, direction := "", "DESC"
+	if opts.Ascending {
+		direction = "ASC"
+	}
+	if opts.backward() {
+		nulls = " DESC"
+		direction = map[string]string{"ASC": "DESC", "DESC": "ASC"}[direction]
+	}
+
+	return fmt.Sprintf("ORDER BY CASE WHEN %[1]s IS NULL THEN 1 ELSE 0 END%[2]s, %[1]s %[3]s, u.id %[3]s",
+		urlSortFields[opts.sortKey()].column, nulls, direction)
+}
+
+// matches reports whether a URL and its analysis pass the filters of opts,
+// other than search, for the in-memory store
+func (opts URLListOptions) matches(u *URL, analysis *AnalysisResult) bool {
+	if u.WorkspaceID != opts.WorkspaceID {
+		return false
+	}
+	if opts.Status != "" && u.Status != opts.Status {
+		return false
+	}
+	if opts.CreatedAfter != nil && u.CreatedAt.Before(*opts.CreatedAfter) {
+		return false
+	}
+	if opts.CreatedBefore != nil && !u.CreatedAt.Before(*opts.CreatedBefore) {
+		return false
+	}
+	if opts.CompletedAfter != nil && (u.CompletedAt == nil || u.CompletedAt.Before(*opts.CompletedAfter)) {
+		return false
+	}
+	if opts.CompletedBefore != nil && (u.CompletedAt == nil || !u.CompletedAt.Before(*opts.CompletedBefore)) {
+		return false
+	}
+	if opts.Host != "" {
+		parsed, err := url.Parse(u.URL)
+		if err != nil || parsed.Hostname() != opts.Host {
+			return false
+		}
+	}
+
+	needsAnalysis := opts.HasLoginForm != nil || opts.MinBrokenLinks != nil || opts.MaxBrokenLinks != nil || opts.HTMLVersion != ""
+	if !needsAnalysis {
+		return true
+	}
+	if analysis == nil {
+		return false
+	}
+	if opts.HasLoginForm != nil && analysis.HasLoginForm != *opts.HasLoginForm {
+		return false
+	}
+	if opts.MinBrokenLinks != nil && analysis.BrokenLinksCount < *opts.MinBrokenLinks {
+		return false
+	}
+	if opts.MaxBrokenLinks != nil && analysis.BrokenLinksCount > *opts.MaxBrokenLinks {
+		return false
+	}
+	if opts.HTMLVersion != "" && (analysis.HTMLVersion == nil || *analysis.HTMLVersion != opts.HTMLVersion) {
+		return false
+	}
+	return true
+}
+
+// compare orders two rows of the list by their sort values and IDs,
+// returning a negative number when a comes first
+func (opts URLListOptions) compare(valueA interface{}, idA int64, valueB interface{}, idB int64) int {
+	cmp := 0
+	switch {
+	case valueA == nil && valueB == nil:
+	case valueA == nil:
+		// NULLs sort last in both directions
+		return 1
+	case valueB == nil:
+		return -1
+	default:
+		cmp = compareSortValues(valueA, valueB)
+	}
+	if cmp == 0 {
+		cmp = compareInt64(idA, idB)
+	}
+
+	if opts.Ascending {
+		return cmp
+	}
+	return -cmp
+}
+
+// sortValue reads the sort field of opts, for the in-memory store
+func (opts URLListOptions) sortValue(url *URL, analysis *AnalysisResult) interface{} {
+	return urlSortFields[opts.sortKey()].value(url, analysis)
+}
+
+// listPage builds the response from the rows fetched for opts, with the
+// sort value of each: up to PageSize+1 rows, in reverse list order when
+// paging backwards. The extra row only tells that more rows follow.
+func (opts URLListOptions) listPage(urls []URL, values []interface{}) (*URLListResponse, error) {
+	hasMore := len(urls) > opts.PageSize
+	if hasMore {
+		urls, values = urls[:opts.PageSize], values[:opts.PageSize]
+	}
+	if opts.backward() {
+		for i, j := 0, len(urls)-1; i < j; i, j = i+1, j-1 {
+			urls[i], urls[j] = urls[j], urls[i]
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+
+	response := &URLListResponse{URLs: urls, PageSize: opts.PageSize}
+	if opts.Cursor == nil {
+		response.Page = opts.Page
+	}
+	if len(urls) == 0 {
+		return response, nil
+	}
+
+	cursorAt := func(i int, before bool) (string, error) {
+		cursor := URLCursor{Sort: opts.sortKey(), Ascending: opts.Ascending, Value: values[i], ID: urls[i].ID, Before: before}
+		return cursor.Encode()
+	}
+	// Paging forwards, rows precede this page when it starts after a cursor or
+	// past the first page; paging backwards, rows always follow it
+	hasPrev, hasNext := opts.Cursor != nil || opts.offset() > 0, hasMore
+	if opts.backward() {
+		hasPrev, hasNext = hasMore, true
+	}
+
+	var err error
+	if hasPrev {
+		if response.PrevCursor, err = cursorAt(0, true); err != nil {
+			return nil, err
+		}
+	}
+	if hasNext {
+		if response.NextCursor, err = cursorAt(len(urls)-1, false); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// setTotal fills in the total counts of a page
+func (r *URLListResponse) setTotal(total int64, pageSize int) {
+	totalPages := int((total + int64(pageSize) - 1) / int64(pageSize))
+	r.Total = &total
+	r.TotalPages = &totalPages
+}
+
+// URLCursor marks a row of the URL list by its sort value and ID. Clients get
+// it as an opaque string and pass it back to continue after the row, or
+// before it when Before is set.
+type URLCursor struct {
+	Sort      string      `json:"s"`
+	Ascending bool        `json:"a,omitempty"`
+	Value     interface{} `json:"v"`
+	ID        int64       `json:"id"`
+	Before    bool        `json:"b,omitempty"`
+}
+
+// Encode returns the cursor as an opaque, URL safe string
+func (c URLCursor) Encode() (string, error) {
+	if t, ok := c.Value.(time.Time); ok {
+		c.Value = t.UTC().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeURLCursor parses a cursor made by Encode, restoring the type of its
+// value from the sort field
+func DecodeURLCursor(encoded string) (*URLCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var cursor URLCursor
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, err
+	}
+
+	field, ok := urlSortFields[cursor.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort field %q", cursor.Sort)
+	}
+	if cursor.Value == nil {
+		return &cursor, nil
+	}
+
+	ok = false
+	switch field.kind {
+	case sortInt:
+		var number json.Number
+		if number, ok = cursor.Value.(json.Number); ok {
+			cursor.Value, err = number.Int64()
+		}
+	case sortString:
+		_, ok = cursor.Value.(string)
+	case sortBool:
+		_, ok = cursor.Value.(bool)
+	case sortTime:
+		var value string
+		if value, ok = cursor.Value.(string); ok {
+			cursor.Value, err = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	if !ok || err != nil {
+		return nil, fmt.Errorf("invalid cursor value for %s", cursor.Sort)
+	}
+	return &cursor, nil
+}
+
+// scanSortValue returns a scan destination for the sort column of opts and
+// a function reading the scanned value like urlSortField.value does
+func (opts URLListOptions) scanSortValue() (interface{}, func() interface{}) {
+	switch urlSortFields[opts.sortKey()].kind {
+	case sortInt:
+		var v sql.NullInt64
+		return &v, func() interface{} { return nullValue(v.Valid, v.Int64) }
+	case sortBool:
+		var v sql.NullBool
+		return &v, func() interface{} { return nullValue(v.Valid, v.Bool) }
+	case sortTime:
+		var v sql.NullTime
+		return &v, func() interface{} { return nullValue(v.Valid, v.Time.UTC()) }
+	default:
+		var v sql.NullString
+		return &v, func() interface{} { return nullValue(v.Valid, v.String) }
+	}
+}
+
+func nullValue(valid bool, value interface{}) interface{} {
+	if !valid {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrInvalidResetToken is returned for unknown, used or expired reset tokens
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	// ErrInvalidRefreshToken is returned for unknown, used, revoked or expired
+	// refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrInvalidStreamTicket is returned for unknown, used or expired stream
+	// tickets
+	ErrInvalidStreamTicket = errors.New("invalid or expired stream ticket")
+)
+
+// bcryptMaxPasswordLength is the number of bytes bcrypt hashes; longer
+// passwords are rejected rather than silently truncated
+const bcryptMaxPasswordLength = 72
+
+// PasswordPolicy is what new passwords must satisfy. Passwords set before
+// the policy changed keep working.
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+func NewPasswordPolicy() *PasswordPolicy {
+	minLength, err := strconv.Atoi(getEnv("PASSWORD_MIN_LENGTH", "12"))
+	if err != nil || minLength < 1 {
+		minLength = 12
+	}
+
+	return &PasswordPolicy{
+		MinLength:        minLength,
+		RequireMixedCase: getEnv("PASSWORD_REQUIRE_MIXED_CASE", "false") == "true",
+		RequireDigit:     getEnv("PASSWORD_REQUIRE_DIGIT", "true") == "true",
+		RequireSymbol:    getEnv("PASSWORD_REQUIRE_SYMBOL", "false") == "true",
+	}
+}
+
+// Validate returns the ways password breaks the policy, reported on field
+func (p *PasswordPolicy) Validate(field, password string) []FieldError {
+	var errs []FieldError
+	fail := func(message string) {
+		errs = append(errs, FieldError{Field: field, Message: message})
+	}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		fail(fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(password) > bcryptMaxPasswordLength {
+		fail(fmt.Sprintf("must be at most %d bytes", bcryptMaxPasswordLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireMixedCase && !(upper && lower) {
+		fail("must contain upper and lower case letters")
+	}
+	if p.RequireDigit && !digit {
+		fail("must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		fail("must contain a symbol")
+	}
+
+	return errs
+}
+
+// usernamePattern is what usernames may contain, within the users column size
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,50}$`)
+
+// maxEmailLength matches the size of the users email column
+const maxEmailLength = 255
+
+// validateUsername returns the problems with a new username
+func validateUsername(username string) []FieldError {
+	if !usernamePattern.MatchString(username) {
+		return []FieldError{{Field: "username", Message: "must be 3 to 50 letters, digits, '.', '_' or '-'"}}
+	}
+	return nil
+}
+
+// validateRole returns the problems with a role assigned to a user
+func validateRole(role string) []FieldError {
+	if !isValidRole(role) {
+		return []FieldError{{Field: "role", Message: "must be one of " + strings.Join(Roles, ", ")}}
+	}
+	return nil
+}
+
+// normalizeEmail validates an email address, returning nil for an empty one
+func normalizeEmail(email *string) (*string, []FieldError) {
+	if email == nil || *email == "" {
+		return nil, nil
+	}
+	address, err := mail.ParseAddress(*email)
+	if err != nil || address.Name != "" || len(address.Address) > maxEmailLength {
+		return nil, []FieldError{{Field: "email", Message: "must be an email address"}}
+	}
+	return &address.Address, nil
+}
+
+// UserService manages accounts and their passwords
+type UserService struct {
+	userRepo UserRepository
+	policy   *PasswordPolicy
+	resetTTL time.Duration
+}
+
+func NewUserService(userRepo UserRepository, policy *PasswordPolicy) *UserService {
+	resetTTL, err := time.ParseDuration(getEnv("PASSWORD_RESET_TTL", "1h"))
+	if err != nil || resetTTL <= 0 {
+		resetTTL = time.Hour
+	}
+
+	return &UserService{userRepo: userRepo, policy: policy, resetTTL: resetTTL}
+}
+
+// ValidatePassword checks a new password against the policy
+func (s *UserService) ValidatePassword(field, password string) []FieldError {
+	return s.policy.Validate(field, password)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CreateUser stores a new user with a validated password
+func (s *UserService) CreateUser(ctx context.Context, user *User, password string) (*User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user.PasswordHash = hash
+	if user.Role == "" {
+		user.Role = RoleViewer
+	}
+	return s.userRepo.Create(ctx, user)
+}
+
+// ChangePassword sets a new password for user after checking their current
+// one, returning ErrInvalidCredentials when it does not match
+func (s *UserService) ChangePassword(ctx context.Context, user *User, currentPassword, newPassword string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return s.setPassword(ctx, user.ID, hash)
+}
+
+// IssuePasswordReset returns a one-time token that sets a new password for
+// user, replacing any earlier token. Only its hash is stored.
+func (s *UserService) IssuePasswordReset(ctx context.Context, user *User) (string, time.Time, error) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate password reset token: %w", err)
+	}
+	expiresAt := time.Now().UTC().Add(s.resetTTL)
+
+	if err := s.userRepo.CreatePasswordReset(ctx, user.ID, hashToken(token), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// ResetPassword uses a reset token to set a new password, returning
+// ErrInvalidResetToken when the token is unknown, used or expired
+func (s *UserService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	userID, err := s.userRepo.ConsumePasswordReset(ctx, hashToken(token), time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	return s.setPassword(ctx, userID, hash)
+}
+
+// setPassword stores a new password hash and then ends every session of the
+// user, so whoever knew the old password loses access. Sessions are revoked
+// after the update so none started with the old password can survive.
+func (s *UserService) setPassword(ctx context.Context, userID int64, hash string) error {
+	if err := s.userRepo.UpdatePassword(ctx, userID, hash); err != nil {
+		return err
+	}
+	return s.userRepo.RevokeUserRefreshTokens(ctx, userID, time.Now().UTC())
+}
+
+// newOneTimeToken returns a random token for password resets, invitations and
+// refresh tokens
+func newOneTimeToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newTokenFamilyID returns a random ID for the refresh tokens of a login
+func newTokenFamilyID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken returns the stored form of a one-time token. Tokens are random,
+// so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// unknownUserHash returns a bcrypt hash of a random password at the cost of
+// real ones, compared against when a login names an unknown user
+var unknownUserHash = sync.OnceValue(func() []byte {
+	password := make([]byte, 16)
+	rand.Read(password)
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError describes why a single request field failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// URLValidator checks that a canonical URL is something the crawler can fetch
+type URLValidator struct {
+	MaxLength  int
+	CheckDNS   bool
+	DNSTimeout time.Duration
+	resolver   *net.Resolver
+}
+
+func NewURLValidator() *URLValidator {
+	maxLength, err := strconv.Atoi(getEnv("URL_MAX_LENGTH", "2048"))
+	if err != nil || maxLength <= 0 {
+		maxLength = 2048
+	}
+
+	return &URLValidator{
+		MaxLength:  maxLength,
+		CheckDNS:   getEnv("URL_DNS_CHECK", "false") == "true",
+		DNSTimeout: 3 * time.Second,
+		resolver:   net.DefaultResolver,
+	}
+}
+
+// Validate returns the problems found with rawURL, or nil when it is valid
+func (v *URLValidator) Validate(rawURL string) []FieldError {
+	if len(rawURL) > v.MaxLength {
+		return []FieldError{{Field: "url", Message: fmt.Sprintf("must be at most %d characters", v.MaxLength)}}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return []FieldError{{Field: "url", Message: "is not a valid URL"}}
+	}
+
+	var errs []FieldError
+	if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, FieldError{Field: "url.scheme", Message: "must be http or https"})
+	}
+
+	host := u.Hostname()
+	switch {
+	case host == "":
+		errs = append(errs, FieldError{Field: "url.host", Message: "is required"})
+	case net.ParseIP(host) != nil:
+		// IP literals need no TLD
+	case !hasValidTLD(host):
+		errs = append(errs, FieldError{Field: "url.host", Message: "must be an IP address or a domain with a valid TLD"})
+	}
+
+	if len(errs) == 0 && v.CheckDNS {
+		ctx, cancel := context.WithTimeout(context.Background(), v.DNSTimeout)
+		defer cancel()
+		if _, err := v.resolver.LookupHost(ctx, host); err != nil {
+			errs = append(errs, FieldError{Field: "url.host", Message: "does not resolve"})
+		}
+	}
+
+	return errs
+}
+
+// hasValidTLD reports whether host is made of valid DNS labels and ends in an
+// alphabetic or punycode TLD
+func hasValidTLD(host string) bool {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' {
+				return false
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(tld, "xn--") {
+		return true
+	}
+	if len(tld) < 2 {
+		return false
+	}
+	for _, r := range tld {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
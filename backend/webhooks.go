@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookAnalysisCompleted   = "analysis.completed"
+	WebhookAnalysisFailed      = "analysis.failed"
+	WebhookBrokenLinksDetected = "broken_links.detected"
+)
+
+// ErrWebhookAddressNotPublic is returned for webhook receivers on loopback,
+// private, link-local and other non-public addresses
+var ErrWebhookAddressNotPublic = errors.New("webhook receivers must have a public address")
+
+// nonPublicPrefixes are ranges not reachable from the internet that the net.IP
+// predicates do not cover
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// WebhookEventTypes lists the event types a webhook can subscribe to
+var WebhookEventTypes = []string{WebhookAnalysisCompleted, WebhookAnalysisFailed, WebhookBrokenLinksDetected}
+
+// WebhookPayload is the JSON body POSTed to webhook receivers
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      URLEvent  `json:"data"`
+}
+
+// WebhookService sends the webhook deliveries the crawler queues, retrying
+// failures with exponential backoff. Each replica claims the deliveries it
+// sends for claimFor, so they are sent once however many replicas run; a
+// delivery whose replica dies mid-send is sent again once the claim expires.
+type WebhookService struct {
+	webhookRepo  WebhookRepository
+	logger       *slog.Logger
+	client       *http.Client
+	maxAttempts  int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	pollInterval time.Duration
+	claimFor     time.Duration
+	// ctx is the parent of every delivery the loop sends; Stop cancels it
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewWebhookService(webhookRepo WebhookRepository) *WebhookService {
+	maxAttempts, err := strconv.Atoi(getEnv("WEBHOOK_MAX_ATTEMPTS", "6"))
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = 6
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookService{
+		webhookRepo:  webhookRepo,
+		logger:       slog.Default().With("component", "webhooks"),
+		client:       newWebhookClient(webhookAllowPrivateNetworks()),
+		maxAttempts:  maxAttempts,
+		baseBackoff:  30 * time.Second,
+		maxBackoff:   time.Hour,
+		pollInterval: 5 * time.Second,
+		claimFor:     time.Minute,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func (s *WebhookService) Start() {
+	s.wg.Add(1)
+	go s.processDeliveries()
+}
+
+func (s *WebhookService) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// webhookEventsFor maps a crawler status event to the webhook events it triggers
+func webhookEventsFor(event URLEvent) []string {
+	switch event.Status {
+	case "completed":
+		events := []string{WebhookAnalysisCompleted}
+		if event.Analysis != nil && event.Analysis.BrokenLinksCount > 0 {
+			events = append(events, WebhookBrokenLinksDetected)
+		}
+		return events
+	case "failed":
+		return []string{WebhookAnalysisFailed}
+	}
+	return nil
+}
+
+// queueWebhookDeliveries creates a delivery of event for every webhook of its
+// workspace subscribed to it. The crawler calls it in the unit of work that
+// records the status change, so a delivery exists exactly when the change was
+// committed, and the delivery loop sends it even after a restart.
+func queueWebhookDeliveries(ctx context.Context, webhookRepo WebhookRepository, event URLEvent) error {
+	for _, eventType := range webhookEventsFor(event) {
+		webhooks, err := webhookRepo.GetActiveForEvent(ctx, event.WorkspaceID, eventType)
+		if err != nil {
+			return err
+		}
+		if len(webhooks) == 0 {
+			continue
+		}
+
+		payload, err := json.Marshal(WebhookPayload{Event: eventType, CreatedAt: event.Timestamp, Data: event})
+		if err != nil {
+			return fmt.Errorf("failed to encode webhook payload: %w", err)
+		}
+
+		for _, webhook := range webhooks {
+			if _, err := webhookRepo.CreateDelivery(ctx, webhook.ID, eventType, string(payload)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *WebhookService) processDeliveries() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			ctx := s.ctx
+			now := time.Now().UTC()
+			deliveries, err := s.webhookRepo.ClaimDueDeliveries(ctx, 50, now, now.Add(s.claimFor))
+			if err != nil {
+				s.logger.Error("Failed to claim due webhook deliveries", "error", err)
+				continue
+			}
+
+			for i := range deliveries {
+				delivery := &deliveries[i]
+				webhook, err := s.webhookRepo.GetForDelivery(ctx, delivery.WebhookID)
+				if err != nil {
+					s.logger.Error("Failed to load webhook", "webhook_id", delivery.WebhookID, "delivery_id", delivery.ID, "error", err)
+					continue
+				}
+				s.attempt(ctx, webhook, delivery)
+			}
+		}
+	}
+}
+
+// Redeliver sends the payload of an earlier delivery again as a new delivery
+// and returns it once the attempt has been made. The new delivery is due at
+// once, so when a delivery loop claims it first it is returned unattempted.
+func (s *WebhookService) Redeliver(ctx context.Context, webhook *Webhook, original *WebhookDelivery) (*WebhookDelivery, error) {
+	delivery, err := s.webhookRepo.CreateDelivery(ctx, webhook.ID, original.EventType, original.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	claimed, err := s.webhookRepo.ClaimDelivery(ctx, delivery.ID, now, now.Add(s.claimFor))
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		s.attempt(ctx, webhook, delivery)
+	}
+	return delivery, nil
+}
+
+// attempt sends a delivery once and persists the outcome. An attempt cut
+// short by Stop, or by the client of a redelivery leaving, is not counted;
+// the claim is released so the delivery is sent again.
+func (s *WebhookService) attempt(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) {
+	statusCode, err := s.send(ctx, webhook, delivery)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err != nil && errors.Is(err, context.Canceled) {
+		if err := s.webhookRepo.UpdateDelivery(ctx, delivery); err != nil {
+			s.logger.Error("Failed to release webhook delivery", "webhook_id", webhook.ID, "delivery_id", delivery.ID, "error", err)
+		}
+		return
+	}
+
+	s.recordAttempt(delivery, statusCode, err, time.Now().UTC())
+	if err != nil {
+		s.logger.Warn("Webhook delivery attempt failed",
+			"webhook_id", webhook.ID,
+			"delivery_id", delivery.ID,
+			"attempts", delivery.Attempts,
+			"status", delivery.Status,
+			"error", err,
+		)
+	}
+
+	if err := s.webhookRepo.UpdateDelivery(ctx, delivery); err != nil {
+		s.logger.Error("Failed to update webhook delivery", "webhook_id", webhook.ID, "delivery_id", delivery.ID, "error", err)
+	}
+}
+
+// webhookAllowPrivateNetworks reports whether WEBHOOK_ALLOW_PRIVATE_NETWORKS
+// lets webhooks reach non-public addresses, for local development
+func webhookAllowPrivateNetworks() bool {
+	return getEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+}
+
+// isPublicIP reports whether ip is an address on the internet
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses connections to non-public addresses. It runs
+// after DNS resolution, for every address dialed, so a host name that
+// resolves to an internal address, or starts to, cannot reach it.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrWebhookAddressNotPublic, host)
+	}
+	return nil
+}
+
+// newWebhookClient returns the client deliveries are sent with. It only
+// dials public addresses unless allowPrivate is set, ignores proxy settings,
+// which would dial for it, and does not follow redirects, which receivers
+// could use to point it elsewhere; a redirect counts as a failed attempt.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: traceTransport(transport),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// send POSTs the delivery payload, signed with the webhook secret. Only the
+// receiver's status code is kept, not what it responded with.
+func (s *WebhookService) send(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "crawler-webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", SignWebhookPayload(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with HTTP %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// recordAttempt updates a delivery after an attempt, scheduling the next try
+// with exponential backoff or marking it failed once attempts are exhausted
+func (s *WebhookService) recordAttempt(delivery *WebhookDelivery, statusCode int, err error, now time.Time) {
+	delivery.Attempts++
+	delivery.ResponseStatus = nil
+	if statusCode != 0 {
+		delivery.ResponseStatus = &statusCode
+	}
+
+	if err == nil {
+		delivery.Status = "succeeded"
+		delivery.ErrorMessage = nil
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+		return
+	}
+
+	errorMsg := err.Error()
+	delivery.ErrorMessage = &errorMsg
+
+	if delivery.Attempts >= s.maxAttempts {
+		delivery.Status = "failed"
+		delivery.NextAttemptAt = nil
+		return
+	}
+
+	backoff := s.baseBackoff << (delivery.Attempts - 1)
+	if backoff > s.maxBackoff || backoff <= 0 {
+		backoff = s.maxBackoff
+	}
+	next := now.Add(backoff)
+	delivery.Status = "pending"
+	delivery.NextAttemptAt = &next
+}
+
+// SignWebhookPayload returns the X-Webhook-Signature header value: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret
+func SignWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateWebhookSecret returns a random secret for webhooks created without one
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
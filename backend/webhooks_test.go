@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookEventsFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    URLEvent
+		expected []string
+	}{
+		{
+			name:     "should send analysis.completed on completion",
+			event:    URLEvent{Status: "completed", Analysis: &AnalysisSummary{}},
+			expected: []string{WebhookAnalysisCompleted},
+		},
+		{
+			name:     "should also send broken_links.detected when links are broken",
+			event:    URLEvent{Status: "completed", Analysis: &AnalysisSummary{BrokenLinksCount: 2}},
+			expected: []string{WebhookAnalysisCompleted, WebhookBrokenLinksDetected},
+		},
+		{
+			name:     "should send analysis.failed on failure",
+			event:    URLEvent{Status: "failed"},
+			expected: []string{WebhookAnalysisFailed},
+		},
+		{
+			name:  "should ignore other transitions",
+			event: URLEvent{Status: "running"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := webhookEventsFor(tt.event)
+			if len(result) != len(tt.expected) {
+				t.Fatalf("webhookEventsFor() = %v, want %v", result, tt.expected)
+			}
+			for i := range result {
+				if result[i] != tt.expected[i] {
+					t.Errorf("webhookEventsFor() = %v, want %v", result, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	webhook := &Webhook{Secret: "s3cret"}
+	delivery := &WebhookDelivery{ID: 7, EventType: WebhookAnalysisCompleted, Payload: `{"event":"analysis.completed"}`}
+
+	t.Run("should POST a signed payload to the receiver", func(t *testing.T) {
+		var received *http.Request
+		var body []byte
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			body, _ = io.ReadAll(r.Body)
+			w.Write([]byte("ok"))
+		}))
+		defer receiver.Close()
+		webhook.URL = receiver.URL
+
+		s := &WebhookService{client: receiver.Client()}
+		status, err := s.send(context.Background(), webhook, delivery)
+		if err != nil {
+			t.Fatalf("send() returned error: %v", err)
+		}
+		if status != http.StatusOK {
+			t.Errorf("send() = %d, want 200", status)
+		}
+
+		if received.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", received.Method)
+		}
+		if received.Header.Get("X-Webhook-Event") != WebhookAnalysisCompleted {
+			t.Errorf("X-Webhook-Event = %s", received.Header.Get("X-Webhook-Event"))
+		}
+		if received.Header.Get("X-Webhook-Delivery") != "7" {
+			t.Errorf("X-Webhook-Delivery = %s, want 7", received.Header.Get("X-Webhook-Delivery"))
+		}
+		expected := SignWebhookPayload("s3cret", received.Header.Get("X-Webhook-Timestamp"), body)
+		if received.Header.Get("X-Webhook-Signature") != expected {
+			t.Errorf("X-Webhook-Signature = %s, want %s", received.Header.Get("X-Webhook-Signature"), expected)
+		}
+	})
+
+	t.Run("should report non-2xx responses as errors", func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer receiver.Close()
+		webhook.URL = receiver.URL
+
+		s := &WebhookService{client: receiver.Client()}
+		status, err := s.send(context.Background(), webhook, delivery)
+		if err == nil || status != http.StatusServiceUnavailable {
+			t.Errorf("send() = %d, %v, want 503 and an error", status, err)
+		}
+	})
+}
+
+func TestWebhookClient(t *testing.T) {
+	webhook := &Webhook{Secret: "s3cret"}
+	delivery := &WebhookDelivery{ID: 7, EventType: WebhookAnalysisCompleted, Payload: `{}`}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer receiver.Close()
+
+	t.Run("should refuse to dial non-public addresses", func(t *testing.T) {
+		s := &WebhookService{client: newWebhookClient(false)}
+		webhook.URL = receiver.URL
+		if _, err := s.send(context.Background(), webhook, delivery); !errors.Is(err, ErrWebhookAddressNotPublic) {
+			t.Errorf("send() error = %v, want ErrWebhookAddressNotPublic", err)
+		}
+	})
+
+	t.Run("should not follow redirects", func(t *testing.T) {
+		s := &WebhookService{client: newWebhookClient(true)}
+		webhook.URL = receiver.URL + "/redirect"
+		if status, err := s.send(context.Background(), webhook, delivery); err == nil || status != http.StatusFound {
+			t.Errorf("send() = %d, %v, want 302 and an error", status, err)
+		}
+	})
+}
+
+func TestWebhookAttemptCancelled(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client leaving once the body is read
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer receiver.Close()
+
+	webhook, err := store.Webhooks.Create(ctx, &Webhook{WorkspaceID: defaultWorkspaceID, URL: receiver.URL, Secret: "s",
+		EventTypes: WebhookEventTypes, Active: true})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	delivery, err := store.Webhooks.CreateDelivery(ctx, webhook.ID, WebhookAnalysisFailed, `{}`)
+	if err != nil {
+		t.Fatalf("CreateDelivery() error = %v", err)
+	}
+	now := time.Now().UTC()
+	if claimed, err := store.Webhooks.ClaimDelivery(ctx, delivery.ID, now, now.Add(time.Minute)); err != nil || !claimed {
+		t.Fatalf("ClaimDelivery() = %v, %v", claimed, err)
+	}
+
+	s := &WebhookService{webhookRepo: store.Webhooks, client: receiver.Client(), logger: slog.Default(), maxAttempts: 3}
+	attemptCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	s.attempt(attemptCtx, webhook, delivery)
+
+	stored, err := store.Webhooks.GetDeliveryByID(ctx, webhook.ID, delivery.ID)
+	if err != nil {
+		t.Fatalf("GetDeliveryByID() error = %v", err)
+	}
+	if stored.Attempts != 0 || stored.Status != "pending" || stored.LockedUntil != nil {
+		t.Errorf("delivery = %+v, want pending, unclaimed and no attempts counted", stored)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":      true,
+		"2606:2800:220:1::1": true,
+		"127.0.0.1":          false,
+		"10.1.2.3":           false,
+		"172.16.0.1":         false,
+		"192.168.1.1":        false,
+		"169.254.169.254":    false,
+		"100.64.0.1":         false,
+		"0.0.0.0":            false,
+		"::1":                false,
+		"fd00::1":            false,
+		"fe80::1":            false,
+		"::ffff:127.0.0.1":   false,
+	}
+	for address, want := range tests {
+		if got := isPublicIP(net.ParseIP(address)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestValidateWebhookRequest(t *testing.T) {
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data", "http://localhost:8080/hook", "http://[::1]/hook", "https://10.0.0.5/hook"} {
+		if errs := validateWebhookRequest(&WebhookRequest{URL: url, EventTypes: []string{WebhookAnalysisFailed}}); len(errs) != 1 || errs[0].Field != "url" {
+			t.Errorf("validateWebhookRequest(%s) = %+v, want a url error", url, errs)
+		}
+	}
+	if errs := validateWebhookRequest(&WebhookRequest{URL: "https://hooks.example.com/crawler", EventTypes: []string{WebhookAnalysisFailed}}); len(errs) != 0 {
+		t.Errorf("validateWebhookRequest(public) = %+v, want none", errs)
+	}
+}
+
+func TestWebhookRecordAttempt(t *testing.T) {
+	s := &WebhookService{maxAttempts: 3, baseBackoff: time.Minute, maxBackoff: time.Hour}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("should mark successful deliveries as succeeded", func(t *testing.T) {
+		delivery := &WebhookDelivery{Status: "pending"}
+		s.recordAttempt(delivery, http.StatusOK, nil, now)
+
+		if delivery.Status != "succeeded" || delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil {
+			t.Errorf("delivery = %+v, want succeeded", delivery)
+		}
+	})
+
+	t.Run("should back off exponentially and fail after max attempts", func(t *testing.T) {
+		delivery := &WebhookDelivery{Status: "pending"}
+		failure := errors.New("receiver responded with HTTP 500")
+
+		s.recordAttempt(delivery, http.StatusInternalServerError, failure, now)
+		if delivery.Status != "pending" || !delivery.NextAttemptAt.Equal(now.Add(time.Minute)) {
+			t.Errorf("first retry at %v, want %v", delivery.NextAttemptAt, now.Add(time.Minute))
+		}
+
+		s.recordAttempt(delivery, http.StatusInternalServerError, failure, now)
+		if delivery.Status != "pending" || !delivery.NextAttemptAt.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("second retry at %v, want %v", delivery.NextAttemptAt, now.Add(2*time.Minute))
+		}
+
+		s.recordAttempt(delivery, http.StatusInternalServerError, failure, now)
+		if delivery.Status != "failed" || delivery.NextAttemptAt != nil || delivery.Attempts != 3 {
+			t.Errorf("delivery = %+v, want failed after 3 attempts", delivery)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultWorkspaceID is the workspace the migrations move existing URLs,
+// webhooks and users into
+const defaultWorkspaceID int64 = 1
+
+// maxWorkspaceNameLength matches the size of the workspaces name column
+const maxWorkspaceNameLength = 100
+
+var (
+	// ErrNoWorkspace is returned when a user without memberships needs a workspace
+	ErrNoWorkspace = errors.New("user is not a member of any workspace")
+	// ErrLastWorkspaceAdmin is returned when a change would leave a workspace
+	// without an admin
+	ErrLastWorkspaceAdmin = errors.New("workspace must keep at least one admin")
+	// ErrInvalidInvitation is returned for unknown, accepted or expired invitations
+	ErrInvalidInvitation = errors.New("invalid or expired workspace invitation")
+	// ErrInvitationEmailMismatch is returned when an invitation for an email
+	// address is accepted by a user with another address
+	ErrInvitationEmailMismatch = errors.New("workspace invitation was sent to another email address")
+)
+
+// validateWorkspaceName returns the problems with a workspace name
+func validateWorkspaceName(name string) []FieldError {
+	if name == "" || utf8.RuneCountInString(name) > maxWorkspaceNameLength {
+		return []FieldError{{Field: "name", Message: fmt.Sprintf("must be 1 to %d characters", maxWorkspaceNameLength)}}
+	}
+	return nil
+}
+
+// WorkspaceService manages workspaces, their members and invitations
+type WorkspaceService struct {
+	workspaceRepo WorkspaceRepository
+	unitOfWork    UnitOfWork
+	invitationTTL time.Duration
+}
+
+func NewWorkspaceService(workspaceRepo WorkspaceRepository, unitOfWork UnitOfWork) *WorkspaceService {
+	invitationTTL, err := time.ParseDuration(getEnv("WORKSPACE_INVITATION_TTL", "168h"))
+	if err != nil || invitationTTL <= 0 {
+		invitationTTL = 7 * 24 * time.Hour
+	}
+
+	return &WorkspaceService{workspaceRepo: workspaceRepo, unitOfWork: unitOfWork, invitationTTL: invitationTTL}
+}
+
+// Resolve returns a workspace of the user with Role set to their role in it:
+// the one with workspaceID, or the first they joined when it is zero. It
+// returns sql.ErrNoRows when the user is not a member of the workspace, and
+// ErrNoWorkspace when they have none.
+func (s *WorkspaceService) Resolve(ctx context.Context, userID, workspaceID int64) (*Workspace, error) {
+	if workspaceID == 0 {
+		workspaces, err := s.workspaceRepo.GetForUser(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(workspaces) == 0 {
+			return nil, ErrNoWorkspace
+		}
+		return &workspaces[0], nil
+	}
+
+	member, err := s.workspaceRepo.GetMember(ctx, workspaceID, userID)
+	if err != nil {
+		return nil, err
+	}
+	workspace, err := s.workspaceRepo.GetByID(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	workspace.Role = member.Role
+	return workspace, nil
+}
+
+// Create starts a workspace with owner as its admin
+func (s *WorkspaceService) Create(ctx context.Context, name string, owner *User) (*Workspace, error) {
+	var workspace *Workspace
+	err := s.unitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		var err error
+		if workspace, err = tx.Workspaces.Create(ctx, name); err != nil {
+			return err
+		}
+		return tx.Workspaces.AddMember(ctx, workspace.ID, owner.ID, RoleAdmin)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	workspace.Role = RoleAdmin
+	return workspace, nil
+}
+
+// changeMember applies change to a member of a workspace unless it would
+// demote or remove the workspace's last admin. It returns sql.ErrNoRows when
+// the user is not a member.
+func (s *WorkspaceService) changeMember(ctx context.Context, workspaceID, userID int64, newRole string, change func(tx *TxRepositories) error) error {
+	return s.unitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		// Without the lock two admins demoting each other could both see
+		// the other one still being an admin
+		if err := tx.Workspaces.Lock(ctx, workspaceID); err != nil {
+			return err
+		}
+
+		members, err := tx.Workspaces.GetMembers(ctx, workspaceID)
+		if err != nil {
+			return err
+		}
+
+		var target *WorkspaceMember
+		admins := 0
+		for i := range members {
+			if members[i].Role == RoleAdmin {
+				admins++
+			}
+			if members[i].UserID == userID {
+				target = &members[i]
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("failed to get workspace member: %w", sql.ErrNoRows)
+		}
+		if target.Role == RoleAdmin && newRole != RoleAdmin && admins == 1 {
+			return ErrLastWorkspaceAdmin
+		}
+
+		return change(tx)
+	})
+}
+
+// UpdateMemberRole changes a member's role in a workspace
+func (s *WorkspaceService) UpdateMemberRole(ctx context.Context, workspaceID, userID int64, role string) error {
+	return s.changeMember(ctx, workspaceID, userID, role, func(tx *TxRepositories) error {
+		return tx.Workspaces.UpdateMemberRole(ctx, workspaceID, userID, role)
+	})
+}
+
+// RemoveMember takes a user out of a workspace
+func (s *WorkspaceService) RemoveMember(ctx context.Context, workspaceID, userID int64) error {
+	return s.changeMember(ctx, workspaceID, userID, "", func(tx *TxRepositories) error {
+		return tx.Workspaces.RemoveMember(ctx, workspaceID, userID)
+	})
+}
+
+// Invite returns an invitation to join a workspace in role and its one-time
+// token. Only the token's hash is stored.
+func (s *WorkspaceService) Invite(ctx context.Context, workspaceID int64, inviter *User, role string, email *string) (*WorkspaceInvitation, string, error) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate workspace invitation token: %w", err)
+	}
+
+	invitation, err := s.workspaceRepo.CreateInvitation(ctx, &WorkspaceInvitation{
+		WorkspaceID: workspaceID,
+		Role:        role,
+		Email:       email,
+		TokenHash:   hashToken(token),
+		InvitedBy:   &inviter.ID,
+		ExpiresAt:   time.Now().UTC().Add(s.invitationTTL),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return invitation, token, nil
+}
+
+// AcceptInvitation adds user to the workspace of an invitation token and
+// returns the workspace. It returns ErrInvalidInvitation when the token is
+// unknown, used or expired, ErrInvitationEmailMismatch when the invitation
+// names another email address than the user's, and ErrAlreadyMember when the
+// user is in the workspace already. The invitation stays unused on errors.
+func (s *WorkspaceService) AcceptInvitation(ctx context.Context, token string, user *User) (*Workspace, error) {
+	var workspaceID int64
+	err := s.unitOfWork.Do(ctx, func(tx *TxRepositories) error {
+		invitation, err := tx.Workspaces.ConsumeInvitation(ctx, hashToken(strings.TrimSpace(token)), user.ID, time.Now().UTC())
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidInvitation
+		}
+		if err != nil {
+			return err
+		}
+		if invitation.Email != nil && (user.Email == nil || !strings.EqualFold(strings.TrimSpace(*invitation.Email), strings.TrimSpace(*user.Email))) {
+			return ErrInvitationEmailMismatch
+		}
+
+		workspaceID = invitation.WorkspaceID
+		return tx.Workspaces.AddMember(ctx, invitation.WorkspaceID, user.ID, invitation.Role)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Resolve(ctx, user.ID, workspaceID)
+}
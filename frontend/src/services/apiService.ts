@@ -12,6 +12,16 @@ export interface URL {
   started_at?: string;
   completed_at?: string;
   error_message?: string;
+  analysis?: AnalysisSummary;
+}
+
+export interface AnalysisSummary {
+  html_version?: string;
+  page_title?: string;
+  internal_links_count: number;
+  external_links_count: number;
+  broken_links_count: number;
+  has_login_form: boolean;
 }
 
 export interface AnalysisResult {
@@ -48,6 +58,8 @@ export interface URLListResponse {
   page: number;
   page_size: number;
   total_pages: number;
+  next_cursor?: string;
+  prev_cursor?: string;
 }
 
 export interface AnalysisDetailResponse {
@@ -58,8 +70,31 @@ export interface AnalysisDetailResponse {
   external_links: any[];
 }
 
+export interface StatsResponse {
+  from: string;
+  to: string;
+  status_counts: Record<string, number>;
+  total_urls: number;
+  daily: { date: string; completed: number; failed: number }[];
+  crawl_duration: {
+    count: number;
+    average_seconds?: number;
+    p50_seconds?: number;
+    p90_seconds?: number;
+    p95_seconds?: number;
+    p99_seconds?: number;
+  };
+  total_broken_links: number;
+  top_broken_domains: { domain: string; broken_links: number; urls: number }[];
+  top_failures: { message: string; count: number }[];
+  login_forms: { analyzed: number; with_login_form: number; share: number };
+  generated_at: string;
+}
+
 export interface LoginResponse {
   token: string;
+  expires_at: string;
+  refresh_token: string;
   user: {
     id: number;
     username: string;
@@ -80,6 +115,7 @@ export interface CurrentUserResponse {
 
 class ApiService {
   private api: AxiosInstance;
+  private refreshing: Promise<string | null> | null = null;
 
   constructor() {
     this.api = axios.create({
@@ -92,10 +128,21 @@ class ApiService {
     // Add response interceptor for error handling
     this.api.interceptors.response.use(
       (response) => response,
-      (error) => {
+      async (error) => {
+        const request = error.config;
+        if (error.response?.status === 401 && request && !request._retried && !/^\/api\/auth\/(login|refresh|logout)$/.test(request.url || '')) {
+          // Access tokens are short-lived; get a new one and retry once
+          request._retried = true;
+          const token = await this.refreshToken();
+          if (token) {
+            request.headers['Authorization'] = `Bearer ${token}`;
+            return this.api(request);
+          }
+        }
         if (error.response?.status === 401) {
           // Token expired or invalid
           localStorage.removeItem('token');
+          localStorage.removeItem('refresh_token');
           window.location.href = '/login';
         }
         return Promise.reject(error);
@@ -103,6 +150,31 @@ class ApiService {
     );
   }
 
+  // refreshToken exchanges the stored refresh token for a new token pair,
+  // sharing one request between concurrent callers since each refresh
+  // token works only once
+  private refreshToken(): Promise<string | null> {
+    const refreshToken = localStorage.getItem('refresh_token');
+    if (!refreshToken) {
+      return Promise.resolve(null);
+    }
+    if (!this.refreshing) {
+      this.refreshing = this.api
+        .post<LoginResponse>('/api/auth/refresh', { refresh_token: refreshToken })
+        .then((response) => {
+          localStorage.setItem('token', response.data.token);
+          localStorage.setItem('refresh_token', response.data.refresh_token);
+          this.setToken(response.data.token);
+          return response.data.token;
+        })
+        .catch(() => null)
+        .finally(() => {
+          this.refreshing = null;
+        });
+    }
+    return this.refreshing;
+  }
+
   setToken(token: string | null) {
     if (token) {
       this.api.defaults.headers.common['Authorization'] = `Bearer ${token}`;
@@ -120,6 +192,13 @@ class ApiService {
     return response.data;
   }
 
+  async logout(): Promise<void> {
+    const refreshToken = localStorage.getItem('refresh_token');
+    if (refreshToken) {
+      await this.api.post('/api/auth/logout', { refresh_token: refreshToken });
+    }
+  }
+
   async getCurrentUser(): Promise<CurrentUserResponse> {
     const response: AxiosResponse<CurrentUserResponse> = await this.api.get('/api/auth/me');
     return response.data;
@@ -131,6 +210,7 @@ class ApiService {
     pageSize?: number;
     status?: string;
     search?: string;
+    include?: string;
   } = {}): Promise<URLListResponse> {
     const response: AxiosResponse<URLListResponse> = await this.api.get('/api/urls', {
       params,
@@ -169,6 +249,12 @@ class ApiService {
     const response: AxiosResponse<{ broken_links: BrokenLink[] }> = await this.api.get(`/api/analysis/${id}/links`);
     return response.data.broken_links;
   }
+
+  // Dashboard statistics
+  async getStats(params: { from?: string; to?: string } = {}): Promise<StatsResponse> {
+    const response: AxiosResponse<StatsResponse> = await this.api.get('/api/stats', { params });
+    return response.data;
+  }
 }
 
 export const apiService = new ApiService(); 
\ No newline at end of file
@@ -35,8 +35,8 @@ export const loginUser = createAsyncThunk(
 export const logoutUser = createAsyncThunk(
   'auth/logoutUser',
   async () => {
-    // Call logout API if needed
-    // await apiService.logout();
+    // Revoke the refresh token and the access tokens issued with it
+    await apiService.logout();
     return null;
   }
 );
@@ -68,6 +68,7 @@ const authSlice = createSlice({
       state.isAuthenticated = false;
       state.error = null;
       localStorage.removeItem('token');
+      localStorage.removeItem('refresh_token');
     },
   },
   extraReducers: (builder) => {
@@ -90,6 +91,9 @@ const authSlice = createSlice({
         state.token = action.payload.token;
         state.error = null;
         localStorage.setItem('token', action.payload.token);
+        if (action.payload.refresh_token) {
+          localStorage.setItem('refresh_token', action.payload.refresh_token);
+        }
         apiService.setToken(action.payload.token);
       })
       .addCase(loginUser.rejected, (state, action) => {
@@ -112,6 +116,7 @@ const authSlice = createSlice({
         state.isAuthenticated = false;
         state.error = null;
         localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
         // Clear token in API service
         apiService.setToken(null);
       })
@@ -122,6 +127,7 @@ const authSlice = createSlice({
         state.token = null;
         state.isAuthenticated = false;
         localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
       });
 
     // Check Auth Status
@@ -153,6 +159,7 @@ const authSlice = createSlice({
         state.token = null;
         state.isAuthenticated = false;
         localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
       });
   },
 });